@@ -40,10 +40,12 @@ type Statement interface {
 	statementNode()
 }
 
-// ImportStmt: import "file.haiku"
+// ImportStmt: import "file.haiku" [only name, ... | with requests]
 type ImportStmt struct {
 	Position Position
 	Path     string
+	Only     []string // with "only", just these variables are imported and requests are not sent
+	Requests bool     // with requests: the requests and loops of the imported file run too
 }
 
 func (s *ImportStmt) nodeType() string  { return "ImportStmt" }
@@ -61,25 +63,67 @@ func (s *VarDefStmt) nodeType() string  { return "VarDefStmt" }
 func (s *VarDefStmt) Pos() Position     { return s.Position }
 func (s *VarDefStmt) statementNode()    {}
 
-// RequestStmt: get "url" headers ... body ... timeout ...
+// RequestStmt: get "url" headers ... query ... body ... timeout ...
 type RequestStmt struct {
 	Position Position
 	Method   string
+	Verb     Expression // custom method of method "PURGE" "url" (Method is then "method")
 	URL      Expression
 	Headers  *BlockExpr
-	Body     Expression // can be BlockExpr or other Expression
-	Timeout  Expression // optional timeout expression (e.g., 30, "30s", "5000ms")
+	Uses     []string    // named header variables merged in order (use auth_headers)
+	Query    *BlockExpr  // query parameters appended to the URL
+	Body     Expression  // can be BlockExpr or other Expression
+	Form     *BlockExpr  // form-urlencoded body (form section)
+	Timeout  Expression  // optional timeout expression (e.g., 30, "30s", "5000ms")
+	Retry    *RetrySpec  // optional retry policy (retry 3 exponential)
+	Auth     *AuthSpec   // optional authentication (auth basic $user $pass)
+	Asserts  []Assertion // checks against the response (assert status 200)
+	Validate Expression  // optional: JSON Schema for the response body (validate file`schema.json`)
+	Insecure Expression  // optional: skip TLS certificate verification (insecure true)
+	CACert   Expression  // optional: PEM bundle of trusted CAs (ca_cert "ca.pem")
+	Proxy    Expression  // optional: proxy URL for this request (proxy "socks5://localhost:1080")
+	Skip     Expression  // optional: the request is not sent when this holds (get "url" skip if cond)
+	GQLQuery Expression  // graphql only: the query`...` document
+	GQLVars  Expression  // graphql only: the variables block
+	WSSend   Expression  // ws only: the messages to send
 }
 
 func (s *RequestStmt) nodeType() string  { return "RequestStmt" }
 func (s *RequestStmt) Pos() Position     { return s.Position }
 func (s *RequestStmt) statementNode()    {}
 
+// AuthSpec: auth basic <user> <pass> | auth bearer <token>
+//         | auth awsv4 <access key> <secret key> <region> <service> [session token]
+type AuthSpec struct {
+	Position Position
+	Scheme   string       // "basic", "bearer" or "awsv4"
+	Args     []Expression // basic: user, password; bearer: token; awsv4: access key, secret key, region, service[, session token]
+}
+
+// Assertion: assert <subject> [op] <expected>
+// Subject is "status", "time", or a response path (body.user.id, headers.Content-Type)
+type Assertion struct {
+	Position Position
+	Subject  []string
+	Operator string // ==, !=, <, >, <=, >= (defaults to ==)
+	Expected Expression
+}
+
+// RetrySpec: retry <count> [fixed|linear|exponential] [on <status>,...] [always]
+type RetrySpec struct {
+	Position Position
+	Count    Expression
+	Backoff  string // "fixed" (default), "linear" or "exponential"
+	On       []int  // statuses that are retried instead of any 5xx
+	Always   bool   // also retry non-idempotent methods (POST, PUT, PATCH, DELETE)
+}
+
 // ForStmt: for $item in $items ... or parallel [N] for $item in $items ...
 type ForStmt struct {
 	Position    Position
 	Parallel    bool        // true if this is a parallel for loop
 	Concurrency int         // max concurrent requests (0 means unlimited)
+	Rate        float64     // max iterations started per second (0 means unlimited)
 	IndexVar    string      // optional, for "for $i, $item in ..."
 	ItemVar     string      // loop variable name
 	Iterable    Expression  // the collection to iterate
@@ -107,6 +151,64 @@ func (s *IfStmt) nodeType() string  { return "IfStmt" }
 func (s *IfStmt) Pos() Position     { return s.Position }
 func (s *IfStmt) statementNode()    {}
 
+// WhileStmt: while condition ... (body repeats while the condition holds)
+type WhileStmt struct {
+	Position  Position
+	Condition Expression
+	Body      []Statement
+}
+
+func (s *WhileStmt) nodeType() string { return "WhileStmt" }
+func (s *WhileStmt) Pos() Position    { return s.Position }
+func (s *WhileStmt) statementNode()   {}
+
+// MatchStmt: match subject followed by case arms and an optional default arm
+type MatchStmt struct {
+	Position Position
+	Subject  Expression
+	Cases    []MatchCase
+	Default  []Statement // statements of the default arm (optional)
+}
+
+// MatchCase is a single case arm; it matches when the subject equals any of its values
+type MatchCase struct {
+	Position Position
+	Values   []Expression // case 200 or case 301, 302
+	Body     []Statement
+}
+
+func (s *MatchStmt) nodeType() string  { return "MatchStmt" }
+func (s *MatchStmt) Pos() Position     { return s.Position }
+func (s *MatchStmt) statementNode()    {}
+
+// SkipStmt: skip if condition (stops processing the rest of the file)
+type SkipStmt struct {
+	Position  Position
+	Condition Expression
+}
+
+func (s *SkipStmt) nodeType() string { return "SkipStmt" }
+func (s *SkipStmt) Pos() Position    { return s.Position }
+func (s *SkipStmt) statementNode()   {}
+
+// BreakStmt: break (ends the enclosing loop)
+type BreakStmt struct {
+	Position Position
+}
+
+func (s *BreakStmt) nodeType() string { return "BreakStmt" }
+func (s *BreakStmt) Pos() Position    { return s.Position }
+func (s *BreakStmt) statementNode()   {}
+
+// ContinueStmt: continue (skips to the next iteration of the enclosing loop)
+type ContinueStmt struct {
+	Position Position
+}
+
+func (s *ContinueStmt) nodeType() string { return "ContinueStmt" }
+func (s *ContinueStmt) Pos() Position    { return s.Position }
+func (s *ContinueStmt) statementNode()   {}
+
 // EchoStmt: echo expression (debug output)
 type EchoStmt struct {
 	Position Position
@@ -117,6 +219,28 @@ func (s *EchoStmt) nodeType() string  { return "EchoStmt" }
 func (s *EchoStmt) Pos() Position     { return s.Position }
 func (s *EchoStmt) statementNode()    {}
 
+// SleepStmt: sleep duration (pause, e.g. sleep "2s", sleep 500ms)
+type SleepStmt struct {
+	Position Position
+	Duration Expression
+}
+
+func (s *SleepStmt) nodeType() string  { return "SleepStmt" }
+func (s *SleepStmt) Pos() Position     { return s.Position }
+func (s *SleepStmt) statementNode()    {}
+
+// CaptureStmt: capture name expression
+// Stores a value from the previous response in a variable (capture token $_.data.token)
+type CaptureStmt struct {
+	Position Position
+	Name     string
+	Path     Expression
+}
+
+func (s *CaptureStmt) nodeType() string { return "CaptureStmt" }
+func (s *CaptureStmt) Pos() Position    { return s.Position }
+func (s *CaptureStmt) statementNode()   {}
+
 // SeparatorStmt: --- (request separator)
 type SeparatorStmt struct {
 	Position Position
@@ -126,6 +250,62 @@ func (s *SeparatorStmt) nodeType() string  { return "SeparatorStmt" }
 func (s *SeparatorStmt) Pos() Position     { return s.Position }
 func (s *SeparatorStmt) statementNode()    {}
 
+// FlowDefStmt: @flow name followed by an indented block of statements
+type FlowDefStmt struct {
+	Position Position
+	Name     string
+	Body     []Statement
+}
+
+func (s *FlowDefStmt) nodeType() string  { return "FlowDefStmt" }
+func (s *FlowDefStmt) Pos() Position     { return s.Position }
+func (s *FlowDefStmt) statementNode()    {}
+
+// FuncDefStmt: def name($param, ...) followed by an indented block of statements
+type FuncDefStmt struct {
+	Position Position
+	Name     string
+	Params   []string // parameter names without the $
+	Body     []Statement
+}
+
+func (s *FuncDefStmt) nodeType() string  { return "FuncDefStmt" }
+func (s *FuncDefStmt) Pos() Position     { return s.Position }
+func (s *FuncDefStmt) statementNode()    {}
+
+// CallStmt: name arg ... (calls a function defined with def)
+type CallStmt struct {
+	Position Position
+	Name     string
+	Args     []Expression
+}
+
+func (s *CallStmt) nodeType() string  { return "CallStmt" }
+func (s *CallStmt) Pos() Position     { return s.Position }
+func (s *CallStmt) statementNode()    {}
+
+// RunStmt: run name (executes a flow defined with @flow)
+type RunStmt struct {
+	Position Position
+	Name     string
+}
+
+func (s *RunStmt) nodeType() string  { return "RunStmt" }
+func (s *RunStmt) Pos() Position     { return s.Position }
+func (s *RunStmt) statementNode()    {}
+
+// TemplateDefStmt: @template name followed by an indented block of request
+// sections (headers, body, auth, ...), applied to requests with use name
+type TemplateDefStmt struct {
+	Position Position
+	Name     string
+	Request  *RequestStmt // the sections; Method and URL are unset
+}
+
+func (s *TemplateDefStmt) nodeType() string  { return "TemplateDefStmt" }
+func (s *TemplateDefStmt) Pos() Position     { return s.Position }
+func (s *TemplateDefStmt) statementNode()    {}
+
 // ---------------------------------------------------------
 // Expressions
 // ---------------------------------------------------------
@@ -216,6 +396,17 @@ func (e *VarRef) nodeType() string  { return "VarRef" }
 func (e *VarRef) Pos() Position     { return e.Position }
 func (e *VarRef) exprNode()         {}
 
+// CallExpr: name(arg, ...) (built-in function call, e.g., len($items))
+type CallExpr struct {
+	Position Position
+	Name     string
+	Args     []Expression
+}
+
+func (e *CallExpr) nodeType() string { return "CallExpr" }
+func (e *CallExpr) Pos() Position    { return e.Position }
+func (e *CallExpr) exprNode()        {}
+
 // BinaryExpr: left op right (e.g., $env.ENV == "production", $x > 10)
 type BinaryExpr struct {
 	Position Position
@@ -239,6 +430,18 @@ func (e *UnaryExpr) nodeType() string  { return "UnaryExpr" }
 func (e *UnaryExpr) Pos() Position     { return e.Position }
 func (e *UnaryExpr) exprNode()         {}
 
+// RangeExpr: start..end [step n] (inclusive integer range, e.g., 1..$_.total_pages, 10..0 step -2)
+type RangeExpr struct {
+	Position Position
+	Start    Expression
+	End      Expression
+	Step     Expression // nil means 1
+}
+
+func (e *RangeExpr) nodeType() string  { return "RangeExpr" }
+func (e *RangeExpr) Pos() Position     { return e.Position }
+func (e *RangeExpr) exprNode()         {}
+
 // FullPath returns the complete variable path as a string
 func (e *VarRef) FullPath() string {
 	if len(e.Path) == 0 {
@@ -251,10 +454,10 @@ func (e *VarRef) FullPath() string {
 	return result
 }
 
-// ProcessedString: json`...`, base64`...`, file`...`
+// ProcessedString: json`...`, xml`...`, base64`...`, hex`...`, urlencode`...`, file`...`, stdin``
 type ProcessedString struct {
 	Position  Position
-	Processor string // "json", "base64", "file", etc.
+	Processor string // "json", "xml", "base64", "hex", "urlencode", "urldecode", "file", "stdin", etc.
 	Content   string // content inside backticks
 }
 
@@ -262,7 +465,8 @@ func (e *ProcessedString) nodeType() string  { return "ProcessedString" }
 func (e *ProcessedString) Pos() Position     { return e.Position }
 func (e *ProcessedString) exprNode()         {}
 
-// BlockExpr: indented block of key-value pairs or list items
+// BlockExpr: indented block of key-value pairs or list items,
+// or an inline object: {name=John, age: 25}
 type BlockExpr struct {
 	Position Position
 	Entries  []Entry
@@ -275,7 +479,7 @@ func (e *BlockExpr) exprNode()         {}
 // IsArray returns true if this block represents an array (all entries have no key)
 func (e *BlockExpr) IsArray() bool {
 	for _, entry := range e.Entries {
-		if entry.Key != "" && entry.Value != nil {
+		if (entry.Key != "" || entry.KeyExpr != nil) && entry.Value != nil {
 			return false
 		}
 	}
@@ -284,9 +488,11 @@ func (e *BlockExpr) IsArray() bool {
 
 // Entry represents a key-value pair or a list item in a block
 type Entry struct {
-	Position Position
-	Key      string     // empty for array items
-	Value    Expression // the value (can be another BlockExpr for nesting)
+	Position  Position
+	Key       string     // empty for array items
+	KeyExpr   Expression // computed key ([$field] value), resolved at eval time
+	Value     Expression // the value (can be another BlockExpr for nesting)
+	Condition Expression // optional guard (key value if cond); entry is omitted when false
 }
 
 // ---------------------------------------------------------
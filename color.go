@@ -0,0 +1,47 @@
+package main
+
+import "os"
+
+// ANSI 颜色码
+const (
+	ansiReset   = "\033[0m"
+	ansiBold    = "\033[1m"
+	ansiDim     = "\033[2m"
+	ansiRed     = "\033[31m"
+	ansiGreen   = "\033[32m"
+	ansiYellow  = "\033[33m"
+	ansiMagenta = "\033[35m"
+	ansiCyan    = "\033[36m"
+)
+
+// 是否在 stdout / stderr 输出颜色码，由 initColors 根据环境设置
+var colorOutput, colorErrors = true, true
+
+// initColors 在 --no-color、设置了 NO_COLOR 或输出不是终端（管道、重定向到文件）时关闭颜色
+func initColors(disabled bool) {
+	disabled = disabled || os.Getenv("NO_COLOR") != ""
+	colorOutput = !disabled && isTerminal(os.Stdout)
+	colorErrors = !disabled && isTerminal(os.Stderr)
+}
+
+// isTerminal 判断文件是否是终端（字符设备）
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// color 返回 stdout 使用的颜色码，关闭颜色时返回空字符串
+func color(code string) string {
+	if !colorOutput {
+		return ""
+	}
+	return code
+}
+
+// errColor 返回 stderr 使用的颜色码，关闭颜色时返回空字符串
+func errColor(code string) string {
+	if !colorErrors {
+		return ""
+	}
+	return code
+}
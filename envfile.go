@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// envEntry .env 文件中的一个变量
+type envEntry struct {
+	key   string
+	value string
+}
+
+// loadEnvFiles 依次读取 .env 文件并写入进程环境变量，使 $env.KEY 可以读取
+// 同名变量以后出现的为准；加载前已存在的环境变量默认保留，override 为 true 时由文件中的值覆盖
+func loadEnvFiles(paths []string, override bool) error {
+	var entries []envEntry
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		fileEntries, err := parseEnvFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		entries = append(entries, fileEntries...)
+	}
+
+	// 先记录真实环境中已有的变量，避免前面文件设置的值被当作已有变量
+	existing := make(map[string]bool)
+	for _, e := range entries {
+		if _, ok := os.LookupEnv(e.key); ok {
+			existing[e.key] = true
+		}
+	}
+	for _, e := range entries {
+		if existing[e.key] && !override {
+			continue
+		}
+		if err := os.Setenv(e.key, e.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseEnvFile 解析 KEY=VALUE 格式的内容
+// 支持 # 注释、空行、export 前缀；双引号值支持 \n \t \" \\ 转义，单引号值原样保留，
+// 未加引号的值去掉首尾空白和行尾的 " #" 注释
+func parseEnvFile(r io.Reader) ([]envEntry, error) {
+	var entries []envEntry
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNum)
+		}
+
+		value, err := parseEnvValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		entries = append(entries, envEntry{key: key, value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseEnvValue 解析等号右侧的值
+func parseEnvValue(s string) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated single quote")
+		}
+		return s[1 : end+1], nil
+
+	case '"':
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			switch c := s[i]; c {
+			case '"':
+				return sb.String(), nil
+			case '\\':
+				if i+1 >= len(s) {
+					break
+				}
+				i++
+				switch s[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				case 'r':
+					sb.WriteByte('\r')
+				default:
+					sb.WriteByte(s[i])
+				}
+			default:
+				sb.WriteByte(c)
+			}
+		}
+		return "", fmt.Errorf("unterminated double quote")
+	}
+
+	// 未加引号：行尾注释需要以空白开头，"a#b" 中的 # 属于值
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "\t#"); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s), nil
+}
@@ -0,0 +1,231 @@
+package eval
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/LingHeChen/haiku/ast"
+)
+
+// builtin is a function callable from expressions, e.g. len($items)
+type builtin struct {
+	arity    int  // number of arguments
+	variadic bool // arity is the minimum, more arguments may follow
+	renames  bool // accepts name -> new_name arguments
+	fn       func(args []interface{}) (interface{}, error)
+}
+
+// fieldRename is the value of a "name -> new_name" call argument
+type fieldRename struct {
+	from, to string
+}
+
+// builtins holds the functions available in expressions; new built-ins are
+// added by registering them here
+var builtins = map[string]builtin{
+	"len":   {arity: 1, fn: builtinLen},
+	"upper": {arity: 1, fn: stringBuiltin(strings.ToUpper)},
+	"lower": {arity: 1, fn: stringBuiltin(strings.ToLower)},
+	"trim":  {arity: 1, fn: stringBuiltin(strings.TrimSpace)},
+	"pick":  {arity: 1, variadic: true, renames: true, fn: builtinPick},
+}
+
+func (e *Evaluator) evalCallExpr(call *ast.CallExpr) interface{} {
+	args := make([]interface{}, len(call.Args))
+	for i, arg := range call.Args {
+		if rename, ok := arg.(*ast.BinaryExpr); ok && rename.Operator == "->" {
+			args[i] = fieldRename{
+				from: fmt.Sprintf("%v", e.evalExpr(rename.Left)),
+				to:   fmt.Sprintf("%v", e.evalExpr(rename.Right)),
+			}
+			continue
+		}
+		args[i] = e.evalExpr(arg)
+	}
+	result, err := callBuiltin(call.Name, args)
+	if err != nil {
+		e.recordErr(&PosError{Pos: call.Position, Err: err})
+		return nil
+	}
+	return result
+}
+
+// callBuiltin looks up a built-in by name and calls it with evaluated arguments
+func callBuiltin(name string, args []interface{}) (interface{}, error) {
+	fn, ok := builtins[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+	if fn.variadic && len(args) < fn.arity {
+		return nil, fmt.Errorf("%s() takes at least %d argument(s), got %d", name, fn.arity, len(args))
+	}
+	if !fn.variadic && len(args) != fn.arity {
+		return nil, fmt.Errorf("%s() takes %d argument(s), got %d", name, fn.arity, len(args))
+	}
+	if !fn.renames {
+		for _, arg := range args {
+			if _, ok := arg.(fieldRename); ok {
+				return nil, fmt.Errorf("%s() does not take name -> new_name arguments", name)
+			}
+		}
+	}
+	result, err := fn.fn(args)
+	if err != nil {
+		return nil, fmt.Errorf("%s(): %w", name, err)
+	}
+	return result, nil
+}
+
+// evalInlineExpr evaluates the inside of ${...}: a variable path ($ is optional),
+// a quoted string, or a function call whose arguments are any of these,
+// e.g. ${upper(user.name)}. "a ?? b" falls back to b when a is unset or empty.
+func (e *Evaluator) evalInlineExpr(src string) (interface{}, error) {
+	src = strings.TrimSpace(src)
+
+	if parts := splitInline(src, "??"); len(parts) > 1 {
+		for _, part := range parts[:len(parts)-1] {
+			val, ok, err := e.evalInlineOperand(part)
+			if err != nil {
+				return nil, err
+			}
+			if ok && val != nil && val != "" {
+				return val, nil
+			}
+		}
+		return e.evalInlineExpr(parts[len(parts)-1])
+	}
+
+	val, ok, err := e.evalInlineOperand(src)
+	if !ok && err == nil {
+		// Interpolated like $var: an unset $env is "", an unknown variable stays as written
+		return e.resolveVarPath(strings.TrimPrefix(src, "$")), nil
+	}
+	return val, err
+}
+
+// evalInlineOperand evaluates an inline expression without "??". ok is false
+// when it is a variable that is not defined (or an environment variable that
+// is not set).
+func (e *Evaluator) evalInlineOperand(src string) (val interface{}, ok bool, err error) {
+	src = strings.TrimSpace(src)
+
+	// Single quotes can be used inside a double-quoted string: "${env.USER ?? 'guest'}"
+	if len(src) >= 2 && (src[0] == '"' || src[0] == '\'') && src[len(src)-1] == src[0] {
+		return src[1 : len(src)-1], true, nil
+	}
+
+	if open := strings.IndexByte(src, '('); open > 0 && strings.HasSuffix(src, ")") {
+		name := strings.TrimSpace(src[:open])
+		var args []interface{}
+		for _, argSrc := range splitInline(src[open+1:len(src)-1], ",") {
+			arg, err := e.evalInlineExpr(argSrc)
+			if err != nil {
+				return nil, false, err
+			}
+			args = append(args, arg)
+		}
+		val, err := callBuiltin(name, args)
+		return val, true, err
+	}
+
+	val, ok = e.lookupVarPath(strings.TrimPrefix(src, "$"))
+	return val, ok, nil
+}
+
+// splitInline splits s on occurrences of sep that are not inside
+// parentheses or quotes (call arguments on ",", defaults on "??")
+func splitInline(s, sep string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var parts []string
+	depth, start := 0, 0
+	var quote byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == '(':
+			depth++
+		case s[i] == ')':
+			depth--
+		case depth == 0 && strings.HasPrefix(s[i:], sep):
+			parts = append(parts, s[start:i])
+			start = i + len(sep)
+			i += len(sep) - 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// builtinLen returns the number of elements of an array or object, or the
+// number of characters of a string; null has length 0
+func builtinLen(args []interface{}) (interface{}, error) {
+	switch v := args[0].(type) {
+	case nil:
+		return int64(0), nil
+	case []interface{}:
+		return int64(len(v)), nil
+	case map[string]interface{}:
+		return int64(len(v)), nil
+	case string:
+		return int64(utf8.RuneCountInString(v)), nil
+	default:
+		return nil, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// stringBuiltin wraps a string transform; non-string arguments are formatted
+// with %v and null becomes an empty string
+func stringBuiltin(transform func(string) string) func(args []interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		if args[0] == nil {
+			return "", nil
+		}
+		return transform(fmt.Sprintf("%v", args[0])), nil
+	}
+}
+
+// builtinPick builds a new object from selected fields of the first argument:
+// pick($_, id, name -> full_name). A field may be a dotted path ("user.email"),
+// which is stored under its last segment unless renamed. Missing fields are null.
+func builtinPick(args []interface{}) (interface{}, error) {
+	src, ok := args[0].(map[string]interface{})
+	if !ok && args[0] != nil {
+		return nil, fmt.Errorf("expected an object, got %T", args[0])
+	}
+
+	result := make(map[string]interface{}, len(args)-1)
+	for _, arg := range args[1:] {
+		var from, to string
+		switch v := arg.(type) {
+		case fieldRename:
+			from, to = v.from, v.to
+		case string:
+			from = v
+			to = v[strings.LastIndex(v, ".")+1:]
+		default:
+			return nil, fmt.Errorf("expected a field name, got %v", arg)
+		}
+		result[to] = pickField(src, strings.Split(from, "."))
+	}
+	return result, nil
+}
+
+// pickField looks up a field path; like $_.id, a field missing from a
+// response ($_) is looked up in its body
+func pickField(src map[string]interface{}, path []string) interface{} {
+	if _, ok := src[path[0]]; !ok {
+		if _, isResponse := src["status"]; isResponse {
+			if body, ok := src["body"]; ok {
+				return getNestedValue(body, path)
+			}
+		}
+	}
+	return getNestedValue(src, path)
+}
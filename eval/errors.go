@@ -0,0 +1,56 @@
+package eval
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/LingHeChen/haiku/ast"
+)
+
+// PosError is an evaluation error with the source position of the statement
+// (or expression) that caused it. Statement errors are wrapped on the way up,
+// the innermost position wins, so errors.As finds the line that failed even
+// inside loops, ifs and function bodies.
+type PosError struct {
+	File string // the imported file the position refers to, empty for the script itself
+	Pos  ast.Position
+	Err  error
+}
+
+func (e *PosError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s: line %d: %v", e.File, e.Pos.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d: %v", e.Pos.Line, e.Err)
+}
+
+func (e *PosError) Unwrap() error {
+	return e.Err
+}
+
+// errorAt returns a formatted error at pos
+func errorAt(pos ast.Position, format string, args ...interface{}) error {
+	return &PosError{Pos: pos, Err: fmt.Errorf(format, args...)}
+}
+
+// atPos wraps err with pos unless it already has a position. The control flow
+// errors (break, continue, skip) are handled by enclosing statements and are
+// returned unchanged.
+func atPos(pos ast.Position, err error) error {
+	if err == nil || errors.Is(err, errBreak) || errors.Is(err, errContinue) || errors.Is(err, errSkip) {
+		return err
+	}
+	var pe *PosError
+	if errors.As(err, &pe) {
+		return err
+	}
+	return &PosError{Pos: pos, Err: err}
+}
+
+// inFile records that the positions in err refer to the imported file path
+func inFile(path string, err error) {
+	var pe *PosError
+	if errors.As(err, &pe) && pe.File == "" {
+		pe.File = path
+	}
+}
@@ -3,15 +3,30 @@ package eval
 
 import (
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/LingHeChen/haiku/ast"
+	"github.com/LingHeChen/haiku/internal/textblock"
+	"github.com/LingHeChen/haiku/xmlmap"
+	"gopkg.in/yaml.v3"
 )
 
 // Scope represents a variable scope
@@ -48,10 +63,57 @@ func (s *Scope) Get(name string) (interface{}, bool) {
 type Evaluator struct {
 	scope             *Scope
 	prevResponse      map[string]interface{}
+	responses         []map[string]interface{} // the latest responses, oldest first ($responses, $_1, $_2, ...)
+	maxHistory        int                      // responses kept in the history (@history, 0 = DefaultMaxHistory)
 	basePath          string
-	requestCallback   func(req map[string]interface{}) (map[string]interface{}, error)
+	requestCallback   func(req map[string]interface{}) (RequestResult, error)
 	collectedRequests []map[string]interface{}
-	defaultTimeout    time.Duration // global default timeout
+	defaultTimeout    time.Duration                   // global default timeout
+	fixedTimeout      bool                            // defaultTimeout comes from WithDefaultTimeout and ignores @timeout
+	delay             time.Duration                   // pause between sequential requests (@delay)
+	sentRequest       bool                            // whether a request has gone through the callback yet
+	envPrefix         string                          // prefix prepended to $env lookups (@env_prefix)
+	depth             int                             // current block nesting depth during evaluation
+	maxDepth          int                             // maximum block nesting depth (0 = unlimited)
+	evalErr           error                           // first error raised while evaluating an expression (too deep, bad call)
+	flows             map[string]*ast.FlowDefStmt     // named flows defined with @flow
+	runningFlows      map[string]bool                 // flows currently executing (recursion guard)
+	templates         map[string]*ast.TemplateDefStmt // request templates defined with @template
+	funcs             map[string]*ast.FuncDefStmt     // functions defined with def
+	callDepth         int                             // nesting depth of function calls (recursion guard)
+	warnOut           io.Writer                       // where warnings are written (nil = stderr)
+	strict            bool                            // unknown processors are errors instead of warnings
+	overrides         map[string]interface{}          // variables set from the CLI (--set), win over @var
+	stdin             *stdinSource                    // where stdin`` reads from (nil = not available)
+	errorKind         func(error) string              // classifies failed requests; nil = a failed request stops the run
+	failures          *requestFailures                // failed requests recorded while continuing on errors
+	failedRequests    int                             // requests that failed in this evaluator (per parallel iteration)
+	responseBytes     int64                           // raw response body bytes reported by the executor (RequestResult.Bytes)
+	skipRequests      bool                            // evaluating an import without "with requests": requests and loops are skipped
+	skippedRequests   int                             // requests and loops skipped because of skipRequests
+	imports           []importFrame                   // files being imported, outermost first (cycle detection)
+}
+
+// importFrame is a file on the import stack
+type importFrame struct {
+	key  string // absolute path with symlinks resolved, identifies the file
+	path string // the path as resolved against the base path, for messages
+}
+
+// stdinSource reads the process's stdin once for stdin`` strings, so every
+// use in a run (including loop iterations) sees the same content
+type stdinSource struct {
+	r    io.Reader
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func (s *stdinSource) read() ([]byte, error) {
+	s.once.Do(func() {
+		s.data, s.err = io.ReadAll(s.r)
+	})
+	return s.data, s.err
 }
 
 // EvalOption is a functional option for Evaluator
@@ -67,15 +129,119 @@ func WithBasePath(path string) EvalOption {
 // WithRequestCallback sets the callback for executing requests
 func WithRequestCallback(cb func(req map[string]interface{}) (map[string]interface{}, error)) EvalOption {
 	return func(e *Evaluator) {
-		e.requestCallback = cb
+		e.requestCallback = func(req map[string]interface{}) (RequestResult, error) {
+			resp, err := cb(req)
+			return RequestResult{Response: resp}, err
+		}
+	}
+}
+
+// WithRequestExecutor sets the function for executing requests. Unlike
+// WithRequestCallback it can also report the raw body size of the response.
+func WithRequestExecutor(exec func(req map[string]interface{}) (RequestResult, error)) EvalOption {
+	return func(e *Evaluator) {
+		e.requestCallback = exec
+	}
+}
+
+// WithMaxDepth sets the maximum nesting depth of evaluated blocks (0 = unlimited)
+func WithMaxDepth(n int) EvalOption {
+	return func(e *Evaluator) {
+		e.maxDepth = n
+	}
+}
+
+// WithOverrides defines variables from key=value strings (types are inferred).
+// They take precedence over @var definitions with the same name.
+func WithOverrides(vars map[string]string) EvalOption {
+	return func(e *Evaluator) {
+		if e.overrides == nil {
+			e.overrides = make(map[string]interface{})
+		}
+		for name, raw := range vars {
+			val := e.inferType(raw)
+			e.overrides[name] = val
+			e.setVar(name, val)
+		}
+	}
+}
+
+// WithStdin makes stdin`` strings read from r. It is read lazily, the first
+// time a stdin`` string is evaluated. Without this option stdin`` is an error,
+// which is what callers want when stdin already holds the script itself;
+// passing a nil reader has the same effect.
+func WithStdin(r io.Reader) EvalOption {
+	return func(e *Evaluator) {
+		if r != nil {
+			e.stdin = &stdinSource{r: r}
+		}
+	}
+}
+
+// WithContinueOnError keeps going when the request callback returns an error.
+// The error is recorded under kind(err) (see RequestFailures), $_ becomes a
+// response with status 0 and the message in "error", and execution goes on.
+// A parallel loop iteration with a failed request counts as failed, and the
+// loop's stats list the errors under "errors". A nil kind keeps the default,
+// where a failed request stops the run.
+func WithContinueOnError(kind func(err error) string) EvalOption {
+	return func(e *Evaluator) {
+		if kind == nil {
+			return
+		}
+		e.errorKind = kind
+		e.failures = &requestFailures{}
+	}
+}
+
+// WithDefaultTimeout sets the timeout of requests without a timeout section.
+// It takes precedence over @timeout, which is then ignored. A duration <= 0
+// keeps the default of 30 seconds and @timeout.
+func WithDefaultTimeout(d time.Duration) EvalOption {
+	return func(e *Evaluator) {
+		if d <= 0 {
+			return
+		}
+		e.defaultTimeout = d
+		e.fixedTimeout = true
+	}
+}
+
+// WithWarningOutput sets where warnings are written (default os.Stderr)
+func WithWarningOutput(w io.Writer) EvalOption {
+	return func(e *Evaluator) {
+		e.warnOut = w
+	}
+}
+
+// WithStrict makes an unknown processor (like a misspelled jsom`...`) an error.
+// Otherwise it is a warning and the content is used as a raw string.
+func WithStrict(strict bool) EvalOption {
+	return func(e *Evaluator) {
+		e.strict = strict
+	}
+}
+
+// WithScriptPath sets the path of the file being evaluated, so that an import
+// of that file from one of its imports is reported as a circular import.
+// An empty path (a script from stdin or -e) is ignored.
+func WithScriptPath(path string) EvalOption {
+	return func(e *Evaluator) {
+		if path != "" {
+			e.imports = []importFrame{{key: importKey(path), path: path}}
+		}
 	}
 }
 
+// DefaultMaxDepth is the default maximum nesting depth of evaluated blocks
+const DefaultMaxDepth = 100
+
 // NewEvaluator creates a new Evaluator
 func NewEvaluator(opts ...EvalOption) *Evaluator {
 	e := &Evaluator{
 		scope:          NewScope(nil),
 		defaultTimeout: 30 * time.Second, // default 30 seconds
+		maxDepth:       DefaultMaxDepth,
 	}
 	for _, opt := range opts {
 		opt(e)
@@ -87,21 +253,15 @@ func NewEvaluator(opts ...EvalOption) *Evaluator {
 func (e *Evaluator) Eval(program *ast.Program) ([]map[string]interface{}, error) {
 	e.collectedRequests = nil
 
+	// Requests are executed in order as they are reached (if a callback is set),
+	// so later statements see the real previous response via $_
 	for _, stmt := range program.Statements {
 		err := e.evalStatementCollect(stmt)
-		if err != nil {
-			return nil, err
+		if errors.Is(err, errSkip) {
+			break
 		}
-	}
-
-	// Execute collected requests if callback is set
-	if e.requestCallback != nil {
-		for _, req := range e.collectedRequests {
-			response, err := e.requestCallback(req)
-			if err != nil {
-				return e.collectedRequests, err
-			}
-			e.prevResponse = response
+		if err != nil {
+			return e.collectedRequests, err
 		}
 	}
 
@@ -114,6 +274,9 @@ func (e *Evaluator) EvalToRequests(program *ast.Program) ([]map[string]interface
 
 	for _, stmt := range program.Statements {
 		err := e.evalStatementCollect(stmt)
+		if errors.Is(err, errSkip) {
+			break
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -122,7 +285,8 @@ func (e *Evaluator) EvalToRequests(program *ast.Program) ([]map[string]interface
 	return e.collectedRequests, nil
 }
 
-func (e *Evaluator) evalStatement(stmt ast.Statement) (map[string]interface{}, error) {
+func (e *Evaluator) evalStatement(stmt ast.Statement) (req map[string]interface{}, err error) {
+	defer func() { err = atPos(stmt.Pos(), err) }()
 	switch s := stmt.(type) {
 	case *ast.ImportStmt:
 		return nil, e.evalImport(s)
@@ -134,8 +298,36 @@ func (e *Evaluator) evalStatement(stmt ast.Statement) (map[string]interface{}, e
 		return nil, e.evalForCollect(s)
 	case *ast.IfStmt:
 		return nil, e.evalIf(s)
+	case *ast.WhileStmt:
+		return nil, e.evalWhile(s)
+	case *ast.MatchStmt:
+		return nil, e.evalMatch(s)
+	case *ast.SkipStmt:
+		skip, err := e.evalSkip(s)
+		if err == nil && skip {
+			return nil, errSkip
+		}
+		return nil, err
+	case *ast.BreakStmt:
+		return nil, errBreak
+	case *ast.ContinueStmt:
+		return nil, errContinue
 	case *ast.EchoStmt:
 		return nil, e.evalEcho(s)
+	case *ast.SleepStmt:
+		return nil, e.evalSleep(s)
+	case *ast.CaptureStmt:
+		return nil, e.evalCapture(s)
+	case *ast.FlowDefStmt:
+		return nil, e.evalFlowDef(s)
+	case *ast.TemplateDefStmt:
+		return nil, e.evalTemplateDef(s)
+	case *ast.FuncDefStmt:
+		return nil, e.evalFuncDef(s)
+	case *ast.CallStmt:
+		return nil, e.evalCall(s)
+	case *ast.RunStmt:
+		return nil, e.evalRun(s)
 	case *ast.SeparatorStmt:
 		// Separator doesn't produce output
 		return nil, nil
@@ -143,7 +335,15 @@ func (e *Evaluator) evalStatement(stmt ast.Statement) (map[string]interface{}, e
 	return nil, nil
 }
 
-func (e *Evaluator) evalStatementCollect(stmt ast.Statement) error {
+func (e *Evaluator) evalStatementCollect(stmt ast.Statement) (err error) {
+	defer func() { err = atPos(stmt.Pos(), err) }()
+	if e.skipRequests {
+		switch stmt.(type) {
+		case *ast.RequestStmt, *ast.ForStmt, *ast.WhileStmt:
+			e.skippedRequests++
+			return nil
+		}
+	}
 	switch s := stmt.(type) {
 	case *ast.ImportStmt:
 		return e.evalImport(s)
@@ -156,16 +356,47 @@ func (e *Evaluator) evalStatementCollect(stmt ast.Statement) error {
 		}
 		if req != nil {
 			e.collectedRequests = append(e.collectedRequests, req)
+			if e.requestCallback != nil {
+				return e.ExecuteRequest(req)
+			}
 			// Use as mock response for chaining
-			e.prevResponse = req
+			e.recordResponse(req)
 		}
 		return nil
 	case *ast.ForStmt:
 		return e.evalForCollect(s)
 	case *ast.IfStmt:
 		return e.evalIf(s)
+	case *ast.WhileStmt:
+		return e.evalWhile(s)
+	case *ast.MatchStmt:
+		return e.evalMatch(s)
+	case *ast.SkipStmt:
+		skip, err := e.evalSkip(s)
+		if err == nil && skip {
+			return errSkip
+		}
+		return err
+	case *ast.BreakStmt:
+		return errBreak
+	case *ast.ContinueStmt:
+		return errContinue
 	case *ast.EchoStmt:
 		return e.evalEcho(s)
+	case *ast.SleepStmt:
+		return e.evalSleep(s)
+	case *ast.CaptureStmt:
+		return e.evalCapture(s)
+	case *ast.FlowDefStmt:
+		return e.evalFlowDef(s)
+	case *ast.TemplateDefStmt:
+		return e.evalTemplateDef(s)
+	case *ast.FuncDefStmt:
+		return e.evalFuncDef(s)
+	case *ast.CallStmt:
+		return e.evalCall(s)
+	case *ast.RunStmt:
+		return e.evalRun(s)
 	case *ast.SeparatorStmt:
 		return nil
 	}
@@ -174,29 +405,91 @@ func (e *Evaluator) evalStatementCollect(stmt ast.Statement) error {
 
 // EvalImport evaluates an import statement (public method)
 func (e *Evaluator) EvalImport(stmt *ast.ImportStmt) error {
-	return e.evalImport(stmt)
+	return atPos(stmt.Pos(), e.evalImport(stmt))
 }
 
-func (e *Evaluator) evalImport(stmt *ast.ImportStmt) error {
-	path := stmt.Path
+// resolvePath resolves a relative file path against the base path
+func (e *Evaluator) resolvePath(path string) string {
 	if e.basePath != "" && !strings.HasPrefix(path, "/") {
-		path = e.basePath + "/" + path
+		return e.basePath + "/" + path
+	}
+	return path
+}
+
+// importKey identifies an imported file: two spellings of the same file (with
+// .. or through a symlink) get the same key
+func importKey(path string) string {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return path
 	}
+	if resolved, err := filepath.EvalSymlinks(key); err == nil {
+		key = resolved
+	}
+	return key
+}
+
+func (e *Evaluator) evalImport(stmt *ast.ImportStmt) error {
+	path := e.resolvePath(stmt.Path)
 
 	content, err := os.ReadFile(path)
 	if err != nil {
 		return fmt.Errorf("import error: %w", err)
 	}
 
+	// A file that is already being imported further up would recurse forever
+	key := importKey(path)
+	for i, frame := range e.imports {
+		if frame.key == key {
+			chain := make([]string, 0, len(e.imports)-i+1)
+			for _, f := range e.imports[i:] {
+				chain = append(chain, f.path)
+			}
+			if path != frame.path {
+				// Another spelling of the same file
+				path += " (" + frame.path + ")"
+			}
+			return fmt.Errorf("circular import: %s -> %s", strings.Join(chain, " -> "), path)
+		}
+	}
+	imports := e.imports
+	e.imports = append(slices.Clip(imports), importFrame{key: key, path: path})
+	defer func() { e.imports = imports }()
+
 	// Parse and evaluate the imported file
 	importProgram, err := parseImportedFile(string(content))
 	if err != nil {
 		return fmt.Errorf("import parse error: %w", err)
 	}
 
+	if stmt.Only != nil {
+		return e.evalImportOnly(stmt, path, importProgram)
+	}
+
+	// Unless the import says "with requests", the imported file only sets up
+	// variables, flows and the like: its requests and loops are skipped
+	if !stmt.Requests && !e.skipRequests {
+		e.skipRequests = true
+		e.skippedRequests = 0
+		defer func() {
+			e.skipRequests = false
+			if e.skippedRequests > 0 {
+				e.warn("line %d: import %q: skipped %d request(s) and loop(s), use import %q with requests to run them",
+					stmt.Position.Line, stmt.Path, e.skippedRequests, stmt.Path)
+			}
+		}()
+	}
+
 	// Evaluate all statements in the imported file (including if statements, variable definitions, etc.)
 	for _, stmt := range importProgram.Statements {
-		if err := e.evalStatementCollect(stmt); err != nil {
+		err := e.evalStatementCollect(stmt)
+		if errors.Is(err, errSkip) {
+			// skip if ... only ends the imported file, the importer continues
+			break
+		}
+		if err != nil {
+			// Positions in the error refer to the imported file
+			inFile(path, err)
 			return fmt.Errorf("import evaluation error: %w", err)
 		}
 	}
@@ -204,66 +497,869 @@ func (e *Evaluator) evalImport(stmt *ast.ImportStmt) error {
 	return nil
 }
 
+// evalImportOnly evaluates an imported file in a separate evaluator that does
+// not send requests, then copies the variables listed after "only" into the
+// current scope. Nothing else the file defines (other variables, flows,
+// templates, functions, $_) leaks into the importer.
+func (e *Evaluator) evalImportOnly(stmt *ast.ImportStmt, path string, program *ast.Program) error {
+	sub := &Evaluator{
+		scope:          NewScope(e.scope),
+		basePath:       e.basePath,
+		defaultTimeout: e.defaultTimeout,
+		fixedTimeout:   e.fixedTimeout,
+		envPrefix:      e.envPrefix,
+		maxDepth:       e.maxDepth,
+		flows:          maps.Clone(e.flows),
+		templates:      e.templates,
+		funcs:          e.funcs,
+		warnOut:        e.warnOut,
+		strict:         e.strict,
+		overrides:      e.overrides,
+		stdin:          e.stdin,
+		skipRequests:   true,
+		imports:        e.imports,
+	}
+	for _, s := range program.Statements {
+		err := sub.evalStatementCollect(s)
+		if errors.Is(err, errSkip) {
+			break
+		}
+		if err != nil {
+			inFile(path, err)
+			return fmt.Errorf("import evaluation error: %w", err)
+		}
+	}
+
+	for _, name := range stmt.Only {
+		val, ok := sub.scope.vars[name]
+		if !ok {
+			return fmt.Errorf("import %q: variable %s is not defined", stmt.Path, name)
+		}
+		e.setVar(name, val)
+	}
+	return nil
+}
+
 // EvalVarDef evaluates a variable definition (public method)
 func (e *Evaluator) EvalVarDef(stmt *ast.VarDefStmt) error {
-	return e.evalVarDef(stmt)
+	return atPos(stmt.Pos(), e.evalVarDef(stmt))
 }
 
 func (e *Evaluator) evalVarDef(stmt *ast.VarDefStmt) error {
+	// Variables set from the CLI win over the file
+	if override, ok := e.overrides[stmt.Name]; ok {
+		e.setVar(stmt.Name, override)
+		return nil
+	}
 	if stmt.Value == nil {
 		e.scope.Set(stmt.Name, nil)
 		return nil
 	}
 
-	val := e.evalExpr(stmt.Value)
-	e.scope.Set(stmt.Name, val)
-	
-	// Special handling for @timeout variable
-	if stmt.Name == "timeout" {
-		if timeout, err := parseTimeout(val); err == nil {
-			e.defaultTimeout = timeout
-		}
+	val := e.evalExpr(stmt.Value)
+	if err := e.takeEvalErr(); err != nil {
+		return err
+	}
+	e.setVar(stmt.Name, val)
+	return nil
+}
+
+// setVar sets a variable in the current scope and applies special variables
+func (e *Evaluator) setVar(name string, val interface{}) {
+	e.scope.Set(name, val)
+
+	// Special handling for @timeout variable
+	if name == "timeout" && !e.fixedTimeout {
+		if timeout, err := parseTimeout(val); err == nil {
+			e.defaultTimeout = timeout
+		}
+	}
+
+	// Special handling for @delay variable
+	if name == "delay" {
+		if val == nil {
+			e.delay = 0
+		} else if delay, err := parseTimeout(val); err == nil {
+			e.delay = delay
+		}
+	}
+
+	// Special handling for @history variable
+	if name == "history" {
+		if val == nil {
+			e.maxHistory = 0
+		} else if n, ok := toInt64(val); ok && n > 0 {
+			e.maxHistory = int(n)
+		}
+	}
+
+	// Special handling for @env_prefix variable
+	if name == "env_prefix" {
+		if val == nil {
+			e.envPrefix = ""
+		} else {
+			e.envPrefix = fmt.Sprintf("%v", val)
+		}
+	}
+}
+
+// EvalRequest evaluates a request statement (public method)
+func (e *Evaluator) EvalRequest(stmt *ast.RequestStmt) (map[string]interface{}, error) {
+	req, err := e.evalRequest(stmt)
+	return req, atPos(stmt.Pos(), err)
+}
+
+// ExecuteRequest sends an evaluated request through the request callback and
+// keeps its response for $_. When @delay is set, it first waits that long,
+// except before the first request. Parallel loops call the callback directly
+// and are not delayed.
+func (e *Evaluator) ExecuteRequest(req map[string]interface{}) error {
+	if e.requestCallback == nil {
+		return nil
+	}
+	if e.sentRequest && e.delay > 0 {
+		time.Sleep(e.delay)
+	}
+	e.sentRequest = true
+
+	result, err := e.requestCallback(req)
+	if err != nil {
+		if e.errorKind == nil {
+			return err
+		}
+		e.failures.add(e.errorKind(err), err.Error())
+		e.failedRequests++
+		e.recordResponse(map[string]interface{}{
+			"status":  int64(0),
+			"headers": map[string]interface{}{},
+			"body":    nil,
+			"error":   err.Error(),
+		})
+		return nil
+	}
+	e.responseBytes += result.Bytes
+	if result.Response != nil {
+		e.recordResponse(result.Response)
+	}
+	return nil
+}
+
+// RequestFailures returns the requests that failed while continuing on errors
+// (see WithContinueOnError), grouped by kind
+func (e *Evaluator) RequestFailures() []ErrorGroup {
+	return e.failures.list()
+}
+
+func (e *Evaluator) evalRequest(stmt *ast.RequestStmt) (map[string]interface{}, error) {
+	// get "url" skip if cond: a skipped request is neither sent nor collected
+	if stmt.Skip != nil {
+		skip := e.isTruthy(e.evalExpr(stmt.Skip))
+		if err := e.takeEvalErr(); err != nil {
+			return nil, err
+		}
+		if skip {
+			return nil, nil
+		}
+	}
+
+	// use <template>: the sections of @template definitions go under the request's own
+	uses, err := e.expandUses(stmt.Uses, nil)
+	if err != nil {
+		return nil, err
+	}
+	stmt = e.applyTemplates(stmt, uses)
+
+	req := make(map[string]interface{})
+
+	// Method. A custom verb is stored under "method" with the URL under "url",
+	// so a verb like "BODY" can't collide with the other request keys.
+	method := stmt.Method
+	target := e.evalExprToValue(stmt.URL)
+	if stmt.Verb != nil {
+		verb := e.evalExprToValue(stmt.Verb)
+		req["method"] = verb
+		req["url"] = target
+		method, _ = verb.(string)
+	} else if stmt.Method == "graphql" {
+		// graphql "url" is sent as a POST with a JSON body
+		req["post"] = target
+		method = "post"
+	} else {
+		req[stmt.Method] = target
+	}
+
+	// Headers: @headers and @defaults, then templates and named header sets
+	// (use ...) merge in order, explicit headers win
+	headers, err := e.defaultHeaders(stmt, method, fmt.Sprintf("%v", target))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range uses {
+		if t, ok := e.templates[name]; ok {
+			if t.Request.Headers != nil {
+				for k, v := range e.evalBlockToMap(t.Request.Headers) {
+					setHeader(headers, k, v)
+				}
+			}
+			continue
+		}
+		val, ok := e.scope.Get(name)
+		if !ok {
+			return nil, fmt.Errorf("use: undefined template or header set %q", name)
+		}
+		set, ok := val.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("use: variable %q is not a header block (got %T)", name, val)
+		}
+		for k, v := range set {
+			setHeader(headers, k, v)
+		}
+	}
+	if stmt.Headers != nil {
+		for k, v := range e.evalBlockToMap(stmt.Headers) {
+			setHeader(headers, k, v)
+		}
+	}
+	if stmt.GQLQuery != nil && !hasHeader(headers, "Content-Type") {
+		headers["Content-Type"] = "application/json"
+	}
+	if len(headers) > 0 || stmt.Headers != nil {
+		e.checkHeaderValues(stmt, headers)
+		req["headers"] = headers
+	}
+
+	// Query parameters
+	if stmt.Query != nil {
+		req["query"] = e.evalBlockToMap(stmt.Query)
+	}
+
+	// Body
+	if stmt.Body != nil {
+		bodyVal := e.evalExpr(stmt.Body)
+		req["body"] = bodyVal
+	}
+
+	// GraphQL body: {"query": ..., "variables": ...}
+	if stmt.GQLQuery != nil {
+		// query`...` is the GraphQL document as written, not a processor
+		var query string
+		if ps, ok := stmt.GQLQuery.(*ast.ProcessedString); ok {
+			query = ps.Content
+		} else {
+			query = fmt.Sprintf("%v", e.evalExpr(stmt.GQLQuery))
+		}
+		body := map[string]interface{}{"query": strings.TrimSpace(query)}
+		if stmt.GQLVars != nil {
+			body["variables"] = e.evalExpr(stmt.GQLVars)
+		}
+		req["body"] = body
+	}
+
+	// WebSocket messages, sent in order after connecting
+	if stmt.WSSend != nil {
+		req["send"] = e.evalExpr(stmt.WSSend)
+	}
+
+	// Form body (encoded as application/x-www-form-urlencoded when sent)
+	if stmt.Form != nil {
+		req["form"] = e.evalBlockToMap(stmt.Form)
+	}
+
+	// Timeout: request-level timeout takes precedence over global timeout
+	if stmt.Timeout != nil {
+		timeoutVal := e.evalExpr(stmt.Timeout)
+		if timeout, err := parseTimeout(timeoutVal); err == nil {
+			req["timeout"] = timeout
+		} else {
+			return nil, fmt.Errorf("invalid timeout value: %v", timeoutVal)
+		}
+	} else if e.defaultTimeout > 0 {
+		// Use global default timeout if no request-level timeout specified
+		req["timeout"] = e.defaultTimeout
+	}
+
+	// Auth: turned into an Authorization header when sent (an explicit header wins)
+	if stmt.Auth != nil {
+		auth := map[string]interface{}{"scheme": stmt.Auth.Scheme}
+		switch stmt.Auth.Scheme {
+		case "basic":
+			auth["username"] = fmt.Sprintf("%v", e.evalExpr(stmt.Auth.Args[0]))
+			auth["password"] = fmt.Sprintf("%v", e.evalExpr(stmt.Auth.Args[1]))
+		case "bearer":
+			auth["token"] = fmt.Sprintf("%v", e.evalExpr(stmt.Auth.Args[0]))
+		case "awsv4":
+			// Signed with SigV4 when sent, see package request. A null value
+			// (like an unset $env.AWS_SESSION_TOKEN) is left out
+			for i, key := range []string{"access_key", "secret_key", "region", "service", "session_token"}[:len(stmt.Auth.Args)] {
+				if v := e.evalExpr(stmt.Auth.Args[i]); v != nil {
+					auth[key] = fmt.Sprintf("%v", v)
+				}
+			}
+		}
+		req["auth"] = auth
+	}
+
+	// Insecure: request-level setting takes precedence over global @insecure
+	if stmt.Insecure != nil {
+		req["insecure"] = e.boolSetting(e.evalExpr(stmt.Insecure))
+	} else if val, ok := e.scope.Get("insecure"); ok && val != nil {
+		req["insecure"] = e.boolSetting(val)
+	}
+
+	// CA bundle: request-level setting takes precedence over global @ca_cert
+	if stmt.CACert != nil {
+		req["ca_cert"] = e.resolvePath(fmt.Sprintf("%v", e.evalExpr(stmt.CACert)))
+	} else if val, ok := e.scope.Get("ca_cert"); ok && val != nil {
+		req["ca_cert"] = e.resolvePath(fmt.Sprintf("%v", val))
+	}
+
+	// Proxy: request-level setting takes precedence over global @proxy
+	if stmt.Proxy != nil {
+		req["proxy"] = fmt.Sprintf("%v", e.evalExpr(stmt.Proxy))
+	} else if val, ok := e.scope.Get("proxy"); ok && val != nil {
+		req["proxy"] = fmt.Sprintf("%v", val)
+	}
+
+	// Assertions are checked against the response by the request callback
+	if len(stmt.Asserts) > 0 {
+		asserts := make([]interface{}, 0, len(stmt.Asserts))
+		for _, a := range stmt.Asserts {
+			assertion, err := e.evalAssertion(a)
+			if err != nil {
+				return nil, err
+			}
+			asserts = append(asserts, assertion)
+		}
+		req["assert"] = asserts
+	}
+
+	// JSON Schema for the response body, checked by the request callback
+	if stmt.Validate != nil {
+		validate, err := e.evalValidate(stmt.Validate)
+		if err != nil {
+			return nil, err
+		}
+		req["validate"] = validate
+	}
+
+	if err := e.takeEvalErr(); err != nil {
+		return nil, err
+	}
+
+	// Retry: request-level retry takes precedence over global @retry
+	if stmt.Retry != nil {
+		var opts []string
+		if stmt.Retry.Backoff != "" {
+			opts = append(opts, stmt.Retry.Backoff)
+		}
+		if stmt.Retry.Always {
+			opts = append(opts, "always")
+		}
+		if len(stmt.Retry.On) > 0 {
+			statuses := make([]string, len(stmt.Retry.On))
+			for i, status := range stmt.Retry.On {
+				statuses[i] = strconv.Itoa(status)
+			}
+			opts = append(opts, "on", strings.Join(statuses, ","))
+		}
+		retry, err := retryConfig(e.evalExpr(stmt.Retry.Count), opts...)
+		if err != nil {
+			return nil, err
+		}
+		req["retry"] = retry
+	} else if val, ok := e.scope.Get("retry"); ok && val != nil {
+		retry, err := retryConfig(val)
+		if err != nil {
+			return nil, fmt.Errorf("@retry: %w", err)
+		}
+		req["retry"] = retry
+	}
+
+	return req, nil
+}
+
+// expandUses lists the templates and header sets a request uses, in the order
+// they apply: a template's own uses come before the template itself
+func (e *Evaluator) expandUses(uses []string, active []string) ([]string, error) {
+	var names []string
+	for _, name := range uses {
+		t, ok := e.templates[name]
+		if !ok {
+			names = append(names, name)
+			continue
+		}
+		for _, a := range active {
+			if a == name {
+				return nil, fmt.Errorf("use: template %q uses itself", name)
+			}
+		}
+		inner, err := e.expandUses(t.Request.Uses, append(active, name))
+		if err != nil {
+			return nil, err
+		}
+		names = append(append(names, inner...), name)
+	}
+	return names, nil
+}
+
+// applyTemplates returns the request with the sections of its templates layered
+// underneath, in use order. Query, form and block bodies merge key by key and
+// asserts add up; any other section comes from the request itself, or else
+// from the last template that has it. Headers are merged by evalRequest, in
+// order with the header sets.
+func (e *Evaluator) applyTemplates(stmt *ast.RequestStmt, uses []string) *ast.RequestStmt {
+	var layers []*ast.RequestStmt
+	for _, name := range uses {
+		if t, ok := e.templates[name]; ok {
+			layers = append(layers, t.Request)
+		}
+	}
+	if len(layers) == 0 {
+		return stmt
+	}
+
+	merged := &ast.RequestStmt{
+		Position: stmt.Position,
+		Method:   stmt.Method,
+		Verb:     stmt.Verb,
+		URL:      stmt.URL,
+		Headers:  stmt.Headers,
+		Uses:     stmt.Uses,
+		Skip:     stmt.Skip,
+		GQLQuery: stmt.GQLQuery,
+		GQLVars:  stmt.GQLVars,
+		WSSend:   stmt.WSSend,
+	}
+	for _, l := range append(layers, stmt) {
+		merged.Query = mergeBlocks(merged.Query, l.Query)
+		merged.Form = mergeBlocks(merged.Form, l.Form)
+		merged.Asserts = append(merged.Asserts, l.Asserts...)
+
+		base, ok1 := merged.Body.(*ast.BlockExpr)
+		body, ok2 := l.Body.(*ast.BlockExpr)
+		if ok1 && ok2 && !base.IsArray() && !body.IsArray() {
+			merged.Body = mergeBlocks(base, body)
+		} else if l.Body != nil {
+			merged.Body = l.Body
+		}
+
+		if l.Timeout != nil {
+			merged.Timeout = l.Timeout
+		}
+		if l.Retry != nil {
+			merged.Retry = l.Retry
+		}
+		if l.Auth != nil {
+			merged.Auth = l.Auth
+		}
+		if l.Validate != nil {
+			merged.Validate = l.Validate
+		}
+		if l.Insecure != nil {
+			merged.Insecure = l.Insecure
+		}
+		if l.CACert != nil {
+			merged.CACert = l.CACert
+		}
+		if l.Proxy != nil {
+			merged.Proxy = l.Proxy
+		}
+	}
+	return merged
+}
+
+// mergeBlocks appends the entries of b to a; as later keys win when a block is
+// evaluated, b overrides a
+func mergeBlocks(a, b *ast.BlockExpr) *ast.BlockExpr {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	entries := make([]ast.Entry, 0, len(a.Entries)+len(b.Entries))
+	entries = append(append(entries, a.Entries...), b.Entries...)
+	return &ast.BlockExpr{Position: b.Position, Entries: entries}
+}
+
+// httpMethods are the request keywords, which nest method-specific entries in @headers
+var httpMethods = map[string]bool{
+	"get": true, "post": true, "put": true, "delete": true,
+	"patch": true, "head": true, "options": true,
+}
+
+// defaultHeaders returns the @headers defaults that apply to a request, with
+// the headers of matching @defaults URL patterns on top. Entries nested under
+// a method name (post, put, ...) only apply to that method, and a default
+// Content-Type is only sent with a body.
+func (e *Evaluator) defaultHeaders(stmt *ast.RequestStmt, method, rawURL string) (map[string]interface{}, error) {
+	headers := make(map[string]interface{})
+	val, _ := e.scope.Get("headers")
+	if defaults, ok := val.(map[string]interface{}); ok {
+		mergeMethodHeaders(headers, defaults, method)
+	}
+
+	scoped, err := e.urlDefaults(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	for _, defaults := range scoped {
+		mergeMethodHeaders(headers, defaults, method)
+	}
+
+	if stmt.Body == nil && stmt.GQLQuery == nil {
+		for k := range headers {
+			if strings.EqualFold(k, "Content-Type") {
+				delete(headers, k)
+			}
+		}
+	}
+	return headers, nil
+}
+
+// mergeMethodHeaders sets a block of default headers. Entries nested under a
+// method name are only set for that method, after the others.
+func mergeMethodHeaders(headers, defaults map[string]interface{}, method string) {
+	var methodHeaders map[string]interface{}
+	for k, v := range defaults {
+		if httpMethods[strings.ToLower(k)] {
+			if strings.EqualFold(k, method) {
+				methodHeaders, _ = v.(map[string]interface{})
+			}
+			continue
+		}
+		setHeader(headers, k, v)
+	}
+	for k, v := range methodHeaders {
+		setHeader(headers, k, v)
+	}
+}
+
+// urlDefaults returns the header blocks of the @defaults URL patterns that
+// match a request URL (without its query string), least specific first: when
+// patterns overlap, the longer one wins.
+//
+//	@defaults
+//	  "https://api.internal/**"
+//	    headers
+//	      Authorization $token
+func (e *Evaluator) urlDefaults(rawURL string) ([]map[string]interface{}, error) {
+	val, ok := e.scope.Get("defaults")
+	if !ok || val == nil {
+		return nil, nil
+	}
+	rules, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("@defaults: expected a block of URL patterns, got %T", val)
+	}
+
+	patterns := make([]string, 0, len(rules))
+	for pattern := range rules {
+		patterns = append(patterns, pattern)
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		if len(patterns[i]) != len(patterns[j]) {
+			return len(patterns[i]) < len(patterns[j])
+		}
+		return patterns[i] < patterns[j]
+	})
+
+	if i := strings.IndexAny(rawURL, "?#"); i >= 0 {
+		rawURL = rawURL[:i]
+	}
+	var matched []map[string]interface{}
+	for _, pattern := range patterns {
+		rule, ok := rules[pattern].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("@defaults %q: expected a block with headers, got %T", pattern, rules[pattern])
+		}
+		for section := range rule {
+			if section != "headers" {
+				return nil, fmt.Errorf("@defaults %q: unsupported section %q (only headers)", pattern, section)
+			}
+		}
+		if rule["headers"] == nil || !globMatch(pattern, rawURL) {
+			continue
+		}
+		headers, ok := rule["headers"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("@defaults %q: headers must be a block, got %T", pattern, rule["headers"])
+		}
+		matched = append(matched, headers)
+	}
+	return matched, nil
+}
+
+// globMatch matches a URL against a @defaults pattern: * matches any run of
+// characters except /, ** also matches /, and ? matches one character other than /
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch {
+		case strings.HasPrefix(pattern, "**"):
+			rest := strings.TrimLeft(pattern, "*")
+			for i := 0; i <= len(s); i++ {
+				if globMatch(rest, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case pattern[0] == '*':
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[1:], s[i:]) {
+					return true
+				}
+				if i < len(s) && s[i] == '/' {
+					return false
+				}
+			}
+			return false
+		case pattern[0] == '?':
+			if s == "" || s[0] == '/' {
+				return false
+			}
+		default:
+			if s == "" || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return s == ""
+}
+
+// hasHeader reports whether headers has name, ignoring case
+func hasHeader(headers map[string]interface{}, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeader sets a header, replacing any existing key that differs only in case
+func setHeader(headers map[string]interface{}, name string, value interface{}) {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			delete(headers, k)
+		}
+	}
+	headers[name] = value
+}
+
+// checkHeaderValues warns about header values that are blocks or arrays. They
+// would be sent as Go-formatted text (map[...]), which usually means a block
+// was indented under a header key by mistake.
+func (e *Evaluator) checkHeaderValues(stmt *ast.RequestStmt, headers map[string]interface{}) {
+	for name, val := range headers {
+		var kind string
+		switch val.(type) {
+		case map[string]interface{}:
+			kind = "a block"
+		case []interface{}:
+			kind = "an array"
+		default:
+			continue
+		}
+		line := stmt.Position.Line
+		if stmt.Headers != nil {
+			for _, entry := range stmt.Headers.Entries {
+				if entry.Key == name {
+					line = entry.Position.Line
+				}
+			}
+		}
+		e.warn("line %d: header %q has %s value and will be sent as %q", line, name, kind, fmt.Sprintf("%v", val))
+	}
+}
+
+// warn writes a warning without stopping evaluation
+func (e *Evaluator) warn(format string, args ...interface{}) {
+	out := e.warnOut
+	if out == nil {
+		out = os.Stderr
+	}
+	fmt.Fprintf(out, "[warning] "+format+"\n", args...)
+}
+
+// evalAssertion turns an assert section into a map carried on the request.
+// For "time" the expected value is a budget in milliseconds; a bare number means ms.
+func (e *Evaluator) evalAssertion(a ast.Assertion) (map[string]interface{}, error) {
+	subject := strings.Join(a.Subject, ".")
+	expected := e.evalExpr(a.Expected)
+	if subject == "time" {
+		var d time.Duration
+		var err error
+		switch v := expected.(type) {
+		case int64:
+			d = time.Duration(v) * time.Millisecond
+		case float64:
+			d = time.Duration(v * float64(time.Millisecond))
+		default:
+			d, err = parseTimeout(v)
+		}
+		if err != nil {
+			return nil, errorAt(a.Position, "invalid time assertion value: %v", expected)
+		}
+		expected = float64(d) / float64(time.Millisecond)
+	}
+	return map[string]interface{}{
+		"line":     a.Position.Line,
+		"subject":  subject,
+		"op":       a.Operator,
+		"expected": expected,
+	}, nil
+}
+
+// CheckAssertions checks a request's assertions (req["assert"]) against its
+// response, given in the $_ shape (status, headers, body), and the request
+// duration. It returns one message per failed assertion.
+func CheckAssertions(asserts interface{}, response map[string]interface{}, duration time.Duration) []string {
+	list, ok := asserts.([]interface{})
+	if !ok {
+		return nil
+	}
+	e := &Evaluator{prevResponse: response}
+
+	var failures []string
+	for _, item := range list {
+		a, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		subject, _ := a["subject"].(string)
+		op, _ := a["op"].(string)
+		expected := a["expected"]
+
+		var actual interface{}
+		if subject == "time" {
+			actual = float64(duration) / float64(time.Millisecond)
+		} else {
+			actual = e.resolveResponseRef(strings.Split(subject, "."))
+		}
+
+		if !e.compareOp(op, actual, expected) {
+			got := actual
+			if subject == "time" {
+				got = duration.Round(time.Millisecond)
+			}
+			failures = append(failures, fmt.Sprintf("line %v: assert %s %s %v failed (got %v)", a["line"], subject, op, formatExpected(subject, expected), got))
+		}
+	}
+	return failures
+}
+
+// compareOp applies a comparison operator with the same semantics as conditions
+func (e *Evaluator) compareOp(op string, left, right interface{}) bool {
+	switch op {
+	case "==":
+		return e.compareValues(left, right) == 0
+	case "!=":
+		return e.compareValues(left, right) != 0
+	case ">":
+		return e.compareValues(left, right) > 0
+	case "<":
+		return e.compareValues(left, right) < 0
+	case ">=":
+		return e.compareValues(left, right) >= 0
+	case "<=":
+		return e.compareValues(left, right) <= 0
+	}
+	return false
+}
+
+func formatExpected(subject string, expected interface{}) interface{} {
+	if ms, ok := expected.(float64); ok && subject == "time" {
+		return time.Duration(ms * float64(time.Millisecond))
 	}
-	
-	return nil
+	return expected
 }
 
-// EvalRequest evaluates a request statement (public method)
-func (e *Evaluator) EvalRequest(stmt *ast.RequestStmt) (map[string]interface{}, error) {
-	return e.evalRequest(stmt)
+// takeEvalErr returns and clears the error recorded while evaluating expressions
+func (e *Evaluator) takeEvalErr() error {
+	err := e.evalErr
+	e.evalErr = nil
+	return err
 }
 
-func (e *Evaluator) evalRequest(stmt *ast.RequestStmt) (map[string]interface{}, error) {
-	req := make(map[string]interface{})
-
-	// Method
-	req[stmt.Method] = e.evalExprToValue(stmt.URL)
-
-	// Headers
-	if stmt.Headers != nil {
-		req["headers"] = e.evalBlockToMap(stmt.Headers)
-	}
-
-	// Body
-	if stmt.Body != nil {
-		bodyVal := e.evalExpr(stmt.Body)
-		req["body"] = bodyVal
+// recordErr keeps the first expression error until the statement checks it
+func (e *Evaluator) recordErr(err error) {
+	if e.evalErr == nil {
+		e.evalErr = err
 	}
+}
 
-	// Timeout: request-level timeout takes precedence over global timeout
-	if stmt.Timeout != nil {
-		timeoutVal := e.evalExpr(stmt.Timeout)
-		if timeout, err := parseTimeout(timeoutVal); err == nil {
-			req["timeout"] = timeout
-		} else {
-			return nil, fmt.Errorf("invalid timeout value: %v", timeoutVal)
+// retryConfig builds the request's retry map from a count and options.
+// A string value may carry the options itself, e.g. @retry "3 exponential on 429,503".
+func retryConfig(val interface{}, opts ...string) (map[string]interface{}, error) {
+	if str, ok := val.(string); ok {
+		fields := strings.Fields(str)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid retry value: %q", str)
+		}
+		val = fields[0]
+		opts = append(fields[1:], opts...)
+	}
+
+	count, ok := toInt64(val)
+	if !ok || count < 0 {
+		return nil, fmt.Errorf("invalid retry count: %v", val)
+	}
+
+	retry := map[string]interface{}{
+		"count":   count,
+		"backoff": "fixed",
+		"always":  false,
+	}
+	for i := 0; i < len(opts); i++ {
+		switch opt := opts[i]; opt {
+		case "fixed", "linear", "exponential":
+			retry["backoff"] = opt
+		case "always":
+			retry["always"] = true
+		case "on":
+			// The status list may be split into several options ("429, 503")
+			var statuses []interface{}
+			for i+1 < len(opts) && strings.Trim(opts[i+1], "0123456789,") == "" {
+				i++
+				for _, s := range strings.Split(opts[i], ",") {
+					if s == "" {
+						continue
+					}
+					status, err := strconv.ParseInt(s, 10, 64)
+					if err != nil || status < 100 || status > 599 {
+						return nil, fmt.Errorf("invalid retry status %q", s)
+					}
+					statuses = append(statuses, status)
+				}
+			}
+			if len(statuses) == 0 {
+				return nil, fmt.Errorf("retry on expects status codes, like on 429,503")
+			}
+			retry["on"] = statuses
+		default:
+			return nil, fmt.Errorf("unknown retry option %q", opt)
 		}
-	} else if e.defaultTimeout > 0 {
-		// Use global default timeout if no request-level timeout specified
-		req["timeout"] = e.defaultTimeout
 	}
+	return retry, nil
+}
 
-	return req, nil
+// RequestResult is what a request executor returns: the response map that
+// becomes $_ and the raw body size, summed into the "total_bytes" of parallel
+// loop stats.
+type RequestResult struct {
+	Response map[string]interface{}
+	Bytes    int64
+}
+
+// perSecond returns the rate of count events over d. A loop that finishes
+// within the clock's resolution has no measurable duration and a rate of 0,
+// rather than +Inf, which can't be encoded as JSON.
+func perSecond(count int, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(count) / d.Seconds()
 }
 
 // ParallelStats holds statistics from parallel execution
@@ -275,6 +1371,32 @@ type ParallelStats struct {
 	MinTime   time.Duration
 	MaxTime   time.Duration
 	AvgTime   time.Duration
+	P50Time   time.Duration
+	P95Time   time.Duration
+	P99Time   time.Duration
+}
+
+// setPercentiles computes P50Time, P95Time and P99Time from the iteration times
+func (s *ParallelStats) setPercentiles(times []time.Duration) {
+	sorted := append([]time.Duration(nil), times...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s.P50Time = percentile(sorted, 50)
+	s.P95Time = percentile(sorted, 95)
+	s.P99Time = percentile(sorted, 99)
+}
+
+// percentile returns the p-th percentile of sorted durations by the nearest-rank
+// method: the smallest time that at least p% of the times are less than or equal
+// to. With few samples the high percentiles are simply the maximum.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
 }
 
 func (e *Evaluator) evalFor(stmt *ast.ForStmt) error {
@@ -283,15 +1405,61 @@ func (e *Evaluator) evalFor(stmt *ast.ForStmt) error {
 
 // EvalForCollect evaluates a for loop and collects/executes requests (public method)
 func (e *Evaluator) EvalForCollect(stmt *ast.ForStmt) error {
-	return e.evalForCollect(stmt)
+	return atPos(stmt.Pos(), e.evalForCollect(stmt))
+}
+
+// errBreak and errContinue are returned by break/continue statements and
+// handled by the enclosing loop; outside a loop they surface as errors
+var (
+	errBreak    = errors.New("break outside of a loop")
+	errContinue = errors.New("continue outside of a loop")
+)
+
+// errSkip is returned when a "skip if" guard holds; the evaluation of the
+// current file stops without an error
+var errSkip = errors.New("file skipped")
+
+// EvalSkip evaluates a skip guard (public method) and reports whether the rest
+// of the file should be skipped
+func (e *Evaluator) EvalSkip(stmt *ast.SkipStmt) (bool, error) {
+	skip, err := e.evalSkip(stmt)
+	return skip, atPos(stmt.Pos(), err)
+}
+
+func (e *Evaluator) evalSkip(stmt *ast.SkipStmt) (bool, error) {
+	return e.isTruthy(e.evalExpr(stmt.Condition)), nil
+}
+
+// evalLoopBody runs the body of one loop iteration. It reports whether a break
+// statement ended the loop; continue only ends the current iteration.
+// break/continue may be nested in if bodies, they propagate up as errors.
+func (e *Evaluator) evalLoopBody(body []ast.Statement) (bool, error) {
+	for _, s := range body {
+		err := e.evalStatementCollect(s)
+		switch {
+		case errors.Is(err, errBreak):
+			return true, nil
+		case errors.Is(err, errContinue):
+			return false, nil
+		case err != nil:
+			return false, err
+		}
+	}
+	return false, nil
 }
 
 // EvalIf evaluates an if statement (public method)
 func (e *Evaluator) EvalIf(stmt *ast.IfStmt) error {
-	return e.evalIf(stmt)
+	return atPos(stmt.Pos(), e.evalIf(stmt))
 }
 
-func (e *Evaluator) evalForCollect(stmt *ast.ForStmt) error {
+// loopItems evaluates the iterable of a for loop into the items to iterate
+func (e *Evaluator) loopItems(stmt *ast.ForStmt) ([]interface{}, error) {
+	// Ranges are evaluated here so that bad bounds surface as errors
+	if r, ok := stmt.Iterable.(*ast.RangeExpr); ok {
+		return e.evalRange(r)
+	}
+
 	// Evaluate iterable
 	iterable := e.evalExpr(stmt.Iterable)
 
@@ -308,7 +1476,7 @@ func (e *Evaluator) evalForCollect(stmt *ast.ForStmt) error {
 	case int64:
 		// Convert number to range [0, 1, 2, ..., N-1]
 		if v < 0 {
-			return fmt.Errorf("for loop: cannot iterate over negative number %d", v)
+			return nil, fmt.Errorf("for loop: cannot iterate over negative number %d", v)
 		}
 		items = make([]interface{}, v)
 		for i := int64(0); i < v; i++ {
@@ -318,14 +1486,23 @@ func (e *Evaluator) evalForCollect(stmt *ast.ForStmt) error {
 		// Convert float to int and create range
 		n := int64(v)
 		if v < 0 || float64(n) != v {
-			return fmt.Errorf("for loop: cannot iterate over non-positive integer %g", v)
+			return nil, fmt.Errorf("for loop: cannot iterate over non-positive integer %g", v)
 		}
 		items = make([]interface{}, n)
 		for i := int64(0); i < n; i++ {
 			items[i] = i
 		}
 	default:
-		return fmt.Errorf("for loop: cannot iterate over %T", iterable)
+		return nil, fmt.Errorf("for loop: cannot iterate over %T", iterable)
+	}
+
+	return items, nil
+}
+
+func (e *Evaluator) evalForCollect(stmt *ast.ForStmt) error {
+	items, err := e.loopItems(stmt)
+	if err != nil {
+		return err
 	}
 
 	// Handle parallel execution
@@ -351,54 +1528,38 @@ func (e *Evaluator) evalForCollect(stmt *ast.ForStmt) error {
 		e.scope = loopScope
 
 		// Execute body statements
-		for _, bodyStmt := range stmt.Body {
-			if reqStmt, ok := bodyStmt.(*ast.RequestStmt); ok {
-				// Evaluate request
-				req, err := e.evalRequest(reqStmt)
-				if err != nil {
-					e.scope = oldScope
-					return err
-				}
-				if req != nil {
-					// Execute request if callback is set (for real-time output)
-					if e.requestCallback != nil {
-						resp, err := e.requestCallback(req)
-						if err != nil {
-							e.scope = oldScope
-							return err
-						}
-						// Update prevResponse for chaining
-						if resp != nil {
-							e.prevResponse = resp
-						}
-					} else {
-						// No callback: just collect
-						e.collectedRequests = append(e.collectedRequests, req)
-						e.prevResponse = req
-					}
-				}
-			} else {
-				// Non-request statement: use evalStatementCollect
-				err := e.evalStatementCollect(bodyStmt)
-				if err != nil {
-					e.scope = oldScope
-					return err
-				}
-			}
-		}
+		brk, err := e.evalLoopBody(stmt.Body)
 
 		// Restore scope
 		e.scope = oldScope
+		if err != nil {
+			return err
+		}
+		if brk {
+			break
+		}
 	}
 
 	return nil
 }
 
+// paceTicker returns a ticker that spaces out the starts of a parallel loop's
+// iterations to its rate (rate N/s), or nil when the loop has no rate. Loops
+// that only collect requests (no callback) are not slowed down.
+func (e *Evaluator) paceTicker(stmt *ast.ForStmt) *time.Ticker {
+	if stmt.Rate <= 0 || e.requestCallback == nil {
+		return nil
+	}
+	return time.NewTicker(time.Duration(float64(time.Second) / stmt.Rate))
+}
+
 func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) error {
 	if len(items) == 0 {
 		return nil
 	}
 
+	loopStartTime := time.Now()
+
 	// Determine concurrency limit
 	concurrency := stmt.Concurrency
 	if concurrency <= 0 {
@@ -413,15 +1574,34 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 	
 	// Mutex for thread-safe collection
 	var mu sync.Mutex
-	var errors []error
+	var errs []error
 	var parallelRequests []map[string]interface{}
 	
 	// Statistics
 	var stats ParallelStats
 	stats.Total = len(items)
 	var times []time.Duration
+	var totalBytes int64
+
+	// Set by break: iterations that have not started yet are skipped
+	var stopped atomic.Bool
+
+	// Requests that failed while continuing on errors, reported in the stats
+	loopFailures := e.failures.child()
+
+	ticker := e.paceTicker(stmt)
+	if ticker != nil {
+		defer ticker.Stop()
+	}
 
 	for i, item := range items {
+		// Wait for the rate limiter before starting the next iteration
+		if ticker != nil && i > 0 {
+			<-ticker.C
+			if stopped.Load() {
+				break
+			}
+		}
 		wg.Add(1)
 		
 		go func(idx int, itm interface{}) {
@@ -430,6 +1610,9 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 			// Acquire semaphore
 			sem <- struct{}{}
 			defer func() { <-sem }()
+			if stopped.Load() {
+				return
+			}
 			
 			start := time.Now()
 			
@@ -445,45 +1628,66 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 			tempEval := &Evaluator{
 				scope:          loopScope,
 				prevResponse:   e.prevResponse,
+				responses:      e.loopHistory(),
+				maxHistory:     e.maxHistory,
 				basePath:       e.basePath,
 				requestCallback: e.requestCallback,
 				defaultTimeout: e.defaultTimeout, // Copy default timeout
+				fixedTimeout:   e.fixedTimeout,
+				flows:          e.flows,
+				templates:      e.templates,
+				funcs:          e.funcs,
+				callDepth:      e.callDepth,
+				envPrefix:      e.envPrefix,
+				maxDepth:       e.maxDepth,
+				warnOut:        e.warnOut,
+				strict:         e.strict,
+				overrides:      e.overrides,
+				stdin:          e.stdin,
+				errorKind:      e.errorKind,
+				failures:       loopFailures,
+				imports:        e.imports,
 			}
+			defer func() {
+				mu.Lock()
+				totalBytes += tempEval.responseBytes
+				mu.Unlock()
+			}()
 			
 			// Evaluate body statements
-			var iterRequests []map[string]interface{}
-			for _, bodyStmt := range stmt.Body {
-				if reqStmt, ok := bodyStmt.(*ast.RequestStmt); ok {
-					req, err := tempEval.evalRequest(reqStmt)
-					if err != nil {
-						mu.Lock()
-						errors = append(errors, err)
-						stats.Failed++
-						mu.Unlock()
-						return
-					}
-					if req != nil {
-						iterRequests = append(iterRequests, req)
-						
-						// Don't execute callback here - it's handled by EvalParallelForWithOutput
-						// This function is only for collecting requests (EvalToRequests)
-					}
-				}
+			brk, err := tempEval.evalLoopBody(stmt.Body)
+			if brk {
+				stopped.Store(true)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				stats.Failed++
+				mu.Unlock()
+				return
 			}
+			iterRequests := tempEval.collectedRequests
 			
 			elapsed := time.Since(start)
 			
 			mu.Lock()
 			parallelRequests = append(parallelRequests, iterRequests...)
-			times = append(times, elapsed)
-			if len(errors) == 0 || errors[len(errors)-1] == nil {
-				stats.Success++
+			if tempEval.failedRequests > 0 {
+				stats.Failed++
+			} else {
+				times = append(times, elapsed)
+				if len(errs) == 0 || errs[len(errs)-1] == nil {
+					stats.Success++
+				}
 			}
 			mu.Unlock()
 		}(i, item)
 	}
 	
 	wg.Wait()
+	wallTime := time.Since(loopStartTime)
+	throughput := perSecond(stats.Success+stats.Failed, wallTime)
+	e.responseBytes += totalBytes // count towards an enclosing loop
 	
 	// Calculate statistics
 	if len(times) > 0 {
@@ -501,6 +1705,7 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 		}
 		stats.TotalTime = totalTime
 		stats.AvgTime = totalTime / time.Duration(len(times))
+		stats.setPercentiles(times)
 	}
 	
 	// Add collected requests (but mark them as already executed if callback was set)
@@ -510,13 +1715,21 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 	
 	// Store stats in a special variable for potential output
 	statsMap := map[string]interface{}{
-		"total":      stats.Total,
-		"success":    stats.Success,
-		"failed":     stats.Failed,
-		"total_time": stats.TotalTime.String(),
-		"min_time":   stats.MinTime.String(),
-		"max_time":   stats.MaxTime.String(),
-		"avg_time":   stats.AvgTime.String(),
+		"total":       stats.Total,
+		"success":     stats.Success,
+		"failed":      stats.Failed,
+		"total_time":  stats.TotalTime.String(),
+		"min_time":    stats.MinTime.String(),
+		"max_time":    stats.MaxTime.String(),
+		"avg_time":    stats.AvgTime.String(),
+		"p50_time":    stats.P50Time.String(),
+		"p95_time":    stats.P95Time.String(),
+		"p99_time":    stats.P99Time.String(),
+		"throughput":  throughput,
+		"total_bytes": totalBytes,
+	}
+	if groups := loopFailures.statsValue(); len(groups) > 0 {
+		statsMap["errors"] = groups
 	}
 	e.scope.Set("_parallel_stats", statsMap) // keep last stats for compatibility
 
@@ -532,8 +1745,8 @@ func (e *Evaluator) evalParallelFor(stmt *ast.ForStmt, items []interface{}) erro
 		e.scope.Set("_parallel_stats_list", []interface{}{statsMap})
 	}
 	
-	if len(errors) > 0 {
-		return fmt.Errorf("parallel execution had %d errors, first: %v", len(errors), errors[0])
+	if len(errs) > 0 {
+		return fmt.Errorf("parallel execution had %d errors, first: %v", len(errs), errs[0])
 	}
 	
 	return nil
@@ -573,50 +1786,93 @@ func (e *Evaluator) GetAllParallelStats() []map[string]interface{} {
 
 // GetRequestCallback returns the request callback function
 func (e *Evaluator) GetRequestCallback() func(req map[string]interface{}) (map[string]interface{}, error) {
-	return e.requestCallback
+	if e.requestCallback == nil {
+		return nil
+	}
+	return func(req map[string]interface{}) (map[string]interface{}, error) {
+		result, err := e.requestCallback(req)
+		return result.Response, err
+	}
 }
 
 // SetPrevResponse sets the previous response for chaining
 func (e *Evaluator) SetPrevResponse(resp map[string]interface{}) {
+	e.recordResponse(resp)
+}
+
+// DefaultMaxHistory is the default number of responses kept for $responses
+// and $_1, $_2, ... (@history)
+const DefaultMaxHistory = 1000
+
+// recordResponse makes resp the previous response ($_) and appends it to the
+// history. Once the history is full, the oldest response is dropped, so long
+// runs don't keep every response in memory.
+func (e *Evaluator) recordResponse(resp map[string]interface{}) {
 	e.prevResponse = resp
+	e.responses = append(e.responses, resp)
+
+	limit := e.maxHistory
+	if limit <= 0 {
+		limit = DefaultMaxHistory
+	}
+	if len(e.responses) > limit {
+		e.responses = e.responses[len(e.responses)-limit:]
+	}
 }
 
-// EvalParallelForWithOutput evaluates a parallel for loop with real-time output
-func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
-	// Evaluate iterable
-	iterable := e.evalExpr(stmt.Iterable)
+// loopHistory returns the history for a parallel loop iteration: the responses
+// before the loop, capped so that each iteration's appends get their own array.
+// Iterations don't see each other's responses, and none of them are added to
+// the history after the loop, since their order is not deterministic.
+func (e *Evaluator) loopHistory() []map[string]interface{} {
+	return e.responses[:len(e.responses):len(e.responses)]
+}
 
-	// Get slice to iterate
-	var items []interface{}
-	switch v := iterable.(type) {
-	case []interface{}:
-		items = v
-	case map[string]interface{}:
-		// Iterate over values
-		for _, val := range v {
-			items = append(items, val)
-		}
-	case int64:
-		// Convert number to range [0, 1, 2, ..., N-1]
-		if v < 0 {
-			return fmt.Errorf("for loop: cannot iterate over negative number %d", v)
-		}
-		items = make([]interface{}, v)
-		for i := int64(0); i < v; i++ {
-			items[i] = i
-		}
-	case float64:
-		// Convert float to int and create range
-		n := int64(v)
-		if v < 0 || float64(n) != v {
-			return fmt.Errorf("for loop: cannot iterate over non-positive integer %g", v)
+// historyResponse resolves $_1, $_2, ...: the response N requests before $_.
+// ok is false when name is not of that form.
+func (e *Evaluator) historyResponse(name string) (resp map[string]interface{}, ok bool) {
+	if len(name) < 2 || name[0] != '_' {
+		return nil, false
+	}
+	for _, c := range name[1:] {
+		if c < '0' || c > '9' {
+			return nil, false
 		}
-		items = make([]interface{}, n)
-		for i := int64(0); i < n; i++ {
-			items[i] = i
+	}
+	n, err := strconv.Atoi(name[1:])
+	if err != nil {
+		return nil, true
+	}
+	if i := len(e.responses) - 1 - n; i >= 0 {
+		return e.responses[i], true
+	}
+	return nil, true
+}
+
+// resolveHistoryRef resolves a $responses path: $responses is the list of all
+// responses so far, $responses.0 the first one and $responses.-1 the latest,
+// addressed like $_
+func (e *Evaluator) resolveHistoryRef(path []string) interface{} {
+	if len(path) == 0 {
+		list := make([]interface{}, len(e.responses))
+		for i, resp := range e.responses {
+			list[i] = resp
 		}
-	default:
-		return fmt.Errorf("for loop: cannot iterate over %T", iterable)
+		return list
+	}
+	i, ok := arrayIndex(path[0], len(e.responses))
+	if !ok {
+		return nil
+	}
+	return responsePath(e.responses[i], path[1:])
+}
+
+// EvalParallelForWithOutput evaluates a parallel for loop with real-time output
+func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) (err error) {
+	defer func() { err = atPos(stmt.Pos(), err) }()
+	items, err := e.loopItems(stmt)
+	if err != nil {
+		return err
 	}
 
 	if len(items) == 0 {
@@ -640,14 +1896,33 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 	
 	// Mutex for thread-safe collection
 	var mu sync.Mutex
-	var errors []error
+	var errs []error
 	
 	// Statistics
 	var stats ParallelStats
 	stats.Total = len(items)
 	var times []time.Duration
+	var totalBytes int64
+
+	// Set by break: iterations that have not started yet are skipped
+	var stopped atomic.Bool
+
+	// Requests that failed while continuing on errors, reported in the stats
+	loopFailures := e.failures.child()
+
+	ticker := e.paceTicker(stmt)
+	if ticker != nil {
+		defer ticker.Stop()
+	}
 
 	for i, item := range items {
+		// Wait for the rate limiter before starting the next iteration
+		if ticker != nil && i > 0 {
+			<-ticker.C
+			if stopped.Load() {
+				break
+			}
+		}
 		wg.Add(1)
 		
 		go func(idx int, itm interface{}) {
@@ -656,6 +1931,9 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 			// Acquire semaphore
 			sem <- struct{}{}
 			defer func() { <-sem }()
+			if stopped.Load() {
+				return
+			}
 			
 			start := time.Now()
 			
@@ -670,34 +1948,49 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 			tempEval := &Evaluator{
 				scope:          loopScope,
 				prevResponse:   e.prevResponse,
+				responses:      e.loopHistory(),
+				maxHistory:     e.maxHistory,
 				basePath:       e.basePath,
 				requestCallback: e.requestCallback,
 				defaultTimeout: e.defaultTimeout, // Copy default timeout
+				fixedTimeout:   e.fixedTimeout,
+				flows:          e.flows,
+				templates:      e.templates,
+				funcs:          e.funcs,
+				callDepth:      e.callDepth,
+				envPrefix:      e.envPrefix,
+				maxDepth:       e.maxDepth,
+				warnOut:        e.warnOut,
+				strict:         e.strict,
+				overrides:      e.overrides,
+				stdin:          e.stdin,
+				errorKind:      e.errorKind,
+				failures:       loopFailures,
+				imports:        e.imports,
 			}
+			defer func() {
+				mu.Lock()
+				totalBytes += tempEval.responseBytes
+				mu.Unlock()
+			}()
 			
 			// Evaluate body statements and execute requests with real-time output
-			for _, bodyStmt := range stmt.Body {
-				if reqStmt, ok := bodyStmt.(*ast.RequestStmt); ok {
-					req, err := tempEval.evalRequest(reqStmt)
-					if err != nil {
-						mu.Lock()
-						errors = append(errors, err)
-						stats.Failed++
-						mu.Unlock()
-						return
-					}
-					if req != nil && e.requestCallback != nil {
-						// Execute request and output immediately
-						_, err := e.requestCallback(req)
-						if err != nil {
-							mu.Lock()
-							errors = append(errors, err)
-							stats.Failed++
-							mu.Unlock()
-							return
-						}
-					}
-				}
+			brk, err := tempEval.evalLoopBody(stmt.Body)
+			if brk {
+				stopped.Store(true)
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				stats.Failed++
+				mu.Unlock()
+				return
+			}
+			if tempEval.failedRequests > 0 {
+				mu.Lock()
+				stats.Failed++
+				mu.Unlock()
+				return
 			}
 			
 			elapsed := time.Since(start)
@@ -713,6 +2006,8 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 	
 	// Calculate wall time (actual elapsed time for the parallel loop)
 	wallTime := time.Since(loopStartTime)
+	throughput := perSecond(stats.Success+stats.Failed, wallTime)
+	e.responseBytes += totalBytes // count towards an enclosing loop
 	
 	// Calculate statistics
 	if len(times) > 0 {
@@ -730,6 +2025,7 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 		}
 		stats.TotalTime = totalTime
 		stats.AvgTime = totalTime / time.Duration(len(times))
+		stats.setPercentiles(times)
 	}
 	
 	// Store stats in a special variable for potential output
@@ -741,7 +2037,16 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 		"min_time":    stats.MinTime.String(),
 		"max_time":    stats.MaxTime.String(),
 		"avg_time":    stats.AvgTime.String(),
+		"p50_time":    stats.P50Time.String(),
+		"p95_time":    stats.P95Time.String(),
+		"p99_time":    stats.P99Time.String(),
 		"wall_time":   wallTime.String(),
+		"rate":        fmt.Sprintf("%.1f/s", throughput),
+		"throughput":  throughput,
+		"total_bytes": totalBytes,
+	}
+	if groups := loopFailures.statsValue(); len(groups) > 0 {
+		statsMap["errors"] = groups
 	}
 	e.scope.Set("_parallel_stats", statsMap) // keep last stats for compatibility
 
@@ -757,8 +2062,8 @@ func (e *Evaluator) EvalParallelForWithOutput(stmt *ast.ForStmt) error {
 		e.scope.Set("_parallel_stats_list", []interface{}{statsMap})
 	}
 	
-	if len(errors) > 0 {
-		return fmt.Errorf("parallel execution had %d errors, first: %v", len(errors), errors[0])
+	if len(errs) > 0 {
+		return fmt.Errorf("parallel execution had %d errors, first: %v", len(errs), errs[0])
 	}
 	
 	return nil
@@ -794,10 +2099,19 @@ func (e *Evaluator) evalExpr(expr ast.Expression) interface{} {
 	case *ast.VarRef:
 		return e.evalVarRef(ex)
 
+	case *ast.CallExpr:
+		return e.evalCallExpr(ex)
+
 	case *ast.ProcessedString:
 		return e.evalProcessedString(ex)
 
 	case *ast.BlockExpr:
+		e.depth++
+		defer func() { e.depth-- }()
+		if e.maxDepth > 0 && e.depth > e.maxDepth {
+			e.recordErr(fmt.Errorf("nesting too deep at line %d", ex.Position.Line))
+			return nil
+		}
 		if ex.IsArray() {
 			return e.evalBlockToSlice(ex)
 		}
@@ -811,30 +2125,136 @@ func (e *Evaluator) evalExpr(expr ast.Expression) interface{} {
 
 	case *ast.UnaryExpr:
 		return e.evalUnaryExpr(ex)
+
+	case *ast.RangeExpr:
+		items, err := e.evalRange(ex)
+		if err != nil {
+			e.recordErr(err)
+			return nil
+		}
+		return items
 	}
 
 	return nil
 }
 
+// evalRange expands start..end into an inclusive list of integers, counting by
+// the optional step (default 1; a negative step counts down). Bounds may be
+// dynamic (e.g., $_.total_pages) and are resolved at evaluation time.
+func (e *Evaluator) evalRange(r *ast.RangeExpr) ([]interface{}, error) {
+	start, ok := toInt64(e.evalExpr(r.Start))
+	if !ok {
+		return nil, fmt.Errorf("range: start must be an integer, got %v", e.evalExpr(r.Start))
+	}
+	end, ok := toInt64(e.evalExpr(r.End))
+	if !ok {
+		return nil, fmt.Errorf("range: end must be an integer, got %v", e.evalExpr(r.End))
+	}
+
+	step := int64(1)
+	if r.Step != nil {
+		step, ok = toInt64(e.evalExpr(r.Step))
+		if !ok {
+			return nil, fmt.Errorf("range: step must be an integer, got %v", e.evalExpr(r.Step))
+		}
+		if step == 0 {
+			return nil, fmt.Errorf("range: step must not be zero")
+		}
+	}
+
+	// A range that the step moves away from is empty, e.g. 2..1 when there is only one page
+	if (step > 0 && start > end) || (step < 0 && start < end) {
+		return []interface{}{}, nil
+	}
+
+	// Count the items before building the list, so that a bound taken from a
+	// response (or a typo) can't allocate an unbounded slice. The unsigned
+	// arithmetic keeps ranges spanning the whole int64 space from overflowing.
+	var span, stride uint64
+	if step > 0 {
+		span, stride = uint64(end)-uint64(start), uint64(step)
+	} else {
+		span, stride = uint64(start)-uint64(end), -uint64(step)
+	}
+	if span/stride >= MaxRangeItems {
+		return nil, fmt.Errorf("range: %d..%d has more than %d items", start, end, MaxRangeItems)
+	}
+	n := int(span/stride) + 1
+
+	items := make([]interface{}, n)
+	for k := range items {
+		items[k] = start + int64(k)*step
+	}
+	return items, nil
+}
+
+// MaxRangeItems is the largest number of items a range may expand to
+const MaxRangeItems = 1000000
+
 func (e *Evaluator) evalExprToValue(expr ast.Expression) interface{} {
 	return e.evalExpr(expr)
 }
 
-func (e *Evaluator) evalVarRef(ref *ast.VarRef) interface{} {
-	// Handle $_ (previous response)
-	if ref.Name == "_" {
-		if e.prevResponse == nil {
+// resolveResponseRef resolves a $_ path against the previous response.
+// The CLI stores responses as {"status": ..., "headers": ..., "body": ...}, so
+// $_.status, $_.headers.Content-Type and $_.body.id address those parts directly.
+// For compatibility, a path whose first key is not a top-level key falls back to
+// the body: $_.id is the same as $_.body.id unless the body has a field named
+// status, headers or body, which must then be written as $_.body.<field>.
+func (e *Evaluator) resolveResponseRef(path []string) interface{} {
+	return responsePath(e.prevResponse, path)
+}
+
+// responsePath resolves a path against a response the way $_ does
+func responsePath(resp map[string]interface{}, path []string) interface{} {
+	if resp == nil {
+		return nil
+	}
+	if len(path) == 0 {
+		return resp
+	}
+	// Header names are case-insensitive: $_.headers.location finds "Location"
+	if path[0] == "headers" && len(path) == 2 {
+		if headers, ok := resp["headers"].(map[string]interface{}); ok {
+			if val, ok := headers[path[1]]; ok {
+				return val
+			}
+			for k, val := range headers {
+				if strings.EqualFold(k, path[1]) {
+					return val
+				}
+			}
 			return nil
 		}
-		if len(ref.Path) == 0 {
-			return e.prevResponse
+	}
+	if _, ok := resp[path[0]]; !ok {
+		if body, ok := resp["body"]; ok {
+			return getNestedValue(body, path)
 		}
-		return getNestedValue(e.prevResponse, ref.Path)
+	}
+	return getNestedValue(resp, path)
+}
+
+func (e *Evaluator) evalVarRef(ref *ast.VarRef) interface{} {
+	// Handle $_ (previous response)
+	if ref.Name == "_" {
+		return e.resolveResponseRef(ref.Path)
 	}
 
-	// Handle $env.VAR
-	if ref.Name == "env" && len(ref.Path) > 0 {
-		return os.Getenv(ref.Path[0])
+	// Handle $_1, $_2, ... and $responses (response history) unless @responses is defined
+	if resp, ok := e.historyResponse(ref.Name); ok {
+		return responsePath(resp, ref.Path)
+	}
+	if _, defined := e.scope.Get("responses"); ref.Name == "responses" && !defined {
+		return e.resolveHistoryRef(ref.Path)
+	}
+
+	// Handle $env.VAR and $env_raw.VAR; an unset variable is null
+	if (ref.Name == "env" || ref.Name == "env_raw") && len(ref.Path) > 0 {
+		if val, ok := e.getEnv(ref.Name, ref.Path[0]); ok {
+			return val
+		}
+		return nil
 	}
 
 	// Regular variable
@@ -860,6 +2280,21 @@ func (e *Evaluator) evalProcessedString(ps *ast.ProcessedString) interface{} {
 		}
 		return result
 
+	case "yaml":
+		result, err := parseYAML(ps.Content)
+		if err != nil {
+			return ps.Content
+		}
+		return result
+
+	case "xml":
+		// Attributes become @name keys and repeated elements become arrays (see package xmlmap)
+		result, err := xmlmap.Decode([]byte(strings.TrimSpace(ps.Content)))
+		if err != nil {
+			return ps.Content
+		}
+		return result
+
 	case "base64":
 		decoded, err := base64.StdEncoding.DecodeString(ps.Content)
 		if err != nil {
@@ -867,6 +2302,24 @@ func (e *Evaluator) evalProcessedString(ps *ast.ProcessedString) interface{} {
 		}
 		return string(decoded)
 
+	case "hex":
+		decoded, err := hex.DecodeString(ps.Content)
+		if err != nil {
+			return ps.Content
+		}
+		return string(decoded)
+
+	case "urlencode":
+		// RFC 3986: everything except letters, digits and -._~ is escaped, spaces as %20
+		return strings.ReplaceAll(url.QueryEscape(ps.Content), "+", "%20")
+
+	case "urldecode":
+		decoded, err := url.QueryUnescape(ps.Content)
+		if err != nil {
+			return ps.Content
+		}
+		return decoded
+
 	case "file":
 		data, err := os.ReadFile(ps.Content)
 		if err != nil {
@@ -877,17 +2330,136 @@ func (e *Evaluator) evalProcessedString(ps *ast.ProcessedString) interface{} {
 		if err := json.Unmarshal(data, &result); err == nil {
 			return result
 		}
+		// .csv and .tsv files become a list of rows keyed by the header line
+		switch strings.ToLower(filepath.Ext(ps.Content)) {
+		case ".csv":
+			return e.evalCSV(ps, string(data), ',')
+		case ".tsv":
+			return e.evalCSV(ps, string(data), '\t')
+		}
+		return string(data)
+
+	case "csv":
+		return e.evalCSV(ps, textblock.Dedent(ps.Content), ',')
+
+	case "stdin":
+		if ps.Content != "" {
+			e.recordErr(errorAt(ps.Position, "stdin`` takes no content"))
+			return nil
+		}
+		if e.stdin == nil {
+			e.recordErr(errorAt(ps.Position, "stdin`` is not available: stdin is already used for the script"))
+			return nil
+		}
+		data, err := e.stdin.read()
+		if err != nil {
+			e.recordErr(fmt.Errorf("stdin``: %w", err))
+			return nil
+		}
+		// Like file``, JSON input becomes structured data, anything else is a raw string
+		var result interface{}
+		if err := json.Unmarshal(data, &result); err == nil {
+			return result
+		}
 		return string(data)
+
+	case "schema":
+		// JSON Schema text for validate, which compiles it (see evalValidate)
+		return ps.Content
 	}
 
+	if e.strict {
+		e.recordErr(errorAt(ps.Position, "unknown processor %q (valid processors: %s)", ps.Processor, strings.Join(processorNames, ", ")))
+		return nil
+	}
+	e.warn("line %d: unknown processor %q, using the content as a raw string (valid processors: %s)", ps.Position.Line, ps.Processor, strings.Join(processorNames, ", "))
 	return ps.Content
 }
 
+// processorNames lists the processors evalProcessedString knows, for the
+// unknown processor message
+var processorNames = []string{"base64", "csv", "file", "hex", "json", "schema", "stdin", "urldecode", "urlencode", "xml", "yaml"}
+
+// evalCSV parses CSV into a list of rows, each a map from the column names of
+// the header line to the fields of the row. Fields stay strings. @csv_delimiter
+// overrides the default delimiter.
+func (e *Evaluator) evalCSV(ps *ast.ProcessedString, content string, delim rune) interface{} {
+	if val, ok := e.scope.Get("csv_delimiter"); ok && val != nil {
+		s := fmt.Sprintf("%v", val)
+		if utf8.RuneCountInString(s) != 1 {
+			e.recordErr(fmt.Errorf("@csv_delimiter must be a single character, got %q", s))
+			return nil
+		}
+		delim, _ = utf8.DecodeRuneInString(s)
+	}
+	rows, err := parseCSV(content, delim)
+	if err != nil {
+		if ps.Processor == "csv" {
+			e.recordErr(errorAt(ps.Position, "csv``: %w", err))
+		} else {
+			e.recordErr(fmt.Errorf("file`%s`: %w", ps.Content, err))
+		}
+		return nil
+	}
+	return rows
+}
+
+// parseCSV parses CSV content with a header line into []interface{} of
+// map[string]interface{} rows. Quoted fields may contain the delimiter, quotes
+// ("") and newlines; blank lines are skipped.
+func parseCSV(content string, delim rune) ([]interface{}, error) {
+	r := csv.NewReader(strings.NewReader(strings.TrimPrefix(content, "\ufeff")))
+	r.Comma = delim
+	records, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]interface{}, 0, len(records))
+	if len(records) == 0 {
+		return rows, nil
+	}
+
+	header := records[0]
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, field := range record {
+			row[header[i]] = field
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// parseYAML parses the content of a yaml`...` string. The common indentation
+// of the lines is removed first, so the YAML can be indented with the request.
+func parseYAML(content string) (interface{}, error) {
+	var result interface{}
+	if err := yaml.Unmarshal([]byte(textblock.Dedent(content)), &result); err != nil {
+		return nil, err
+	}
+	return textblock.NormalizeYAML(result), nil
+}
+
 func (e *Evaluator) evalBlockToMap(block *ast.BlockExpr) map[string]interface{} {
 	result := make(map[string]interface{})
 	for _, entry := range block.Entries {
-		if entry.Key != "" {
-			result[entry.Key] = e.evalExpr(entry.Value)
+		if !e.entryEnabled(entry) {
+			continue
+		}
+		key := entry.Key
+		if entry.KeyExpr != nil {
+			// Computed key: [$field] value
+			keyVal := e.evalExpr(entry.KeyExpr)
+			if keyVal == nil {
+				continue
+			}
+			key = fmt.Sprintf("%v", keyVal)
+		}
+		if key != "" {
+			result[key] = e.evalExpr(entry.Value)
 		}
 	}
 	return result
@@ -896,28 +2468,59 @@ func (e *Evaluator) evalBlockToMap(block *ast.BlockExpr) map[string]interface{}
 func (e *Evaluator) evalBlockToSlice(block *ast.BlockExpr) []interface{} {
 	result := make([]interface{}, 0, len(block.Entries))
 	for _, entry := range block.Entries {
-		result = append(result, e.evalExpr(entry.Value))
+		if e.entryEnabled(entry) {
+			result = append(result, e.evalExpr(entry.Value))
+		}
 	}
 	return result
 }
 
+// entryEnabled evaluates an entry's optional guard (key value if cond)
+func (e *Evaluator) entryEnabled(entry ast.Entry) bool {
+	if entry.Condition == nil {
+		return true
+	}
+	return e.isTruthy(e.evalExpr(entry.Condition))
+}
+
 func (e *Evaluator) interpolateString(s string) string {
-	// Simple variable interpolation: $var or $var.path
+	// Simple variable interpolation: $var, $var.path or ${var.path}
 	// This is a simplified implementation
 	result := s
 
 	// Find all $varname or $varname.path patterns
 	i := 0
 	for i < len(result) {
-		if result[i] == '$' {
-			// Find the end of variable reference
-			j := i + 1
-			for j < len(result) && (isIdentChar(result[j]) || result[j] == '.') {
-				j++
+		// ${var.path} is delimited, so it can be followed directly by text ("${host}name")
+		if result[i] == '$' && i+1 < len(result) && result[i+1] == '{' {
+			if end := strings.IndexByte(result[i+2:], '}'); end >= 0 {
+				if inner := strings.TrimSpace(result[i+2 : i+2+end]); inner != "" {
+					value, err := e.evalInlineExpr(inner)
+					if err != nil {
+						e.recordErr(fmt.Errorf("${%s}: %w", inner, err))
+					}
+					valueStr := fmt.Sprintf("%v", value)
+					result = result[:i] + valueStr + result[i+3+end:]
+					i += len(valueStr)
+					continue
+				}
 			}
+		}
+		if result[i] == '$' {
+			j := varRefEnd(result, i)
 			if j > i+1 {
-				varRef := result[i+1 : j]
-				value := e.resolveVarPath(varRef)
+				var value interface{}
+				if end := defaultsEnd(result, j); end > j {
+					// "$env.TOKEN ?? 'anonymous'" works like ${env.TOKEN ?? 'anonymous'}
+					inner := result[i:end]
+					var err error
+					if value, err = e.evalInlineExpr(inner); err != nil {
+						e.recordErr(fmt.Errorf("%s: %w", inner, err))
+					}
+					j = end
+				} else {
+					value = e.resolveVarPath(result[i+1 : j])
+				}
 				valueStr := fmt.Sprintf("%v", value)
 				result = result[:i] + valueStr + result[j:]
 				i += len(valueStr)
@@ -930,46 +2533,287 @@ func (e *Evaluator) interpolateString(s string) string {
 	return result
 }
 
+// varRefEnd returns the end of the variable reference starting with the $ at
+// s[i], or i+1 if no name follows. A dot only continues the path if a key or
+// index follows it ("$items.0" vs. "ends with $name."). Path keys may contain
+// dashes like bare identifiers ($_.headers.Content-Type), indices may be
+// negative or in brackets ($items.-1, $items[0]), and * maps over an array
+// ($_.items.*.id).
+func varRefEnd(s string, i int) int {
+	j := i + 1
+	inPath := false
+	for j < len(s) {
+		if isIdentChar(s[j]) {
+			j++
+		} else if (s[j] == '.' || (s[j] == '-' && inPath)) && j+1 < len(s) &&
+			(isIdentChar(s[j+1]) || (s[j] == '.' && s[j+1] == '-' && j+2 < len(s) && isDigit(s[j+2]))) {
+			inPath = inPath || s[j] == '.'
+			j++
+		} else if s[j] == '.' && j+1 < len(s) && s[j+1] == '*' && j > i+1 {
+			// Wildcard segment: $_.items.*.id
+			inPath = true
+			j += 2
+		} else if end := bracketIndexEnd(s, j); j > i+1 && end > 0 {
+			inPath = true
+			j = end
+		} else {
+			break
+		}
+	}
+	return j
+}
+
+// defaultsEnd returns the end of the "?? default" operands that follow a
+// variable reference ending at s[j], or j if there are none. A default is a
+// single-quoted string or another variable reference, and may itself be
+// followed by "??".
+func defaultsEnd(s string, j int) int {
+	end := j
+	for {
+		k := end
+		for k < len(s) && s[k] == ' ' {
+			k++
+		}
+		if !strings.HasPrefix(s[k:], "??") {
+			return end
+		}
+		k += 2
+		for k < len(s) && s[k] == ' ' {
+			k++
+		}
+		switch {
+		case k < len(s) && s[k] == '\'':
+			closing := strings.IndexByte(s[k+1:], '\'')
+			if closing < 0 {
+				return end
+			}
+			end = k + closing + 2
+		case k < len(s) && s[k] == '$':
+			if next := varRefEnd(s, k); next > k+1 {
+				end = next
+			} else {
+				return end
+			}
+		default:
+			return end
+		}
+	}
+}
+
 func (e *Evaluator) resolveVarPath(path string) interface{} {
-	parts := strings.Split(path, ".")
+	val, ok := e.lookupVarPath(path)
+	if !ok {
+		return "$" + path // Return original if not found
+	}
+	return val
+}
+
+// lookupVarPath resolves a variable path like resolveVarPath. ok is false when
+// the variable is not defined or, for $env and $env_raw, not set.
+func (e *Evaluator) lookupVarPath(path string) (val interface{}, ok bool) {
+	parts := strings.Split(bracketIndexes.Replace(path), ".")
 	if len(parts) == 0 {
-		return nil
+		return nil, false
 	}
 
 	name := parts[0]
 
 	// Handle $_
 	if name == "_" {
-		if e.prevResponse == nil {
-			return nil
-		}
-		if len(parts) == 1 {
-			return e.prevResponse
-		}
-		return getNestedValue(e.prevResponse, parts[1:])
+		return e.resolveResponseRef(parts[1:]), true
+	}
+	if resp, ok := e.historyResponse(name); ok {
+		return responsePath(resp, parts[1:]), true
+	}
+	if _, defined := e.scope.Get("responses"); name == "responses" && !defined {
+		return e.resolveHistoryRef(parts[1:]), true
 	}
 
-	// Handle $env
-	if name == "env" && len(parts) > 1 {
-		return os.Getenv(parts[1])
+	// Handle $env and $env_raw; an unset variable interpolates as ""
+	if (name == "env" || name == "env_raw") && len(parts) > 1 {
+		return e.getEnv(name, parts[1])
 	}
 
 	// Regular variable
-	val, ok := e.scope.Get(name)
+	val, ok = e.scope.Get(name)
 	if !ok {
-		return "$" + path // Return original if not found
+		return nil, false
 	}
 
 	if len(parts) == 1 {
-		return val
+		return val, true
+	}
+
+	return getNestedValue(val, parts[1:]), true
+}
+
+// getEnv reads an environment variable and reports whether it is set.
+// $env lookups get the @env_prefix prepended; $env_raw bypasses the prefix.
+func (e *Evaluator) getEnv(kind, name string) (string, bool) {
+	if kind == "env" {
+		name = e.envPrefix + name
+	}
+	return os.LookupEnv(name)
+}
+
+// EvalFlowDef registers a flow definition (public method)
+func (e *Evaluator) EvalFlowDef(stmt *ast.FlowDefStmt) error {
+	return atPos(stmt.Pos(), e.evalFlowDef(stmt))
+}
+
+// evalFlowDef copies the flow map before adding to it, for the same reason as
+// evalTemplateDef
+func (e *Evaluator) evalFlowDef(stmt *ast.FlowDefStmt) error {
+	flows := make(map[string]*ast.FlowDefStmt, len(e.flows)+1)
+	for name, f := range e.flows {
+		flows[name] = f
+	}
+	flows[stmt.Name] = stmt
+	e.flows = flows
+	return nil
+}
+
+// EvalTemplateDef registers a request template (public method)
+func (e *Evaluator) EvalTemplateDef(stmt *ast.TemplateDefStmt) error {
+	return atPos(stmt.Pos(), e.evalTemplateDef(stmt))
+}
+
+// evalTemplateDef copies the template map before adding to it: parallel loop
+// iterations share their parent's map and may define templates of their own.
+func (e *Evaluator) evalTemplateDef(stmt *ast.TemplateDefStmt) error {
+	templates := make(map[string]*ast.TemplateDefStmt, len(e.templates)+1)
+	for name, t := range e.templates {
+		templates[name] = t
+	}
+	templates[stmt.Name] = stmt
+	e.templates = templates
+	return nil
+}
+
+// EvalFuncDef registers a function definition (public method)
+func (e *Evaluator) EvalFuncDef(stmt *ast.FuncDefStmt) error {
+	return atPos(stmt.Pos(), e.evalFuncDef(stmt))
+}
+
+// evalFuncDef copies the function map before adding to it, for the same
+// reason as evalTemplateDef
+func (e *Evaluator) evalFuncDef(stmt *ast.FuncDefStmt) error {
+	funcs := make(map[string]*ast.FuncDefStmt, len(e.funcs)+1)
+	for name, f := range e.funcs {
+		funcs[name] = f
+	}
+	funcs[stmt.Name] = stmt
+	e.funcs = funcs
+	return nil
+}
+
+// MaxCallDepth bounds the nesting of function calls, so that runaway
+// recursion fails with an error instead of exhausting the stack
+const MaxCallDepth = 100
+
+// EvalCall calls a function defined with def (public method)
+func (e *Evaluator) EvalCall(stmt *ast.CallStmt) error {
+	return atPos(stmt.Pos(), e.evalCall(stmt))
+}
+
+// evalCall runs the body of a function in a child scope of the caller with the
+// parameters bound to the arguments. Like a flow, the function can read the
+// caller's variables, its own @var definitions are local, and $_ is shared.
+func (e *Evaluator) evalCall(stmt *ast.CallStmt) error {
+	fn, ok := e.funcs[stmt.Name]
+	if !ok {
+		return errorAt(stmt.Position, "undefined function %q", stmt.Name)
+	}
+	if len(stmt.Args) != len(fn.Params) {
+		return errorAt(stmt.Position, "%s expects %d argument(s), got %d",
+			stmt.Name, len(fn.Params), len(stmt.Args))
+	}
+	if e.callDepth >= MaxCallDepth {
+		return errorAt(stmt.Position, "%s: calls nested deeper than %d (runaway recursion?)",
+			stmt.Name, MaxCallDepth)
+	}
+
+	// Arguments are evaluated in the caller's scope
+	args := make([]interface{}, len(stmt.Args))
+	for i, arg := range stmt.Args {
+		args[i] = e.evalExpr(arg)
+	}
+	if err := e.takeEvalErr(); err != nil {
+		return err
+	}
+
+	e.callDepth++
+	defer func() { e.callDepth-- }()
+	oldScope := e.scope
+	e.scope = NewScope(oldScope)
+	defer func() { e.scope = oldScope }()
+	for i, param := range fn.Params {
+		e.scope.Set(param, args[i])
+	}
+
+	for _, s := range fn.Body {
+		err := e.evalStatementCollect(s)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, errBreak) || errors.Is(err, errContinue):
+			// A function body is not a loop: break and continue don't reach the caller's loop
+			return fmt.Errorf("%s: %v", stmt.Name, err)
+		case e.callDepth > 1:
+			// Only the outermost call names itself, so recursion doesn't repeat the name
+			return err
+		}
+		return fmt.Errorf("%s: %w", stmt.Name, err)
 	}
+	return nil
+}
+
+// EvalRun executes a named flow (public method)
+func (e *Evaluator) EvalRun(stmt *ast.RunStmt) error {
+	return atPos(stmt.Pos(), e.evalRun(stmt))
+}
 
-	return getNestedValue(val, parts[1:])
+// evalRun executes the statements of a flow in order.
+// The flow runs in a child scope: it can read the caller's variables, but its own
+// @var definitions are local to the run. $_ is shared, so the flow sees the caller's
+// previous response and, after the run, $_ is the flow's last response.
+func (e *Evaluator) evalRun(stmt *ast.RunStmt) error {
+	flow, ok := e.flows[stmt.Name]
+	if !ok {
+		return fmt.Errorf("run: undefined flow %q", stmt.Name)
+	}
+	if e.runningFlows[stmt.Name] {
+		return fmt.Errorf("run: flow %q is already running (recursive run)", stmt.Name)
+	}
+	if e.runningFlows == nil {
+		e.runningFlows = make(map[string]bool)
+	}
+	e.runningFlows[stmt.Name] = true
+	defer delete(e.runningFlows, stmt.Name)
+
+	oldScope := e.scope
+	e.scope = NewScope(oldScope)
+	defer func() { e.scope = oldScope }()
+
+	// skip if needs no case here: it is a file-level guard that the parser
+	// rejects in a flow body, and a request's trailing skip if only skips the request
+	for _, s := range flow.Body {
+		err := e.evalStatementCollect(s)
+		switch {
+		case err == nil:
+			continue
+		case errors.Is(err, errBreak) || errors.Is(err, errContinue):
+			// Like a function body, a flow is not a loop: break and continue don't reach the caller's loop
+			return fmt.Errorf("flow %s: %v", stmt.Name, err)
+		}
+		return fmt.Errorf("flow %s: %w", stmt.Name, err)
+	}
+	return nil
 }
 
 // EvalEcho evaluates an echo statement (public method)
 func (e *Evaluator) EvalEcho(stmt *ast.EchoStmt) error {
-	return e.evalEcho(stmt)
+	return atPos(stmt.Pos(), e.evalEcho(stmt))
 }
 
 func (e *Evaluator) evalEcho(stmt *ast.EchoStmt) error {
@@ -982,10 +2826,58 @@ func (e *Evaluator) evalEcho(stmt *ast.EchoStmt) error {
 	return nil
 }
 
+// EvalSleep evaluates a sleep statement (public method)
+func (e *Evaluator) EvalSleep(stmt *ast.SleepStmt) error {
+	return atPos(stmt.Pos(), e.evalSleep(stmt))
+}
+
+// evalSleep pauses for the given duration. Like while loops, it only takes
+// effect when requests are executed; parsing a file (-p) does not wait.
+func (e *Evaluator) evalSleep(stmt *ast.SleepStmt) error {
+	val := e.evalExpr(stmt.Duration)
+	if err := e.takeEvalErr(); err != nil {
+		return err
+	}
+	d, err := parseTimeout(val)
+	if err != nil {
+		return errorAt(stmt.Position, "sleep: %v", err)
+	}
+	if d < 0 {
+		return errorAt(stmt.Position, "sleep: negative duration %v", d)
+	}
+	if e.requestCallback != nil {
+		time.Sleep(d)
+	}
+	return nil
+}
+
+// EvalCapture evaluates a capture statement (public method)
+func (e *Evaluator) EvalCapture(stmt *ast.CaptureStmt) error {
+	return atPos(stmt.Pos(), e.evalCapture(stmt))
+}
+
+// evalCapture stores the value of the expression, usually a path into the
+// previous response ($_), in the current scope. Inside a loop body the
+// variable lives for the current iteration.
+func (e *Evaluator) evalCapture(stmt *ast.CaptureStmt) error {
+	if e.prevResponse == nil {
+		return errorAt(stmt.Position, "capture %s: no previous response", stmt.Name)
+	}
+	val := e.evalExpr(stmt.Path)
+	if err := e.takeEvalErr(); err != nil {
+		return err
+	}
+	e.scope.Set(stmt.Name, val)
+	return nil
+}
+
 func (e *Evaluator) evalIf(stmt *ast.IfStmt) error {
 	// Try each branch in order
 	for _, branch := range stmt.Branches {
 		condition := e.evalExpr(branch.Condition)
+		if err := e.takeEvalErr(); err != nil {
+			return err
+		}
 		if e.isTruthy(condition) {
 			// Execute this branch
 			for _, s := range branch.Body {
@@ -1007,7 +2899,103 @@ func (e *Evaluator) evalIf(stmt *ast.IfStmt) error {
 	return nil
 }
 
+// EvalMatch evaluates a match statement (public method)
+func (e *Evaluator) EvalMatch(stmt *ast.MatchStmt) error {
+	return atPos(stmt.Pos(), e.evalMatch(stmt))
+}
+
+// evalMatch runs the first case arm with a value equal to the subject (as
+// with ==), or the default arm when no case matches
+func (e *Evaluator) evalMatch(stmt *ast.MatchStmt) error {
+	subject := e.evalExpr(stmt.Subject)
+	if err := e.takeEvalErr(); err != nil {
+		return err
+	}
+
+	body := stmt.Default
+arms:
+	for _, arm := range stmt.Cases {
+		for _, v := range arm.Values {
+			value := e.evalExpr(v)
+			if err := e.takeEvalErr(); err != nil {
+				return err
+			}
+			if e.compareValues(subject, value) == 0 {
+				body = arm.Body
+				break arms
+			}
+		}
+	}
+
+	for _, s := range body {
+		if err := e.evalStatementCollect(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultMaxIterations is the default iteration cap of while loops (@max_iterations)
+const DefaultMaxIterations = 100
+
+// EvalWhile evaluates a while loop (public method)
+func (e *Evaluator) EvalWhile(stmt *ast.WhileStmt) error {
+	return atPos(stmt.Pos(), e.evalWhile(stmt))
+}
+
+// evalWhile repeats the body while the condition holds. The condition is
+// re-evaluated before every iteration, so it sees the latest $_ response.
+// Without a request callback (parse-only mode) responses never change, so the
+// body is evaluated at most once to show the requests it would send.
+func (e *Evaluator) evalWhile(stmt *ast.WhileStmt) error {
+	maxIterations := int64(DefaultMaxIterations)
+	if val, ok := e.scope.Get("max_iterations"); ok && val != nil {
+		n, ok := toInt64(val)
+		if !ok || n <= 0 {
+			return fmt.Errorf("@max_iterations must be a positive integer, got %v", val)
+		}
+		maxIterations = n
+	}
+
+	for i := int64(0); ; i++ {
+		condition := e.evalExpr(stmt.Condition)
+		if err := e.takeEvalErr(); err != nil {
+			return err
+		}
+		if !e.isTruthy(condition) {
+			break
+		}
+		if i >= maxIterations {
+			return errorAt(stmt.Position, "while loop exceeded %d iterations (set @max_iterations to raise the limit)",
+				maxIterations)
+		}
+		brk, err := e.evalLoopBody(stmt.Body)
+		if err != nil {
+			return err
+		}
+		if brk || e.requestCallback == nil {
+			break
+		}
+	}
+
+	return nil
+}
+
 func (e *Evaluator) evalBinaryExpr(expr *ast.BinaryExpr) interface{} {
+	// Logical operators short-circuit: the right side is only evaluated when needed
+	switch expr.Operator {
+	case "??":
+		// Default value: the fallback is used when the left side is null or empty
+		if left := e.evalExpr(expr.Left); left != nil && left != "" {
+			return left
+		}
+		return e.evalExpr(expr.Right)
+	case "and":
+		return e.isTruthy(e.evalExpr(expr.Left)) && e.isTruthy(e.evalExpr(expr.Right))
+	case "or":
+		return e.isTruthy(e.evalExpr(expr.Left)) || e.isTruthy(e.evalExpr(expr.Right))
+	}
+
 	left := e.evalExpr(expr.Left)
 	right := e.evalExpr(expr.Right)
 
@@ -1023,22 +3011,8 @@ func (e *Evaluator) evalBinaryExpr(expr *ast.BinaryExpr) interface{} {
 			rightStr = fmt.Sprintf("%v", right)
 		}
 		return leftStr + rightStr
-	case "==":
-		return e.compareValues(left, right) == 0
-	case "!=":
-		return e.compareValues(left, right) != 0
-	case ">":
-		return e.compareValues(left, right) > 0
-	case "<":
-		return e.compareValues(left, right) < 0
-	case ">=":
-		return e.compareValues(left, right) >= 0
-	case "<=":
-		return e.compareValues(left, right) <= 0
-	case "and":
-		return e.isTruthy(left) && e.isTruthy(right)
-	case "or":
-		return e.isTruthy(left) || e.isTruthy(right)
+	case "==", "!=", ">", "<", ">=", "<=":
+		return e.compareOp(expr.Operator, left, right)
 	default:
 		return false
 	}
@@ -1155,6 +3129,16 @@ func (e *Evaluator) compareValues(left, right interface{}) int {
 	}
 }
 
+// boolSetting reads an on/off setting; strings such as "false" (e.g. from $env) are parsed
+func (e *Evaluator) boolSetting(val interface{}) bool {
+	if str, ok := val.(string); ok {
+		if b, err := strconv.ParseBool(str); err == nil {
+			return b
+		}
+	}
+	return e.isTruthy(val)
+}
+
 func (e *Evaluator) isTruthy(val interface{}) bool {
 	if val == nil {
 		return false
@@ -1210,12 +3194,15 @@ func (e *Evaluator) inferType(s string) interface{} {
 
 func getNestedValue(data interface{}, path []string) interface{} {
 	current := data
-	for _, key := range path {
+	for i, key := range path {
+		if key == "*" {
+			return mapWildcard(current, path[i+1:])
+		}
 		switch v := current.(type) {
 		case map[string]interface{}:
 			current = v[key]
 		case []interface{}:
-			if idx, err := strconv.Atoi(key); err == nil && idx >= 0 && idx < len(v) {
+			if idx, ok := arrayIndex(key, len(v)); ok {
 				current = v[idx]
 			} else {
 				return nil
@@ -1227,6 +3214,80 @@ func getNestedValue(data interface{}, path []string) interface{} {
 	return current
 }
 
+// mapWildcard resolves the rest of a path after * against each element of an
+// array: $_.items.*.id collects the id of every item. Elements without the
+// field give null, so the result lines up with the array. * on anything but
+// an array is null.
+func mapWildcard(data interface{}, rest []string) interface{} {
+	items, ok := data.([]interface{})
+	if !ok {
+		return nil
+	}
+	out := make([]interface{}, len(items))
+	for i, item := range items {
+		out[i] = getNestedValue(item, rest)
+	}
+	return out
+}
+
+// arrayIndex resolves a path key against an array of length n; negative keys
+// count from the end ($items.-1 is the last element)
+func arrayIndex(key string, n int) (int, bool) {
+	idx, err := strconv.Atoi(key)
+	if err != nil {
+		return 0, false
+	}
+	if idx < 0 {
+		idx += n
+	}
+	return idx, idx >= 0 && idx < n
+}
+
+// toInt64 converts integral values (including JSON numbers and numeric strings) to int64
+func toInt64(val interface{}) (int64, bool) {
+	switch v := val.(type) {
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	case float64:
+		if v != float64(int64(v)) {
+			return 0, false
+		}
+		return int64(v), true
+	case string:
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return i, err == nil
+	}
+	return 0, false
+}
+
+func isDigit(ch byte) bool {
+	return ch >= '0' && ch <= '9'
+}
+
+// bracketIndexes rewrites bracket indices in a variable path to dot form: items[0] -> items.0
+var bracketIndexes = strings.NewReplacer("[", ".", "]", "")
+
+// bracketIndexEnd returns the position after an index like [0] or [-1] starting at s[i], or -1
+func bracketIndexEnd(s string, i int) int {
+	if i >= len(s) || s[i] != '[' {
+		return -1
+	}
+	j := i + 1
+	if j < len(s) && s[j] == '-' {
+		j++
+	}
+	start := j
+	for j < len(s) && isDigit(s[j]) {
+		j++
+	}
+	if j == start || j >= len(s) || s[j] != ']' {
+		return -1
+	}
+	return j + 1
+}
+
 func isIdentChar(ch byte) bool {
 	return (ch >= 'a' && ch <= 'z') ||
 		(ch >= 'A' && ch <= 'Z') ||
@@ -1252,6 +3313,12 @@ func parseTimeout(val interface{}) (time.Duration, error) {
 	}
 }
 
+// ParseTimeout parses a duration like "30s", "5000ms" or "2m" the way @timeout
+// does; a number without a unit means seconds
+func ParseTimeout(s string) (time.Duration, error) {
+	return parseTimeoutString(s)
+}
+
 // parseTimeoutString parses timeout strings like "30s", "5000ms", "2m"
 func parseTimeoutString(s string) (time.Duration, error) {
 	s = strings.TrimSpace(s)
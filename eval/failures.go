@@ -0,0 +1,67 @@
+package eval
+
+import "sync"
+
+// ErrorGroup counts failed requests of one kind (see WithContinueOnError)
+type ErrorGroup struct {
+	Kind    string
+	Count   int
+	Message string // the first error of this kind
+}
+
+// requestFailures records requests that failed while continuing on errors,
+// grouped by kind in order of first appearance. A parallel loop records into
+// its own child log, which also adds every failure to its parent.
+type requestFailures struct {
+	mu     sync.Mutex
+	parent *requestFailures
+	groups []ErrorGroup
+}
+
+func (f *requestFailures) add(kind, msg string) {
+	for ; f != nil; f = f.parent {
+		f.mu.Lock()
+		found := false
+		for i := range f.groups {
+			if f.groups[i].Kind == kind {
+				f.groups[i].Count++
+				found = true
+				break
+			}
+		}
+		if !found {
+			f.groups = append(f.groups, ErrorGroup{Kind: kind, Count: 1, Message: msg})
+		}
+		f.mu.Unlock()
+	}
+}
+
+// child returns a log for a parallel loop (nil when not continuing on errors)
+func (f *requestFailures) child() *requestFailures {
+	if f == nil {
+		return nil
+	}
+	return &requestFailures{parent: f}
+}
+
+func (f *requestFailures) list() []ErrorGroup {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]ErrorGroup(nil), f.groups...)
+}
+
+// statsValue returns the groups in the form stored in parallel loop stats
+func (f *requestFailures) statsValue() []interface{} {
+	var out []interface{}
+	for _, g := range f.list() {
+		out = append(out, map[string]interface{}{
+			"kind":    g.Kind,
+			"count":   g.Count,
+			"message": g.Message,
+		})
+	}
+	return out
+}
@@ -0,0 +1,141 @@
+package eval
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/LingHeChen/haiku/ast"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// schemaResource is the URL the validate schema is registered under; relative
+// $ref inside the schema resolve against it
+const schemaResource = "validate.json"
+
+// evalValidate turns the schema of a validate section into the form stored in
+// req["validate"]: schema`...` is JSON text, anything else (file`schema.json`,
+// json`...`, a variable) may be a decoded document or JSON text. The schema is
+// compiled here so that a broken schema is reported before the request; the
+// compiled schema is cached for CheckSchema.
+func (e *Evaluator) evalValidate(expr ast.Expression) (map[string]interface{}, error) {
+	pos := expr.Pos()
+	var doc interface{}
+	if ps, ok := expr.(*ast.ProcessedString); ok && ps.Processor == "schema" {
+		if err := json.Unmarshal([]byte(ps.Content), &doc); err != nil {
+			return nil, errorAt(pos, "validate: invalid schema: %v", err)
+		}
+	} else {
+		doc = e.evalExpr(expr)
+		if s, ok := doc.(string); ok {
+			if err := json.Unmarshal([]byte(s), &doc); err != nil {
+				return nil, errorAt(pos, "validate: schema is not JSON: %q", s)
+			}
+		}
+	}
+	if _, err := compileSchema(doc); err != nil {
+		return nil, errorAt(pos, "validate: invalid schema: %v", err)
+	}
+	return map[string]interface{}{"schema": doc, "line": pos.Line}, nil
+}
+
+// schemaCache holds compiled schemas by their JSON text, so that a request
+// sent many times (in a loop, with retries) compiles its schema only once
+var schemaCache = struct {
+	sync.Mutex
+	schemas map[string]*jsonschema.Schema
+}{schemas: map[string]*jsonschema.Schema{}}
+
+// maxCachedSchemas bounds schemaCache; schemas built from variables may differ
+// for every request, and the cache starts over once it is full
+const maxCachedSchemas = 64
+
+func compileSchema(doc interface{}) (*jsonschema.Schema, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	key := string(data)
+	schemaCache.Lock()
+	schema, ok := schemaCache.schemas[key]
+	schemaCache.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(schemaResource, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+	schema, err = c.Compile(schemaResource)
+	if err != nil {
+		return nil, err
+	}
+	schemaCache.Lock()
+	if len(schemaCache.schemas) >= maxCachedSchemas {
+		clear(schemaCache.schemas)
+	}
+	schemaCache.schemas[key] = schema
+	schemaCache.Unlock()
+	return schema, nil
+}
+
+// CheckSchema validates a response body, given in the $_ shape, against the
+// schema of a validate section (req["validate"]). It returns one message per
+// offending location of the body, or nil when the request has no schema.
+func CheckSchema(validate interface{}, response map[string]interface{}) []string {
+	v, ok := validate.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	schema, err := compileSchema(v["schema"])
+	if err != nil {
+		return []string{fmt.Sprintf("line %v: validate: invalid schema: %v", v["line"], err)}
+	}
+
+	err = schema.Validate(response["body"])
+	if err == nil {
+		return nil
+	}
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return []string{fmt.Sprintf("line %v: validate: %v", v["line"], err)}
+	}
+
+	var failures []string
+	for _, leaf := range schemaLeaves(verr) {
+		failures = append(failures, fmt.Sprintf("line %v: validate body%s: %s", v["line"], instancePath(leaf.InstanceLocation), leaf.Message))
+	}
+	sort.SliceStable(failures, func(i, j int) bool { return failures[i] < failures[j] })
+	return failures
+}
+
+// schemaLeaves returns the innermost causes of a validation error, which name
+// the actual offending values rather than the schemas that contain them
+func schemaLeaves(err *jsonschema.ValidationError) []*jsonschema.ValidationError {
+	if len(err.Causes) == 0 {
+		return []*jsonschema.ValidationError{err}
+	}
+	var leaves []*jsonschema.ValidationError
+	for _, cause := range err.Causes {
+		leaves = append(leaves, schemaLeaves(cause)...)
+	}
+	return leaves
+}
+
+// instancePath turns a JSON pointer into the path syntax of $_ references:
+// /items/0/name becomes .items.0.name
+func instancePath(pointer string) string {
+	if pointer == "" {
+		return ""
+	}
+	parts := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, p := range parts {
+		parts[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(p)
+	}
+	return "." + strings.Join(parts, ".")
+}
@@ -2,4 +2,9 @@ module github.com/LingHeChen/haiku
 
 go 1.25.1
 
-require github.com/alecthomas/participle/v2 v2.1.4
+require (
+	github.com/alecthomas/participle/v2 v2.1.4
+	github.com/andybalholm/brotli v1.2.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	gopkg.in/yaml.v3 v3.0.1
+)
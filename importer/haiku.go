@@ -0,0 +1,210 @@
+// Package importer 将其他格式的 API 描述转换为 .haiku 文件
+package importer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/LingHeChen/haiku/lexer"
+)
+
+// object 保持键顺序的对象，生成的请求体按规范中的顺序输出字段
+type object []field
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// MarshalJSON 按字段顺序输出 JSON（用于 json`...` 形式的值）
+func (o object) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := marshalJSON(f.key)
+		if err != nil {
+			return nil, err
+		}
+		val, err := marshalJSON(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalJSON 与 json.Marshal 相同，但不转义 <、>、&
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// jsonValue 将值写成 json`...`，可以表示任意 JSON 值且内容不会被插值
+// JSON 中的反引号只可能出现在字符串里，替换为 \u0060 以免提前结束
+func jsonValue(v interface{}) string {
+	data, err := marshalJSON(v)
+	if err != nil {
+		data = []byte("null")
+	}
+	return "json`" + strings.ReplaceAll(string(data), "`", `\u0060`) + "`"
+}
+
+// scalar 返回标量值的写法；对象和数组使用 json`...`
+func scalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return quote(v)
+	}
+	return jsonValue(v)
+}
+
+// quote 返回字符串字面量
+// 包含引号、反斜杠、控制字符的字符串，或会被 $name、{{name}} 插值的字符串，改用 json`...`
+func quote(s string) string {
+	if !plainString(s) || strings.Contains(s, "$") || strings.Contains(s, "{{") {
+		return jsonValue(s)
+	}
+	return `"` + s + `"`
+}
+
+// plainString 判断字符串能否直接放在双引号中（不含引号、反斜杠和控制字符）
+func plainString(s string) bool {
+	for _, r := range s {
+		if r == '"' || r == '\\' || r < 0x20 || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// keyLiteral 返回键的写法：词法分析后是单个标识符的键不加引号，其余加双引号
+// 加引号也无法表示的键（包含引号、反斜杠或 $）返回 false，所在的对象改用 json`...`
+func keyLiteral(key string) (string, bool) {
+	tokens := lexer.Tokenize(key)
+	if len(tokens) == 2 && tokens[0].Type == lexer.IDENT && tokens[0].Literal == key {
+		return key, true
+	}
+	if key == "" || !plainString(key) || strings.Contains(key, "$") || strings.Contains(key, "{{") {
+		return "", false
+	}
+	return `"` + key + `"`, true
+}
+
+// blockable 判断对象能否写成缩进块（所有键都能表示）
+func blockable(o object) bool {
+	for _, f := range o {
+		if _, ok := keyLiteral(f.key); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// scalarList 判断数组是否只包含标量，只有这样的数组写成每行一个值的缩进块
+func scalarList(items []interface{}) bool {
+	for _, item := range items {
+		switch item.(type) {
+		case object, []interface{}:
+			return false
+		}
+	}
+	return true
+}
+
+// writer 生成 haiku 源码，缩进为两个空格
+type writer struct {
+	buf strings.Builder
+}
+
+func (w *writer) line(indent int, format string, args ...interface{}) {
+	w.buf.WriteString(strings.Repeat("  ", indent))
+	fmt.Fprintf(&w.buf, format, args...)
+	w.buf.WriteByte('\n')
+}
+
+// section 写出 body、query 等块：可以写成缩进块的对象逐行写字段，其他值写在同一行
+func (w *writer) section(name string, v interface{}) {
+	if o, ok := v.(object); ok && len(o) > 0 && blockable(o) {
+		w.line(0, "%s", name)
+		w.fields(o, 1)
+		return
+	}
+	switch v := v.(type) {
+	case object:
+		if len(v) == 0 {
+			w.line(0, "%s {}", name)
+			return
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			w.line(0, "%s []", name)
+			return
+		}
+	}
+	w.line(0, "%s %s", name, scalar(v))
+}
+
+// fields 将对象的字段写成缩进块，每行 "key value"，嵌套对象和只含标量的数组继续缩进
+func (w *writer) fields(o object, indent int) {
+	for _, f := range o {
+		key, _ := keyLiteral(f.key)
+		switch v := f.value.(type) {
+		case object:
+			switch {
+			case len(v) == 0:
+				w.line(indent, "%s {}", key)
+			case blockable(v):
+				w.line(indent, "%s", key)
+				w.fields(v, indent+1)
+			default:
+				w.line(indent, "%s %s", key, jsonValue(v))
+			}
+		case []interface{}:
+			switch {
+			case len(v) == 0:
+				w.line(indent, "%s []", key)
+			case scalarList(v):
+				w.line(indent, "%s", key)
+				for _, item := range v {
+					w.line(indent+1, "%s", scalar(item))
+				}
+			default:
+				w.line(indent, "%s %s", key, jsonValue(v))
+			}
+		default:
+			w.line(indent, "%s %s", key, scalar(v))
+		}
+	}
+}
+
+// comment 写出一行注释，去掉换行以免注释内容变成代码
+func (w *writer) comment(text string) {
+	w.line(0, "# %s", strings.Join(strings.Fields(text), " "))
+}
+
+func (w *writer) String() string {
+	return w.buf.String()
+}
@@ -0,0 +1,547 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// haiku 支持的 HTTP 方法（OpenAPI 中的 trace 不生成）
+var openAPIMethods = map[string]bool{
+	"get": true, "put": true, "post": true, "delete": true,
+	"options": true, "head": true, "patch": true,
+}
+
+// 由 evaluator 特殊处理的变量名，路径参数不能使用这些名称
+var reservedVars = map[string]bool{
+	"base_url": true, "timeout": true, "delay": true, "headers": true, "retry": true,
+	"insecure": true, "ca_cert": true, "proxy": true, "env_prefix": true, "max_iterations": true,
+	"env": true, "env_raw": true,
+}
+
+// OpenAPI 中不作为 header 参数使用的请求头（由 body 和 auth 决定）
+var ignoredHeaderParams = map[string]bool{
+	"accept": true, "content-type": true, "authorization": true,
+}
+
+// $ref 引用链的最大长度，防止互相引用的 $ref 死循环
+const maxRefDepth = 8
+
+var pathParamPattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// openAPISpec 解析后的 OpenAPI 文档，使用 yaml.Node 以保持键的顺序
+type openAPISpec struct {
+	root *yaml.Node
+}
+
+// OpenAPI 根据 OpenAPI 3 规范（YAML 或 JSON）生成 .haiku 文件内容，每个操作生成一个请求
+// URL 为 $base_url 加路径，路径参数使用变量插值；必填或带示例的 query、header 参数写入 query、headers 块；
+// 请求体使用规范中的示例，没有示例时根据 schema 生成
+func OpenAPI(data []byte) (string, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("failed to parse OpenAPI spec: %w", err)
+	}
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return "", errors.New("failed to parse OpenAPI spec: expected a YAML or JSON object")
+	}
+	spec := &openAPISpec{root: doc.Content[0]}
+
+	version := get(spec.root, "openapi")
+	if version == nil {
+		if get(spec.root, "swagger") != nil {
+			return "", errors.New("Swagger 2.0 specs are not supported, convert the spec to OpenAPI 3 first")
+		}
+		return "", errors.New("not an OpenAPI spec: missing openapi version")
+	}
+	if !strings.HasPrefix(version.Value, "3.") {
+		return "", fmt.Errorf("unsupported OpenAPI version %s, expected 3.x", version.Value)
+	}
+
+	w := &writer{}
+	title := "API"
+	if info := get(spec.root, "info"); info != nil {
+		if t := get(info, "title"); t != nil && t.Value != "" {
+			title = t.Value
+		}
+		if v := get(info, "version"); v != nil && v.Value != "" {
+			title += " " + v.Value
+		}
+	}
+	w.comment("Generated from " + title + " by haiku import openapi")
+	w.line(0, "@base_url %s", quote(spec.baseURL()))
+
+	paths := get(spec.root, "paths")
+	if paths == nil || paths.Kind != yaml.MappingNode {
+		return w.String(), nil
+	}
+	first := true
+	for i := 0; i+1 < len(paths.Content); i += 2 {
+		path := paths.Content[i].Value
+		item := spec.resolve(paths.Content[i+1])
+		if item == nil || item.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(item.Content); j += 2 {
+			method := item.Content[j].Value
+			if !openAPIMethods[method] {
+				continue
+			}
+			w.line(0, "")
+			if !first {
+				w.line(0, "---")
+				w.line(0, "")
+			}
+			first = false
+			spec.writeOperation(w, method, path, get(item, "parameters"), item.Content[j+1])
+		}
+	}
+	return w.String(), nil
+}
+
+// writeOperation 写出一个操作对应的请求
+func (s *openAPISpec) writeOperation(w *writer, method, path string, pathParams, op *yaml.Node) {
+	op = s.resolve(op)
+
+	title := strings.ToUpper(method) + " " + path
+	if summary := get(op, "summary"); summary != nil && summary.Value != "" {
+		title += " - " + summary.Value
+	} else if id := get(op, "operationId"); id != nil && id.Value != "" {
+		title += " - " + id.Value
+	}
+	if deprecated := get(op, "deprecated"); deprecated != nil && deprecated.Value == "true" {
+		title += " (deprecated)"
+	}
+	w.comment(title)
+
+	var query, headers object
+	pathVars := map[string]string{}
+	for _, p := range s.parameters(pathParams, get(op, "parameters")) {
+		name := stringValue(get(p, "name"))
+		switch stringValue(get(p, "in")) {
+		case "path":
+			v := varName(name)
+			pathVars[name] = v
+			// 变量直接插入 URL，示例值按路径段编码
+			value := s.paramExample(p)
+			if str, ok := value.(string); ok {
+				value = url.PathEscape(str)
+			}
+			w.line(0, "@%s %s", v, scalar(value))
+		case "query":
+			if s.includeParam(p) {
+				query = append(query, field{name, s.paramExample(p)})
+			}
+		case "header":
+			if s.includeParam(p) && !ignoredHeaderParams[strings.ToLower(name)] {
+				headers = append(headers, field{name, s.paramExample(p)})
+			}
+		}
+	}
+
+	w.line(0, "%s %s", method, urlLiteral(path, pathVars))
+	if len(query) > 0 {
+		w.section("query", query)
+	}
+
+	mediaType, body, hasBody := s.requestBody(op)
+	switch {
+	case !hasBody:
+	case isJSONMediaType(mediaType):
+		// 客户端不会为 body 自动设置 Content-Type
+		headers = append(headers, field{"Content-Type", mediaType})
+	case mediaType == "application/x-www-form-urlencoded":
+	default:
+		w.comment("request body (" + mediaType + ") is not generated")
+		hasBody = false
+	}
+	if len(headers) > 0 {
+		w.section("headers", headers)
+	}
+	if hasBody {
+		if mediaType == "application/x-www-form-urlencoded" {
+			w.section("form", body)
+		} else {
+			w.section("body", body)
+		}
+	}
+}
+
+// baseURL 返回第一个 server 的 URL，server 变量替换为默认值；相对地址基于 http://localhost
+func (s *openAPISpec) baseURL() string {
+	base := ""
+	if servers := get(s.root, "servers"); servers != nil && servers.Kind == yaml.SequenceNode && len(servers.Content) > 0 {
+		server := s.resolve(servers.Content[0])
+		base = stringValue(get(server, "url"))
+		if vars := get(server, "variables"); vars != nil && vars.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(vars.Content); i += 2 {
+				def := stringValue(get(vars.Content[i+1], "default"))
+				base = strings.ReplaceAll(base, "{"+vars.Content[i].Value+"}", def)
+			}
+		}
+	}
+	if base == "" || strings.HasPrefix(base, "/") {
+		base = "http://localhost" + base
+	}
+	return strings.TrimRight(base, "/")
+}
+
+// parameters 合并路径级和操作级参数，操作级参数按 name + in 覆盖路径级参数
+func (s *openAPISpec) parameters(pathLevel, opLevel *yaml.Node) []*yaml.Node {
+	var params []*yaml.Node
+	index := map[string]int{}
+	for _, list := range []*yaml.Node{pathLevel, opLevel} {
+		if list == nil || list.Kind != yaml.SequenceNode {
+			continue
+		}
+		for _, item := range list.Content {
+			p := s.resolve(item)
+			if p == nil || stringValue(get(p, "name")) == "" {
+				continue
+			}
+			key := stringValue(get(p, "in")) + ":" + stringValue(get(p, "name"))
+			if i, ok := index[key]; ok {
+				params[i] = p
+				continue
+			}
+			index[key] = len(params)
+			params = append(params, p)
+		}
+	}
+	return params
+}
+
+// includeParam query 和 header 参数只在必填或规范给出了示例、默认值时生成，避免发送占位值
+func (s *openAPISpec) includeParam(p *yaml.Node) bool {
+	if stringValue(get(p, "required")) == "true" || get(p, "example") != nil || get(p, "examples") != nil {
+		return true
+	}
+	schema := s.resolve(get(p, "schema"))
+	return get(schema, "example") != nil || get(schema, "default") != nil
+}
+
+// paramExample 返回参数的示例值：example、examples 中的第一个，或根据 schema 生成
+func (s *openAPISpec) paramExample(p *yaml.Node) interface{} {
+	if v, ok := s.example(p); ok {
+		return v
+	}
+	v, _ := s.schemaExample(get(p, "schema"), map[string]bool{})
+	return v
+}
+
+// example 读取节点上的 example 或 examples 中第一个示例的 value
+func (s *openAPISpec) example(n *yaml.Node) (interface{}, bool) {
+	if ex := get(n, "example"); ex != nil {
+		return nodeValue(ex), true
+	}
+	if exs := get(n, "examples"); exs != nil && exs.Kind == yaml.MappingNode && len(exs.Content) >= 2 {
+		if v := get(s.resolve(exs.Content[1]), "value"); v != nil {
+			return nodeValue(v), true
+		}
+	}
+	return nil, false
+}
+
+// requestBody 选择请求体的媒体类型（优先 JSON，其次表单）并返回示例
+func (s *openAPISpec) requestBody(op *yaml.Node) (string, interface{}, bool) {
+	content := get(s.resolve(get(op, "requestBody")), "content")
+	if content == nil || content.Kind != yaml.MappingNode || len(content.Content) < 2 {
+		return "", nil, false
+	}
+	chosen := 0
+	for i := len(content.Content) - 2; i >= 0; i -= 2 {
+		if content.Content[i].Value == "application/x-www-form-urlencoded" {
+			chosen = i
+		}
+	}
+	for i := len(content.Content) - 2; i >= 0; i -= 2 {
+		if isJSONMediaType(content.Content[i].Value) {
+			chosen = i
+		}
+	}
+	mediaType := content.Content[chosen].Value
+	media := s.resolve(content.Content[chosen+1])
+	if v, ok := s.example(media); ok {
+		return mediaType, v, true
+	}
+	v, _ := s.schemaExample(get(media, "schema"), map[string]bool{})
+	return mediaType, v, true
+}
+
+// schemaExample 根据 schema 生成示例值：优先使用 example、default、enum，
+// 否则按类型生成占位值，对象包含所有非只读属性
+// expanding 记录正在展开的 $ref，递归引用自身时返回 false，由调用方省略该属性或数组元素
+func (s *openAPISpec) schemaExample(n *yaml.Node, expanding map[string]bool) (interface{}, bool) {
+	for n != nil {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+			continue
+		}
+		ref := get(n, "$ref")
+		if ref == nil {
+			break
+		}
+		if expanding[ref.Value] {
+			return nil, false
+		}
+		expanding[ref.Value] = true
+		defer delete(expanding, ref.Value)
+		n = s.lookup(ref.Value)
+	}
+	if n == nil {
+		return nil, true
+	}
+
+	if ex := get(n, "example"); ex != nil {
+		return nodeValue(ex), true
+	}
+	// OpenAPI 3.1 的 schema 使用 JSON Schema 的 examples 数组
+	if exs := get(n, "examples"); exs != nil && exs.Kind == yaml.SequenceNode && len(exs.Content) > 0 {
+		return nodeValue(exs.Content[0]), true
+	}
+	for _, key := range []string{"default", "const"} {
+		if v := get(n, key); v != nil {
+			return nodeValue(v), true
+		}
+	}
+	if enum := get(n, "enum"); enum != nil && enum.Kind == yaml.SequenceNode && len(enum.Content) > 0 {
+		return nodeValue(enum.Content[0]), true
+	}
+	if all := get(n, "allOf"); all != nil && all.Kind == yaml.SequenceNode {
+		merged := object{}
+		for _, sub := range all.Content {
+			v, _ := s.schemaExample(sub, expanding)
+			if o, ok := v.(object); ok {
+				merged = append(merged, o...)
+			}
+		}
+		return merged, true
+	}
+	for _, key := range []string{"oneOf", "anyOf"} {
+		if alt := get(n, key); alt != nil && alt.Kind == yaml.SequenceNode && len(alt.Content) > 0 {
+			return s.schemaExample(alt.Content[0], expanding)
+		}
+	}
+
+	switch schemaType(n) {
+	case "object":
+		o := object{}
+		props := get(n, "properties")
+		if props == nil || props.Kind != yaml.MappingNode {
+			return o, true
+		}
+		for i := 0; i+1 < len(props.Content); i += 2 {
+			if stringValue(get(s.resolve(props.Content[i+1]), "readOnly")) == "true" {
+				continue
+			}
+			if v, ok := s.schemaExample(props.Content[i+1], expanding); ok {
+				o = append(o, field{props.Content[i].Value, v})
+			}
+		}
+		return o, true
+	case "array":
+		if v, ok := s.schemaExample(get(n, "items"), expanding); ok {
+			return []interface{}{v}, true
+		}
+		return []interface{}{}, true
+	case "integer", "number":
+		return int64(0), true
+	case "boolean":
+		return false, true
+	case "string":
+		switch stringValue(get(n, "format")) {
+		case "date-time":
+			return "2024-01-01T00:00:00Z", true
+		case "date":
+			return "2024-01-01", true
+		case "email":
+			return "user@example.com", true
+		case "uuid":
+			return "00000000-0000-0000-0000-000000000000", true
+		case "uri", "url":
+			return "https://example.com", true
+		}
+		return "string", true
+	}
+	return nil, true
+}
+
+// schemaType 返回 schema 的类型；OpenAPI 3.1 中 type 可以是数组，取第一个非 null 的类型
+// 没有 type 但有 properties 时视为 object
+func schemaType(n *yaml.Node) string {
+	t := get(n, "type")
+	switch {
+	case t == nil:
+		if get(n, "properties") != nil {
+			return "object"
+		}
+		return ""
+	case t.Kind == yaml.SequenceNode:
+		for _, item := range t.Content {
+			if item.Value != "null" {
+				return item.Value
+			}
+		}
+		return "null"
+	}
+	return t.Value
+}
+
+// resolve 解析本地 $ref（#/components/...），引用链过长或无法解析时返回 nil
+func (s *openAPISpec) resolve(n *yaml.Node) *yaml.Node {
+	for i := 0; n != nil; i++ {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+			continue
+		}
+		ref := get(n, "$ref")
+		if ref == nil {
+			return n
+		}
+		if i >= maxRefDepth {
+			return nil
+		}
+		n = s.lookup(ref.Value)
+	}
+	return nil
+}
+
+// lookup 按 JSON Pointer 查找文档中的节点，不支持外部文件引用
+func (s *openAPISpec) lookup(ref string) *yaml.Node {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+	n := s.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		if unescaped, err := url.PathUnescape(part); err == nil {
+			part = unescaped
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		n = get(n, part)
+	}
+	return n
+}
+
+// get 返回 mapping 节点中 key 对应的值
+func get(n *yaml.Node, key string) *yaml.Node {
+	if n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// stringValue 返回标量节点的值，节点不存在时返回空字符串
+func stringValue(n *yaml.Node) string {
+	if n == nil {
+		return ""
+	}
+	return n.Value
+}
+
+// nodeValue 将 YAML 节点转换为示例值，对象保持键的顺序
+// 只有 null、bool、int、float 按类型转换，其他标量（包括时间戳）保留原始字符串
+func nodeValue(n *yaml.Node) interface{} {
+	switch n.Kind {
+	case yaml.AliasNode:
+		return nodeValue(n.Alias)
+	case yaml.SequenceNode:
+		items := make([]interface{}, 0, len(n.Content))
+		for _, item := range n.Content {
+			items = append(items, nodeValue(item))
+		}
+		return items
+	case yaml.MappingNode:
+		o := object{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			o = append(o, field{n.Content[i].Value, nodeValue(n.Content[i+1])})
+		}
+		return o
+	}
+
+	switch n.ShortTag() {
+	case "!!null":
+		return nil
+	case "!!bool":
+		var b bool
+		if err := n.Decode(&b); err == nil {
+			return b
+		}
+	case "!!int":
+		if i, err := strconv.ParseInt(n.Value, 0, 64); err == nil {
+			return i
+		}
+		var f float64
+		if err := n.Decode(&f); err == nil {
+			return f
+		}
+	case "!!float":
+		var f float64
+		if err := n.Decode(&f); err == nil {
+			return f
+		}
+	}
+	return n.Value
+}
+
+// isJSONMediaType 判断是否为 JSON 媒体类型（application/json 或 +json 后缀）
+func isJSONMediaType(mediaType string) bool {
+	mediaType = strings.TrimSpace(strings.SplitN(mediaType, ";", 2)[0])
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// varName 将参数名转换为合法的变量名，与特殊变量或关键字冲突时加 _param 后缀
+func varName(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_') {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	v := b.String()
+	if v == "" || unicode.IsDigit(rune(v[0])) {
+		v = "_" + v
+	}
+	if key, ok := keyLiteral(v); !ok || key != v || reservedVars[v] {
+		v += "_param"
+	}
+	return v
+}
+
+// urlLiteral 生成请求 URL：$base_url 加路径，{param} 替换为 ${变量}
+// 路径中会被当作插值或结束引号的字符按 URL 编码写出
+func urlLiteral(path string, vars map[string]string) string {
+	escape := strings.NewReplacer(`"`, "%22", `\`, "%5C", "$", "%24", "{", "%7B", "}", "%7D", " ", "%20")
+	var b strings.Builder
+	b.WriteString(`"$base_url`)
+	last := 0
+	for _, m := range pathParamPattern.FindAllStringSubmatchIndex(path, -1) {
+		b.WriteString(escape.Replace(path[last:m[0]]))
+		name := path[m[2]:m[3]]
+		v, ok := vars[name]
+		if !ok {
+			// 没有声明的路径参数也定义为变量名，运行前需要用 @ 或 --set 设置
+			v = varName(name)
+		}
+		b.WriteString("${" + v + "}")
+		last = m[1]
+	}
+	b.WriteString(escape.Replace(path[last:]))
+	b.WriteString(`"`)
+	return b.String()
+}
@@ -0,0 +1,183 @@
+package importer
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/LingHeChen/haiku/eval"
+	"github.com/LingHeChen/haiku/parser"
+)
+
+const petStoreSpec = `
+openapi: 3.0.3
+info:
+  title: Pet Store
+  version: 1.2.0
+servers:
+  - url: https://{region}.example.com/v1/
+    variables:
+      region:
+        default: eu
+paths:
+  /pets:
+    get:
+      summary: List pets
+      parameters:
+        - name: limit
+          in: query
+          schema: {type: integer, default: 20}
+        - name: "filter[name]"
+          in: query
+          required: true
+          example: "Tom $cat {{x}}"
+        - name: optional
+          in: query
+          schema: {type: string}
+        - name: X-Request-Id
+          in: header
+          required: true
+          schema: {type: string, format: uuid}
+        - name: Accept
+          in: header
+          required: true
+          schema: {type: string}
+    post:
+      summary: Create pet
+      requestBody:
+        content:
+          text/plain:
+            schema: {type: string}
+          application/json:
+            schema:
+              $ref: '#/components/schemas/Pet'
+  /pets/{pet-id}/tags/{if}:
+    parameters:
+      - name: pet-id
+        in: path
+        required: true
+        schema: {type: integer, example: 42}
+      - name: if
+        in: path
+        required: true
+        example: a b
+    put:
+      deprecated: true
+      requestBody:
+        content:
+          application/merge-patch+json:
+            example:
+              name: "Rex \"the dog\" \\o/"
+              "weird key": [1, 2.5, null, true]
+              "$ref-like": x
+              nested: {a: {b: "` + "`tick`" + `"}, empty: {}, list: []}
+              objects: [{id: 1}]
+              if: keyword
+  /login:
+    post:
+      requestBody:
+        content:
+          application/x-www-form-urlencoded:
+            schema:
+              type: object
+              properties:
+                user: {type: string, format: email}
+                remember: {type: boolean}
+  /upload:
+    post:
+      requestBody:
+        content:
+          multipart/form-data:
+            schema: {type: object}
+components:
+  schemas:
+    Pet:
+      type: object
+      properties:
+        id: {type: integer, readOnly: true}
+        name: {type: string, example: Rex}
+        tags: {type: array, items: {type: string}}
+        owner:
+          allOf:
+            - $ref: '#/components/schemas/Owner'
+            - type: object
+              properties:
+                since: {type: string, format: date}
+        status: {type: string, enum: [available, sold]}
+    Owner:
+      type: object
+      properties:
+        email: {type: string, format: email}
+        pets: {type: array, items: {$ref: '#/components/schemas/Pet'}}
+`
+
+func TestOpenAPIRoundTrip(t *testing.T) {
+	out, err := OpenAPI([]byte(petStoreSpec))
+	if err != nil {
+		t.Fatalf("import error: %v", err)
+	}
+
+	program, err := parser.ParseFile(out)
+	if err != nil {
+		t.Fatalf("generated file does not parse: %v\n%s", err, out)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("generated file does not evaluate: %v\n%s", err, out)
+	}
+
+	expected := []string{
+		`{"get":"https://eu.example.com/v1/pets","query":{"filter[name]":"Tom $cat {{x}}","limit":20},"headers":{"X-Request-Id":"00000000-0000-0000-0000-000000000000"}}`,
+		`{"post":"https://eu.example.com/v1/pets","headers":{"Content-Type":"application/json"},"body":{"name":"Rex","owner":{"email":"user@example.com","pets":[],"since":"2024-01-01"},"status":"available","tags":["string"]}}`,
+		`{"put":"https://eu.example.com/v1/pets/42/tags/a%20b","headers":{"Content-Type":"application/merge-patch+json"},"body":{"$ref-like":"x","if":"keyword","name":"Rex \"the dog\" \\o/","nested":{"a":{"b":"` + "`tick`" + `"},"empty":{},"list":[]},"objects":[{"id":1}],"weird key":[1,2.5,null,true]}}`,
+		`{"post":"https://eu.example.com/v1/login","form":{"remember":false,"user":"user@example.com"}}`,
+		`{"post":"https://eu.example.com/v1/upload"}`,
+	}
+	if len(requests) != len(expected) {
+		t.Fatalf("expected %d requests, got %d\n%s", len(expected), len(requests), out)
+	}
+	for i, req := range requests {
+		delete(req, "timeout")
+		var want map[string]interface{}
+		if err := json.Unmarshal([]byte(expected[i]), &want); err != nil {
+			t.Fatalf("bad expectation %d: %v", i, err)
+		}
+		got, _ := json.Marshal(req)
+		wantJSON, _ := json.Marshal(want)
+		if string(got) != string(wantJSON) {
+			t.Errorf("request %d:\n got  %s\n want %s", i+1, got, wantJSON)
+		}
+	}
+	if t.Failed() {
+		t.Logf("generated file:\n%s", out)
+	}
+
+	for _, want := range []string{
+		"# GET /pets - List pets\n",
+		"(deprecated)\n",
+		"@if_param \"a%20b\"\n",
+		"# request body (multipart/form-data) is not generated\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected output to contain %q\n%s", want, out)
+		}
+	}
+}
+
+func TestOpenAPIRejectsOtherDocuments(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{`swagger: "2.0"`, "Swagger 2.0"},
+		{`openapi: 2.5.0`, "unsupported OpenAPI version"},
+		{`title: nothing`, "not an OpenAPI spec"},
+		{`[1, 2]`, "expected a YAML or JSON object"},
+	}
+	for _, tt := range tests {
+		_, err := OpenAPI([]byte(tt.spec))
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("OpenAPI(%q) error = %v, want %q", tt.spec, err, tt.err)
+		}
+	}
+}
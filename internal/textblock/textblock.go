@@ -0,0 +1,66 @@
+// Package textblock 处理反引号中的多行内容（yaml`...`、csv`...` 等），
+// 供 parser 和 eval 共用
+package textblock
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dedent 去掉多行内容的公共缩进，使内容可以随请求一起缩进；
+// 紧跟反引号的第一行保持不变
+func Dedent(content string) string {
+	lines := strings.Split(content, "\n")
+	start := 0
+	if strings.TrimSpace(lines[0]) != "" {
+		start = 1
+	}
+
+	indent := -1
+	for _, line := range lines[start:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		n := len(line) - len(strings.TrimLeft(line, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	if indent <= 0 {
+		return content
+	}
+
+	for i := start; i < len(lines); i++ {
+		if len(lines[i]) >= indent {
+			lines[i] = lines[i][indent:]
+		} else {
+			lines[i] = strings.TrimLeft(lines[i], " \t")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NormalizeYAML 将 YAML 解析结果转换为统一的类型（map[string]interface{}、int64）
+func NormalizeYAML(val interface{}) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			v[k] = NormalizeYAML(item)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[fmt.Sprintf("%v", k)] = NormalizeYAML(item)
+		}
+		return m
+	case []interface{}:
+		for i, item := range v {
+			v[i] = NormalizeYAML(item)
+		}
+		return v
+	case int:
+		return int64(v)
+	}
+	return val
+}
@@ -0,0 +1,36 @@
+package textblock
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDedent(t *testing.T) {
+	tests := []struct {
+		name, input, want string
+	}{
+		{"common indent", "\n    a: 1\n    b:\n      c: 2\n  ", "\na: 1\nb:\n  c: 2\n"},
+		{"first line kept", "x\n    a\n    b", "x\na\nb"},
+		{"no indent", "a\nb", "a\nb"},
+		{"blank lines ignored", "\n  a\n\n  b", "\na\n\nb"},
+	}
+	for _, tt := range tests {
+		if got := Dedent(tt.input); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestNormalizeYAML(t *testing.T) {
+	input := map[interface{}]interface{}{
+		"a": 1,
+		2:   []interface{}{3, map[interface{}]interface{}{"b": true}},
+	}
+	want := map[string]interface{}{
+		"a": int64(1),
+		"2": []interface{}{int64(3), map[string]interface{}{"b": true}},
+	}
+	if got := NormalizeYAML(input); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -3,8 +3,10 @@ package lexer
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf16"
 )
 
 // TokenType represents the type of token
@@ -39,6 +41,7 @@ const (
 	OPTIONS
 	HEADERS
 	BODY
+	QUERY
 	TIMEOUT
 	TRUE
 	FALSE
@@ -49,11 +52,21 @@ const (
 	OR
 	NOT
 	ECHO
+	CAPTURE
+	WHILE
+	BREAK
+	CONTINUE
+	SLEEP
+	DEF
+	GRAPHQL
+	WS
+	METHOD
 
 	// Symbols
 	AT          // @
 	DOLLAR      // $
 	DOT         // .
+	RANGE       // .. (numeric range)
 	COMMA       // ,
 	UNDERSCORE  // _ (as null)
 	EMPTY_ARRAY // []
@@ -62,6 +75,13 @@ const (
 	COMMENT     // # comment
 	QUESTION    // ? (for conditional)
 	COLON       // : (for else)
+	LBRACE      // { (inline object)
+	RBRACE      // } (inline object)
+	ASSIGN      // = (inline object key/value separator)
+	LBRACKET    // [ (computed key)
+	RBRACKET    // ] (computed key)
+	LPAREN      // ( (function call)
+	RPAREN      // ) (function call)
 	
 	// Comparison operators
 	EQ    // ==
@@ -73,6 +93,12 @@ const (
 
 	// String concatenation
 	PLUS  // +
+
+	// Default value
+	NULLISH // ??
+
+	// Field rename in call arguments
+	ARROW // ->
 )
 
 var tokenNames = map[TokenType]string{
@@ -99,6 +125,7 @@ var tokenNames = map[TokenType]string{
 	OPTIONS:     "OPTIONS",
 	HEADERS:     "HEADERS",
 	BODY:        "BODY",
+	QUERY:       "QUERY",
 	TIMEOUT:     "TIMEOUT",
 	TRUE:        "TRUE",
 	FALSE:       "FALSE",
@@ -109,9 +136,19 @@ var tokenNames = map[TokenType]string{
 	OR:          "OR",
 	NOT:         "NOT",
 	ECHO:        "ECHO",
+	CAPTURE:     "CAPTURE",
+	WHILE:       "WHILE",
+	BREAK:       "BREAK",
+	CONTINUE:    "CONTINUE",
+	SLEEP:       "SLEEP",
+	DEF:         "DEF",
+	GRAPHQL:     "GRAPHQL",
+	WS:          "WS",
+	METHOD:      "METHOD",
 	AT:          "AT",
 	DOLLAR:      "DOLLAR",
 	DOT:         "DOT",
+	RANGE:       "RANGE",
 	COMMA:       "COMMA",
 	UNDERSCORE:  "UNDERSCORE",
 	EMPTY_ARRAY: "EMPTY_ARRAY",
@@ -120,6 +157,13 @@ var tokenNames = map[TokenType]string{
 	COMMENT:     "COMMENT",
 	QUESTION:    "QUESTION",
 	COLON:       "COLON",
+	LBRACE:      "LBRACE",
+	RBRACE:      "RBRACE",
+	ASSIGN:      "ASSIGN",
+	LBRACKET:    "LBRACKET",
+	RBRACKET:    "RBRACKET",
+	LPAREN:      "LPAREN",
+	RPAREN:      "RPAREN",
 	EQ:          "EQ",
 	NE:          "NE",
 	GT:          "GT",
@@ -127,6 +171,8 @@ var tokenNames = map[TokenType]string{
 	GTE:         "GTE",
 	LTE:         "LTE",
 	PLUS:        "PLUS",
+	NULLISH:     "NULLISH",
+	ARROW:       "ARROW",
 }
 
 func (t TokenType) String() string {
@@ -159,6 +205,7 @@ type Lexer struct {
 	indentStack  []int // stack of indentation levels
 	pendingTokens []Token // tokens to emit (for DEDENT)
 	atLineStart  bool
+	braceDepth   int // nesting depth of inline objects; newlines are ignored inside
 }
 
 // New creates a new Lexer
@@ -213,6 +260,17 @@ func (l *Lexer) NextToken() Token {
 
 	l.skipSpaces() // skip spaces (but not newlines)
 
+	// Inside an inline object, line breaks and indentation are insignificant
+	if l.braceDepth > 0 {
+		for l.ch == '\n' || l.ch == '\r' || l.ch == ' ' || l.ch == '\t' {
+			if l.ch == '\n' {
+				l.line++
+				l.column = 0
+			}
+			l.readChar()
+		}
+	}
+
 	var tok Token
 	tok.Line = l.line
 	tok.Column = l.column
@@ -234,7 +292,7 @@ func (l *Lexer) NextToken() Token {
 		tok.Literal = "\n"
 		l.readChar()
 		l.line++
-		l.column = 0
+		l.column = 1 // the first character of the next line is already read
 		l.atLineStart = true
 
 	case '\r':
@@ -244,13 +302,13 @@ func (l *Lexer) NextToken() Token {
 			tok.Literal = "\n"
 			l.readChar()
 			l.line++
-			l.column = 0
+			l.column = 1
 			l.atLineStart = true
 		} else {
 			tok.Type = NEWLINE
 			tok.Literal = "\n"
 			l.line++
-			l.column = 0
+			l.column = 1
 			l.atLineStart = true
 		}
 
@@ -269,9 +327,16 @@ func (l *Lexer) NextToken() Token {
 		l.readChar()
 
 	case '.':
-		tok.Type = DOT
-		tok.Literal = "."
-		l.readChar()
+		if l.peekChar() == '.' {
+			l.readChar()
+			tok.Type = RANGE
+			tok.Literal = ".."
+			l.readChar()
+		} else {
+			tok.Type = DOT
+			tok.Literal = "."
+			l.readChar()
+		}
 
 	case ',':
 		tok.Type = COMMA
@@ -279,9 +344,16 @@ func (l *Lexer) NextToken() Token {
 		l.readChar()
 
 	case '?':
-		tok.Type = QUESTION
-		tok.Literal = "?"
-		l.readChar()
+		if l.peekChar() == '?' {
+			l.readChar()
+			tok.Type = NULLISH
+			tok.Literal = "??"
+			l.readChar()
+		} else {
+			tok.Type = QUESTION
+			tok.Literal = "?"
+			l.readChar()
+		}
 
 	case ':':
 		tok.Type = COLON
@@ -295,8 +367,8 @@ func (l *Lexer) NextToken() Token {
 			tok.Literal = "=="
 			l.readChar()
 		} else {
-			tok.Type = ILLEGAL
-			tok.Literal = string(l.ch)
+			tok.Type = ASSIGN
+			tok.Literal = "="
 			l.readChar()
 		}
 
@@ -343,7 +415,11 @@ func (l *Lexer) NextToken() Token {
 
 	case '"':
 		tok.Type = STRING
-		tok.Literal = l.readString()
+		if strings.HasPrefix(l.input[l.pos:], `"""`) {
+			tok.Literal = l.readRawString()
+		} else {
+			tok.Literal = l.readString()
+		}
 
 	case '[':
 		if l.peekChar() == ']' {
@@ -352,11 +428,26 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			l.readChar()
 		} else {
-			tok.Type = ILLEGAL
-			tok.Literal = string(l.ch)
+			tok.Type = LBRACKET
+			tok.Literal = "["
 			l.readChar()
 		}
 
+	case ']':
+		tok.Type = RBRACKET
+		tok.Literal = "]"
+		l.readChar()
+
+	case '(':
+		tok.Type = LPAREN
+		tok.Literal = "("
+		l.readChar()
+
+	case ')':
+		tok.Type = RPAREN
+		tok.Literal = ")"
+		l.readChar()
+
 	case '{':
 		if l.peekChar() == '}' {
 			tok.Type = EMPTY_OBJ
@@ -364,11 +455,20 @@ func (l *Lexer) NextToken() Token {
 			l.readChar()
 			l.readChar()
 		} else {
-			tok.Type = ILLEGAL
-			tok.Literal = string(l.ch)
+			tok.Type = LBRACE
+			tok.Literal = "{"
+			l.braceDepth++
 			l.readChar()
 		}
 
+	case '}':
+		tok.Type = RBRACE
+		tok.Literal = "}"
+		if l.braceDepth > 0 {
+			l.braceDepth--
+		}
+		l.readChar()
+
 	case '-':
 		if l.peekChar() == '-' {
 			start := l.pos
@@ -384,6 +484,11 @@ func (l *Lexer) NextToken() Token {
 				tok.Literal = l.input[start:l.pos]
 				l.readChar()
 			}
+		} else if l.peekChar() == '>' {
+			l.readChar()
+			tok.Type = ARROW
+			tok.Literal = "->"
+			l.readChar()
 		} else if isDigit(l.peekChar()) {
 			// Negative number
 			tok.Literal = l.readNumber()
@@ -449,7 +554,7 @@ func (l *Lexer) handleIndentation() Token {
 				l.readChar()
 			}
 			l.line++
-			l.column = 0
+			l.column = 1
 			continue
 		}
 
@@ -462,7 +567,7 @@ func (l *Lexer) handleIndentation() Token {
 					l.readChar()
 				}
 				l.line++
-				l.column = 0
+				l.column = 1
 				continue
 			}
 			continue
@@ -531,6 +636,107 @@ func (l *Lexer) readString() string {
 	if l.ch == '"' {
 		l.readChar() // skip closing quote
 	}
+	return Unescape(str)
+}
+
+// Unescape decodes the escape sequences of a quoted string: \n, \t, \r, \f,
+// \", \\, \/ and \uXXXX (UTF-16 surrogate pairs are combined). Unknown
+// escapes such as \d are kept as written, so regular expressions and Windows
+// paths without escapable letters pass through unchanged. \b is kept too: in
+// a regular expression it is a word boundary, not a backspace.
+func Unescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			sb.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'n':
+			sb.WriteByte('\n')
+		case 't':
+			sb.WriteByte('\t')
+		case 'r':
+			sb.WriteByte('\r')
+		case 'f':
+			sb.WriteByte('\f')
+		case '"', '\\', '/':
+			sb.WriteByte(c)
+		case 'u':
+			r, n := readUnicodeEscape(s[i+1:])
+			if n == 0 {
+				sb.WriteString("\\u")
+				continue
+			}
+			sb.WriteRune(r)
+			i += n
+		default:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// readUnicodeEscape decodes the XXXX after \u, plus a following \uXXXX low
+// surrogate if the first one is a high surrogate. It returns the rune and the
+// number of bytes consumed, or 0 if s does not start with four hex digits.
+func readUnicodeEscape(s string) (rune, int) {
+	if len(s) < 4 {
+		return 0, 0
+	}
+	v, err := strconv.ParseUint(s[:4], 16, 16)
+	if err != nil {
+		return 0, 0
+	}
+	r := rune(v)
+	if utf16.IsSurrogate(r) && len(s) >= 10 && s[4:6] == "\\u" {
+		if low, err := strconv.ParseUint(s[6:10], 16, 16); err == nil {
+			if pair := utf16.DecodeRune(r, rune(low)); pair != unicode.ReplacementChar {
+				return pair, 10
+			}
+		}
+	}
+	if utf16.IsSurrogate(r) {
+		r = unicode.ReplacementChar
+	}
+	return r, 4
+}
+
+// readRawString reads a triple-quoted string verbatim up to the closing """.
+// Newlines and indentation are kept and escapes are not decoded; only a line
+// break right after the opening """ is dropped, so the content can start on
+// its own line.
+func (l *Lexer) readRawString() string {
+	for i := 0; i < 3; i++ {
+		l.readChar() // skip opening """
+	}
+	if l.ch == '\r' && l.peekChar() == '\n' {
+		l.readChar()
+	}
+	if l.ch == '\n' {
+		l.readChar()
+		l.line++
+		l.column = 1
+	}
+	start := l.pos
+	for l.ch != 0 && !strings.HasPrefix(l.input[l.pos:], `"""`) {
+		if l.ch == '\n' {
+			l.line++
+			l.column = 0
+		}
+		l.readChar()
+	}
+	str := l.input[start:l.pos]
+	if l.ch != 0 {
+		for i := 0; i < 3; i++ {
+			l.readChar() // skip closing """
+		}
+	}
 	return str
 }
 
@@ -566,7 +772,8 @@ func (l *Lexer) readNumber() string {
 
 func (l *Lexer) readIdentifier() string {
 	start := l.pos
-	for isIdentChar(l.ch) {
+	// A dash followed by > starts an arrow (name->new_name), not part of the name
+	for isIdentChar(l.ch) && !(l.ch == '-' && l.peekChar() == '>') {
 		l.readChar()
 	}
 	return l.input[start:l.pos]
@@ -598,6 +805,7 @@ var keywords = map[string]TokenType{
 	"options":  OPTIONS,
 	"headers":  HEADERS,
 	"body":     BODY,
+	"query":    QUERY,
 	"timeout":  TIMEOUT,
 	"true":     TRUE,
 	"false":    FALSE,
@@ -610,6 +818,15 @@ var keywords = map[string]TokenType{
 	"or":       OR,
 	"not":      NOT,
 	"echo":     ECHO,
+	"capture":  CAPTURE,
+	"while":    WHILE,
+	"break":    BREAK,
+	"continue": CONTINUE,
+	"sleep":    SLEEP,
+	"def":      DEF,
+	"graphql":  GRAPHQL,
+	"ws":       WS,
+	"method":   METHOD,
 }
 
 func lookupKeyword(ident string) TokenType {
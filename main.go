@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/LingHeChen/haiku/ast"
 	"github.com/LingHeChen/haiku/eval"
+	"github.com/LingHeChen/haiku/importer"
 	"github.com/LingHeChen/haiku/parser"
 	"github.com/LingHeChen/haiku/request"
 )
@@ -18,10 +30,55 @@ const version = "0.1.0"
 
 // 输出选项
 var (
-	outputFile  string // -o file.json
-	quietMode   bool   // -q / --quiet
-	bodyOnly    bool   // --body-only
-	verboseMode bool   // --verbose
+	outputFile   string // -o file.json
+	outputDir    string // --output-dir DIR，每个响应保存为单独的文件
+	outputFormat string // --format json|raw|headers|status，为空时使用默认的彩色输出
+	verboseMode  bool   // --verbose
+	traceMode    bool   // --trace
+	streamMode   bool   // --stream
+
+	maxResponseSize int64 // --max-response-size 10MB
+	noCookies       bool  // --no-cookies
+	noFollow        bool  // --no-follow
+	maxRedirects    = -1  // --max-redirects，-1 表示使用默认策略（最多 10 次）
+	profileMode     bool  // --profile
+	prettySave      bool  // --pretty-save
+	curlMode        bool  // --curl
+	insecureMode    bool  // -k / --insecure
+	useNetrc        bool  // --netrc
+	continueOnError bool  // --continue-on-error
+	failOnStatus    bool  // --fail
+	strictMode      bool  // --strict
+
+	defaultTimeout time.Duration // --timeout，优先于文件中的 @timeout，请求级 timeout 优先于它
+
+	harFile    string // --har out.har
+	jsonOutput string // --json-output report.json
+
+	jsonReport *runReport // --json-output 时记录每个请求的结果，fatal 退出时也会写入
+
+	cacheDir string            // --cache DIR，缓存 GET/HEAD 响应
+	cacheTTL = 5 * time.Minute // --cache-ttl，响应没有 Cache-Control 或 Expires 时的缓存时长
+	noCache  bool              // --no-cache，忽略 --cache
+
+	proxyURL     string // --proxy，为空时使用 HTTP_PROXY 等环境变量
+	httpProtocol string // --http1.1 / --http2，为空时自动协商
+
+	envFiles    []string // --env-file path（可重复）
+	envOverride bool     // --env-file-override
+
+	dryRun       bool   // --dry-run
+	dryRunStatus = 200  // --dry-run-status，模拟响应的状态码
+	dryRunBody   = "{}" // --dry-run-body，模拟响应的 body（作为 $_ 使用）
+
+	setVars = map[string]string{} // --set key=value（可重复），覆盖文件中的同名 @var
+
+	// 脚本的名称，用于错误位置（file:line:col）：文件路径，haiku - 为 <stdin>，-e 为 <inline>
+	scriptName string
+	scriptFile string // 从文件执行时的脚本路径，用于检测循环 import
+
+	// stdin`` 读取的输入；脚本本身从 stdin 读取（haiku -）时为 nil，stdin`` 报错
+	bodyStdin io.Reader = os.Stdin
 )
 
 // 输出长度限制
@@ -32,15 +89,65 @@ const usage = `haiku - 人类友好的 HTTP 客户端
 用法:
   haiku <file.haiku>          执行请求文件
   haiku -p <file.haiku>       只解析，显示 JSON（不发请求）
+  haiku --curl <file.haiku>   输出等价的 curl 命令（不发请求）
+  haiku --dry-run <file.haiku>
+                              按实际执行流程输出每个请求（不发请求，$_ 为模拟响应）
   haiku -                     从 stdin 读取
   haiku -e '<request>'        执行内联请求
+  haiku -i, --repl            交互模式（逐条输入并执行，保留变量和 $_）
+  haiku import openapi <spec> 根据 OpenAPI 3 规范（YAML/JSON，- 为 stdin）生成 .haiku
   haiku -h                    显示帮助
 
 选项:
-  -o <file>      保存响应到文件
-  -q, --quiet    静默模式，只显示状态码和耗时
-  --body-only    只输出 body（方便管道处理）
+  -o <file>      保存响应到文件（原样保存响应体）
+  --output-dir <dir>
+                 每个响应保存为 dir 中的单独文件（按方法和 URL 路径命名，如 get-users-1.json）
+  --pretty-save  保存时格式化 JSON
+  --format <fmt> 输出格式: json（状态码、响应头和 body 的 JSON 对象，每行一个）、
+                 raw（原样输出 body）、headers（只输出响应头）、status（只输出状态行）
+  -q, --quiet    静默模式，只显示状态码和耗时（等同 --format status）
+  --body-only    只输出 body，方便管道处理（等同 --format raw）
   --verbose      详细模式，显示请求信息（METHOD URL, Headers, Body）
+  --trace        将实际发出的原始请求（包括自动添加的请求头）和收到的原始响应输出到 stderr
+  --stream       逐行输出响应体（SSE、NDJSON 等流式接口），状态行输出到 stderr
+  --no-color     不输出颜色（输出不是终端或设置了 NO_COLOR 时自动关闭）
+  --json         以 JSON 格式输出响应（等同 --format json，二进制 body 使用 base64）
+  --max-response-size <size>
+                 限制读取的响应体大小（如 512KB、10MB），超出部分截断
+  --no-cookies   不在请求之间保存和发送 cookie
+  --proxy <url>  所有请求通过代理发送（http、https、socks5），默认使用 HTTP_PROXY/HTTPS_PROXY
+  --no-follow    不跟随重定向，直接输出 3xx 响应（包括 Location 头）
+  --max-redirects <n>
+                 最多跟随 n 次重定向（默认 10），超出时请求失败
+  -k, --insecure 跳过 TLS 证书校验（自签名证书）
+  --http1.1      只使用 HTTP/1.1（默认在 TLS 上协商 HTTP/2）
+  --http2        只使用 HTTP/2，明文的 http:// 使用 h2c
+  --netrc        使用 ~/.netrc（或 $NETRC）中与 host 匹配的凭据作为 basic auth
+  --continue-on-error
+                 请求失败（连接错误、超时等）时继续执行，最后按类型汇总失败的请求
+  --fail         有响应状态码 >= 400 时以状态码 1 退出（与断言或请求失败相同）
+  --strict       未知的处理器（如拼错的 jsom）报错退出，默认只输出警告并使用原始字符串
+  --timeout <duration>
+                 所有请求的默认超时（如 10s、500ms），优先于 @timeout，请求级 timeout 优先于它
+  --profile      运行结束后输出请求耗时直方图
+  --har <file>   将所有请求和响应导出为 HAR 文件
+  --json-output <file>
+                 运行结束后将每个请求的方法、URL、状态码、耗时、断言结果和错误以及并行循环统计写入 JSON 文件
+  --cache <dir>  将 GET/HEAD 的 2xx 响应缓存到 dir，有效期内重复运行时直接使用缓存，不发送请求
+                 （有效期按 Cache-Control max-age 或 Expires，都没有时按 --cache-ttl）
+  --cache-ttl <duration>
+                 响应没有 Cache-Control 或 Expires 时的缓存时长（默认 5m）
+  --no-cache     不使用缓存（忽略 --cache）
+  --set <key=value>
+                 定义变量（可重复），优先于文件中的同名 @var
+  --dry-run-status <code>
+                 --dry-run 模拟响应的状态码（默认 200）
+  --dry-run-body <json>
+                 --dry-run 模拟响应的 body（默认 {}）
+  --env-file <file>
+                 从 .env 文件加载环境变量（可重复），不覆盖已有的环境变量
+  --env-file-override
+                 --env-file 中的值覆盖已有的环境变量
 
 示例:
   # 执行文件
@@ -83,6 +190,7 @@ const usage = `haiku - 人类友好的 HTTP 客户端
 
 func main() {
 	args := os.Args[1:]
+	initColors(false)
 
 	if len(args) == 0 {
 		fmt.Print(usage)
@@ -92,6 +200,12 @@ func main() {
 	var input string
 	var basePath string // 用于解析相对 import 路径
 	parseOnly := false
+	interactive := false
+
+	if args[0] == "import" {
+		runImport(args[1:])
+		return
+	}
 
 	// 处理 flags
 	i := 0
@@ -109,18 +223,224 @@ func main() {
 			parseOnly = true
 			i++
 
+		case "-i", "--interactive", "--repl":
+			interactive = true
+			i++
+
 		case "-q", "--quiet":
-			quietMode = true
+			outputFormat = "status"
 			i++
 
 		case "--body-only":
-			bodyOnly = true
+			outputFormat = "raw"
 			i++
 
+		case "--format":
+			if i+1 >= len(args) {
+				fatal("错误: --format 需要格式参数（json、raw、headers、status）")
+			}
+			if _, ok := responseRenderers[args[i+1]]; !ok {
+				fatal("错误: 未知的输出格式 %q（可选 json、raw、headers、status）", args[i+1])
+			}
+			outputFormat = args[i+1]
+			i += 2
+
 		case "--verbose":
 			verboseMode = true
 			i++
 
+		case "--trace":
+			traceMode = true
+			i++
+
+		case "--no-color":
+			initColors(true)
+			i++
+
+		case "--stream":
+			streamMode = true
+			i++
+
+		case "--json":
+			outputFormat = "json"
+			i++
+
+		case "--curl":
+			curlMode = true
+			i++
+
+		case "--dry-run":
+			dryRun = true
+			i++
+
+		case "--dry-run-status":
+			if i+1 >= len(args) {
+				fatal("错误: --dry-run-status 需要状态码参数")
+			}
+			code, err := strconv.Atoi(args[i+1])
+			if err != nil || code < 100 || code > 999 {
+				fatal("错误: 无效的状态码: %q", args[i+1])
+			}
+			dryRun = true
+			dryRunStatus = code
+			i += 2
+
+		case "--dry-run-body":
+			if i+1 >= len(args) {
+				fatal("错误: --dry-run-body 需要 JSON 参数")
+			}
+			if !json.Valid([]byte(args[i+1])) {
+				fatal("错误: --dry-run-body 不是合法的 JSON: %s", args[i+1])
+			}
+			dryRun = true
+			dryRunBody = args[i+1]
+			i += 2
+
+		case "--pretty-save":
+			prettySave = true
+			i++
+
+		case "--profile":
+			profileMode = true
+			i++
+
+		case "--netrc":
+			useNetrc = true
+			i++
+
+		case "-k", "--insecure":
+			insecureMode = true
+			i++
+
+		case "--http1.1":
+			httpProtocol = request.ProtocolHTTP1
+			i++
+
+		case "--http2":
+			httpProtocol = request.ProtocolHTTP2
+			i++
+
+		case "--no-cookies":
+			noCookies = true
+			i++
+
+		case "--proxy":
+			if i+1 >= len(args) {
+				fatal("错误: --proxy 需要代理 URL 参数")
+			}
+			if _, err := request.ParseProxyURL(args[i+1]); err != nil {
+				fatal("错误: %v", err)
+			}
+			proxyURL = args[i+1]
+			i += 2
+
+		case "--no-follow":
+			noFollow = true
+			i++
+
+		case "--continue-on-error":
+			continueOnError = true
+			i++
+
+		case "--fail":
+			failOnStatus = true
+			i++
+
+		case "--strict":
+			strictMode = true
+			i++
+
+		case "--timeout":
+			if i+1 >= len(args) {
+				fatal("错误: --timeout 需要时长参数（如 10s、500ms）")
+			}
+			d, err := eval.ParseTimeout(args[i+1])
+			if err != nil || d <= 0 {
+				fatal("错误: 无效的超时时间: %q", args[i+1])
+			}
+			defaultTimeout = d
+			i += 2
+
+		case "--max-redirects":
+			if i+1 >= len(args) {
+				fatal("错误: --max-redirects 需要次数参数")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				fatal("错误: 无效的重定向次数: %q", args[i+1])
+			}
+			maxRedirects = n
+			i += 2
+
+		case "--max-response-size":
+			if i+1 >= len(args) {
+				fatal("错误: --max-response-size 需要大小参数")
+			}
+			size, err := parseSize(args[i+1])
+			if err != nil {
+				fatal("错误: %v", err)
+			}
+			maxResponseSize = size
+			i += 2
+
+		case "--set":
+			if i+1 >= len(args) {
+				fatal("错误: --set 需要 key=value 参数")
+			}
+			key, value, ok := strings.Cut(args[i+1], "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				fatal("错误: --set 参数格式应为 key=value: %q", args[i+1])
+			}
+			setVars[strings.TrimSpace(key)] = value
+			i += 2
+
+		case "--env-file":
+			if i+1 >= len(args) {
+				fatal("错误: --env-file 需要文件名参数")
+			}
+			envFiles = append(envFiles, args[i+1])
+			i += 2
+
+		case "--env-file-override":
+			envOverride = true
+			i++
+
+		case "--cache":
+			if i+1 >= len(args) {
+				fatal("错误: --cache 需要目录参数")
+			}
+			cacheDir = args[i+1]
+			i += 2
+
+		case "--cache-ttl":
+			if i+1 >= len(args) {
+				fatal("错误: --cache-ttl 需要时长参数（如 10m、1h）")
+			}
+			d, err := eval.ParseTimeout(args[i+1])
+			if err != nil || d <= 0 {
+				fatal("错误: 无效的缓存时长: %q", args[i+1])
+			}
+			cacheTTL = d
+			i += 2
+
+		case "--no-cache":
+			noCache = true
+			i++
+
+		case "--har":
+			if i+1 >= len(args) {
+				fatal("错误: --har 需要文件名参数")
+			}
+			harFile = args[i+1]
+			i += 2
+
+		case "--json-output":
+			if i+1 >= len(args) {
+				fatal("错误: --json-output 需要文件名参数")
+			}
+			jsonOutput = args[i+1]
+			i += 2
+
 		case "-o":
 			if i+1 >= len(args) {
 				fatal("错误: -o 需要文件名参数")
@@ -128,11 +448,19 @@ func main() {
 			outputFile = args[i+1]
 			i += 2
 
+		case "--output-dir":
+			if i+1 >= len(args) {
+				fatal("错误: --output-dir 需要目录参数")
+			}
+			outputDir = args[i+1]
+			i += 2
+
 		case "-e":
 			if i+1 >= len(args) {
 				fatal("错误: -e 需要参数")
 			}
 			input = args[i+1]
+			scriptName = "<inline>"
 			basePath = "." // 当前目录
 			i += 2
 
@@ -143,7 +471,9 @@ func main() {
 				fatal("读取 stdin 失败: %v", err)
 			}
 			input = string(data)
+			scriptName = "<stdin>"
 			basePath = "." // 当前目录
+			bodyStdin = nil
 			i++
 
 		default:
@@ -154,12 +484,25 @@ func main() {
 				fatal("读取文件失败: %v", err)
 			}
 			input = string(data)
+			scriptName = filename
+			scriptFile = filename
 			// 获取文件所在目录作为 basePath
 			basePath = dirPath(filename)
 			i++
 		}
 	}
 
+	// 在执行前加载 .env 文件，$env.KEY 即可读取
+	if err := loadEnvFiles(envFiles, envOverride); err != nil {
+		fatal("加载 env 文件失败: %v", err)
+	}
+
+	if interactive {
+		// 交互模式：从 stdin 逐条读取语句，相对 import 以当前目录为准
+		runREPL(os.Stdin, os.Stdout, ".")
+		return
+	}
+
 	if input == "" {
 		fatal("错误: 没有输入")
 	}
@@ -167,12 +510,66 @@ func main() {
 	if parseOnly {
 		// 只解析，显示 JSON
 		showParsed(input, basePath)
+	} else if curlMode {
+		// 输出 curl 命令，不发请求
+		showCurl(input, basePath)
 	} else {
 		// 解析并执行
 		execute(input, basePath)
 	}
 }
 
+// runImport 处理 haiku import 子命令，生成的 .haiku 内容输出到 stdout
+func runImport(args []string) {
+	if len(args) != 2 || args[0] != "openapi" {
+		fatal("用法: haiku import openapi <spec.yaml|spec.json>")
+	}
+
+	var data []byte
+	var err error
+	if args[1] == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(args[1])
+	}
+	if err != nil {
+		fatal("读取文件失败: %v", err)
+	}
+
+	out, err := importer.OpenAPI(data)
+	if err != nil {
+		fatal("导入失败: %v", err)
+	}
+	fmt.Print(out)
+}
+
+// parseSize 解析大小参数，支持 B/KB/MB/GB 后缀（1024 进制），无后缀按字节处理
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{
+		{"GB", 1 << 30},
+		{"MB", 1 << 20},
+		{"KB", 1 << 10},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("无效的大小: %q", s)
+	}
+	return n * multiplier, nil
+}
+
 // dirPath 获取文件所在目录
 func dirPath(filePath string) string {
 	lastSlash := strings.LastIndex(filePath, "/")
@@ -191,10 +588,10 @@ func showParsed(input string, basePath string) {
 		fatal("解析错误: %v", err)
 	}
 
-	evaluator := eval.NewEvaluator(eval.WithBasePath(basePath))
+	evaluator := eval.NewEvaluator(eval.WithBasePath(basePath), eval.WithOverrides(setVars), eval.WithDefaultTimeout(defaultTimeout), eval.WithStdin(bodyStdin), eval.WithStrict(strictMode), eval.WithScriptPath(scriptFile))
 	requests, err := evaluator.EvalToRequests(program)
 	if err != nil {
-		fatal("执行错误: %v", err)
+		fatalAt("执行错误", ast.Position{}, err)
 	}
 
 	for i, req := range requests {
@@ -211,6 +608,39 @@ func showParsed(input string, basePath string) {
 	}
 }
 
+// showCurl 将每个请求输出为可直接在 shell 中执行的 curl 命令
+func showCurl(input string, basePath string) {
+	eval.SetImportParser(parser.ParseFile)
+
+	program, err := parser.ParseFile(input)
+	if err != nil {
+		fatal("解析错误: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator(eval.WithBasePath(basePath), eval.WithOverrides(setVars), eval.WithDefaultTimeout(defaultTimeout), eval.WithStdin(bodyStdin), eval.WithStrict(strictMode), eval.WithScriptPath(scriptFile))
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		fatalAt("执行错误", ast.Position{}, err)
+	}
+
+	for i, req := range requests {
+		if _, ok := req["insecure"]; !ok && insecureMode {
+			req["insecure"] = true
+		}
+		if _, ok := req["proxy"]; !ok && proxyURL != "" {
+			req["proxy"] = proxyURL
+		}
+		cmd, err := request.ToCurl(req)
+		if err != nil {
+			fatal("请求错误: %v", err)
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Println(cmd)
+	}
+}
+
 func execute(input string, basePath string) {
 	// 使用 v2 AST 架构
 	eval.SetImportParser(parser.ParseFile)
@@ -220,12 +650,39 @@ func execute(input string, basePath string) {
 		fatal("解析错误: %v", err)
 	}
 
+	client := newClient()
+	simulate := dryRunCallback(os.Stdout) // --dry-run 时代替真实请求
+
+	// --continue-on-error：失败的请求按类型记录，执行继续
+	var errorKind func(error) string
+	if continueOnError {
+		errorKind = requestErrorKind
+	}
+
+	// --output-dir：目录不存在时创建
+	var namer *outputNamer
+	if outputDir != "" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			fatal("创建输出目录失败: %v", err)
+		}
+		namer = newOutputNamer()
+	}
+	if jsonOutput != "" {
+		jsonReport = newRunReport()
+	}
+
 	var lastResp *request.Response
 	requestCount := 0
+	histogram := newLatencyHistogram()
+	var resultMu sync.Mutex // 保护 requestCount、lastResp、assertFailures、harEntries 和 httpErrors
+	var assertFailures []string // 失败的 assert 断言（并行请求时可能并发追加）
+	var httpErrors statusErrors // --fail：状态码 >= 400 的响应
+	var harEntries []request.HAREntry // --har 导出的请求记录
 	var isParallelRequest bool // 标记当前请求是否来自并行循环
 	
 	// 使用 channel 进行输出，避免锁阻塞
 	type outputMsg struct {
+		line           []byte // --stream 时流式输出的一行响应体
 		resp           *request.Response
 		req            map[string]interface{}
 		duration       time.Duration
@@ -239,11 +696,16 @@ func execute(input string, basePath string) {
 	go func() {
 		defer close(outputDone)
 		for msg := range outputChan {
-			if !quietMode && !bodyOnly {
-				printResponse(msg.resp, msg.duration, msg.req, msg.isParallel)
-				if msg.requestNumber > 1 {
-					fmt.Println()
-				}
+			if msg.line != nil {
+				os.Stdout.Write(append(msg.line, '\n'))
+				continue
+			}
+			printResponse(msg.resp, msg.duration, msg.req, msg.isParallel)
+			if namer != nil {
+				saveToDir(namer, msg.resp, msg.req, msg.requestNumber)
+			}
+			if outputFormat == "" && !streamMode && msg.requestNumber > 1 {
+				fmt.Println()
 			}
 		}
 	}()
@@ -251,67 +713,121 @@ func execute(input string, basePath string) {
 	// 创建 evaluator，带请求回调用于实时执行和输出
 	evaluator := eval.NewEvaluator(
 		eval.WithBasePath(basePath),
-		eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		eval.WithOverrides(setVars),
+		eval.WithDefaultTimeout(defaultTimeout),
+		eval.WithStdin(bodyStdin),
+		eval.WithStrict(strictMode),
+		eval.WithScriptPath(scriptFile),
+		eval.WithContinueOnError(errorKind),
+		eval.WithRequestExecutor(func(req map[string]interface{}) (eval.RequestResult, error) {
+			if dryRun {
+				ref, err := simulate(req)
+				return eval.RequestResult{Response: ref}, err
+			}
+			// 并行循环中回调会被并发调用，序号（--output-dir 的文件名）在锁内分配，保证不重复
+			resultMu.Lock()
 			requestCount++
+			number := requestCount
+			resultMu.Unlock()
 			start := time.Now()
 			
-			// 执行请求
-			resp, err := request.Do(req)
+			// 执行请求（--stream 时每行响应体、ws 请求每条消息到达后立即输出，阻塞发送以保证顺序）
+			var onLine func(line []byte)
+			if streamMode || req["ws"] != nil {
+				onLine = func(line []byte) {
+					outputChan <- outputMsg{line: line}
+				}
+			}
+			resp, err := sendRequest(client, req, onLine)
 			if err != nil {
-				return nil, err
+				if jsonReport != nil {
+					jsonReport.add(req, nil, time.Since(start), isParallelRequest, nil, err)
+				}
+				if continueOnError {
+					fmt.Fprintf(os.Stderr, "%s请求错误: %v%s\n", errColor(ansiRed), err, errColor(ansiReset))
+				}
+				return eval.RequestResult{}, err
+			}
+			histogram.add(resp.Duration)
+			ref := responseRef(resp)
+			if failOnStatus && resp.StatusCode >= 400 {
+				resultMu.Lock()
+				httpErrors.add(resp.StatusCode)
+				resultMu.Unlock()
+			}
+			
+			// 检查 assert 断言，失败信息在最后统一输出
+			// 按 validate 的 JSON Schema 校验响应体，每个不符合的路径算一条断言失败
+			failures := eval.CheckAssertions(req["assert"], ref, resp.Duration)
+			failures = append(failures, eval.CheckSchema(req["validate"], ref)...)
+			if len(failures) > 0 {
+				resultMu.Lock()
+				assertFailures = append(assertFailures, failures...)
+				resultMu.Unlock()
+			}
+			if jsonReport != nil {
+				jsonReport.add(req, resp, resp.Duration, isParallelRequest, failures, nil)
+			}
+			if harFile != "" && req["ws"] == nil {
+				resultMu.Lock()
+				harEntries = append(harEntries, request.HAREntry{Request: req, Response: resp, StartedAt: start})
+				resultMu.Unlock()
 			}
 			
-			// 通过 channel 发送输出消息，非阻塞
-			select {
-			case outputChan <- outputMsg{
+			// 通过 channel 发送输出消息，输出和 --output-dir 的保存都只在输出 goroutine 中进行；
+			// channel 满时等待输出 goroutine 取走，不在这里直接输出，避免与其并发写入
+			outputChan <- outputMsg{
 				resp:          resp,
 				req:           req,
 				duration:      time.Since(start),
 				isParallel:    isParallelRequest,
-				requestNumber: requestCount,
-			}:
-			default:
-				// Channel 满了，直接输出（不应该发生，但作为 fallback）
-				if !quietMode && !bodyOnly {
-					printResponse(resp, time.Since(start), req, isParallelRequest)
-				}
+				requestNumber: number,
 			}
 			
+			resultMu.Lock()
 			lastResp = resp
+			resultMu.Unlock()
 			
-			// 返回响应体作为下一个请求的 $_ 引用
-			if jsonData, err := resp.JSON(); err == nil {
-				return jsonData, nil
-			}
-			return map[string]interface{}{"body": resp.String()}, nil
+			// 返回状态码、响应头和响应体作为下一个请求的 $_ 引用
+			// 原始响应体字节数（解压后、格式化前）计入并行统计的 total_bytes
+			return eval.RequestResult{Response: ref, Bytes: int64(len(resp.Body))}, nil
 		}),
 	)
 	
+	if jsonReport != nil {
+		jsonReport.parallelStats = evaluator.GetAllParallelStats
+	}
+
 	// 按语句顺序执行
+statements:
 	for _, stmt := range program.Statements {
 		switch s := stmt.(type) {
+		case *ast.SkipStmt:
+			skip, err := evaluator.EvalSkip(s)
+			if err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+			if skip {
+				break statements
+			}
 		case *ast.ImportStmt:
 			if err := evaluator.EvalImport(s); err != nil {
-				fatal("执行错误: %v", err)
+				fatalAt("执行错误", s.Pos(), err)
 			}
 		case *ast.VarDefStmt:
 			if err := evaluator.EvalVarDef(s); err != nil {
-				fatal("执行错误: %v", err)
+				fatalAt("执行错误", s.Pos(), err)
 			}
 		case *ast.RequestStmt:
 			// 普通请求：立即执行（已在回调中输出）
 			req, err := evaluator.EvalRequest(s)
 			if err != nil {
-				fatal("请求错误: %v", err)
+				fatalAt("请求错误", s.Pos(), err)
 			}
-			if req != nil && evaluator.GetRequestCallback() != nil {
-				resp, err := evaluator.GetRequestCallback()(req)
-				if err != nil {
-					fatal("请求错误: %v", err)
-				}
-				// Update prevResponse for chaining
-				if resp != nil {
-					evaluator.SetPrevResponse(resp)
+			if req != nil {
+				// 执行请求并更新 $_（设置了 @delay 时会在请求之间等待）
+				if err := evaluator.ExecuteRequest(req); err != nil {
+					fatalAt("请求错误", s.Pos(), err)
 				}
 			}
 		case *ast.ForStmt:
@@ -319,24 +835,63 @@ func execute(input string, basePath string) {
 				// 并行循环：并发执行，每个请求完成后实时输出
 				isParallelRequest = true
 				if err := evaluator.EvalParallelForWithOutput(s); err != nil {
-					fatal("执行错误: %v", err)
+					fatalAt("执行错误", s.Pos(), err)
 				}
 				isParallelRequest = false
 			} else {
 				// 普通循环：顺序执行（已在回调中输出）
 				isParallelRequest = false
 				if err := evaluator.EvalForCollect(s); err != nil {
-					fatal("执行错误: %v", err)
+					fatalAt("执行错误", s.Pos(), err)
 				}
 			}
 		case *ast.IfStmt:
 			if err := evaluator.EvalIf(s); err != nil {
-				fatal("执行错误: %v", err)
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.WhileStmt:
+			if err := evaluator.EvalWhile(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.MatchStmt:
+			if err := evaluator.EvalMatch(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
 			}
 		case *ast.EchoStmt:
 			if err := evaluator.EvalEcho(s); err != nil {
-				fatal("执行错误: %v", err)
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.CaptureStmt:
+			if err := evaluator.EvalCapture(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
 			}
+		case *ast.SleepStmt:
+			// 在执行语句的 goroutine 中等待，输出 goroutine 继续输出已完成的响应
+			if err := evaluator.EvalSleep(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.FlowDefStmt:
+			if err := evaluator.EvalFlowDef(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.TemplateDefStmt:
+			if err := evaluator.EvalTemplateDef(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.FuncDefStmt:
+			if err := evaluator.EvalFuncDef(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.CallStmt:
+			if err := evaluator.EvalCall(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.RunStmt:
+			if err := evaluator.EvalRun(s); err != nil {
+				fatalAt("执行错误", s.Pos(), err)
+			}
+		case *ast.BreakStmt, *ast.ContinueStmt:
+			fatalAt("执行错误", s.Pos(), errors.New("break/continue 只能在循环中使用"))
 		case *ast.SeparatorStmt:
 			// 分隔符：跳过
 		}
@@ -347,7 +902,7 @@ func execute(input string, basePath string) {
 	<-outputDone
 	
 	// 显示并行执行统计（如果有）
-	if !quietMode && !bodyOnly {
+	if outputFormat == "" {
 		all := evaluator.GetAllParallelStats()
 		if len(all) > 0 {
 			for idx, stats := range all {
@@ -356,10 +911,240 @@ func execute(input string, basePath string) {
 		}
 	}
 
+	// 耗时直方图
+	if profileMode {
+		fmt.Print(histogram.render())
+	}
+
 	// 保存到文件（只保存最后一个响应）
 	if outputFile != "" && lastResp != nil {
 		saveToFile(lastResp)
 	}
+
+	// 导出 HAR
+	if harFile != "" {
+		saveHAR(harEntries)
+	}
+
+	// 有断言失败、请求失败或（--fail 时）HTTP 错误状态码时以红色输出并以非零状态码退出
+	failures := evaluator.RequestFailures()
+	if len(assertFailures) > 0 {
+		printAssertFailures(assertFailures)
+	}
+	if len(failures) > 0 {
+		printRequestFailures(failures)
+	}
+	if httpErrors.count > 0 {
+		printStatusErrors(httpErrors)
+	}
+	code := exitCode(len(assertFailures)+len(failures), httpErrors)
+
+	// 导出 JSON 报告
+	saveReport(code)
+
+	if code != 0 {
+		os.Exit(code)
+	}
+}
+
+// saveReport 在设置了 --json-output 时写入运行报告，只写一次
+func saveReport(code int) {
+	report := jsonReport
+	if report == nil {
+		return
+	}
+	jsonReport = nil // 写入失败时 fatal 不再重复写入
+	if err := report.write(jsonOutput, code); err != nil {
+		fatal("保存 JSON 报告失败: %v", err)
+	}
+}
+
+// statusErrors 记录 --fail 时状态码 >= 400 的响应数量和最差（最大）的状态码
+type statusErrors struct {
+	count int
+	worst int
+}
+
+func (s *statusErrors) add(status int) {
+	s.count++
+	if status > s.worst {
+		s.worst = status
+	}
+}
+
+// exitCode 返回运行结束时的退出码：断言失败、请求失败或（--fail 时）有 HTTP 错误状态码为 1，全部成功为 0
+func exitCode(failed int, httpErrors statusErrors) int {
+	if failed > 0 || httpErrors.count > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printStatusErrors 输出 --fail 记录的 HTTP 错误状态码汇总到 stderr
+func printStatusErrors(s statusErrors) {
+	red, bold, reset := errColor(ansiRed), errColor(ansiBold), errColor(ansiReset)
+	fmt.Fprintf(os.Stderr, "%s%s%d request(s) got an HTTP error status (worst: %d)%s\n", red, bold, s.count, s.worst, reset)
+}
+
+// requestErrorKind 返回 --continue-on-error 汇总时请求错误的类型：
+// connection、timeout、protocol，其余（URL 无效、请求体编码失败等）为 invalid
+func requestErrorKind(err error) string {
+	var reqErr *request.RequestError
+	if errors.As(err, &reqErr) {
+		return string(reqErr.Kind)
+	}
+	return "invalid"
+}
+
+// printRequestFailures 将 --continue-on-error 记录的失败请求按类型汇总输出到 stderr
+func printRequestFailures(groups []eval.ErrorGroup) {
+	red, bold, reset := errColor(ansiRed), errColor(ansiBold), errColor(ansiReset)
+	total := 0
+	for _, g := range groups {
+		total += g.Count
+	}
+	fmt.Fprintf(os.Stderr, "%s%s%d request(s) failed:%s\n", red, bold, total, reset)
+	for _, g := range groups {
+		fmt.Fprintf(os.Stderr, "%s  ✗ %s ×%d: %s%s\n", red, g.Kind, g.Count, g.Message, reset)
+	}
+}
+
+// printAssertFailures 将失败的断言以红色输出到 stderr
+func printAssertFailures(failures []string) {
+	red, bold, reset := errColor(ansiRed), errColor(ansiBold), errColor(ansiReset)
+	fmt.Fprintf(os.Stderr, "%s%s%d assertion(s) failed:%s\n", red, bold, len(failures), reset)
+	for _, f := range failures {
+		fmt.Fprintf(os.Stderr, "%s  ✗ %s%s\n", red, f, reset)
+	}
+}
+
+// dryRunCallback 返回 --dry-run 使用的请求回调：输出解析后的请求而不发送，
+// 以模拟响应作为 $_，使循环、条件和链式请求按实际执行流程展开
+func dryRunCallback(w io.Writer) func(req map[string]interface{}) (map[string]interface{}, error) {
+	var mu sync.Mutex // 并行循环中回调会被并发调用
+	count := 0
+	return func(req map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		count++
+		if count > 1 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "--- Request %d (dry run) ---\n", count)
+		jsonBytes, err := json.MarshalIndent(req, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintln(w, string(jsonBytes))
+
+		return responseRef(&request.Response{
+			StatusCode: dryRunStatus,
+			Status:     fmt.Sprintf("%d %s", dryRunStatus, http.StatusText(dryRunStatus)),
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       []byte(dryRunBody),
+		}), nil
+	}
+}
+
+// sendRequest 执行一个请求：ws 请求连接 WebSocket，每条消息到达时调用 onLine；
+// 其他请求为 HTTP 请求，onLine 不为 nil 时逐行读取响应体
+func sendRequest(client *request.Client, req map[string]interface{}, onLine func(line []byte)) (*request.Response, error) {
+	if _, ok := req["ws"]; ok {
+		return client.DoWebSocket(req, onLine)
+	}
+	return client.DoStream(req, onLine)
+}
+
+// newClient 根据命令行选项创建所有请求共享的 HTTP 客户端
+// 默认启用 cookie jar，使前面响应设置的 cookie 在后续请求中自动发送
+func newClient() *request.Client {
+	opts := []request.Option{
+		request.WithMaxResponseSize(maxResponseSize),
+		request.WithInsecure(insecureMode),
+		request.WithProxy(proxyURL),
+		request.WithProtocol(httpProtocol),
+	}
+	if traceMode {
+		opts = append(opts, request.WithTrace(func(dump []byte, out bool) {
+			fmt.Fprint(os.Stderr, traceText(dump, out))
+		}))
+	}
+	if noFollow {
+		opts = append(opts, request.WithRedirectPolicy(false, 0))
+	} else if maxRedirects >= 0 {
+		opts = append(opts, request.WithRedirectPolicy(true, maxRedirects))
+	}
+	if useNetrc {
+		n, err := request.LoadNetrc(netrcPath())
+		if err != nil {
+			fatal("读取 .netrc 失败: %v", err)
+		}
+		opts = append(opts, request.WithNetrc(n))
+	}
+	if cacheDir != "" && !noCache {
+		cache, err := request.NewCache(cacheDir, cacheTTL)
+		if err != nil {
+			fatal("创建缓存目录失败: %v", err)
+		}
+		opts = append(opts, request.WithCache(cache))
+	}
+	if !noCookies {
+		jar, err := cookiejar.New(nil)
+		if err != nil {
+			fatal("创建 cookie jar 失败: %v", err)
+		}
+		opts = append(opts, request.WithCookieJar(jar))
+	}
+	return request.New(opts...)
+}
+
+// traceText 格式化 --trace 的原始请求（每行前加 "> "）或响应（"< "），
+// body 超过 maxBodyLines 行时截断，非 UTF-8 的 body 只显示字节数
+func traceText(dump []byte, out bool) string {
+	prefix := "< "
+	if out {
+		prefix = "> "
+	}
+	head, body, _ := bytes.Cut(dump, []byte("\r\n\r\n"))
+
+	var sb strings.Builder
+	sb.WriteString(errColor(ansiDim))
+	for _, line := range strings.Split(string(head), "\r\n") {
+		sb.WriteString(prefix + line + "\n")
+	}
+	sb.WriteString(prefix + "\n")
+	switch {
+	case len(body) == 0:
+	case !utf8.Valid(body):
+		fmt.Fprintf(&sb, "%s(%d bytes of binary data)\n", prefix, len(body))
+	default:
+		lines := strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+		more := len(lines) - maxBodyLines
+		if more > 0 {
+			lines = lines[:maxBodyLines]
+		}
+		for _, line := range lines {
+			sb.WriteString(prefix + strings.TrimSuffix(line, "\r") + "\n")
+		}
+		if more > 0 {
+			fmt.Fprintf(&sb, "%s... (%d more lines)\n", prefix, more)
+		}
+	}
+	sb.WriteString(errColor(ansiReset))
+	return sb.String()
+}
+
+// netrcPath 返回 .netrc 路径：优先使用 $NETRC，否则为 ~/.netrc
+func netrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		fatal("读取 .netrc 失败: %v", err)
+	}
+	return filepath.Join(home, ".netrc")
 }
 
 // containsParallelFor 检查程序是否包含 parallel for 语句
@@ -377,12 +1162,12 @@ func containsParallelFor(program *ast.Program) bool {
 // printParallelStats 打印并行执行统计
 func printParallelStats(stats map[string]interface{}, loopIndex int) {
 	// 颜色码
-	reset := "\033[0m"
-	bold := "\033[1m"
-	green := "\033[32m"
-	red := "\033[31m"
-	cyan := "\033[36m"
-	dim := "\033[2m"
+	reset := color(ansiReset)
+	bold := color(ansiBold)
+	green := color(ansiGreen)
+	red := color(ansiRed)
+	cyan := color(ansiCyan)
+	dim := color(ansiDim)
 
 	fmt.Println()
 	fmt.Printf("%s%s═══ Parallel Execution Stats (loop %d) ═══%s\n", bold, cyan, loopIndex, reset)
@@ -401,6 +1186,13 @@ func printParallelStats(stats map[string]interface{}, loopIndex int) {
 	if failed > 0 {
 		fmt.Printf("  Failed:   %s%d%s\n", red, failed, reset)
 	}
+	// --continue-on-error 时按类型列出失败的请求
+	if groups, ok := stats["errors"].([]interface{}); ok {
+		for _, item := range groups {
+			g, _ := item.(map[string]interface{})
+			fmt.Printf("    %s%v ×%v:%s %s%v%s\n", red, g["kind"], g["count"], reset, dim, g["message"], reset)
+		}
+	}
 	
 	if avgTime, ok := stats["avg_time"].(string); ok {
 		fmt.Printf("  Avg Time: %s\n", avgTime)
@@ -411,161 +1203,560 @@ func printParallelStats(stats map[string]interface{}, loopIndex int) {
 	if maxTime, ok := stats["max_time"].(string); ok {
 		fmt.Printf("  Max Time: %s\n", maxTime)
 	}
+	// 百分位耗时（nearest-rank），只统计成功的迭代
+	for _, p := range []string{"p50", "p95", "p99"} {
+		if t, ok := stats[p+"_time"].(string); ok {
+			fmt.Printf("  %s Time: %s\n", strings.ToUpper(p), t)
+		}
+	}
 	
 	// Use wall_time from stats if available, otherwise fallback
 	if wallTime, ok := stats["wall_time"].(string); ok {
 		fmt.Printf("  %sWall Time: %s%s\n", dim, wallTime, reset)
 	}
+	if rate, ok := stats["rate"].(string); ok {
+		fmt.Printf("  %sRate:     %s%s\n", dim, rate, reset)
+	}
+	if n, ok := stats["total_bytes"].(int64); ok {
+		fmt.Printf("  %sBytes:    %s%s\n", dim, formatBytes(n), reset)
+	}
 	
 	fmt.Printf("%s%s══════════════════════════════════%s\n", bold, cyan, reset)
 }
 
+// formatBytes 将字节数格式化为 B/KB/MB/GB（1024 进制，与 parseSize 一致）
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// savedContent 返回要保存的内容：默认为原始响应字节（便于签名/哈希校验），
+// pretty 为 true 时将 JSON 重新格式化（会改变 key 顺序和空白）
+func savedContent(resp *request.Response, pretty bool) []byte {
+	if pretty {
+		var data interface{}
+		if err := json.Unmarshal(resp.Body, &data); err == nil {
+			if formatted, err := json.MarshalIndent(data, "", "  "); err == nil {
+				return formatted
+			}
+		}
+	}
+	return resp.Body
+}
+
+// latencyBuckets 直方图各桶的上界（最后一个桶没有上界）
+var latencyBuckets = []struct {
+	label string
+	upper time.Duration
+}{
+	{"<10ms", 10 * time.Millisecond},
+	{"10-50ms", 50 * time.Millisecond},
+	{"50-100ms", 100 * time.Millisecond},
+	{"100-250ms", 250 * time.Millisecond},
+	{"250-500ms", 500 * time.Millisecond},
+	{"500ms-1s", time.Second},
+	{">=1s", 0},
+}
+
+// latencyHistogram 统计请求耗时分布（并行请求会并发调用 add）
+type latencyHistogram struct {
+	mu     sync.Mutex
+	counts []int
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{counts: make([]int, len(latencyBuckets))}
+}
+
+// add 记录一次请求耗时
+func (h *latencyHistogram) add(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range latencyBuckets {
+		if b.upper == 0 || d < b.upper {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+// render 渲染文本直方图，条形长度按最大桶缩放
+func (h *latencyHistogram) render() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	const barWidth = 40
+	total, peak := 0, 0
+	for _, c := range h.counts {
+		total += c
+		if c > peak {
+			peak = c
+		}
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "\nLatency (%d requests)\n", total)
+	for i, b := range latencyBuckets {
+		bar := 0
+		if peak > 0 {
+			bar = h.counts[i] * barWidth / peak
+			if bar == 0 && h.counts[i] > 0 {
+				bar = 1
+			}
+		}
+		fmt.Fprintf(&sb, "  %-10s %s %d\n", b.label, strings.Repeat("█", bar), h.counts[i])
+	}
+	return sb.String()
+}
+
 // saveToFile 保存响应到文件
 func saveToFile(resp *request.Response) {
-	var content []byte
-	
-	// 尝试格式化 JSON
-	if jsonData, err := resp.JSON(); err == nil {
-		content, _ = json.MarshalIndent(jsonData, "", "  ")
-	} else {
-		content = resp.Body
-	}
-	
+	content := savedContent(resp, prettySave)
+
 	if err := os.WriteFile(outputFile, content, 0644); err != nil {
 		fatal("保存文件失败: %v", err)
 	}
 	
-	if !quietMode && !bodyOnly {
-		fmt.Printf("\033[2m响应已保存到 %s\033[0m\n", outputFile)
+	if outputFormat == "" {
+		fmt.Printf("%s响应已保存到 %s%s\n", color(ansiDim), outputFile, color(ansiReset))
 	}
 }
 
-func printResponse(resp *request.Response, totalTime time.Duration, req map[string]interface{}, isParallel bool) {
-	// body-only 模式：只输出原始 body
-	if bodyOnly {
-		if jsonData, err := resp.JSON(); err == nil {
-			formatted, _ := json.MarshalIndent(jsonData, "", "  ")
-			fmt.Println(string(formatted))
+// outputNamer 为 --output-dir 中的响应生成文件名。并行请求的输出可能来自不同
+// goroutine，所以用锁保护已用过的名字
+type outputNamer struct {
+	mu   sync.Mutex
+	used map[string]bool
+}
+
+func newOutputNamer() *outputNamer {
+	return &outputNamer{used: make(map[string]bool)}
+}
+
+// name 按请求方法和 URL 路径命名（GET /users/1 -> get-users-1.json），URL 没有
+// 路径时使用 req-<n>.json。本次运行中重名时依次追加 -2、-3……
+func (n *outputNamer) name(method, rawURL string, number int, ext string) string {
+	base := fmt.Sprintf("req-%d", number)
+	if slug := pathSlug(rawURL); slug != "" {
+		base = strings.ToLower(method) + "-" + slug
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	name := base + ext
+	for i := 2; n.used[name]; i++ {
+		name = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+	n.used[name] = true
+	return name
+}
+
+// pathSlug 把 URL 路径转换为文件名：字母、数字和下划线保留，其余字符合并为 -
+func pathSlug(rawURL string) string {
+	path := rawURL
+	if u, err := url.Parse(rawURL); err == nil {
+		path = u.Path
+	}
+	var sb strings.Builder
+	dash := false
+	for _, r := range path {
+		if r < utf8.RuneSelf && (r == '_' || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z') {
+			if dash && sb.Len() > 0 {
+				sb.WriteByte('-')
+			}
+			sb.WriteRune(r)
+			dash = false
 		} else {
-			fmt.Println(resp.String())
+			dash = true
+		}
+	}
+	slug := sb.String()
+	if len(slug) > 80 {
+		slug = slug[:80]
+	}
+	return slug
+}
+
+// savedExt 按响应体内容选择文件扩展名
+func savedExt(resp *request.Response) string {
+	if json.Valid(resp.Body) {
+		return ".json"
+	}
+	if utf8.Valid(resp.Body) {
+		return ".txt"
+	}
+	return ".bin"
+}
+
+// saveToDir 把一个响应保存为 --output-dir 中的单独文件
+func saveToDir(namer *outputNamer, resp *request.Response, req map[string]interface{}, number int) {
+	method, rawURL := requestLine(req)
+	path := filepath.Join(outputDir, namer.name(method, rawURL, number, savedExt(resp)))
+	if err := os.WriteFile(path, savedContent(resp, prettySave), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "%s保存文件失败: %v%s\n", errColor(ansiRed), err, errColor(ansiReset))
+		return
+	}
+	if outputFormat == "" {
+		fmt.Printf("%s响应已保存到 %s%s\n", color(ansiDim), path, color(ansiReset))
+	}
+}
+
+// saveHAR 将执行过的请求和响应写入 --har 指定的文件
+func saveHAR(entries []request.HAREntry) {
+	data, err := request.HAR(entries, version)
+	if err != nil {
+		fatal("导出 HAR 失败: %v", err)
+	}
+	if err := os.WriteFile(harFile, data, 0644); err != nil {
+		fatal("保存 HAR 文件失败: %v", err)
+	}
+
+	if outputFormat == "" {
+		fmt.Printf("%sHAR 已保存到 %s（%d 个请求）%s\n", color(ansiDim), harFile, len(entries), color(ansiReset))
+	}
+}
+
+// responseRenderers --format 对应的输出函数，默认的彩色输出为 renderPretty
+var responseRenderers = map[string]func(w io.Writer, resp *request.Response){
+	"json":    renderJSON,
+	"raw":     renderRaw,
+	"headers": renderHeaders,
+	"status":  renderStatus,
+}
+
+// requestLine 返回请求的方法（大写）和 URL，自定义方法（method "PURGE" "url"）原样返回
+func requestLine(req map[string]interface{}) (method, url string) {
+	if m, ok := req["method"].(string); ok {
+		return m, fmt.Sprintf("%v", req["url"])
+	}
+	if v, ok := req["ws"]; ok {
+		return "WS", fmt.Sprintf("%v", v)
+	}
+	for _, m := range []string{"get", "post", "put", "delete", "patch", "head", "options"} {
+		if v, ok := req[m]; ok {
+			if str, ok := v.(string); ok {
+				return strings.ToUpper(m), str
+			}
+			return strings.ToUpper(m), fmt.Sprintf("%v", v)
+		}
+	}
+	return "", ""
+}
+
+// printResponse 按 --format 将响应输出到 stdout
+func printResponse(resp *request.Response, totalTime time.Duration, req map[string]interface{}, isParallel bool) {
+	// --stream 时响应体已经逐行输出（ws 请求的消息也是），stdout 只保留响应体，状态行输出到 stderr
+	if streamMode || resp.Streamed {
+		if !resp.Streamed && len(resp.Body) > 0 {
+			// 按 retry 配置整体读取的响应（Retry-After 等待用完后不再重试）没有逐行输出，这里补上
+			os.Stdout.Write(resp.Body)
+			if resp.Body[len(resp.Body)-1] != '\n' {
+				fmt.Println()
+			}
+		}
+		reset := errColor(ansiReset)
+		fmt.Fprintf(os.Stderr, "%s%s (%v)%s\n", errColor(ansiDim), resp.Status, resp.Duration.Round(time.Millisecond), reset)
+		if resp.Truncated {
+			fmt.Fprintf(os.Stderr, "%s响应体超过 %d 字节，已截断%s\n", errColor(ansiYellow), maxResponseSize, reset)
 		}
 		return
 	}
+	writeResponse(os.Stdout, resp, totalTime, req, isParallel)
+}
+
+// writeResponse 按 --format 将响应输出到 w
+func writeResponse(w io.Writer, resp *request.Response, totalTime time.Duration, req map[string]interface{}, isParallel bool) {
+	if render, ok := responseRenderers[outputFormat]; ok {
+		render(w, resp)
+		return
+	}
+	renderPretty(w, resp, totalTime, req, isParallel)
+}
 
+// renderStatus 只输出状态行和耗时，来自 --cache 的响应标记为 cached
+func renderStatus(w io.Writer, resp *request.Response) {
+	reset, dim := color(ansiReset), color(ansiDim)
+	elapsed := resp.Duration.Round(time.Millisecond).String()
+	if resp.Cached {
+		elapsed += ", cached"
+	}
+	fmt.Fprintf(w, "%s%s%s %s(%s)%s\n",
+		statusColor(resp.StatusCode), resp.Status, reset, dim, elapsed, reset)
+	if resp.Truncated {
+		fmt.Fprintf(w, "%s响应体超过 %d 字节，已截断%s\n", color(ansiYellow), len(resp.Body), reset)
+	}
+}
+
+// renderRaw 原样输出响应体，不做格式化也不追加换行
+func renderRaw(w io.Writer, resp *request.Response) {
+	w.Write(resp.Body)
+}
+
+// renderHeaders 按名称排序输出响应头，每行一个 "Name: value"
+func renderHeaders(w io.Writer, resp *request.Response) {
+	names := make([]string, 0, len(resp.Headers))
+	for k := range resp.Headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		fmt.Fprintf(w, "%s: %s\n", k, resp.Headers[k])
+	}
+}
+
+// statusColor 按状态码选择颜色：2xx 绿色，3xx 黄色，4xx/5xx 红色
+func statusColor(code int) string {
+	switch {
+	case code >= 400:
+		return color(ansiRed)
+	case code >= 300:
+		return color(ansiYellow)
+	}
+	return color(ansiGreen)
+}
+
+// renderPretty 默认输出：彩色状态行、响应头和格式化后的响应体
+func renderPretty(w io.Writer, resp *request.Response, totalTime time.Duration, req map[string]interface{}, isParallel bool) {
 	// 颜色码
-	reset := "\033[0m"
-	bold := "\033[1m"
-	dim := "\033[2m"
-	green := "\033[32m"
-	red := "\033[31m"
-	cyan := "\033[36m"
-	yellow := "\033[33m"
-	magenta := "\033[35m"
-
-	// 并行请求简化输出（除非 verbose 模式）
+	reset := color(ansiReset)
+	bold := color(ansiBold)
+	dim := color(ansiDim)
+	cyan := color(ansiCyan)
+	magenta := color(ansiMagenta)
+
+	// 并行请求简化输出（除非 verbose 模式）：只显示状态码和耗时
 	if isParallel && !verboseMode {
-		// 状态颜色
-		statusColor := green
-		if resp.StatusCode >= 400 {
-			statusColor = red
-		} else if resp.StatusCode >= 300 {
-			statusColor = yellow
-		}
-		// 只显示状态码和耗时
-		fmt.Printf("%s%s%s %s(%v)%s\n", 
-			statusColor, resp.Status, reset,
-			dim, resp.Duration.Round(time.Millisecond), reset)
+		renderStatus(w, resp)
 		return
 	}
 
 	// verbose 模式：显示请求信息
 	if verboseMode && req != nil {
 		// 提取 METHOD 和 URL
-		var method, url string
-		for k, v := range req {
-			if k != "headers" && k != "body" {
-				method = strings.ToUpper(k)
-				if str, ok := v.(string); ok {
-					url = str
-				} else {
-					url = fmt.Sprintf("%v", v)
-				}
-				break
-			}
-		}
-		
+		method, url := requestLine(req)
 		if method != "" && url != "" {
-			fmt.Printf("%s%s%s %s%s%s\n", bold, magenta, method, reset, url, reset)
+			fmt.Fprintf(w, "%s%s%s %s%s%s\n", bold, magenta, method, reset, url, reset)
 		}
 		
 		// Request Headers
 		if headers, ok := req["headers"].(map[string]interface{}); ok && len(headers) > 0 {
-			fmt.Printf("%s%sRequest Headers%s\n", bold, cyan, reset)
+			fmt.Fprintf(w, "%s%sRequest Headers%s\n", bold, cyan, reset)
 			for k, v := range headers {
-				fmt.Printf("  %s%s%s: %s\n", dim, k, reset, fmt.Sprintf("%v", v))
+				fmt.Fprintf(w, "  %s%s%s: %s\n", dim, k, reset, fmt.Sprintf("%v", v))
 			}
 		}
 		
 		// Request Body
 		if body, ok := req["body"]; ok && body != nil {
-			fmt.Printf("%s%sRequest Body%s\n", bold, cyan, reset)
+			fmt.Fprintf(w, "%s%sRequest Body%s\n", bold, cyan, reset)
 			bodyStr := formatRequestBody(body)
-			fmt.Println(bodyStr)
+			fmt.Fprintln(w, bodyStr)
+		}
+
+		// Request Form
+		if form, ok := req["form"].(map[string]interface{}); ok && len(form) > 0 {
+			fmt.Fprintf(w, "%s%sRequest Form%s\n", bold, cyan, reset)
+			for k, v := range form {
+				fmt.Fprintf(w, "  %s%s%s: %v\n", dim, k, reset, v)
+			}
 		}
 		
-		fmt.Println(dim + strings.Repeat("─", 50) + reset)
+		fmt.Fprintln(w, dim + strings.Repeat("─", 50) + reset)
 	}
 
-	// 状态颜色
-	statusColor := green
-	if resp.StatusCode >= 400 {
-		statusColor = red
-	} else if resp.StatusCode >= 300 {
-		statusColor = yellow
+	// 状态行
+	renderStatus(w, resp)
+
+	// verbose 模式：显示实际使用的协议
+	if verboseMode && resp.Proto != "" {
+		fmt.Fprintf(w, "%sProtocol: %s%s\n", dim, resp.Proto, reset)
 	}
 
-	// 状态行
-	fmt.Printf("%s%s%s %s(%v)%s\n", 
-		statusColor, resp.Status, reset,
-		dim, resp.Duration.Round(time.Millisecond), reset)
+	// verbose 模式：跟随了重定向时显示最终的 URL
+	if verboseMode && resp.Redirected {
+		fmt.Fprintf(w, "%sRedirected to %s%s\n", dim, resp.URL, reset)
+	}
 
-	// quiet 模式：只显示状态行
-	if quietMode {
-		return
+	// verbose 模式：显示压缩传输的大小和压缩比
+	if verboseMode && resp.CompressedSize > 0 {
+		fmt.Fprintf(w, "%s%s: %d → %d bytes (%.1fx)%s\n", dim, resp.Headers["Content-Encoding"],
+			resp.CompressedSize, len(resp.Body), float64(len(resp.Body))/float64(resp.CompressedSize), reset)
 	}
 
-	fmt.Println(dim + strings.Repeat("─", 50) + reset)
+	fmt.Fprintln(w, dim + strings.Repeat("─", 50) + reset)
 
 	// Headers
-	fmt.Printf("%s%sHeaders%s\n", bold, cyan, reset)
+	fmt.Fprintf(w, "%s%sHeaders%s\n", bold, cyan, reset)
 	for k, v := range resp.Headers {
-		fmt.Printf("  %s%s%s: %s\n", dim, k, reset, v)
+		fmt.Fprintf(w, "  %s%s%s: %s\n", dim, k, reset, v)
 	}
-	fmt.Println(dim + strings.Repeat("─", 50) + reset)
+	fmt.Fprintln(w, dim + strings.Repeat("─", 50) + reset)
 
 	// Response Body - 检查是否为空
 	bodyStr := resp.String()
 	bodyIsEmpty := len(strings.TrimSpace(bodyStr)) == 0
 	
 	if !bodyIsEmpty {
-		fmt.Printf("%s%sResponse Body%s\n", bold, cyan, reset)
-		
-		// 尝试格式化 JSON
-		if jsonData, err := resp.JSON(); err == nil {
-			body := formatJSONWithLimit(jsonData)
-			fmt.Println(body)
+		kind := sniffBodyKind(resp.Body, resp.Headers["Content-Type"])
+		if kind == "json" || kind == "text" {
+			fmt.Fprintf(w, "%s%sResponse Body%s\n", bold, cyan, reset)
 		} else {
-			lines := strings.Split(bodyStr, "\n")
-			if len(lines) > maxBodyLines {
-				fmt.Println(strings.Join(lines[:maxBodyLines], "\n"))
-				fmt.Printf("%s... (%d more lines, use -o to save full response)%s\n", dim, len(lines)-maxBodyLines, reset)
-			} else {
-				fmt.Println(bodyStr)
+			fmt.Fprintf(w, "%s%sResponse Body%s %s(%s)%s\n", bold, cyan, reset, dim, kind, reset)
+		}
+
+		// 格式化 JSON（对象过长时只显示顶层结构）
+		if kind == "json" {
+			if jsonData, err := resp.JSON(); err == nil {
+				fmt.Fprintln(w, formatJSONWithLimit(jsonData))
+				return
 			}
+			var data interface{}
+			if err := json.Unmarshal(resp.Body, &data); err == nil {
+				formatted, _ := json.MarshalIndent(data, "", "  ")
+				bodyStr = string(formatted)
+			}
+		}
+
+		lines := strings.Split(bodyStr, "\n")
+		if len(lines) > maxBodyLines {
+			fmt.Fprintln(w, strings.Join(lines[:maxBodyLines], "\n"))
+			fmt.Fprintf(w, "%s... (%d more lines, use -o to save full response)%s\n", dim, len(lines)-maxBodyLines, reset)
+		} else {
+			fmt.Fprintln(w, bodyStr)
 		}
 	}
 }
 
+// sniffBodyKind 判断响应体类型: "json", "html", "xml" 或 "text"
+// 优先尝试 JSON 解析，不依赖 Content-Type（很多简单服务不返回该 header），
+// 其次按开头字节识别 HTML/XML，最后按纯文本处理
+func sniffBodyKind(body []byte, contentType string) string {
+	trimmed := bytes.TrimSpace(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf")))
+	if len(trimmed) == 0 {
+		return "text"
+	}
+
+	// 只把对象和数组当作 JSON，避免把 "123"、"true" 之类的纯文本误判
+	if (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return "json"
+	}
+
+	ct := strings.ToLower(contentType)
+	if ct == "" {
+		ct = strings.ToLower(http.DetectContentType(trimmed))
+	}
+	switch {
+	case strings.Contains(ct, "html"):
+		return "html"
+	case strings.Contains(ct, "xml"):
+		return "xml"
+	}
+	return "text"
+}
+
+// responseRef 构建 $_ 引用的响应对象: {"status": 200, "headers": {...}, "body": ...}
+// body 是合法 JSON 时为解析后的值，否则为原始字符串
+func responseRef(resp *request.Response) map[string]interface{} {
+	headers := make(map[string]interface{}, len(resp.Headers))
+	for k, v := range resp.Headers {
+		headers[k] = v
+	}
+
+	// 流式读取的响应体只有最后一行，直接按单个 JSON 值解析
+	var body interface{}
+	if items, ok := parseNDJSON(resp); ok && !resp.Streamed {
+		body = items
+	} else if err := json.Unmarshal(resp.Body, &body); err != nil {
+		body = resp.String()
+	}
+
+	return map[string]interface{}{
+		"status":  int64(resp.StatusCode),
+		"headers": headers,
+		"body":    body,
+	}
+}
+
+// parseNDJSON 将 NDJSON（每行一个 JSON 值）响应解析为数组
+// Content-Type 为 application/x-ndjson 等时按行解析；否则只有多行且每行都是 JSON 时才视为 NDJSON
+func parseNDJSON(resp *request.Response) ([]interface{}, bool) {
+	contentType := strings.ToLower(resp.Headers["Content-Type"])
+	declared := strings.Contains(contentType, "ndjson") || strings.Contains(contentType, "jsonl") ||
+		strings.Contains(contentType, "json-seq")
+	if !declared && json.Valid(resp.Body) {
+		return nil, false
+	}
+
+	items := []interface{}{}
+	for _, line := range strings.Split(string(resp.Body), "\n") {
+		// json-seq 每条记录以 RS (0x1E) 开头
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\x1e"))
+		if line == "" {
+			continue
+		}
+		var item interface{}
+		if err := json.Unmarshal([]byte(line), &item); err != nil {
+			return nil, false
+		}
+		items = append(items, item)
+	}
+	if !declared && len(items) < 2 {
+		return nil, false
+	}
+	return items, true
+}
+
+// responseJSON 构建 --json 模式下的响应对象
+// body 是合法 JSON 时直接嵌入；非 UTF-8 的二进制 body 以 base64 输出（body_base64 + binary），
+// 避免 json.Marshal 静默替换非法字节；header 值统一清理为合法 UTF-8
+func responseJSON(resp *request.Response) map[string]interface{} {
+	headers := make(map[string]string, len(resp.Headers))
+	for k, v := range resp.Headers {
+		headers[strings.ToValidUTF8(k, "\uFFFD")] = strings.ToValidUTF8(v, "\uFFFD")
+	}
+
+	out := map[string]interface{}{
+		"status_code": resp.StatusCode,
+		"status":      strings.ToValidUTF8(resp.Status, "\uFFFD"),
+		"headers":     headers,
+		"duration_ms": resp.Duration.Milliseconds(),
+	}
+
+	if resp.Truncated {
+		out["truncated"] = true
+	}
+
+	var data interface{}
+	switch {
+	case !utf8.Valid(resp.Body):
+		out["body_base64"] = base64.StdEncoding.EncodeToString(resp.Body)
+		out["binary"] = true
+	case json.Unmarshal(resp.Body, &data) == nil:
+		out["body"] = data
+	default:
+		out["body"] = string(resp.Body)
+	}
+
+	return out
+}
+
+// renderJSON 以单行 JSON 输出响应
+func renderJSON(w io.Writer, resp *request.Response) {
+	jsonBytes, err := json.Marshal(responseJSON(resp))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "JSON 编码失败: %v\n", err)
+		return
+	}
+	fmt.Fprintln(w, string(jsonBytes))
+}
+
 // formatRequestBody 格式化请求体用于显示
 func formatRequestBody(body interface{}) string {
 	// 尝试格式化为 JSON
@@ -620,10 +1811,37 @@ func formatJSONWithLimit(data map[string]interface{}) string {
 	}
 	
 	summaryJSON, _ := json.MarshalIndent(summary, "", "  ")
-	return string(summaryJSON) + "\n\033[2m... (response too long, use -o to save full response)\033[0m"
+	return string(summaryJSON) + "\n" + color(ansiDim) + "... (response too long, use -o to save full response)" + color(ansiReset)
+}
+
+// fatalAt 输出执行错误并退出，见 execError
+func fatalAt(kind string, pos ast.Position, err error) {
+	fatal("%s", execError(kind, pos, err))
+}
+
+// execError 格式化执行错误，带有源码位置时输出 file:line:col: 前缀
+// 错误中有 eval.PosError 时使用它的位置（最内层出错的语句，可能在 import 的文件中），
+// 否则使用 pos（顶层语句的位置，零值时不输出前缀）
+func execError(kind string, pos ast.Position, err error) string {
+	name := scriptName
+	msg := err.Error()
+	var pe *eval.PosError
+	if errors.As(err, &pe) {
+		pos = pe.Pos
+		if pe.File != "" {
+			name = pe.File
+		}
+		// 位置已经在前缀中，去掉消息中的 "line N: "，保留外层的包装（如 flow 名称）
+		msg = strings.Replace(msg, pe.Error(), pe.Err.Error(), 1)
+	}
+	if pos.Line == 0 {
+		return fmt.Sprintf("%s: %s", kind, msg)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", name, pos.Line, pos.Column, kind, msg)
 }
 
 func fatal(format string, args ...interface{}) {
-	fmt.Fprintf(os.Stderr, "\033[31m"+format+"\033[0m\n", args...)
+	saveReport(1)
+	fmt.Fprintf(os.Stderr, errColor(ansiRed)+format+errColor(ansiReset)+"\n", args...)
 	os.Exit(1)
 }
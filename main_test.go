@@ -0,0 +1,775 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/LingHeChen/haiku/ast"
+	"github.com/LingHeChen/haiku/eval"
+	"github.com/LingHeChen/haiku/parser"
+	"github.com/LingHeChen/haiku/request"
+)
+
+func TestResponseJSONBinaryBody(t *testing.T) {
+	binary := []byte{0x89, 'P', 'N', 'G', 0xff, 0xfe, 0x00, 0x01}
+	resp := &request.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Headers: map[string]string{
+			"Content-Type": "image/png",
+			"X-Raw":        "caf\xe9",
+		},
+		Body: binary,
+	}
+
+	out := responseJSON(resp)
+
+	if out["binary"] != true {
+		t.Errorf("expected binary flag, got %v", out["binary"])
+	}
+	if _, ok := out["body"]; ok {
+		t.Errorf("binary response should not have a body field")
+	}
+	encoded, _ := out["body_base64"].(string)
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || string(decoded) != string(binary) {
+		t.Errorf("body_base64 does not round-trip: %q", encoded)
+	}
+
+	jsonBytes, err := json.Marshal(out)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	var parsed struct {
+		Headers map[string]string `json:"headers"`
+	}
+	if err := json.Unmarshal(jsonBytes, &parsed); err != nil {
+		t.Fatalf("output is not valid JSON: %v", err)
+	}
+	if parsed.Headers["X-Raw"] != "caf�" {
+		t.Errorf("expected sanitized header value, got %q", parsed.Headers["X-Raw"])
+	}
+}
+
+func TestResponseJSONTextBody(t *testing.T) {
+	resp := &request.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Body:       []byte(`{"id": 1}`),
+	}
+
+	out := responseJSON(resp)
+
+	if _, ok := out["binary"]; ok {
+		t.Errorf("text response should not be flagged binary")
+	}
+	body, ok := out["body"].(map[string]interface{})
+	if !ok || body["id"] != float64(1) {
+		t.Errorf("expected parsed JSON body, got %v", out["body"])
+	}
+}
+
+func TestSniffBodyKindWithoutContentType(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"json object", `{"id": 1}`, "json"},
+		{"json array", "\n  [1, 2, 3]\n", "json"},
+		{"html document", "<!DOCTYPE html>\n<html><body>hi</body></html>", "html"},
+		{"html fragment", "<html><head></head></html>", "html"},
+		{"xml", `<?xml version="1.0"?><user><id>1</id></user>`, "xml"},
+		{"plain text", "hello world", "text"},
+		{"bare number", "42", "text"},
+		{"broken json", `{"id": `, "text"},
+	}
+
+	for _, tt := range tests {
+		if got := sniffBodyKind([]byte(tt.body), ""); got != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestSniffBodyKindUsesContentType(t *testing.T) {
+	if got := sniffBodyKind([]byte("<feed/>"), "application/atom+xml"); got != "xml" {
+		t.Errorf("expected xml from content type, got %s", got)
+	}
+	if got := sniffBodyKind([]byte(`{"a": 1}`), "text/plain"); got != "json" {
+		t.Errorf("expected JSON body to win over text/plain, got %s", got)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"512":    512,
+		"512B":   512,
+		"4KB":    4 << 10,
+		"10MB":   10 << 20,
+		"1gb":    1 << 30,
+		" 2 MB ": 2 << 20,
+	}
+	for input, want := range cases {
+		got, err := parseSize(input)
+		if err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "MB", "-1KB", "ten"} {
+		if _, err := parseSize(input); err == nil {
+			t.Errorf("parseSize(%q) expected error", input)
+		}
+	}
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	h := newLatencyHistogram()
+	for _, d := range []time.Duration{
+		2 * time.Millisecond,
+		9 * time.Millisecond,
+		10 * time.Millisecond, // bucket bounds are exclusive
+		75 * time.Millisecond,
+		300 * time.Millisecond,
+		999 * time.Millisecond,
+		time.Second,
+		3 * time.Second,
+	} {
+		h.add(d)
+	}
+
+	want := []int{2, 1, 1, 0, 1, 1, 2}
+	for i, c := range want {
+		if h.counts[i] != c {
+			t.Errorf("bucket %s: expected %d, got %d", latencyBuckets[i].label, c, h.counts[i])
+		}
+	}
+
+	out := h.render()
+	if !strings.Contains(out, "Latency (8 requests)") {
+		t.Errorf("expected total in header, got:\n%s", out)
+	}
+	if !strings.Contains(out, "<10ms      "+strings.Repeat("█", 40)+" 2") {
+		t.Errorf("expected full-width bar for the largest bucket, got:\n%s", out)
+	}
+}
+
+func TestResponseRef(t *testing.T) {
+	ref := responseRef(&request.Response{
+		StatusCode: 404,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       []byte(`{"error": "not found"}`),
+	})
+	if ref["status"] != int64(404) {
+		t.Errorf("expected status 404, got %v", ref["status"])
+	}
+	if h := ref["headers"].(map[string]interface{}); h["Content-Type"] != "application/json" {
+		t.Errorf("unexpected headers: %v", h)
+	}
+	if body, ok := ref["body"].(map[string]interface{}); !ok || body["error"] != "not found" {
+		t.Errorf("expected parsed JSON body, got %v", ref["body"])
+	}
+
+	ref = responseRef(&request.Response{StatusCode: 200, Body: []byte("plain text")})
+	if ref["body"] != "plain text" {
+		t.Errorf("expected raw string body, got %v", ref["body"])
+	}
+}
+
+func TestCaptureResponseHeader(t *testing.T) {
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Location", "/users/42")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"ok": true}`))
+			return
+		}
+		fetched = append(fetched, r.URL.Path+" "+r.Header.Get("X-Seen-Type"))
+	}))
+	defer server.Close()
+
+	input := fmt.Sprintf(`
+@base "%s"
+post "$base/users"
+@location $_.headers.Location
+@type $_.headers.content-type
+get "$base$location"
+headers
+  X-Seen-Type $type
+`, server.URL)
+
+	program, err := parser.ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	client := request.New()
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		return responseRef(resp), nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if len(fetched) != 1 || fetched[0] != "/users/42 application/json" {
+		t.Errorf("expected follow-up GET to the captured Location, got %v", fetched)
+	}
+}
+
+func TestSavedContentKeepsRawBytes(t *testing.T) {
+	raw := []byte(`{"b":1,"a":[1,2],  "c":"x"}`)
+	resp := &request.Response{Body: raw}
+
+	if got := savedContent(resp, false); string(got) != string(raw) {
+		t.Errorf("expected raw bytes to be preserved, got %s", got)
+	}
+
+	pretty := string(savedContent(resp, true))
+	if !strings.HasPrefix(pretty, "{\n  \"a\": [") {
+		t.Errorf("expected reformatted JSON with --pretty-save, got %s", pretty)
+	}
+
+	text := &request.Response{Body: []byte("not json")}
+	if got := savedContent(text, true); string(got) != "not json" {
+		t.Errorf("expected non-JSON body to be saved as is, got %s", got)
+	}
+}
+
+func TestREPLKeepsVariablesAndResponse(t *testing.T) {
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"id": 7}`))
+			return
+		}
+		fetched = append(fetched, r.URL.Path)
+	}))
+	defer server.Close()
+
+	oldFormat := outputFormat
+	outputFormat = "status"
+	defer func() { outputFormat = oldFormat }()
+
+	script := fmt.Sprintf(`@base "%s"
+post "$base/users"
+body
+  name John
+
+@id $_.id
+for $id
+get "$base/users/$id"
+headers
+  Accept "application/json"
+exit
+get "$base/never"
+`, server.URL)
+
+	var out strings.Builder
+	runREPL(strings.NewReader(script), &out, ".")
+
+	if len(fetched) != 1 || fetched[0] != "/users/7" {
+		t.Errorf("expected GET /users/7 using the previous response, got %v", fetched)
+	}
+	if strings.Count(out.String(), "200 OK") != 2 {
+		t.Errorf("expected two status lines in output, got %q", out.String())
+	}
+	// A parse error is reported and the session goes on
+	if !strings.Contains(out.String(), "解析错误") {
+		t.Errorf("expected parse error in output, got %q", out.String())
+	}
+}
+
+func TestIsREPLContinuation(t *testing.T) {
+	cases := map[string]bool{
+		"  name John":       true,
+		"headers":           true,
+		"assert status 200": true,
+		"else":              true,
+		`get "https://x"`:   false,
+		"@id $_.id":         false,
+		"header_name":       false,
+	}
+	for line, want := range cases {
+		if got := isREPLContinuation(line); got != want {
+			t.Errorf("isREPLContinuation(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+func TestREPLRawString(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(data))
+	}))
+	defer server.Close()
+
+	oldFormat := outputFormat
+	outputFormat = "status"
+	defer func() { outputFormat = oldFormat }()
+
+	script := fmt.Sprintf(`post "%s"
+body """
+first
+
+last"""
+get "%s"
+`, server.URL, server.URL)
+
+	var out strings.Builder
+	runREPL(strings.NewReader(script), &out, ".")
+
+	if len(bodies) != 2 || bodies[0] != "first\n\nlast" {
+		t.Errorf("expected the empty and unindented lines to stay in the body, got %q\n%s", bodies, out.String())
+	}
+}
+
+func TestNDJSONResponseInLoop(t *testing.T) {
+	var fetched []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/events" {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.Write([]byte("{\"id\": 1}\n{\"id\": 2}\n\n{\"id\": 3}\n"))
+			return
+		}
+		fetched = append(fetched, r.URL.Path)
+	}))
+	defer server.Close()
+
+	input := fmt.Sprintf(`
+@base "%s"
+get "$base/events"
+@first $_.0.id
+for $event in $_.body
+  get "$base/items/$event.id"
+get "$base/first/$first"
+`, server.URL)
+
+	program, err := parser.ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	client := request.New()
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		return responseRef(resp), nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := "/items/1 /items/2 /items/3 /first/1"
+	if got := strings.Join(fetched, " "); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestParseNDJSONWithoutContentType(t *testing.T) {
+	if items, ok := parseNDJSON(&request.Response{Body: []byte("{\"a\":1}\n{\"a\":2}\n")}); !ok || len(items) != 2 {
+		t.Errorf("expected 2 items, got %v %v", items, ok)
+	}
+	// A regular JSON document or plain text is left alone
+	for _, body := range []string{"{\"a\": 1}", "[1, 2]", "hello\nworld"} {
+		if _, ok := parseNDJSON(&request.Response{Body: []byte(body)}); ok {
+			t.Errorf("did not expect %q to be treated as NDJSON", body)
+		}
+	}
+}
+
+func TestParseEnvFile(t *testing.T) {
+	content := `# secrets
+API_TOKEN=abc123
+export REGION = us-east-1
+QUOTED="line one\nsays \"hi\"" # comment
+SINGLE='no $expansion \n here'
+INLINE=value # trailing comment
+HASH=a#b
+EMPTY=
+`
+	entries, err := parseEnvFile(strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("parseEnvFile error: %v", err)
+	}
+	want := []envEntry{
+		{"API_TOKEN", "abc123"},
+		{"REGION", "us-east-1"},
+		{"QUOTED", "line one\nsays \"hi\""},
+		{"SINGLE", `no $expansion \n here`},
+		{"INLINE", "value"},
+		{"HASH", "a#b"},
+		{"EMPTY", ""},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("expected %d entries, got %v", len(want), entries)
+	}
+	for i, e := range entries {
+		if e != want[i] {
+			t.Errorf("entry %d: expected %+v, got %+v", i, want[i], e)
+		}
+	}
+
+	for _, bad := range []string{"NO_EQUALS", "=value", `OPEN="unterminated`, "BAD KEY=1"} {
+		if _, err := parseEnvFile(strings.NewReader(bad)); err == nil {
+			t.Errorf("%q: expected parse error", bad)
+		}
+	}
+}
+
+func TestLoadEnvFiles(t *testing.T) {
+	dir := t.TempDir()
+	first := filepath.Join(dir, ".env")
+	second := filepath.Join(dir, ".env.local")
+	if err := os.WriteFile(first, []byte("HAIKU_TEST_A=file\nHAIKU_TEST_B=first\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(second, []byte("HAIKU_TEST_B=second\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Real environment variables win; later files win over earlier ones
+	t.Setenv("HAIKU_TEST_A", "real")
+	t.Setenv("HAIKU_TEST_B", "")
+	os.Unsetenv("HAIKU_TEST_B")
+	if err := loadEnvFiles([]string{first, second}, false); err != nil {
+		t.Fatalf("loadEnvFiles error: %v", err)
+	}
+	if got := os.Getenv("HAIKU_TEST_A"); got != "real" {
+		t.Errorf("expected existing variable to be kept, got %q", got)
+	}
+	if got := os.Getenv("HAIKU_TEST_B"); got != "second" {
+		t.Errorf("expected later file to win, got %q", got)
+	}
+
+	if err := loadEnvFiles([]string{first}, true); err != nil {
+		t.Fatalf("loadEnvFiles error: %v", err)
+	}
+	if got := os.Getenv("HAIKU_TEST_A"); got != "file" {
+		t.Errorf("expected override to replace existing variable, got %q", got)
+	}
+
+	if err := loadEnvFiles([]string{filepath.Join(dir, "missing")}, false); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func TestResponseRenderers(t *testing.T) {
+	resp := &request.Response{
+		StatusCode: 404,
+		Status:     "404 Not Found",
+		Headers:    map[string]string{"X-Request-Id": "abc", "Content-Type": "application/json"},
+		Body:       []byte(`{"error":"missing"}`),
+		Duration:   12 * time.Millisecond,
+	}
+	render := func(format string) string {
+		var sb strings.Builder
+		responseRenderers[format](&sb, resp)
+		return sb.String()
+	}
+
+	if got := render("raw"); got != `{"error":"missing"}` {
+		t.Errorf("raw: expected unmodified body, got %q", got)
+	}
+	if got := render("headers"); got != "Content-Type: application/json\nX-Request-Id: abc\n" {
+		t.Errorf("headers: got %q", got)
+	}
+	if got := render("status"); !strings.Contains(got, "404 Not Found") || !strings.Contains(got, "12ms") ||
+		strings.Contains(got, "missing") {
+		t.Errorf("status: got %q", got)
+	}
+
+	var out map[string]interface{}
+	if err := json.Unmarshal([]byte(render("json")), &out); err != nil {
+		t.Fatalf("json: invalid output: %v", err)
+	}
+	if out["status_code"] != float64(404) || out["body"].(map[string]interface{})["error"] != "missing" {
+		t.Errorf("json: got %v", out)
+	}
+
+	resp.Cached = true
+	if got := render("status"); !strings.Contains(got, "(12ms, cached)") {
+		t.Errorf("status: expected a cached response to be marked, got %q", got)
+	}
+}
+
+func TestColorsDisabled(t *testing.T) {
+	oldOut, oldErr := colorOutput, colorErrors
+	defer func() { colorOutput, colorErrors = oldOut, oldErr }()
+
+	resp := &request.Response{StatusCode: 500, Status: "500 Internal Server Error", Duration: time.Millisecond}
+	var colored strings.Builder
+	colorOutput = true
+	renderStatus(&colored, resp)
+	if !strings.Contains(colored.String(), ansiRed) {
+		t.Errorf("expected colored status line, got %q", colored.String())
+	}
+
+	// NO_COLOR turns colors off for both streams, as does --no-color
+	t.Setenv("NO_COLOR", "1")
+	initColors(false)
+	if colorOutput || colorErrors {
+		t.Error("expected NO_COLOR to disable colors")
+	}
+	var plain strings.Builder
+	renderStatus(&plain, resp)
+	if got := plain.String(); strings.Contains(got, "\033[") || got != "500 Internal Server Error (1ms)\n" {
+		t.Errorf("expected plain status line, got %q", got)
+	}
+
+	t.Setenv("NO_COLOR", "")
+	initColors(true)
+	if colorOutput || colorErrors {
+		t.Error("expected --no-color to disable colors")
+	}
+}
+
+func TestDryRunCallback(t *testing.T) {
+	oldStatus, oldBody := dryRunStatus, dryRunBody
+	defer func() { dryRunStatus, dryRunBody = oldStatus, oldBody }()
+	dryRunStatus = 201
+	dryRunBody = `{"id": 7, "items": [1, 2]}`
+
+	// $_ chaining and loops over the stub response expand as they would when executed
+	program, err := parser.ParseFile(`post "https://api.example.com/users"
+---
+if $_.status == 201
+  get "https://api.example.com/users/$_.id"
+for $item in $_.items
+  delete "https://api.example.com/items/$item"
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	var out strings.Builder
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(dryRunCallback(&out)))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{
+		"--- Request 1 (dry run) ---",
+		`"get": "https://api.example.com/users/7"`,
+		`"delete": "https://api.example.com/items/1"`,
+		`"delete": "https://api.example.com/items/2"`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in output:\n%s", want, got)
+		}
+	}
+	if n := strings.Count(got, "(dry run)"); n != 4 {
+		t.Errorf("expected 4 requests, got %d:\n%s", n, got)
+	}
+}
+
+func TestRequestErrorKind(t *testing.T) {
+	if kind := requestErrorKind(&request.RequestError{Kind: request.ErrTimeout, Err: fmt.Errorf("slow")}); kind != "timeout" {
+		t.Errorf("expected timeout, got %q", kind)
+	}
+	if kind := requestErrorKind(fmt.Errorf("wrapped: %w", &request.RequestError{Kind: request.ErrConnection})); kind != "connection" {
+		t.Errorf("expected connection, got %q", kind)
+	}
+	if kind := requestErrorKind(fmt.Errorf("missing URL for get")); kind != "invalid" {
+		t.Errorf("expected invalid, got %q", kind)
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	var httpErrors statusErrors
+	if code := exitCode(0, httpErrors); code != 0 {
+		t.Errorf("expected 0 without failures, got %d", code)
+	}
+	httpErrors.add(404)
+	httpErrors.add(503)
+	httpErrors.add(500)
+	if httpErrors.count != 3 || httpErrors.worst != 503 {
+		t.Errorf("unexpected status errors: %+v", httpErrors)
+	}
+	if code := exitCode(0, httpErrors); code != 1 {
+		t.Errorf("expected 1 for HTTP errors, got %d", code)
+	}
+	// Failed assertions and requests exit with 1 too
+	if code := exitCode(2, httpErrors); code != 1 {
+		t.Errorf("expected 1 for failures, got %d", code)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:       "0 B",
+		512:     "512 B",
+		1536:    "1.5 KB",
+		5 << 20: "5.0 MB",
+		3 << 30: "3.0 GB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestOutputNamer(t *testing.T) {
+	n := newOutputNamer()
+	tests := []struct {
+		method, url string
+		want        string
+	}{
+		{"GET", "https://api.example.com/users/1?full=true", "get-users-1.json"},
+		{"GET", "https://api.example.com/users/1", "get-users-1-2.json"},
+		{"GET", "https://api.example.com/users/1", "get-users-1-3.json"},
+		{"POST", "https://api.example.com/users/1", "post-users-1.json"},
+		{"GET", "https://api.example.com/files/report.v2.json", "get-files-report-v2-json.json"},
+		{"GET", "https://api.example.com/", "req-6.json"},
+		{"GET", "https://api.example.com", "req-7.json"},
+	}
+	for i, tt := range tests {
+		if got := n.name(tt.method, tt.url, i+1, ".json"); got != tt.want {
+			t.Errorf("name(%s %s) = %q, want %q", tt.method, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestSaveToDir(t *testing.T) {
+	dir := t.TempDir()
+	outputDir, outputFormat = dir, "status"
+	defer func() { outputDir, outputFormat = "", "" }()
+
+	n := newOutputNamer()
+	req := map[string]interface{}{"get": "https://api.example.com/users"}
+	saveToDir(n, &request.Response{Body: []byte(`{"id":1}`)}, req, 1)
+	saveToDir(n, &request.Response{Body: []byte("plain text")}, req, 2)
+
+	for name, want := range map[string]string{"get-users.json": `{"id":1}`, "get-users.txt": "plain text"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s: got %q, want %q", name, data, want)
+		}
+	}
+}
+
+func TestTraceText(t *testing.T) {
+	oldErr := colorErrors
+	defer func() { colorErrors = oldErr }()
+	colorErrors = false
+
+	got := traceText([]byte("GET /users HTTP/1.1\r\nHost: example.com\r\n\r\n"), true)
+	if want := "> GET /users HTTP/1.1\n> Host: example.com\n> \n"; got != want {
+		t.Errorf("request trace = %q, want %q", got, want)
+	}
+
+	body := strings.Repeat("line\n", maxBodyLines+5)
+	got = traceText([]byte("HTTP/1.1 200 OK\r\n\r\n"+body), false)
+	if !strings.HasPrefix(got, "< HTTP/1.1 200 OK\n< \n< line\n") || !strings.HasSuffix(got, "< ... (5 more lines)\n") {
+		t.Errorf("unexpected response trace: %q", got)
+	}
+	if n := strings.Count(got, "< line\n"); n != maxBodyLines {
+		t.Errorf("expected %d body lines, got %d", maxBodyLines, n)
+	}
+
+	got = traceText([]byte("HTTP/1.1 200 OK\r\n\r\n\xff\xd8\xff"), false)
+	if !strings.HasSuffix(got, "< (3 bytes of binary data)\n") {
+		t.Errorf("unexpected binary trace: %q", got)
+	}
+}
+
+func TestRunReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.json")
+	r := newRunReport()
+	req := map[string]interface{}{
+		"get":      "https://api.example.com/users",
+		"assert":   []interface{}{"$_.status == 200", "$_.body.id == 1"},
+		"validate": map[string]interface{}{"type": "object"},
+	}
+	r.add(req, &request.Response{StatusCode: 200}, 12*time.Millisecond, false, []string{"line 3: assert failed"}, nil)
+	r.add(map[string]interface{}{"post": "https://api.example.com/users"}, nil, 1500*time.Microsecond, true, nil, errors.New("request timed out"))
+	r.parallelStats = func() []map[string]interface{} {
+		return []map[string]interface{}{{"total": 2, "total_time": "30ms", "p95_time": "1.5ms"}}
+	}
+	if err := r.write(path, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Version  int `json:"version"`
+		ExitCode int `json:"exit_code"`
+		Summary  map[string]int
+		Requests []map[string]interface{}
+		Loops    []map[string]interface{} `json:"parallel_loops"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != 1 || doc.ExitCode != 1 {
+		t.Errorf("version %d, exit_code %d", doc.Version, doc.ExitCode)
+	}
+	if want := map[string]int{"requests": 2, "failed_requests": 1, "failed_assertions": 1}; !reflect.DeepEqual(doc.Summary, want) {
+		t.Errorf("summary: got %v, want %v", doc.Summary, want)
+	}
+	if len(doc.Requests) != 2 {
+		t.Fatalf("got %d requests, want 2", len(doc.Requests))
+	}
+	first, second := doc.Requests[0], doc.Requests[1]
+	if first["method"] != "GET" || first["status"] != 200.0 || first["duration_ms"] != 12.0 || first["assertions"] != 3.0 || first["error"] != nil {
+		t.Errorf("first request: %v", first)
+	}
+	if second["method"] != "POST" || second["status"] != nil || second["parallel"] != true || second["duration_ms"] != 1.5 || second["error"] != "request timed out" {
+		t.Errorf("second request: %v", second)
+	}
+	want := map[string]interface{}{"loop": 1.0, "total": 2.0, "total_ms": 30.0, "p95_ms": 1.5}
+	if len(doc.Loops) != 1 || !reflect.DeepEqual(doc.Loops[0], want) {
+		t.Errorf("parallel_loops: got %v, want [%v]", doc.Loops, want)
+	}
+}
+
+func TestExecError(t *testing.T) {
+	defer func(name string) { scriptName = name }(scriptName)
+	scriptName = "api.haiku"
+
+	inner := &eval.PosError{Pos: ast.Position{Line: 7, Column: 3}, Err: errors.New("sleep: negative duration -1s")}
+	tests := []struct {
+		pos  ast.Position
+		err  error
+		want string
+	}{
+		// The position in the error (the innermost statement) wins over the top-level statement
+		{ast.Position{Line: 5, Column: 1}, fmt.Errorf("flow login: %w", inner), "api.haiku:7:3: 执行错误: flow login: sleep: negative duration -1s"},
+		{ast.Position{Line: 5, Column: 1}, errors.New("request failed"), "api.haiku:5:1: 执行错误: request failed"},
+		{ast.Position{}, errors.New("request failed"), "执行错误: request failed"},
+		{ast.Position{Line: 2, Column: 1}, fmt.Errorf("import evaluation error: %w",
+			&eval.PosError{File: "lib/common.haiku", Pos: ast.Position{Line: 4, Column: 1}, Err: errors.New("boom")}),
+			"lib/common.haiku:4:1: 执行错误: import evaluation error: boom"},
+	}
+	for _, tt := range tests {
+		if got := execError("执行错误", tt.pos, tt.err); got != tt.want {
+			t.Errorf("execError(%v) = %q, want %q", tt.err, got, tt.want)
+		}
+	}
+}
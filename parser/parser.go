@@ -4,15 +4,22 @@ package parser
 
 import (
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 
+	"github.com/LingHeChen/haiku/internal/textblock"
+	haikulexer "github.com/LingHeChen/haiku/lexer"
+	"github.com/LingHeChen/haiku/xmlmap"
 	"github.com/alecthomas/participle/v2"
 	"github.com/alecthomas/participle/v2/lexer"
+	"gopkg.in/yaml.v3"
 )
 
 // ---------------------------------------------------------
@@ -56,9 +63,9 @@ type QuotedString string
 // Capture 实现 participle 的 Capture 接口
 func (s *QuotedString) Capture(values []string) error {
 	v := values[0]
-	// 去除首尾引号
+	// 去除首尾引号并解码转义（与 v2 lexer 一致）
 	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
-		*s = QuotedString(v[1 : len(v)-1])
+		*s = QuotedString(haikulexer.Unescape(v[1 : len(v)-1]))
 	} else {
 		*s = QuotedString(v)
 	}
@@ -553,6 +560,7 @@ var haikuLexer = lexer.MustSimple([]lexer.SimpleRule{
 // Parser Haiku 解析器
 type Parser struct {
 	parser *participle.Parser[Config]
+	strict bool // 未知处理器报错，见 Strict
 }
 
 // 全局单例解析器（避免重复初始化）
@@ -580,6 +588,28 @@ func New() (*Parser, error) {
 	return defaultParser, nil
 }
 
+// Strict 返回严格模式的解析器：未知的处理器（如拼错的 jsom`...`）返回错误，
+// 默认的解析器把它们的内容当作原始字符串
+func (p *Parser) Strict() *Parser {
+	strict := *p
+	strict.strict = true
+	return &strict
+}
+
+// parse 解析预处理后的代码，严格模式下检查处理器
+func (p *Parser) parse(bracedCode string) (*Config, error) {
+	config, err := p.parser.ParseString("", bracedCode)
+	if err != nil {
+		return nil, err
+	}
+	if p.strict {
+		if err := config.checkProcessors(); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
 // Parse 解析 Haiku 格式的字符串，返回 Config AST
 func (p *Parser) Parse(input string) (*Config, error) {
 	return p.ParseWithBasePath(input, "")
@@ -597,7 +627,7 @@ func (p *Parser) ParseWithBasePath(input string, basePath string) (*Config, erro
 	bracedCode := preprocess(input)
 
 	// 4. 解析
-	return p.parser.ParseString("", bracedCode)
+	return p.parse(bracedCode)
 }
 
 // ParseToJSON 解析 Haiku 格式的字符串并转换为 JSON 字节数组
@@ -728,12 +758,41 @@ func processString(processor, content string) interface{} {
 			return content
 		}
 		return result
+	case "yaml":
+		var result interface{}
+		if err := yaml.Unmarshal([]byte(textblock.Dedent(content)), &result); err != nil {
+			// 解析失败返回原始字符串
+			return content
+		}
+		return textblock.NormalizeYAML(result)
+	case "xml":
+		result, err := xmlmap.Decode([]byte(strings.TrimSpace(content)))
+		if err != nil {
+			// 解析失败返回原始字符串
+			return content
+		}
+		return result
 	case "base64":
 		decoded, err := base64.StdEncoding.DecodeString(content)
 		if err != nil {
 			return content
 		}
 		return string(decoded)
+	case "hex":
+		decoded, err := hex.DecodeString(content)
+		if err != nil {
+			return content
+		}
+		return string(decoded)
+	case "urlencode":
+		// 按 RFC 3986 编码：只保留字母、数字和 -._~，空格编码为 %20
+		return strings.ReplaceAll(url.QueryEscape(content), "+", "%20")
+	case "urldecode":
+		decoded, err := url.QueryUnescape(content)
+		if err != nil {
+			return content
+		}
+		return decoded
 	case "file":
 		data, err := os.ReadFile(content)
 		if err != nil {
@@ -746,11 +805,32 @@ func processString(processor, content string) interface{} {
 		}
 		return string(data)
 	default:
-		// 未知处理器，返回原始内容
+		// 未知处理器，返回原始内容（严格模式在解析时报错，见 checkProcessors）
 		return content
 	}
 }
 
+// processors processString 支持的处理器
+var processors = []string{"base64", "file", "hex", "json", "urldecode", "urlencode", "xml", "yaml"}
+
+// checkProcessors 检查配置中（包括嵌套块）的处理器都是 processString 支持的
+func (c *Config) checkProcessors() error {
+	for _, e := range c.Entries {
+		if e.Value == nil {
+			continue
+		}
+		if ps := e.Value.Processed; ps != nil && !slices.Contains(processors, ps.Processor) {
+			return fmt.Errorf("unknown processor %q (valid processors: %s)", ps.Processor, strings.Join(processors, ", "))
+		}
+		if e.Value.Block != nil {
+			if err := e.Value.Block.checkProcessors(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
 // inferType 智能推断字符串值的实际类型
 func inferType(s string) interface{} {
 	// 尝试布尔值
@@ -807,16 +887,37 @@ func getNestedValue(data interface{}, path string) interface{} {
 		return data
 	}
 	
-	parts := strings.Split(path, ".")
+	// items[0] 与 items.0 等价
+	parts := strings.Split(strings.NewReplacer("[", ".", "]", "").Replace(path), ".")
 	current := data
 	
-	for _, part := range parts {
+	for i, part := range parts {
+		// items.*.id：对数组的每个元素取剩余路径，缺少字段的元素为 nil
+		if part == "*" {
+			items, ok := current.([]interface{})
+			if !ok {
+				return nil
+			}
+			out := make([]interface{}, len(items))
+			for j, item := range items {
+				if i+1 < len(parts) {
+					out[j] = getNestedValue(item, strings.Join(parts[i+1:], "."))
+				} else {
+					out[j] = item
+				}
+			}
+			return out
+		}
 		switch v := current.(type) {
 		case map[string]interface{}:
 			current = v[part]
 		case []interface{}:
-			// 支持数组索引
-			if idx, err := strconv.Atoi(part); err == nil && idx >= 0 && idx < len(v) {
+			// 支持数组索引，负数从末尾开始计数（-1 为最后一个元素）
+			idx, err := strconv.Atoi(part)
+			if err == nil && idx < 0 {
+				idx += len(v)
+			}
+			if err == nil && idx >= 0 && idx < len(v) {
 				current = v[idx]
 			} else {
 				return nil
@@ -867,7 +968,7 @@ func (p *Parser) ParseToMapWithStructuredVars(input string, vars map[string]inte
 	bracedCode := preprocess(input)
 
 	// 3. 解析
-	config, err := p.parser.ParseString("", bracedCode)
+	config, err := p.parse(bracedCode)
 	if err != nil {
 		return nil, err
 	}
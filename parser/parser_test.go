@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -78,6 +79,38 @@ body
 	}
 }
 
+func TestParseStringEscapes(t *testing.T) {
+	p, _ := New()
+
+	input := `
+post "https://example.com/api"
+body
+  text "line1\nline2\ttab"
+  quoted "say \"hi\" \\o/"
+  unicode "caf\u00e9 \ud83d\ude00"
+  regex "^\d+$"
+  word "\bfoo\b"
+`
+	result, err := p.ParseToMap(input)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	body := result["body"].(map[string]interface{})
+	expected := map[string]string{
+		"text":    "line1\nline2\ttab",
+		"quoted":  `say "hi" \o/`,
+		"unicode": "café 😀",
+		"regex":   `^\d+$`,
+		"word":    `\bfoo\b`,
+	}
+	for key, want := range expected {
+		if body[key] != want {
+			t.Errorf("Expected %s=%q, got %q", key, want, body[key])
+		}
+	}
+}
+
 func TestParseArray(t *testing.T) {
 	p, _ := New()
 
@@ -214,3 +247,123 @@ body
 		}
 	}
 }
+
+func TestProcessStringXML(t *testing.T) {
+	result, ok := processString("xml", "<a><b></a>").(string)
+	if !ok || result != "<a><b></a>" {
+		t.Errorf("expected invalid XML to fall back to the raw string, got %v", result)
+	}
+
+	data, ok := processString("xml", `
+  <user id="1"><name>John</name></user>
+`).(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected map from xml processor")
+	}
+	user, _ := data["user"].(map[string]interface{})
+	if user["@id"] != "1" || user["name"] != "John" {
+		t.Errorf("unexpected xml result: %v", data)
+	}
+}
+
+func TestProcessStringEncodings(t *testing.T) {
+	tests := []struct {
+		processor, content, expected string
+	}{
+		{"hex", "48656c6C6f", "Hello"},
+		{"hex", "xyz", "xyz"}, // 无效的 hex 保留原始内容
+		{"urlencode", "a b&c=d/é~", "a%20b%26c%3Dd%2F%C3%A9~"},
+		{"urldecode", "a%20b+c%26", "a b c&"},
+		{"urldecode", "100%", "100%"},
+	}
+	for _, tt := range tests {
+		if got := processString(tt.processor, tt.content); got != tt.expected {
+			t.Errorf("%s`%s`: expected %q, got %v", tt.processor, tt.content, tt.expected, got)
+		}
+	}
+}
+
+func TestProcessStringYAML(t *testing.T) {
+	result, ok := processString("yaml", "name: [unclosed").(string)
+	if !ok || result != "name: [unclosed" {
+		t.Errorf("expected invalid YAML to fall back to the raw string, got %v", result)
+	}
+
+	data, ok := processString("yaml", "\n  name: John\n  count: 2\n").(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected map from yaml processor")
+	}
+	if data["name"] != "John" || data["count"] != int64(2) {
+		t.Errorf("unexpected yaml result: %v", data)
+	}
+}
+
+func TestGetNestedValueIndexes(t *testing.T) {
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"id": "a"},
+			map[string]interface{}{"id": "b"},
+		},
+	}
+	tests := []struct {
+		path     string
+		expected interface{}
+	}{
+		{"items.0.id", "a"},
+		{"items.-1.id", "b"},
+		{"items[1].id", "b"},
+		{"items[-2].id", "a"},
+		{"items.-3.id", nil}, // 越界返回 nil
+		{"items.2", nil},
+	}
+	for _, tt := range tests {
+		if got := getNestedValue(data, tt.path); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.path, tt.expected, got)
+		}
+	}
+}
+
+func TestGetNestedValueWildcard(t *testing.T) {
+	data := map[string]interface{}{
+		"items": []interface{}{
+			map[string]interface{}{"id": "a"},
+			map[string]interface{}{"name": "no id"},
+			map[string]interface{}{"id": "c"},
+		},
+	}
+	ids, ok := getNestedValue(data, "items.*.id").([]interface{})
+	if !ok || len(ids) != 3 || ids[0] != "a" || ids[1] != nil || ids[2] != "c" {
+		t.Errorf("unexpected ids: %v", ids)
+	}
+	if items, ok := getNestedValue(data, "items.*").([]interface{}); !ok || len(items) != 3 {
+		t.Errorf("expected items.* to be the array itself, got %v", items)
+	}
+	if got := getNestedValue(data, "*.id"); got != nil {
+		t.Errorf("expected * on an object to be nil, got %v", got)
+	}
+}
+
+func TestParseStrictProcessors(t *testing.T) {
+	p, _ := New()
+	input := `
+post "https://example.com/api"
+body
+  data jsom` + "`" + `{"a": 1}` + "`" + `
+`
+	// 默认把未知处理器的内容当作原始字符串
+	result, err := p.ParseToMap(input)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if body, _ := result["body"].(map[string]interface{}); body["data"] != `{"a": 1}` {
+		t.Errorf("expected raw string, got %v", result["body"])
+	}
+
+	_, err = p.Strict().ParseToMap(input)
+	if err == nil || !strings.Contains(err.Error(), `unknown processor "jsom"`) || !strings.Contains(err.Error(), "json, urldecode") {
+		t.Errorf("expected unknown processor error, got %v", err)
+	}
+	if _, err := p.Strict().ParseToMap("post \"https://example.com/api\"\nbody\n  data json`{\"a\": 1}`\n"); err != nil {
+		t.Errorf("unexpected error for a known processor: %v", err)
+	}
+}
@@ -10,18 +10,26 @@ import (
 	"github.com/LingHeChen/haiku/lexer"
 )
 
+// DefaultMaxDepth is the default maximum nesting depth of blocks, statement
+// bodies and inline objects
+const DefaultMaxDepth = 100
+
 // ParserV2 is the AST-based parser
 type ParserV2 struct {
 	l         *lexer.Lexer
 	curToken  lexer.Token
 	peekToken lexer.Token
 	errors    []string
+	depth     int  // current nesting depth
+	maxDepth  int  // maximum nesting depth (0 = unlimited)
+	lineStart bool // curToken is the first token on its line
 }
 
 // NewV2 creates a new AST-based parser
 func NewV2(input string) *ParserV2 {
 	p := &ParserV2{
-		l: lexer.New(input),
+		l:        lexer.New(input),
+		maxDepth: DefaultMaxDepth,
 	}
 	// Read two tokens to initialize curToken and peekToken
 	p.nextToken()
@@ -29,9 +37,28 @@ func NewV2(input string) *ParserV2 {
 	return p
 }
 
+// SetMaxDepth sets the maximum nesting depth (0 disables the limit)
+func (p *ParserV2) SetMaxDepth(n int) {
+	p.maxDepth = n
+}
+
+// enterNesting increments the nesting depth and reports whether it is still
+// within the limit; otherwise a "nesting too deep" error is recorded.
+// Callers must decrement p.depth when leaving the nested construct.
+func (p *ParserV2) enterNesting(line int) bool {
+	p.depth++
+	if p.maxDepth > 0 && p.depth > p.maxDepth {
+		p.errors = append(p.errors, fmt.Sprintf("nesting too deep at line %d", line))
+		return false
+	}
+	return true
+}
+
 func (p *ParserV2) nextToken() {
+	prev := p.curToken
 	p.curToken = p.peekToken
 	p.peekToken = p.l.NextToken()
+	p.lineStart = prev.Line != p.curToken.Line || prev.Type == lexer.INDENT || prev.Type == lexer.DEDENT
 }
 
 func (p *ParserV2) curTokenIs(t lexer.TokenType) bool {
@@ -107,30 +134,117 @@ func (p *ParserV2) parseStatement() ast.Statement {
 		return p.parseForStmt(false, 0)
 	case lexer.IF:
 		return p.parseIfStmt()
+	case lexer.WHILE:
+		return p.parseWhileStmt()
+	case lexer.BREAK:
+		return &ast.BreakStmt{Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}}
+	case lexer.CONTINUE:
+		return &ast.ContinueStmt{Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}}
 	case lexer.ECHO:
 		return p.parseEchoStmt()
+	case lexer.SLEEP:
+		return p.parseSleepStmt()
+	case lexer.DEF:
+		return p.parseFuncDefStmt()
+	case lexer.CAPTURE:
+		return p.parseCaptureStmt()
 	case lexer.QUESTION:
 		return p.parseQuestionIfStmt()
 	case lexer.TRIPLE_DASH:
 		return p.parseSeparatorStmt()
 	case lexer.GET, lexer.POST, lexer.PUT, lexer.DELETE, lexer.PATCH, lexer.HEAD, lexer.OPTIONS:
 		return p.parseRequestStmt()
+	case lexer.GRAPHQL:
+		return p.parseGraphQLStmt()
+	case lexer.WS:
+		return p.parseWebSocketStmt()
+	case lexer.METHOD:
+		// method "VERB" "url" is a request; otherwise method is an ordinary word
+		if p.peekTokenIs(lexer.STRING) || p.peekTokenIs(lexer.DOLLAR) {
+			return p.parseRequestStmt()
+		}
+		if p.lineStart {
+			return p.parseCallStmt()
+		}
+		return nil
+	case lexer.IDENT:
+		// "run", "skip" and "match" are only keywords at the start of a statement
+		if p.curToken.Literal == "run" {
+			if stmt := p.parseRunStmt(); stmt != nil {
+				return stmt
+			}
+		}
+		if p.curToken.Literal == "skip" && p.peekTokenIs(lexer.IF) {
+			// A rejected skip if has already reported its error; don't fall through to a call
+			if stmt := p.parseSkipStmt(); stmt != nil {
+				return stmt
+			}
+			return nil
+		}
+		if p.curToken.Literal == "match" && !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.EOF) {
+			if stmt := p.parseMatchStmt(); stmt != nil {
+				return stmt
+			}
+		}
+		// Any other word at the start of a line calls a function defined with def;
+		// elsewhere it is a leftover token, skipped like other unknown tokens
+		if p.lineStart {
+			return p.parseCallStmt()
+		}
+		return nil
 	case lexer.DEDENT:
 		return nil // End of block
-	case lexer.HEADERS, lexer.BODY:
+	case lexer.HEADERS, lexer.QUERY, lexer.BODY:
 		// These are handled inside parseRequestStmt, skip if encountered at top level
 		return nil
 	case lexer.INDENT:
-		// Unexpected indent at top level
-		p.nextToken()
+		// Indentation is only meaningful after a statement that opens a block;
+		// anywhere else it is an authoring mistake that would hide statements
+		p.errors = append(p.errors, fmt.Sprintf("unexpected indentation at line %d", p.curToken.Line))
+		p.skipIndentedBlock()
 		return nil
 	default:
-		// Skip unknown tokens instead of erroring
-		p.nextToken()
+		// Skip unknown tokens instead of erroring (the caller advances past it)
 		return nil
 	}
 }
 
+// skipIndentedBlock skips an indented block starting at its INDENT token,
+// leaving curToken at the matching DEDENT (or EOF)
+func (p *ParserV2) skipIndentedBlock() {
+	depth := 0
+	for !p.curTokenIs(lexer.EOF) {
+		switch p.curToken.Type {
+		case lexer.INDENT:
+			depth++
+		case lexer.DEDENT:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
+// skipBlockBody skips the rest of the current block, including any nested
+// blocks, leaving curToken at the block's DEDENT
+func (p *ParserV2) skipBlockBody() {
+	depth := 0
+	for !p.curTokenIs(lexer.EOF) {
+		switch p.curToken.Type {
+		case lexer.INDENT:
+			depth++
+		case lexer.DEDENT:
+			if depth == 0 {
+				return
+			}
+			depth--
+		}
+		p.nextToken()
+	}
+}
+
 func (p *ParserV2) parseImportStmt() *ast.ImportStmt {
 	stmt := &ast.ImportStmt{
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
@@ -141,10 +255,41 @@ func (p *ParserV2) parseImportStmt() *ast.ImportStmt {
 	}
 
 	stmt.Path = p.curToken.Literal
+
+	// with requests: also run the requests and loops of the imported file
+	if p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "with" {
+		p.nextToken()
+		if !p.peekTokenIs(lexer.IDENT) || p.peekToken.Literal != "requests" {
+			p.addError("expected requests after with")
+			return nil
+		}
+		p.nextToken()
+		stmt.Requests = true
+		return stmt
+	}
+
+	// only name, ...: import just the listed variables
+	if p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "only" {
+		p.nextToken()
+		for {
+			p.nextToken()
+			switch p.curToken.Type {
+			case lexer.IDENT, lexer.TIMEOUT, lexer.HEADERS, lexer.BODY, lexer.QUERY:
+				stmt.Only = append(stmt.Only, p.curToken.Literal)
+			default:
+				p.addError("expected variable name after only, got %s", p.curToken.Type)
+				return nil
+			}
+			if !p.peekTokenIs(lexer.COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+	}
 	return stmt
 }
 
-func (p *ParserV2) parseVarDefStmt() *ast.VarDefStmt {
+func (p *ParserV2) parseVarDefStmt() ast.Statement {
 	stmt := &ast.VarDefStmt{
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
 	}
@@ -153,8 +298,8 @@ func (p *ParserV2) parseVarDefStmt() *ast.VarDefStmt {
 	p.nextToken()
 	if p.curTokenIs(lexer.IDENT) {
 		stmt.Name = p.curToken.Literal
-	} else if p.curTokenIs(lexer.TIMEOUT) || p.curTokenIs(lexer.HEADERS) || p.curTokenIs(lexer.BODY) {
-		// Allow keywords to be used as variable names
+	} else if isKeywordKey(p.curToken.Type) {
+		// Allow keywords to be used as variable names (@timeout, @def, ...)
 		stmt.Name = p.curToken.Literal
 	} else {
 		p.addError("expected identifier after @")
@@ -163,11 +308,42 @@ func (p *ParserV2) parseVarDefStmt() *ast.VarDefStmt {
 
 	p.nextToken()
 
+	// @flow name followed by an indented block defines a flow
+	if stmt.Name == "flow" && p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.NEWLINE) {
+		name := p.curToken.Literal
+		namePos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+		p.nextToken() // move to NEWLINE
+		if p.peekTokenIs(lexer.INDENT) {
+			return &ast.FlowDefStmt{
+				Position: stmt.Position,
+				Name:     name,
+				// curToken is at DEDENT (last token of the flow) after the body
+				Body: p.parseIndentedBody(),
+			}
+		}
+		// Without a body, @flow is an ordinary variable
+		stmt.Value = &ast.StringLiteral{Position: namePos, Value: name}
+		return stmt
+	}
+
+	// @template name followed by an indented block of request sections defines a template
+	if stmt.Name == "template" && p.curTokenIs(lexer.IDENT) && p.peekTokenIs(lexer.NEWLINE) {
+		name := p.curToken.Literal
+		namePos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+		p.nextToken() // move to NEWLINE
+		if p.peekTokenIs(lexer.INDENT) {
+			return p.parseTemplateDef(stmt.Position, name)
+		}
+		// Without a body, @template is an ordinary variable
+		stmt.Value = &ast.StringLiteral{Position: namePos, Value: name}
+		return stmt
+	}
+
 	// Check if there's a value on the same line or an indented block
 	if p.curTokenIs(lexer.NEWLINE) {
 		// Check for indented block
-		p.nextToken()
-		if p.curTokenIs(lexer.INDENT) {
+		if p.peekTokenIs(lexer.INDENT) {
+			p.nextToken()
 			stmt.Value = p.parseBlockExpr()
 		}
 	} else if !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.DEDENT) {
@@ -178,6 +354,159 @@ func (p *ParserV2) parseVarDefStmt() *ast.VarDefStmt {
 	return stmt
 }
 
+// parseTemplateDef parses the indented block of @template name: one request
+// section (headers, body, auth, use, ...) per line.
+// Starts at the NEWLINE before the block; after return, curToken is at its DEDENT.
+func (p *ParserV2) parseTemplateDef(pos ast.Position, name string) *ast.TemplateDefStmt {
+	stmt := &ast.TemplateDefStmt{
+		Position: pos,
+		Name:     name,
+		Request:  &ast.RequestStmt{Position: pos},
+	}
+	p.nextToken() // move to INDENT
+	for {
+		switch {
+		case p.peekTokenIs(lexer.NEWLINE), p.peekTokenIs(lexer.COMMENT):
+			p.nextToken()
+		case p.peekIsRequestSection():
+			p.nextToken()
+			if !p.parseRequestSection(stmt.Request) {
+				p.skipBlockBody()
+				return stmt
+			}
+		case p.peekTokenIs(lexer.DEDENT), p.peekTokenIs(lexer.EOF):
+			p.nextToken()
+			return stmt
+		default:
+			p.nextToken()
+			p.addError("expected a request section (headers, body, auth, ...) in @template %s, got %s", name, p.curToken.Literal)
+			p.skipBlockBody()
+			return stmt
+		}
+	}
+}
+
+// parseFuncDefStmt parses: def name($param, ...) NEWLINE INDENT body DEDENT.
+// The parameter list is optional for a function without parameters.
+// After return, curToken is at the DEDENT that ends the body.
+func (p *ParserV2) parseFuncDefStmt() *ast.FuncDefStmt {
+	stmt := &ast.FuncDefStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+
+	if p.peekTokenIs(lexer.LPAREN) {
+		p.nextToken()
+		for !p.peekTokenIs(lexer.RPAREN) {
+			if len(stmt.Params) > 0 && !p.expectPeek(lexer.COMMA) {
+				return nil
+			}
+			if !p.expectPeek(lexer.DOLLAR) || !p.expectPeek(lexer.IDENT) {
+				return nil
+			}
+			for _, param := range stmt.Params {
+				if param == p.curToken.Literal {
+					p.addError("duplicate parameter $%s in def %s", param, stmt.Name)
+				}
+			}
+			stmt.Params = append(stmt.Params, p.curToken.Literal)
+		}
+		p.nextToken() // move to )
+	}
+
+	p.nextToken()
+	if !p.curTokenIs(lexer.NEWLINE) || !p.peekTokenIs(lexer.INDENT) {
+		p.addError("expected an indented body after def %s", stmt.Name)
+		return nil
+	}
+	stmt.Body = p.parseIndentedBody()
+	return stmt
+}
+
+// parseCallStmt parses a call of a function defined with def: name [arg ...]
+// with arguments separated by spaces or commas, or name(arg, ...).
+// After return, curToken is at the last token of the call.
+func (p *ParserV2) parseCallStmt() *ast.CallStmt {
+	stmt := &ast.CallStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+		Name:     p.curToken.Literal,
+	}
+	if p.peekTokenIs(lexer.LPAREN) && p.peekIsAdjacent() {
+		p.nextToken()
+		for !p.peekTokenIs(lexer.RPAREN) {
+			if len(stmt.Args) > 0 && !p.expectPeek(lexer.COMMA) {
+				return nil
+			}
+			p.nextToken()
+			arg := p.parseExpression()
+			if arg == nil {
+				p.addError("invalid argument in call of %s", stmt.Name)
+				return nil
+			}
+			stmt.Args = append(stmt.Args, arg)
+		}
+		p.nextToken() // move to )
+		return stmt
+	}
+	for !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.EOF) &&
+		!p.peekTokenIs(lexer.DEDENT) && !p.peekTokenIs(lexer.COMMENT) {
+		if p.peekTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
+		}
+		p.nextToken()
+		arg := p.parseExpression()
+		if arg == nil {
+			p.addError("invalid argument in call of %s", stmt.Name)
+			return nil
+		}
+		stmt.Args = append(stmt.Args, arg)
+	}
+	return stmt
+}
+
+func (p *ParserV2) parseRunStmt() *ast.RunStmt {
+	stmt := &ast.RunStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	stmt.Name = p.curToken.Literal
+	return stmt
+}
+
+// parseSkipStmt parses: skip if condition
+// skip guards a whole file, so it is only allowed at the top level.
+func (p *ParserV2) parseSkipStmt() *ast.SkipStmt {
+	stmt := &ast.SkipStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+	if p.depth > 0 {
+		p.addError("skip is only allowed at the top level of a file")
+		// Consume the condition so the rest of the line isn't reported again
+		p.nextToken()
+		p.nextToken()
+		p.parseConditionExpression()
+		return nil
+	}
+
+	p.nextToken() // skip 'skip'
+	p.nextToken() // skip 'if'
+
+	stmt.Condition = p.parseConditionExpression()
+	if stmt.Condition == nil {
+		p.addError("expected condition after skip if")
+		return nil
+	}
+	return stmt
+}
+
 func (p *ParserV2) parseParallelForStmt() *ast.ForStmt {
 	pos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
 	
@@ -190,6 +519,29 @@ func (p *ParserV2) parseParallelForStmt() *ast.ForStmt {
 		concurrency = val
 		p.nextToken()
 	}
+
+	// Check for optional rate limit: rate 10/s
+	var rate float64
+	if p.curTokenIs(lexer.IDENT) && p.curToken.Literal == "rate" {
+		p.nextToken() // skip 'rate'
+		if !p.curTokenIs(lexer.INT) && !p.curTokenIs(lexer.FLOAT) {
+			p.addError("expected requests per second after 'rate', e.g. rate 10/s")
+			return nil
+		}
+		rate, _ = strconv.ParseFloat(p.curToken.Literal, 64)
+		if rate <= 0 {
+			p.addError("rate must be greater than 0")
+			return nil
+		}
+		p.nextToken()
+		// '/' has no token of its own, so "/s" lexes as ILLEGAL followed by IDENT
+		if p.curToken.Literal != "/" || !p.peekTokenIs(lexer.IDENT) || p.peekToken.Literal != "s" {
+			p.addError("expected '/s' after rate, e.g. rate 10/s")
+			return nil
+		}
+		p.nextToken() // skip '/'
+		p.nextToken() // skip 's'
+	}
 	
 	// Expect 'for'
 	if !p.curTokenIs(lexer.FOR) {
@@ -200,6 +552,7 @@ func (p *ParserV2) parseParallelForStmt() *ast.ForStmt {
 	stmt := p.parseForStmt(true, concurrency)
 	if stmt != nil {
 		stmt.Position = pos
+		stmt.Rate = rate
 	}
 	return stmt
 }
@@ -272,14 +625,7 @@ func (p *ParserV2) parseForStmt(parallel bool, concurrency int) *ast.ForStmt {
 		p.nextToken() // INDENT
 
 		// Parse statements inside the loop
-		// Stop at DEDENT, EOF, or TRIPLE_DASH (request separator)
-		for !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.TRIPLE_DASH) {
-			innerStmt := p.parseStatement()
-			if innerStmt != nil {
-				stmt.Body = append(stmt.Body, innerStmt)
-			}
-			p.nextToken()
-		}
+		stmt.Body = p.parseBlockStatements()
 	}
 
 	return stmt
@@ -300,6 +646,48 @@ func (p *ParserV2) parseEchoStmt() *ast.EchoStmt {
 	return stmt
 }
 
+// parseSleepStmt parses: sleep duration (30, "2s", 500ms, $pause)
+func (p *ParserV2) parseSleepStmt() *ast.SleepStmt {
+	stmt := &ast.SleepStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	if p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.EOF) || p.peekTokenIs(lexer.DEDENT) {
+		p.addError("expected duration after sleep")
+		return nil
+	}
+	p.nextToken() // skip 'sleep'
+	stmt.Duration = p.parseTimeoutExpression()
+	return stmt
+}
+
+// parseCaptureStmt parses: capture name expression
+func (p *ParserV2) parseCaptureStmt() *ast.CaptureStmt {
+	stmt := &ast.CaptureStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	if !p.peekTokenIs(lexer.IDENT) && !isKeywordKey(p.peekToken.Type) {
+		p.addError("expected variable name after capture")
+		return nil
+	}
+	p.nextToken()
+	stmt.Name = p.curToken.Literal
+
+	p.nextToken() // skip name
+	if p.curTokenIs(lexer.NEWLINE) || p.curTokenIs(lexer.EOF) || p.curTokenIs(lexer.DEDENT) {
+		p.addError("expected value after capture %s (e.g. capture %s $_.data.%s)", stmt.Name, stmt.Name, stmt.Name)
+		return nil
+	}
+	stmt.Path = p.parseExpression()
+	if stmt.Path == nil {
+		p.addError("unexpected %s in capture %s", p.curToken.Type, stmt.Name)
+		return nil
+	}
+
+	return stmt
+}
+
 func (p *ParserV2) parseSeparatorStmt() *ast.SeparatorStmt {
 	return &ast.SeparatorStmt{
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
@@ -350,6 +738,102 @@ func (p *ParserV2) parseIfStmt() *ast.IfStmt {
 	return stmt
 }
 
+// parseWhileStmt parses: while condition NEWLINE INDENT body DEDENT
+func (p *ParserV2) parseWhileStmt() *ast.WhileStmt {
+	stmt := &ast.WhileStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	p.nextToken() // skip 'while'
+
+	stmt.Condition = p.parseConditionExpression()
+	if stmt.Condition == nil {
+		p.addError("expected condition after while")
+	}
+
+	// Skip to newline
+	for !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.EOF) {
+		p.nextToken()
+	}
+
+	stmt.Body = p.parseIndentedBody()
+
+	// curToken is at DEDENT (last token of the while statement)
+	return stmt
+}
+
+// parseMatchStmt parses:
+//
+//	match subject
+//	  case value[, value...]
+//	    body
+//	  default
+//	    body
+//
+// After return, curToken is at the DEDENT that ends the case arms.
+func (p *ParserV2) parseMatchStmt() *ast.MatchStmt {
+	stmt := &ast.MatchStmt{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	p.nextToken() // skip 'match'
+	stmt.Subject = p.parseExpression()
+	if stmt.Subject == nil {
+		p.addError("expected value after match")
+		return nil
+	}
+	p.nextToken()
+	if !p.curTokenIs(lexer.NEWLINE) || !p.peekTokenIs(lexer.INDENT) {
+		p.addError("expected indented case arms after match")
+		return nil
+	}
+	p.nextToken() // move to INDENT
+
+	hasDefault := false
+	for {
+		switch {
+		case p.peekTokenIs(lexer.NEWLINE), p.peekTokenIs(lexer.COMMENT):
+			p.nextToken()
+		case p.peekTokenIs(lexer.DEDENT), p.peekTokenIs(lexer.EOF):
+			p.nextToken()
+			return stmt
+		case p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "case":
+			p.nextToken()
+			arm := ast.MatchCase{Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}}
+			for {
+				p.nextToken()
+				value := p.parseExpression()
+				if value == nil {
+					p.addError("expected value after case")
+					p.skipBlockBody()
+					return stmt
+				}
+				arm.Values = append(arm.Values, value)
+				if !p.peekTokenIs(lexer.COMMA) {
+					break
+				}
+				p.nextToken()
+			}
+			p.nextToken()
+			arm.Body = p.parseIndentedBody()
+			stmt.Cases = append(stmt.Cases, arm)
+		case p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "default":
+			p.nextToken()
+			if hasDefault {
+				p.addError("match has more than one default")
+			}
+			hasDefault = true
+			p.nextToken()
+			stmt.Default = p.parseIndentedBody()
+		default:
+			p.nextToken()
+			p.addError("expected case or default in match, got %s", p.curToken.Literal)
+			p.skipBlockBody()
+			return stmt
+		}
+	}
+}
+
 func (p *ParserV2) parseQuestionIfStmt() *ast.IfStmt {
 	stmt := &ast.IfStmt{
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
@@ -422,19 +906,37 @@ func (p *ParserV2) parseIndentedBody() []ast.Statement {
 	p.nextToken() // consume NEWLINE, curToken = INDENT
 	p.nextToken() // consume INDENT, curToken = first token in block
 
-	for !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.TRIPLE_DASH) {
+	// Leave curToken at DEDENT - do NOT advance past it
+	return p.parseBlockStatements()
+}
+
+// parseBlockStatements parses statements until the end of the current block.
+// Expects curToken to be the first token in the block. Every statement ends on
+// its own last token, so the loop always advances once after each statement.
+// Stops at DEDENT, EOF, or TRIPLE_DASH (request separator) without consuming it.
+func (p *ParserV2) parseBlockStatements() []ast.Statement {
+	var stmts []ast.Statement
+
+	defer func() { p.depth-- }()
+	if !p.enterNesting(p.curToken.Line) {
+		p.skipBlockBody()
+		return stmts
+	}
+
+	for {
+		for p.curTokenIs(lexer.NEWLINE) || p.curTokenIs(lexer.COMMENT) {
+			p.nextToken()
+		}
+		if p.curTokenIs(lexer.DEDENT) || p.curTokenIs(lexer.EOF) || p.curTokenIs(lexer.TRIPLE_DASH) {
+			return stmts
+		}
+
 		innerStmt := p.parseStatement()
 		if innerStmt != nil {
 			stmts = append(stmts, innerStmt)
 		}
-		// Only advance if parseStatement didn't already reach a block terminator.
-		if !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.TRIPLE_DASH) {
-			p.nextToken()
-		}
+		p.nextToken()
 	}
-
-	// Leave curToken at DEDENT - do NOT advance past it
-	return stmts
 }
 
 func (p *ParserV2) parseConditionExpression() ast.Expression {
@@ -547,81 +1049,386 @@ func (p *ParserV2) parseRequestStmt() *ast.RequestStmt {
 
 	p.nextToken()
 
+	// method "PURGE" "url": the verb comes before the URL
+	if stmt.Method == "method" {
+		stmt.Verb = p.parseExpression()
+		p.nextToken()
+	}
+
 	// Parse URL
 	stmt.URL = p.parseExpression()
 
-	// Skip to newline
-	for !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.EOF) {
-		p.nextToken()
+	// Parse headers/body/timeout/use sections. They appear either on the URL line
+	// (e.g. post "url" body {name=John}) or on the following lines at the same
+	// indent level as the method. curToken is always the last consumed token, so
+	// the request ends on its own last token like every other statement.
+	for {
+		switch {
+		case p.peekTokenIs(lexer.COMMENT):
+			p.nextToken()
+		case p.peekTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.NEWLINE):
+			p.nextToken() // end of the current line
+		case p.peekIsRequestSection():
+			p.nextToken()
+			if !p.parseRequestSection(stmt) {
+				return stmt
+			}
+		case stmt.Method == "graphql" && p.peekIsGraphQLSection():
+			p.nextToken()
+			p.parseGraphQLSection(stmt)
+		case stmt.Method == "ws" && p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "send":
+			p.nextToken()
+			stmt.WSSend = p.parseValueSection()
+		case !p.curTokenIs(lexer.NEWLINE) && p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "skip":
+			// Trailing guard on the request line: get "url" skip if cond. On a
+			// line of its own, skip if is the file-level skip statement.
+			p.nextToken()
+			if !p.expectPeek(lexer.IF) {
+				return stmt
+			}
+			p.nextToken()
+			stmt.Skip = p.parseConditionExpression()
+			if stmt.Skip == nil {
+				p.addError("expected condition after skip if")
+				return stmt
+			}
+		case !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) &&
+			!p.peekTokenIs(lexer.EOF) && !p.peekTokenIs(lexer.DEDENT):
+			p.nextToken() // skip unknown tokens on the same line
+		default:
+			// Not a request section, done parsing this request
+			return stmt
+		}
 	}
+}
 
-	// Skip newline
-	if p.curTokenIs(lexer.NEWLINE) {
-		p.nextToken()
+// parseGraphQLStmt parses: graphql "url" with a query`...` document and an
+// optional variables block, next to the usual request sections
+func (p *ParserV2) parseGraphQLStmt() *ast.RequestStmt {
+	stmt := p.parseRequestStmt()
+	if stmt.GQLQuery == nil {
+		p.addError("expected query`...` in graphql request")
+	}
+	if stmt.Body != nil || stmt.Form != nil {
+		p.addError("graphql request builds its own body, use query`...` and variables instead")
 	}
+	return stmt
+}
 
-	// Parse headers/body sections (they appear at same indent level as the method)
-	for {
-		// Skip empty lines
-		for p.curTokenIs(lexer.NEWLINE) || p.curTokenIs(lexer.COMMENT) {
+// parseWebSocketStmt parses: ws "url" with an optional send block of messages,
+// next to the usual request sections
+func (p *ParserV2) parseWebSocketStmt() *ast.RequestStmt {
+	stmt := p.parseRequestStmt()
+	if stmt.Body != nil || stmt.Form != nil {
+		p.addError("ws request has no body, use send for the messages")
+	}
+	return stmt
+}
+
+// peekIsGraphQLSection reports whether the next token starts a section that
+// only graphql requests have: query`...` or variables
+func (p *ParserV2) peekIsGraphQLSection() bool {
+	switch p.peekToken.Type {
+	case lexer.PROC_STRING:
+		return strings.HasPrefix(p.peekToken.Literal, "query`")
+	case lexer.IDENT:
+		return p.peekToken.Literal == "variables"
+	}
+	return false
+}
+
+// parseGraphQLSection parses query`...` or variables, with an inline value or
+// an indented block like body.
+// After return, curToken is at the last token of the section.
+func (p *ParserV2) parseGraphQLSection(stmt *ast.RequestStmt) {
+	if p.curTokenIs(lexer.PROC_STRING) {
+		stmt.GQLQuery = p.parseProcessedString()
+		return
+	}
+	stmt.GQLVars = p.parseValueSection()
+}
+
+// parseValueSection parses the value of a section keyword like variables or
+// send: an inline value or an indented block.
+// After return, curToken is at the last token of the section.
+func (p *ParserV2) parseValueSection() ast.Expression {
+	if p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+		if p.peekTokenIs(lexer.INDENT) {
 			p.nextToken()
+			return p.parseBlockExpr()
 		}
+	} else if !p.peekTokenIs(lexer.EOF) && !p.peekTokenIs(lexer.DEDENT) {
+		p.nextToken()
+		return p.parseExpression()
+	}
+	return nil
+}
 
-		if p.curTokenIs(lexer.HEADERS) {
+// peekIsRequestSection reports whether the next token starts a request section
+func (p *ParserV2) peekIsRequestSection() bool {
+	switch p.peekToken.Type {
+	case lexer.HEADERS, lexer.QUERY, lexer.BODY, lexer.TIMEOUT:
+		return true
+	case lexer.IDENT:
+		// "use", "retry", "form", "auth", "assert", "validate", "insecure", "ca_cert" and "proxy" are only keywords here, so they stay usable as body keys
+		switch p.peekToken.Literal {
+		case "use", "retry", "form", "auth", "assert", "validate", "insecure", "ca_cert", "proxy":
+			return true
+		}
+	}
+	return false
+}
+
+// parseRequestSection parses one section of a request, starting at its keyword.
+// After return, curToken is at the last token of the section.
+func (p *ParserV2) parseRequestSection(stmt *ast.RequestStmt) bool {
+	switch p.curToken.Type {
+	case lexer.HEADERS:
+		stmt.Headers = p.parseSectionBlock()
+
+	case lexer.QUERY:
+		stmt.Query = p.parseSectionBlock()
+
+	case lexer.BODY:
+		// Check if body has inline value or block
+		if p.peekTokenIs(lexer.NEWLINE) {
 			p.nextToken()
-			// Skip newline
-			for p.curTokenIs(lexer.NEWLINE) {
+			if p.peekTokenIs(lexer.INDENT) {
 				p.nextToken()
+				stmt.Body = p.parseBlockExpr()
 			}
-			if p.curTokenIs(lexer.INDENT) {
-				stmt.Headers = p.parseBlockExpr()
-				// After parsing block, we're at DEDENT or next token
-				if p.curTokenIs(lexer.DEDENT) {
-					p.nextToken()
+		} else if !p.peekTokenIs(lexer.EOF) && !p.peekTokenIs(lexer.DEDENT) {
+			// Inline body value (e.g., body json`...`, body {name=John})
+			p.nextToken()
+			stmt.Body = p.parseExpression()
+		}
+
+	case lexer.TIMEOUT:
+		p.nextToken()
+		// Parse timeout expression (e.g., 30, "30s", "5000ms", 1m)
+		// Special handling: if we have a number followed by an identifier, combine them
+		stmt.Timeout = p.parseTimeoutExpression()
+
+	case lexer.IDENT:
+		switch p.curToken.Literal {
+		case "retry":
+			stmt.Retry = p.parseRetrySpec()
+			return stmt.Retry != nil
+		case "form":
+			stmt.Form = p.parseSectionBlock()
+			return true
+		case "auth":
+			stmt.Auth = p.parseAuthSpec()
+			return stmt.Auth != nil
+		case "insecure":
+			// insecure [true|false|$var]; a bare insecure means true
+			if p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.EOF) || p.peekTokenIs(lexer.DEDENT) {
+				stmt.Insecure = &ast.BoolLiteral{
+					Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+					Value:    true,
 				}
+				return true
 			}
-		} else if p.curTokenIs(lexer.BODY) {
 			p.nextToken()
-			// Check if body has inline value or block
-			if p.curTokenIs(lexer.NEWLINE) {
-				p.nextToken()
-				if p.curTokenIs(lexer.INDENT) {
-					stmt.Body = p.parseBlockExpr()
-					// After parsing block, we're at DEDENT or next token
-					if p.curTokenIs(lexer.DEDENT) {
-						p.nextToken()
-					}
+			stmt.Insecure = p.parsePrimary()
+			return stmt.Insecure != nil
+		case "ca_cert":
+			// ca_cert "path/to/ca.pem"
+			p.nextToken()
+			stmt.CACert = p.parsePrimary()
+			return stmt.CACert != nil
+		case "proxy":
+			// proxy "http://proxy.internal:3128"
+			p.nextToken()
+			stmt.Proxy = p.parsePrimary()
+			return stmt.Proxy != nil
+		case "assert":
+			assertion := p.parseAssertion()
+			if assertion == nil {
+				return false
+			}
+			stmt.Asserts = append(stmt.Asserts, *assertion)
+			return true
+		case "validate":
+			// validate schema`{...}` | validate file`schema.json`
+			if p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.EOF) || p.peekTokenIs(lexer.DEDENT) {
+				p.addError("expected JSON Schema after validate")
+				return false
+			}
+			p.nextToken()
+			stmt.Validate = p.parsePrimary()
+			return stmt.Validate != nil
+		}
+		// use <name>: merge a named header variable into this request
+		if !p.expectPeek(lexer.IDENT) {
+			return false
+		}
+		stmt.Uses = append(stmt.Uses, p.curToken.Literal)
+	}
+
+	return true
+}
+
+// parseAssertion parses: assert <subject> [op] <expected>
+// Starts at "assert"; after return, curToken is at the last token of the section.
+func (p *ParserV2) parseAssertion() *ast.Assertion {
+	assertion := &ast.Assertion{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+		Operator: "==",
+	}
+
+	p.nextToken()
+	if !p.curTokenIs(lexer.IDENT) && !isKeywordKey(p.curToken.Type) {
+		p.addError("expected assertion subject (status, time or a response path), got %s", p.curToken.Type)
+		return nil
+	}
+	assertion.Subject = append(assertion.Subject, p.curToken.Literal)
+	for p.peekTokenIs(lexer.DOT) {
+		p.nextToken()
+		p.nextToken()
+		switch {
+		case p.curTokenIs(lexer.IDENT), p.curTokenIs(lexer.INT), p.curTokenIs(lexer.STRING), isKeywordKey(p.curToken.Type):
+			assertion.Subject = append(assertion.Subject, p.curToken.Literal)
+		default:
+			p.addError("unexpected %s in assertion path", p.curToken.Type)
+			return nil
+		}
+	}
+
+	switch p.peekToken.Type {
+	case lexer.EQ, lexer.NE, lexer.GT, lexer.LT, lexer.GTE, lexer.LTE:
+		p.nextToken()
+		assertion.Operator = p.curToken.Literal
+	}
+
+	if p.peekTokenIs(lexer.NEWLINE) || p.peekTokenIs(lexer.EOF) || p.peekTokenIs(lexer.DEDENT) {
+		p.addError("expected value after assert %s", strings.Join(assertion.Subject, "."))
+		return nil
+	}
+	p.nextToken()
+	// Durations such as 500ms are combined the same way as in timeout
+	assertion.Expected = p.parseTimeoutExpression()
+	if assertion.Expected == nil {
+		return nil
+	}
+	return assertion
+}
+
+// parseAuthSpec parses: auth basic <user> <pass> | auth bearer <token>
+// | auth awsv4 <access key> <secret key> <region> <service> [session token]
+// Starts at "auth"; after return, curToken is at the last token of the section.
+func (p *ParserV2) parseAuthSpec() *ast.AuthSpec {
+	spec := &ast.AuthSpec{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	if !p.expectPeek(lexer.IDENT) {
+		return nil
+	}
+	spec.Scheme = strings.ToLower(p.curToken.Literal)
+
+	for !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.EOF) && !p.peekTokenIs(lexer.DEDENT) {
+		p.nextToken()
+		arg := p.parsePrimary()
+		if arg == nil {
+			p.addError("unexpected %s in auth", p.curToken.Type)
+			return nil
+		}
+		spec.Args = append(spec.Args, arg)
+	}
+
+	var want int
+	switch spec.Scheme {
+	case "basic":
+		want = 2
+	case "bearer":
+		want = 1
+	case "awsv4":
+		// the session token of temporary credentials is optional
+		if n := len(spec.Args); n != 4 && n != 5 {
+			p.addError("auth awsv4 expects access key, secret key, region and service (and an optional session token), got %d argument(s)", n)
+			return nil
+		}
+		return spec
+	default:
+		p.addError("unknown auth scheme %q (expected basic, bearer or awsv4)", spec.Scheme)
+		return nil
+	}
+	if len(spec.Args) != want {
+		p.addError("auth %s expects %d argument(s), got %d", spec.Scheme, want, len(spec.Args))
+		return nil
+	}
+
+	return spec
+}
+
+// parseRetrySpec parses: retry <count> [fixed|linear|exponential] [always]
+// Starts at "retry"; after return, curToken is at the last token of the section.
+func (p *ParserV2) parseRetrySpec() *ast.RetrySpec {
+	spec := &ast.RetrySpec{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+	}
+
+	p.nextToken()
+	spec.Count = p.parsePrimary()
+	if spec.Count == nil {
+		p.addError("expected retry count")
+		return nil
+	}
+
+	for p.peekTokenIs(lexer.IDENT) {
+		p.nextToken()
+		switch p.curToken.Literal {
+		case "fixed", "linear", "exponential":
+			spec.Backoff = p.curToken.Literal
+		case "always":
+			spec.Always = true
+		case "on":
+			// on 429,503: a comma-separated list of status codes
+			for {
+				if !p.expectPeek(lexer.INT) {
+					return nil
 				}
-			} else if !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.DEDENT) {
-				// Inline body value (e.g., body json`...`)
-				stmt.Body = p.parseExpression()
-				// Skip to newline
-				for !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.EOF) {
-					p.nextToken()
+				status, err := strconv.Atoi(p.curToken.Literal)
+				if err != nil || status < 100 || status > 599 {
+					p.addError("invalid retry status %q", p.curToken.Literal)
+					return nil
 				}
-				if p.curTokenIs(lexer.NEWLINE) {
-					p.nextToken()
+				spec.On = append(spec.On, status)
+				if !p.peekTokenIs(lexer.COMMA) {
+					break
 				}
-			}
-		} else if p.curTokenIs(lexer.TIMEOUT) {
-			p.nextToken()
-			// Parse timeout expression (e.g., 30, "30s", "5000ms", 1m)
-			// Special handling: if we have a number followed by an identifier, combine them
-			stmt.Timeout = p.parseTimeoutExpression()
-			// Skip to newline
-			for !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.DEDENT) {
 				p.nextToken()
 			}
-			if p.curTokenIs(lexer.NEWLINE) {
-				p.nextToken()
-			}
-		} else {
-			// Not headers, body, or timeout, done parsing this request
-			break
+		default:
+			p.addError("unknown retry option %q", p.curToken.Literal)
+			return nil
 		}
 	}
 
-	return stmt
+	return spec
+}
+
+// parseSectionBlock parses the key-value block of a headers/query/form section:
+// either an indented block or an inline object (headers {Accept="application/json"}).
+// Starts at the section keyword; after return, curToken is at the last token of the section.
+func (p *ParserV2) parseSectionBlock() *ast.BlockExpr {
+	if p.peekTokenIs(lexer.LBRACE) {
+		p.nextToken()
+		if block, ok := p.parseInlineObject().(*ast.BlockExpr); ok {
+			return block
+		}
+		return nil
+	}
+	if p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken()
+		if p.peekTokenIs(lexer.INDENT) {
+			p.nextToken()
+			return p.parseBlockExpr()
+		}
+	}
+	return nil
 }
 
 // parseTimeoutExpression parses a timeout value, handling number+unit combinations like "1m", "30s"
@@ -658,6 +1465,12 @@ func (p *ParserV2) parseBlockExpr() *ast.BlockExpr {
 
 	p.nextToken() // move past INDENT
 
+	defer func() { p.depth-- }()
+	if !p.enterNesting(block.Position.Line) {
+		p.skipBlockBody()
+		return block
+	}
+
 	for !p.curTokenIs(lexer.DEDENT) && !p.curTokenIs(lexer.EOF) {
 		// Skip newlines and comments
 		if p.curTokenIs(lexer.NEWLINE) || p.curTokenIs(lexer.COMMENT) {
@@ -681,8 +1494,26 @@ func (p *ParserV2) parseEntry() *ast.Entry {
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
 	}
 
+	// A bare identifier/string is an array item, or the key of a nested block
+	bare := false
+	var bareKey string
+
 	// First token could be a key or a standalone value
-	if p.curTokenIs(lexer.IDENT) || p.curTokenIs(lexer.STRING) {
+	if p.curTokenIs(lexer.LBRACKET) {
+		// Computed key: [$field] value
+		entry.KeyExpr = p.parseComputedKey()
+		if entry.KeyExpr == nil {
+			return nil
+		}
+		if !p.peekTokenIs(lexer.NEWLINE) && !p.peekTokenIs(lexer.IF) && !p.peekTokenIs(lexer.COMMENT) &&
+			!p.peekTokenIs(lexer.DEDENT) && !p.peekTokenIs(lexer.EOF) {
+			p.nextToken()
+			entry.Value = p.parseExpression()
+		} else {
+			// Value comes from a nested block
+			entry.Value = &ast.NullLiteral{Position: entry.Position}
+		}
+	} else if p.curTokenIs(lexer.IDENT) || p.curTokenIs(lexer.STRING) || isKeywordKey(p.curToken.Type) {
 		// Save first value
 		firstVal := p.curToken.Literal
 		firstType := p.curToken.Type
@@ -690,13 +1521,15 @@ func (p *ParserV2) parseEntry() *ast.Entry {
 		p.nextToken()
 
 		// Check if there's a value following (making first token a key)
-		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) && 
-		   !p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.COMMENT) {
+		if !p.curTokenIs(lexer.NEWLINE) && !p.curTokenIs(lexer.DEDENT) &&
+			!p.curTokenIs(lexer.EOF) && !p.curTokenIs(lexer.COMMENT) && !p.curTokenIs(lexer.IF) {
 			// First token is key, parse value
 			entry.Key = firstVal
 			entry.Value = p.parseExpression()
 		} else {
 			// First token is the value (array item)
+			bare = true
+			bareKey = firstVal
 			entry.Key = ""
 			if firstType == lexer.STRING {
 				entry.Value = &ast.StringLiteral{
@@ -717,16 +1550,106 @@ func (p *ParserV2) parseEntry() *ast.Entry {
 		entry.Value = p.parseExpression()
 	}
 
-	// Check for nested block
+	// Optional guard: key value if condition
+	if !p.curTokenIs(lexer.IF) && p.peekTokenIs(lexer.IF) {
+		p.nextToken()
+	}
+	if p.curTokenIs(lexer.IF) {
+		p.nextToken() // skip 'if'
+		// Leaves curToken just past the condition (end of line)
+		entry.Condition = p.parseConditionExpression()
+	}
+
+	// Check for nested block (a bare first token is its key)
+	if !p.curTokenIs(lexer.NEWLINE) && entry.KeyExpr != nil && p.peekTokenIs(lexer.NEWLINE) {
+		p.nextToken() // computed key without inline value: move to end of line
+	}
 	if p.peekTokenIs(lexer.INDENT) {
 		p.nextToken() // move to INDENT
+		if bare {
+			entry.Key = bareKey
+		}
 		entry.Value = p.parseBlockExpr()
 	}
 
 	return entry
 }
 
+// isKeywordKey reports whether a keyword may also be used as a key inside blocks
+// (e.g. "query" in a GraphQL body, "timeout" in a config object)
+func isKeywordKey(t lexer.TokenType) bool {
+	switch t {
+	case lexer.IMPORT, lexer.FOR, lexer.IN, lexer.PARALLEL,
+		lexer.ECHO, lexer.CAPTURE, lexer.ELSE, lexer.WHILE, lexer.BREAK, lexer.CONTINUE, lexer.SLEEP, lexer.DEF, lexer.GRAPHQL, lexer.WS, lexer.METHOD,
+		lexer.GET, lexer.POST, lexer.PUT, lexer.DELETE, lexer.PATCH, lexer.HEAD, lexer.OPTIONS,
+		lexer.HEADERS, lexer.QUERY, lexer.BODY, lexer.TIMEOUT:
+		return true
+	}
+	return false
+}
+
+// parseComputedKey parses [expr] at curToken, leaving curToken at the closing ]
+func (p *ParserV2) parseComputedKey() ast.Expression {
+	p.nextToken() // move past [
+	key := p.parseExpression()
+	if key == nil {
+		p.addError("expected expression in computed key")
+		return nil
+	}
+	if !p.expectPeek(lexer.RBRACKET) {
+		return nil
+	}
+	return key
+}
+
 func (p *ParserV2) parseExpression() ast.Expression {
+	left := p.parseConcatExpr()
+	// Default value: left ?? fallback ?? ...
+	for p.peekTokenIs(lexer.NULLISH) {
+		p.nextToken() // advance to ??
+		pos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+		p.nextToken() // advance past ??
+		right := p.parseConcatExpr()
+		if right == nil {
+			p.addError("expected fallback value after ??")
+		}
+		left = &ast.BinaryExpr{
+			Position: pos,
+			Left:     left,
+			Operator: "??",
+			Right:    right,
+		}
+	}
+	// Range: start..end [step n]
+	if p.peekTokenIs(lexer.RANGE) {
+		p.nextToken() // advance to RANGE
+		pos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+		p.nextToken() // advance past RANGE
+		end := p.parsePrimary()
+		if end == nil {
+			p.addError("expected range end after ..")
+		}
+		var step ast.Expression
+		if p.peekTokenIs(lexer.IDENT) && p.peekToken.Literal == "step" {
+			p.nextToken() // advance to step
+			p.nextToken() // advance past step
+			step = p.parsePrimary()
+			if step == nil {
+				p.addError("expected range step after step")
+			}
+		}
+		return &ast.RangeExpr{
+			Position: pos,
+			Start:    left,
+			End:      end,
+			Step:     step,
+		}
+	}
+	return left
+}
+
+// parseConcatExpr parses a primary expression followed by any "+ primary" parts.
+func (p *ParserV2) parseConcatExpr() ast.Expression {
 	left := p.parsePrimary()
 	// String concatenation: left + right + ...
 	for p.peekTokenIs(lexer.PLUS) {
@@ -757,6 +1680,17 @@ func (p *ParserV2) parsePrimary() ast.Expression {
 		}
 
 	case lexer.IDENT:
+		if p.peekTokenIs(lexer.LPAREN) {
+			return p.parseCallExpr()
+		}
+		return &ast.StringLiteral{
+			Position: pos,
+			Value:    p.curToken.Literal,
+			Quoted:   false,
+		}
+
+	case lexer.CAPTURE, lexer.SLEEP, lexer.DEF, lexer.GRAPHQL, lexer.WS, lexer.METHOD:
+		// capture, sleep, def, graphql, ws and method only start a statement; as a value they stay a bare word
 		return &ast.StringLiteral{
 			Position: pos,
 			Value:    p.curToken.Literal,
@@ -792,6 +1726,9 @@ func (p *ParserV2) parsePrimary() ast.Expression {
 	case lexer.EMPTY_OBJ:
 		return &ast.EmptyObjectLiteral{Position: pos}
 
+	case lexer.LBRACE:
+		return p.parseInlineObject()
+
 	case lexer.DOLLAR:
 		return p.parseVarRef()
 
@@ -803,6 +1740,143 @@ func (p *ParserV2) parsePrimary() ast.Expression {
 	}
 }
 
+// parseCallExpr parses a function call: name(arg, ...)
+// Starts at the function name; after return, curToken is at the closing RPAREN.
+func (p *ParserV2) parseCallExpr() ast.Expression {
+	call := &ast.CallExpr{
+		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+		Name:     p.curToken.Literal,
+	}
+	p.nextToken() // move to (
+
+	if p.peekTokenIs(lexer.RPAREN) {
+		p.nextToken()
+		return call
+	}
+	for {
+		p.nextToken()
+		arg := p.parseExpression()
+		if arg == nil {
+			p.addError("unexpected %s in arguments of %s()", p.curToken.Type, call.Name)
+			return nil
+		}
+		// Field rename: name -> new_name
+		if p.peekTokenIs(lexer.ARROW) {
+			p.nextToken() // advance to ->
+			pos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+			p.nextToken() // advance past ->
+			name, ok := p.parsePrimary().(*ast.StringLiteral)
+			if !ok {
+				p.addError("expected a field name after -> in arguments of %s()", call.Name)
+				return nil
+			}
+			arg = &ast.BinaryExpr{
+				Position: pos,
+				Left:     arg,
+				Operator: "->",
+				Right:    name,
+			}
+		}
+		call.Args = append(call.Args, arg)
+
+		if p.peekTokenIs(lexer.COMMA) {
+			p.nextToken()
+			continue
+		}
+		if !p.expectPeek(lexer.RPAREN) {
+			return nil
+		}
+		return call
+	}
+}
+
+// parseInlineObject parses an inline object: {key=value, key: value, ...}
+// Line breaks inside the braces are ignored by the lexer, so the entries may
+// span multiple lines. After return, curToken is at the closing RBRACE.
+func (p *ParserV2) parseInlineObject() ast.Expression {
+	pos := ast.Position{Line: p.curToken.Line, Column: p.curToken.Column}
+	block := &ast.BlockExpr{Position: pos}
+
+	defer func() { p.depth-- }()
+	if !p.enterNesting(pos.Line) {
+		p.skipInlineObject()
+		return block
+	}
+
+	p.nextToken() // move past {
+
+	for !p.curTokenIs(lexer.RBRACE) {
+		if p.curTokenIs(lexer.EOF) {
+			p.addError("unterminated inline object, expected }")
+			return block
+		}
+
+		entry := ast.Entry{
+			Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
+		}
+		switch {
+		case p.curTokenIs(lexer.IDENT) || p.curTokenIs(lexer.STRING) || isKeywordKey(p.curToken.Type):
+			entry.Key = p.curToken.Literal
+		case p.curTokenIs(lexer.LBRACKET):
+			// Computed key: {[$field]=value}
+			entry.KeyExpr = p.parseComputedKey()
+			if entry.KeyExpr == nil {
+				return block
+			}
+		default:
+			p.addError("expected key in inline object, got %s", p.curToken.Type)
+			return block
+		}
+
+		p.nextToken()
+		if !p.curTokenIs(lexer.ASSIGN) && !p.curTokenIs(lexer.COLON) {
+			p.addError("expected = or : after key %q in inline object", entry.Key)
+			return block
+		}
+
+		p.nextToken()
+		entry.Value = p.parseExpression()
+		if entry.Value == nil {
+			p.addError("expected value for key %q in inline object", entry.Key)
+			return block
+		}
+		block.Entries = append(block.Entries, entry)
+
+		p.nextToken()
+		if p.curTokenIs(lexer.COMMA) {
+			p.nextToken()
+		} else if !p.curTokenIs(lexer.RBRACE) {
+			p.addError("expected , or } in inline object, got %s", p.curToken.Type)
+			return block
+		}
+	}
+
+	// "{ }" with whitespace is the same as the {} shorthand
+	if len(block.Entries) == 0 {
+		return &ast.EmptyObjectLiteral{Position: pos}
+	}
+
+	return block
+}
+
+// skipInlineObject skips an inline object starting at {, leaving curToken at
+// its matching } (or EOF)
+func (p *ParserV2) skipInlineObject() {
+	depth := 0
+	for !p.curTokenIs(lexer.EOF) {
+		switch p.curToken.Type {
+		case lexer.LBRACE:
+			depth++
+		case lexer.RBRACE:
+			depth--
+			if depth == 0 {
+				return
+			}
+		}
+		p.nextToken()
+	}
+}
+
 func (p *ParserV2) parseVarRef() *ast.VarRef {
 	ref := &ast.VarRef{
 		Position: ast.Position{Line: p.curToken.Line, Column: p.curToken.Column},
@@ -810,7 +1884,8 @@ func (p *ParserV2) parseVarRef() *ast.VarRef {
 
 	p.nextToken() // move past $
 
-	if !p.curTokenIs(lexer.IDENT) && !p.curTokenIs(lexer.UNDERSCORE) {
+	// Keywords are valid variable names too ($method, $timeout)
+	if !p.curTokenIs(lexer.IDENT) && !p.curTokenIs(lexer.UNDERSCORE) && !isKeywordKey(p.curToken.Type) {
 		p.addError("expected identifier after $")
 		return ref
 	}
@@ -821,12 +1896,29 @@ func (p *ParserV2) parseVarRef() *ast.VarRef {
 		ref.Name = p.curToken.Literal
 	}
 
-	// Parse path: $var.field.subfield
-	for p.peekTokenIs(lexer.DOT) {
+	// Parse path: $var.field.subfield, $items.-1, $items[0] or $items.*.id
+	for {
+		if p.peekTokenIs(lexer.LBRACKET) && p.peekIsAdjacent() {
+			p.nextToken() // move to [
+			if !p.expectPeek(lexer.INT) {
+				return ref
+			}
+			ref.Path = append(ref.Path, p.curToken.Literal)
+			if !p.expectPeek(lexer.RBRACKET) {
+				return ref
+			}
+			continue
+		}
+		if !p.peekTokenIs(lexer.DOT) {
+			break
+		}
 		p.nextToken() // move to .
 		p.nextToken() // move to field name
 
-		if p.curTokenIs(lexer.IDENT) || p.curTokenIs(lexer.INT) {
+		// Keywords are valid path keys too ($_.headers.Location, $_.body.id).
+		// '*' has no token of its own and lexes as ILLEGAL ($_.items.*.id)
+		if p.curTokenIs(lexer.IDENT) || p.curTokenIs(lexer.INT) || isKeywordKey(p.curToken.Type) ||
+			(p.curTokenIs(lexer.ILLEGAL) && p.curToken.Literal == "*") {
 			ref.Path = append(ref.Path, p.curToken.Literal)
 		} else {
 			break
@@ -836,6 +1928,13 @@ func (p *ParserV2) parseVarRef() *ast.VarRef {
 	return ref
 }
 
+// peekIsAdjacent reports whether the next token directly follows the current one
+// on the same line, so that $items[0] is an index but "$items [0]" is not
+func (p *ParserV2) peekIsAdjacent() bool {
+	return p.peekToken.Line == p.curToken.Line &&
+		p.peekToken.Column == p.curToken.Column+len(p.curToken.Literal)
+}
+
 func (p *ParserV2) parseProcessedString() *ast.ProcessedString {
 	// Literal format: processor`content`
 	literal := p.curToken.Literal
@@ -1,14 +1,28 @@
 package parser
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/LingHeChen/haiku/ast"
 	"github.com/LingHeChen/haiku/eval"
 	"github.com/LingHeChen/haiku/lexer"
+	"github.com/LingHeChen/haiku/request"
 )
 
 func TestLexer(t *testing.T) {
@@ -351,3 +365,3548 @@ for 3
 		}
 	}
 }
+
+func TestParserV2InlineObjectBody(t *testing.T) {
+	input := `post "https://api.example.com/users" body {name=John, age: 25}`
+
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("expected 1 statement, got %d", len(program.Statements))
+	}
+	reqStmt, ok := program.Statements[0].(*ast.RequestStmt)
+	if !ok {
+		t.Fatalf("expected *ast.RequestStmt, got %T", program.Statements[0])
+	}
+	block, ok := reqStmt.Body.(*ast.BlockExpr)
+	if !ok {
+		t.Fatalf("expected body to be *ast.BlockExpr, got %T", reqStmt.Body)
+	}
+	if len(block.Entries) != 2 || block.Entries[0].Key != "name" || block.Entries[1].Key != "age" {
+		t.Fatalf("unexpected inline object entries: %+v", block.Entries)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body, ok := requests[0]["body"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected body to be map, got %T", requests[0]["body"])
+	}
+	if body["name"] != "John" {
+		t.Errorf("expected name John, got %v", body["name"])
+	}
+	if body["age"] != int64(25) {
+		t.Errorf("expected age 25, got %v", body["age"])
+	}
+}
+
+func TestParserV2InlineObjectMultiline(t *testing.T) {
+	input := `
+post "https://api.example.com/users"
+body {
+  user: {name="Bob", tags=[]},
+  meta = { }
+}
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body := requests[0]["body"].(map[string]interface{})
+	user, ok := body["user"].(map[string]interface{})
+	if !ok || user["name"] != "Bob" {
+		t.Errorf("expected nested user object, got %v", body["user"])
+	}
+	if meta, ok := body["meta"].(map[string]interface{}); !ok || len(meta) != 0 {
+		t.Errorf("expected empty object for { }, got %v", body["meta"])
+	}
+}
+
+func TestParserV2UseHeaderSets(t *testing.T) {
+	input := `
+@auth_headers
+  Authorization "Bearer abc"
+  X-Trace base
+
+@json_headers
+  Content-Type "application/json"
+  X-Trace json
+
+get "https://api.example.com/users"
+use auth_headers
+use json_headers
+headers
+  Accept "application/json"
+`
+	eval.SetImportParser(ParseFile)
+
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	headers, ok := requests[0]["headers"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected headers map, got %T", requests[0]["headers"])
+	}
+
+	want := map[string]interface{}{
+		"Authorization": "Bearer abc",
+		"Content-Type":  "application/json",
+		"Accept":        "application/json",
+		"X-Trace":       "json", // later use wins
+	}
+	for k, v := range want {
+		if headers[k] != v {
+			t.Errorf("header %s: expected %v, got %v", k, v, headers[k])
+		}
+	}
+}
+
+func TestParserV2RangeFromResponse(t *testing.T) {
+	input := `
+get "https://api.example.com/items"
+
+---
+
+for $page in 1..$_.total_pages
+  get "https://api.example.com/items?page=$page"
+`
+	eval.SetImportParser(ParseFile)
+
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Mock responses: the first request reports the page count
+	var urls []string
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		url, _ := req["get"].(string)
+		urls = append(urls, url)
+		if len(urls) == 1 {
+			return map[string]interface{}{"total_pages": float64(3)}, nil
+		}
+		return map[string]interface{}{"items": []interface{}{}}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := []string{
+		"https://api.example.com/items",
+		"https://api.example.com/items?page=1",
+		"https://api.example.com/items?page=2",
+		"https://api.example.com/items?page=3",
+	}
+	if len(urls) != len(want) {
+		t.Fatalf("expected %d requests, got %d: %v", len(want), len(urls), urls)
+	}
+	for i := range want {
+		if urls[i] != want[i] {
+			t.Errorf("request %d: expected %s, got %s", i, want[i], urls[i])
+		}
+	}
+}
+
+func TestParserV2UnexpectedIndentation(t *testing.T) {
+	input := `
+@base "https://api.example.com"
+  get "$base/users"
+`
+	_, err := ParseFile(input)
+	if err == nil {
+		t.Fatal("expected parse error for indented top-level statement")
+	}
+	if !strings.Contains(err.Error(), "unexpected indentation at line 3") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+}
+
+func TestParserV2ConsecutiveStatements(t *testing.T) {
+	// Statements without --- separators must not swallow each other
+	input := `
+for 2
+  get "https://api.example.com/loop/$index"
+get "https://api.example.com/after"
+@flag
+get "https://api.example.com/last"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	var urls []string
+	for _, req := range requests {
+		urls = append(urls, req["get"].(string))
+	}
+	want := []string{
+		"https://api.example.com/loop/0",
+		"https://api.example.com/loop/1",
+		"https://api.example.com/after",
+		"https://api.example.com/last",
+	}
+	if strings.Join(urls, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, urls)
+	}
+}
+
+func TestParserV2ConditionalEntries(t *testing.T) {
+	input := `
+@debug true
+@verbose false
+@data
+  trace on
+
+post "https://api.example.com/events"
+body
+  name signup
+  debug_info $data if $debug
+  verbose_info extra if $verbose
+  level high if $debug and not $verbose
+  extras if $debug
+    retries 3
+  tags
+    always
+    sometimes if $verbose
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body := requests[0]["body"].(map[string]interface{})
+	if body["name"] != "signup" {
+		t.Errorf("expected unconditional field, got %v", body["name"])
+	}
+	if info, ok := body["debug_info"].(map[string]interface{}); !ok || info["trace"] != "on" {
+		t.Errorf("expected debug_info to be included, got %v", body["debug_info"])
+	}
+	if _, ok := body["verbose_info"]; ok {
+		t.Errorf("expected verbose_info to be omitted")
+	}
+	if body["level"] != "high" {
+		t.Errorf("expected level high, got %v", body["level"])
+	}
+	if opts, ok := body["extras"].(map[string]interface{}); !ok || opts["retries"] != int64(3) {
+		t.Errorf("expected guarded nested block to be included, got %v", body["extras"])
+	}
+	tags, ok := body["tags"].([]interface{})
+	if !ok || len(tags) != 1 || tags[0] != "always" {
+		t.Errorf("expected guarded array item to be omitted, got %v", body["tags"])
+	}
+}
+
+func TestParserV2ComputedKeys(t *testing.T) {
+	input := `
+@fieldName "user_name"
+@prefix "meta"
+
+post "https://api.example.com/users"
+body
+  [$fieldName] John
+  [$prefix + "_info"]
+    source cli
+  static yes
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	reqStmt := program.Statements[2].(*ast.RequestStmt)
+	block := reqStmt.Body.(*ast.BlockExpr)
+	if len(block.Entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(block.Entries))
+	}
+	if ref, ok := block.Entries[0].KeyExpr.(*ast.VarRef); !ok || ref.Name != "fieldName" {
+		t.Errorf("expected computed key $fieldName, got %#v", block.Entries[0].KeyExpr)
+	}
+	if block.IsArray() {
+		t.Errorf("block with computed keys should not be an array")
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body := requests[0]["body"].(map[string]interface{})
+	if body["user_name"] != "John" {
+		t.Errorf("expected user_name John, got %v", body)
+	}
+	info, ok := body["meta_info"].(map[string]interface{})
+	if !ok || info["source"] != "cli" {
+		t.Errorf("expected nested meta_info object, got %v", body["meta_info"])
+	}
+	if body["static"] != "yes" {
+		t.Errorf("expected static key, got %v", body["static"])
+	}
+}
+
+func TestParserV2ComputedKeyInlineObject(t *testing.T) {
+	input := `
+@field "email"
+post "https://api.example.com/users" body {[$field]="a@example.com", name=John}
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body := requests[0]["body"].(map[string]interface{})
+	if body["email"] != "a@example.com" || body["name"] != "John" {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
+
+func TestParserV2FlowRun(t *testing.T) {
+	input := `
+@base "https://api.example.com"
+
+@flow login
+  @user admin
+  post "$base/login"
+  body
+    username $user
+  get "$base/me"
+  headers
+    Authorization "Bearer $_.token"
+
+run login
+get "$base/users/$_.id"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	if _, ok := program.Statements[1].(*ast.FlowDefStmt); !ok {
+		t.Fatalf("expected *ast.FlowDefStmt, got %T", program.Statements[1])
+	}
+
+	var sent []map[string]interface{}
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		sent = append(sent, req)
+		switch len(sent) {
+		case 1:
+			return map[string]interface{}{"token": "abc"}, nil
+		case 2:
+			return map[string]interface{}{"id": float64(42)}, nil
+		}
+		return map[string]interface{}{}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if len(sent) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(sent))
+	}
+	if body := sent[0]["body"].(map[string]interface{}); body["username"] != "admin" {
+		t.Errorf("expected flow-local variable in body, got %v", body)
+	}
+	if headers := sent[1]["headers"].(map[string]interface{}); headers["Authorization"] != "Bearer abc" {
+		t.Errorf("expected $_ chaining inside flow, got %v", headers)
+	}
+	// After run, $_ is the flow's last response
+	if sent[2]["get"] != "https://api.example.com/users/42" {
+		t.Errorf("expected $_ from flow's last response, got %v", sent[2]["get"])
+	}
+}
+
+func TestParserV2FlowInParallelLoop(t *testing.T) {
+	input := `
+@flow ping
+  get "https://api.example.com/ping/$i"
+
+parallel 2 for $i in 1..3
+  run ping
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	loop := program.Statements[1].(*ast.ForStmt)
+
+	// Both parallel paths: with real-time output and while collecting requests
+	for _, withOutput := range []bool{true, false} {
+		var mu sync.Mutex
+		var urls []string
+		evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+			mu.Lock()
+			urls = append(urls, req["get"].(string))
+			mu.Unlock()
+			return map[string]interface{}{"status": int64(200)}, nil
+		}))
+		if withOutput {
+			if err := evaluator.EvalFlowDef(program.Statements[0].(*ast.FlowDefStmt)); err != nil {
+				t.Fatalf("eval error: %v", err)
+			}
+			err = evaluator.EvalParallelForWithOutput(loop)
+		} else {
+			_, err = evaluator.Eval(program)
+		}
+		if err != nil {
+			t.Fatalf("withOutput=%v: eval error: %v", withOutput, err)
+		}
+		sort.Strings(urls)
+		if want := "https://api.example.com/ping/1,https://api.example.com/ping/2,https://api.example.com/ping/3"; strings.Join(urls, ",") != want {
+			t.Errorf("withOutput=%v: expected every iteration to run the flow, got %v", withOutput, urls)
+		}
+	}
+}
+
+func TestParserV2FlowControlFlow(t *testing.T) {
+	// break and continue in a flow don't end or advance the caller's loop
+	for _, stmt := range []string{"break", "continue"} {
+		src := "@flow f\n  get \"https://x/flow\"\n  " + stmt + "\nfor $i in 1..3\n  run f\n  get \"https://x/$i\"\n"
+		program, err := ParseFile(src)
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", stmt, err)
+		}
+		requests, err := eval.NewEvaluator().EvalToRequests(program)
+		if want := stmt + " outside of a loop"; err == nil || !strings.Contains(err.Error(), "flow f: "+want) {
+			t.Errorf("%s: expected error containing %q, got %v (requests %v)", stmt, want, err, requests)
+		}
+	}
+
+	// skip if guards a whole file and is not allowed in a flow body
+	if _, err := ParseFile("@flow f\n  skip if true\n  get \"https://x\"\n"); err == nil || !strings.Contains(err.Error(), "only allowed at the top level") {
+		t.Errorf("expected skip if in a flow to be rejected, got %v", err)
+	}
+
+	// A trailing skip if on a request in the flow skips only that request
+	program, err := ParseFile("@flow f\n  get \"https://x/a\" skip if true\n  get \"https://x/b\"\nrun f\nget \"https://x/c\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	var urls []string
+	for _, req := range requests {
+		urls = append(urls, req["get"].(string))
+	}
+	if strings.Join(urls, ",") != "https://x/b,https://x/c" {
+		t.Errorf("expected only the guarded request to be skipped, got %v", urls)
+	}
+}
+
+func TestParserV2RunUndefinedFlow(t *testing.T) {
+	program, err := ParseFile("run missing\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	if _, err := evaluator.EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "undefined flow") {
+		t.Errorf("expected undefined flow error, got %v", err)
+	}
+}
+
+func TestParserV2QueryBlock(t *testing.T) {
+	input := `
+@page 2
+
+get "https://api.example.com/search?sort=asc"
+query
+  q "hello world"
+  page $page
+  tags
+    a
+    b
+---
+get "https://api.example.com/items" query {limit=10}
+---
+post "https://api.example.com/graphql"
+body
+  query "{ users { id } }"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	query, ok := requests[0]["query"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected query map, got %T", requests[0]["query"])
+	}
+	if query["q"] != "hello world" || query["page"] != int64(2) {
+		t.Errorf("unexpected query: %v", query)
+	}
+	if tags, ok := query["tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("expected tags array, got %v", query["tags"])
+	}
+
+	inline := requests[1]["query"].(map[string]interface{})
+	if inline["limit"] != int64(10) {
+		t.Errorf("expected inline query limit=10, got %v", inline)
+	}
+
+	// "query" is still usable as a body key
+	body := requests[2]["body"].(map[string]interface{})
+	if body["query"] != "{ users { id } }" {
+		t.Errorf("expected query body key, got %v", body)
+	}
+}
+
+func TestParserV2Retry(t *testing.T) {
+	input := `
+get "https://api.example.com/a"
+retry 3 exponential
+---
+post "https://api.example.com/b" retry 2 always
+body
+  retry yes
+---
+@retry "1 linear"
+get "https://api.example.com/c"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	want := []map[string]interface{}{
+		{"count": int64(3), "backoff": "exponential", "always": false},
+		{"count": int64(2), "backoff": "fixed", "always": true},
+		{"count": int64(1), "backoff": "linear", "always": false},
+	}
+	for i, w := range want {
+		retry, ok := requests[i]["retry"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("request %d: expected retry map, got %v", i, requests[i]["retry"])
+		}
+		for k, v := range w {
+			if retry[k] != v {
+				t.Errorf("request %d: expected %s=%v, got %v", i, k, v, retry[k])
+			}
+		}
+	}
+
+	// "retry" inside a body is still a plain key
+	body := requests[1]["body"].(map[string]interface{})
+	if body["retry"] != "yes" {
+		t.Errorf("expected retry body key, got %v", body)
+	}
+
+	if _, err := ParseFile("get \"https://api.example.com\"\nretry 3 sometimes\n"); err == nil {
+		t.Errorf("expected error for unknown retry option")
+	}
+}
+
+func TestParserV2RetryOn(t *testing.T) {
+	input := `
+get "https://api.example.com/a"
+retry 5 on 429,503
+---
+post "https://api.example.com/b" retry 2 exponential on 429 always
+---
+@retry "3 on 429, 503 linear"
+get "https://api.example.com/c"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := []map[string]interface{}{
+		{"count": int64(5), "backoff": "fixed", "always": false, "on": []interface{}{int64(429), int64(503)}},
+		{"count": int64(2), "backoff": "exponential", "always": true, "on": []interface{}{int64(429)}},
+		{"count": int64(3), "backoff": "linear", "always": false, "on": []interface{}{int64(429), int64(503)}},
+	}
+	for i, w := range want {
+		if !reflect.DeepEqual(requests[i]["retry"], w) {
+			t.Errorf("request %d: got %v, want %v", i, requests[i]["retry"], w)
+		}
+	}
+
+	for _, bad := range []string{
+		"get \"https://api.example.com\"\nretry 3 on\n",
+		"get \"https://api.example.com\"\nretry 3 on 42\n",
+		"get \"https://api.example.com\"\nretry 3 on 429,\n",
+	} {
+		if _, err := ParseFile(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+	program, err = ParseFile("@retry \"3 on\"\nget \"https://api.example.com\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "retry on expects status codes") {
+		t.Errorf("expected error for @retry without statuses, got %v", err)
+	}
+}
+
+func TestParserV2YAMLBody(t *testing.T) {
+	input := `
+post "https://api.example.com/users"
+body yaml` + "`" + `
+  name: John
+  age: 30
+  tags:
+    - api
+    - http
+  address:
+    city: Paris
+` + "`" + `
+---
+post "https://api.example.com/raw"
+body yaml` + "`" + `name: [unclosed` + "`" + `
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body, ok := requests[0]["body"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected yaml body to be a map, got %T", requests[0]["body"])
+	}
+	if body["name"] != "John" || body["age"] != int64(30) {
+		t.Errorf("unexpected body: %v", body)
+	}
+	if tags, ok := body["tags"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "api" {
+		t.Errorf("expected tags list, got %v", body["tags"])
+	}
+	if addr, ok := body["address"].(map[string]interface{}); !ok || addr["city"] != "Paris" {
+		t.Errorf("expected nested address, got %v", body["address"])
+	}
+
+	// Invalid YAML falls back to the raw string
+	if requests[1]["body"] != "name: [unclosed" {
+		t.Errorf("expected raw string fallback, got %v", requests[1]["body"])
+	}
+}
+
+func TestParserV2XMLBody(t *testing.T) {
+	input := `
+@order xml` + "`" + `
+  <order id="7">
+    <item>Pen</item>
+    <item>Ink</item>
+  </order>
+` + "`" + `
+post "https://api.example.com/orders"
+headers
+  Content-Type "application/xml"
+body $order
+---
+post "https://api.example.com/raw"
+body xml` + "`" + `<order><item></order>` + "`" + `
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	body, ok := requests[0]["body"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected xml body to be a map, got %T", requests[0]["body"])
+	}
+	order, _ := body["order"].(map[string]interface{})
+	if order["@id"] != "7" {
+		t.Errorf("expected id attribute as @id, got %v", body)
+	}
+	if items, ok := order["item"].([]interface{}); !ok || len(items) != 2 || items[1] != "Ink" {
+		t.Errorf("expected repeated items as a list, got %v", order["item"])
+	}
+
+	// Invalid XML falls back to the raw string
+	if requests[1]["body"] != "<order><item></order>" {
+		t.Errorf("expected raw string fallback, got %v", requests[1]["body"])
+	}
+}
+
+func TestParserV2EncodingProcessors(t *testing.T) {
+	bt := "`"
+	input := `
+@sig urlencode` + bt + `a+b/c d` + bt + `
+get "https://api.example.com/items?sig=$sig"
+body
+  raw hex` + bt + `00ff41` + bt + `
+  bad hex` + bt + `0g` + bt + `
+  decoded urldecode` + bt + `a%2Bb%2Fc%20d` + bt + `
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if url := requests[0]["get"]; url != "https://api.example.com/items?sig=a%2Bb%2Fc%20d" {
+		t.Errorf("unexpected url: %v", url)
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	if body["raw"] != "\x00\xffA" {
+		t.Errorf("expected hex to decode to raw bytes, got %q", body["raw"])
+	}
+	if body["bad"] != "0g" {
+		t.Errorf("expected invalid hex to stay as is, got %v", body["bad"])
+	}
+	if body["decoded"] != "a+b/c d" {
+		t.Errorf("expected urldecode to reverse urlencode, got %v", body["decoded"])
+	}
+}
+
+func TestParserV2StringEscapes(t *testing.T) {
+	input := `
+@name "Ann \"A\""
+post "https://api.example.com/notes"
+headers
+  "X-Note\u0021" "tab\there"
+body
+  text "line1\nline2"
+  greeting "hi $name\r\n"
+  path "C:\\temp\\x"
+  unicode "caf\u00e9 \ud83d\ude00 \u12"
+  regex "^\d+\.\w$"
+  word "\bfoo\b"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	headers := requests[0]["headers"].(map[string]interface{})
+	if headers["X-Note!"] != "tab\there" {
+		t.Errorf("expected escapes in header keys and values to be decoded, got %v", headers)
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	expected := map[string]string{
+		"text":     "line1\nline2",
+		"greeting": "hi Ann \"A\"\r\n",
+		"path":     `C:\temp\x`,
+		"unicode":  `café 😀 \u12`,
+		"regex":    `^\d+\.\w$`,
+		"word":     `\bfoo\b`,
+	}
+	for key, want := range expected {
+		if body[key] != want {
+			t.Errorf("%s: expected %q, got %q", key, want, body[key])
+		}
+	}
+}
+
+func TestParserV2RawString(t *testing.T) {
+	input := `
+@name "Ann"
+post "https://api.example.com/notes"
+body """
+Dear $name,
+    indented\n "quoted"
+
+  ""
+bye"""
+
+post "https://api.example.com/raw"
+body
+  text """  one line"""
+  empty """"""
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	want := "Dear Ann,\n    indented\\n \"quoted\"\n\n  \"\"\nbye"
+	if requests[0]["body"] != want {
+		t.Errorf("expected raw body %q, got %q", want, requests[0]["body"])
+	}
+	body := requests[1]["body"].(map[string]interface{})
+	if body["text"] != "  one line" || body["empty"] != "" {
+		t.Errorf("unexpected inline raw strings: %v", body)
+	}
+
+	// Lines inside a raw string are counted for later error positions
+	_, err = ParseFile("get \"https://x\"\nbody \"\"\"\na\nb\"\"\"\n  get \"https://y\"\n")
+	if err == nil || !strings.Contains(err.Error(), "line 5") {
+		t.Errorf("expected error at line 5, got %v", err)
+	}
+}
+
+func TestParserV2CustomMethod(t *testing.T) {
+	input := `
+@verb "LOCK"
+@headers
+  Accept "application/json"
+  post
+    Content-Type "application/json"
+method "PURGE" "https://cdn.example.com/a"
+method $verb "https://dav.example.com/f"
+headers
+  Timeout "Second-60"
+method "POST" "https://api.example.com/items"
+body
+  method card
+  kind method
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	if requests[0]["method"] != "PURGE" || requests[0]["url"] != "https://cdn.example.com/a" {
+		t.Errorf("unexpected first request: %v", requests[0])
+	}
+	headers := requests[1]["headers"].(map[string]interface{})
+	if requests[1]["method"] != "LOCK" || headers["Timeout"] != "Second-60" || headers["Accept"] != "application/json" {
+		t.Errorf("unexpected second request: %v", requests[1])
+	}
+	// method "POST" gets the post-specific defaults, and "method" stays a plain word in blocks
+	headers = requests[2]["headers"].(map[string]interface{})
+	if headers["Content-Type"] != "application/json" {
+		t.Errorf("expected post defaults for method \"POST\", got %v", headers)
+	}
+	body := requests[2]["body"].(map[string]interface{})
+	if body["method"] != "card" || body["kind"] != "method" {
+		t.Errorf("unexpected body: %v", body)
+	}
+}
+
+func TestParserV2ArrayIndexInterpolation(t *testing.T) {
+	input := `
+@ids
+  101
+  202
+@users json` + "`" + `[{"name": "Alice"}, {"name": "Bob"}]` + "`" + `
+
+get "https://api.example.com/items/$ids.1?first=$ids.0"
+body
+  greeting "Hello $users.1.name."
+  first $users.0.name
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator()
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if url := requests[0]["get"]; url != "https://api.example.com/items/202?first=101" {
+		t.Errorf("expected indexed elements in URL, got %v", url)
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	if body["greeting"] != "Hello Bob." {
+		t.Errorf("expected trailing dot to stay outside the path, got %v", body["greeting"])
+	}
+	if body["first"] != "Alice" {
+		t.Errorf("expected Alice, got %v", body["first"])
+	}
+}
+
+func TestParserV2EnvPrefix(t *testing.T) {
+	t.Setenv("TOKEN", "plain-token")
+	t.Setenv("API_TOKEN", "prefixed-token")
+
+	evalHeaders := func(input string) map[string]interface{} {
+		program, err := ParseFile(input)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		requests, err := eval.NewEvaluator().EvalToRequests(program)
+		if err != nil {
+			t.Fatalf("eval error: %v", err)
+		}
+		return requests[0]["headers"].(map[string]interface{})
+	}
+
+	// Without a prefix, $env reads the variable as named
+	headers := evalHeaders(`
+get "https://api.example.com"
+headers
+  Authorization "$env.TOKEN"
+`)
+	if headers["Authorization"] != "plain-token" {
+		t.Errorf("expected plain-token, got %v", headers["Authorization"])
+	}
+
+	// With a prefix, $env prepends it and $env_raw bypasses it
+	headers = evalHeaders(`
+@env_prefix "API_"
+get "https://api.example.com"
+headers
+  Authorization "$env.TOKEN"
+  X-Raw "$env_raw.TOKEN"
+  X-Ref $env.TOKEN
+`)
+	if headers["Authorization"] != "prefixed-token" {
+		t.Errorf("expected prefixed-token, got %v", headers["Authorization"])
+	}
+	if headers["X-Raw"] != "plain-token" {
+		t.Errorf("expected $env_raw to bypass the prefix, got %v", headers["X-Raw"])
+	}
+	if headers["X-Ref"] != "prefixed-token" {
+		t.Errorf("expected bare $env reference to use the prefix, got %v", headers["X-Ref"])
+	}
+}
+
+func TestParserV2FormSection(t *testing.T) {
+	input := `
+post "https://api.example.com/login"
+form
+  username admin
+  password "p@ss word"
+---
+post "https://api.example.com/search" form {q=haiku}
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	form, ok := requests[0]["form"].(map[string]interface{})
+	if !ok || form["username"] != "admin" || form["password"] != "p@ss word" {
+		t.Errorf("unexpected form: %v", requests[0]["form"])
+	}
+	if _, ok := requests[0]["body"]; ok {
+		t.Errorf("form section should not set body")
+	}
+	if inline, ok := requests[1]["form"].(map[string]interface{}); !ok || inline["q"] != "haiku" {
+		t.Errorf("unexpected inline form: %v", requests[1]["form"])
+	}
+}
+
+func TestParserV2NestingTooDeep(t *testing.T) {
+	var sb strings.Builder
+	sb.WriteString("post \"https://api.example.com\"\nbody\n")
+	for i := 1; i <= 500; i++ {
+		sb.WriteString(strings.Repeat("  ", i) + "level\n")
+	}
+	sb.WriteString(strings.Repeat("  ", 501) + "leaf yes\n")
+
+	_, err := ParseFile(sb.String())
+	if err == nil || !strings.Contains(err.Error(), "nesting too deep at line") {
+		t.Fatalf("expected nesting too deep error, got %v", err)
+	}
+
+	inline := "post \"https://api.example.com\" body " +
+		strings.Repeat("{a=", 500) + "1" + strings.Repeat("}", 500) + "\n"
+	_, err = ParseFile(inline)
+	if err == nil || !strings.Contains(err.Error(), "nesting too deep at line 1") {
+		t.Fatalf("expected nesting too deep error for inline objects, got %v", err)
+	}
+
+	// The limit is configurable
+	p := NewV2("@a\n  b\n    c\n      d 1\n")
+	p.SetMaxDepth(2)
+	if _, err := p.Parse(); err == nil || !strings.Contains(err.Error(), "nesting too deep at line 4") {
+		t.Errorf("expected error with max depth 2, got %v", err)
+	}
+	p = NewV2("@a\n  b\n    c\n      d 1\n")
+	p.SetMaxDepth(3)
+	program, err := p.Parse()
+	if err != nil {
+		t.Fatalf("unexpected error with max depth 3: %v", err)
+	}
+
+	// The evaluator enforces its own limit
+	evaluator := eval.NewEvaluator(eval.WithMaxDepth(2))
+	if _, err := evaluator.EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "nesting too deep at line") {
+		t.Errorf("expected eval nesting error, got %v", err)
+	}
+}
+
+func TestParserV2BooleanVariableBody(t *testing.T) {
+	var received []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		received = append(received, string(data))
+	}))
+	defer server.Close()
+
+	input := fmt.Sprintf(`
+@enabled true
+@disabled false
+@limit 42
+post "%[1]s/flags"
+body $enabled
+---
+post "%[1]s/flags"
+body $disabled
+---
+post "%[1]s/limit"
+body $limit
+`, server.URL)
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		if _, err := request.Do(req); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := []string{"true", "false", "42"}
+	if strings.Join(received, " ") != strings.Join(want, " ") {
+		t.Errorf("expected JSON literals %v, got %v", want, received)
+	}
+}
+
+func TestParserV2ResponseStatusAndHeaders(t *testing.T) {
+	input := `
+post "https://api.example.com/users"
+---
+if $_.status == 201
+  get "https://api.example.com/users/$_.body.id"
+  headers
+    X-Type "$_.headers.Content-Type"
+    X-Legacy "$_.id"
+else
+  get "https://api.example.com/failed"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var sent []map[string]interface{}
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		sent = append(sent, req)
+		return map[string]interface{}{
+			"status":  int64(201),
+			"headers": map[string]interface{}{"Content-Type": "application/json"},
+			"body":    map[string]interface{}{"id": float64(42)},
+		}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if len(sent) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(sent))
+	}
+	if url := sent[1]["get"]; url != "https://api.example.com/users/42" {
+		t.Errorf("expected $_.status branch with body id, got %v", url)
+	}
+	headers := sent[1]["headers"].(map[string]interface{})
+	if headers["X-Type"] != "application/json" {
+		t.Errorf("expected response header, got %v", headers["X-Type"])
+	}
+	if headers["X-Legacy"] != "42" {
+		t.Errorf("expected $_.id to fall back to the body, got %v", headers["X-Legacy"])
+	}
+}
+
+func TestParserV2WhileLoop(t *testing.T) {
+	input := `
+get "https://api.example.com/job"
+while $_.status != 200
+  get "https://api.example.com/job"
+get "https://api.example.com/result/$_.body.id"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, ok := program.Statements[1].(*ast.WhileStmt); !ok {
+		t.Fatalf("expected WhileStmt, got %T", program.Statements[1])
+	}
+
+	// The job is ready on the 4th poll
+	var urls []string
+	statuses := []int64{202, 202, 202, 200}
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		urls = append(urls, req["get"].(string))
+		status := statuses[0]
+		if len(statuses) > 1 {
+			statuses = statuses[1:]
+		}
+		return map[string]interface{}{"status": status, "body": map[string]interface{}{"id": "j1"}}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(urls) != 5 || urls[4] != "https://api.example.com/result/j1" {
+		t.Errorf("expected 4 polls then the result request, got %v", urls)
+	}
+
+	// Without a callback the body is evaluated once
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Errorf("expected 3 requests in parse-only mode, got %d", len(requests))
+	}
+}
+
+func TestParserV2WhileMaxIterations(t *testing.T) {
+	input := `
+@max_iterations 3
+while $_.status != 200
+  get "https://api.example.com/job"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	calls := 0
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		calls++
+		return map[string]interface{}{"status": int64(500)}, nil
+	}))
+	_, err = evaluator.Eval(program)
+	if err == nil || !strings.Contains(err.Error(), "exceeded 3 iterations") {
+		t.Fatalf("expected max iterations error, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 requests before giving up, got %d", calls)
+	}
+}
+
+func TestParserV2BreakContinue(t *testing.T) {
+	input := `
+@ids
+  1
+  2
+  3
+  4
+for $id in $ids
+  if $id == 2
+    continue
+  get "https://api.example.com/items/$id"
+  if $_.done
+    break
+get "https://api.example.com/after"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var urls []string
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		url := req["get"].(string)
+		urls = append(urls, url)
+		return map[string]interface{}{"done": strings.HasSuffix(url, "/3")}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := []string{
+		"https://api.example.com/items/1",
+		"https://api.example.com/items/3",
+		"https://api.example.com/after",
+	}
+	if strings.Join(urls, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, urls)
+	}
+
+	// Outside a loop, break is an error
+	program, err = ParseFile("break\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().Eval(program); err == nil || !strings.Contains(err.Error(), "outside of a loop") {
+		t.Errorf("expected break outside loop error, got %v", err)
+	}
+}
+
+func TestParserV2ParallelBreak(t *testing.T) {
+	input := `
+parallel 1 for $i in 1..10
+  get "https://api.example.com/items/$i"
+  break
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil, nil
+	}))
+	if err := evaluator.EvalParallelForWithOutput(program.Statements[0].(*ast.ForStmt)); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("expected break to stop launching iterations, got %d requests", calls)
+	}
+}
+
+func TestParserV2Auth(t *testing.T) {
+	input := `
+@user admin
+@token abc123
+get "https://api.example.com/a"
+auth basic $user "p@ss"
+---
+get "https://api.example.com/b" auth bearer $token
+---
+get "https://sqs.us-east-1.amazonaws.com/"
+auth awsv4 $env.AWS_ACCESS_KEY_ID $env.AWS_SECRET_ACCESS_KEY "us-east-1" "sqs" $env.AWS_SESSION_TOKEN
+`
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKID")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	basic := requests[0]["auth"].(map[string]interface{})
+	if basic["scheme"] != "basic" || basic["username"] != "admin" || basic["password"] != "p@ss" {
+		t.Errorf("unexpected basic auth: %v", basic)
+	}
+	bearer := requests[1]["auth"].(map[string]interface{})
+	if bearer["scheme"] != "bearer" || bearer["token"] != "abc123" {
+		t.Errorf("unexpected bearer auth: %v", bearer)
+	}
+	// An unset session token is left out
+	aws := requests[2]["auth"].(map[string]interface{})
+	want := map[string]interface{}{"scheme": "awsv4", "access_key": "AKID", "secret_key": "secret", "region": "us-east-1", "service": "sqs"}
+	if !reflect.DeepEqual(aws, want) {
+		t.Errorf("unexpected awsv4 auth: %v", aws)
+	}
+
+	for _, bad := range []string{
+		"get \"https://api.example.com\"\nauth basic admin\n",
+		"get \"https://api.example.com\"\nauth digest a b\n",
+		"get \"https://api.example.com\"\nauth awsv4 key secret us-east-1\n",
+	} {
+		if _, err := ParseFile(bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestParserV2SkipIf(t *testing.T) {
+	t.Setenv("ENV", "prod")
+
+	input := `
+skip if $env.ENV == "prod"
+get "https://api.example.com/reset"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("expected file to be skipped, got %d requests", len(requests))
+	}
+
+	// An imported file that skips itself leaves the importer running
+	dir := t.TempDir()
+	guarded := "skip if $env.ENV == \"prod\"\n@base \"https://staging.example.com\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "staging.haiku"), []byte(guarded), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input = `
+@base "https://api.example.com"
+import "staging.haiku"
+get "$base/users"
+`
+	eval.SetImportParser(ParseFile)
+	program, err = ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err = eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 1 || requests[0]["get"] != "https://api.example.com/users" {
+		t.Errorf("expected the import to be skipped, got %v", requests)
+	}
+
+	t.Setenv("ENV", "dev")
+	requests, err = eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 1 || requests[0]["get"] != "https://staging.example.com/users" {
+		t.Errorf("expected the import to apply, got %v", requests)
+	}
+
+	// skip is only allowed at the top level
+	if _, err := ParseFile("if true\n  skip if true\n"); err == nil || !strings.Contains(err.Error(), "top level") {
+		t.Errorf("expected top level error, got %v", err)
+	}
+
+	// A nested skip if reports that one error, not a bogus call of skip as well
+	for _, input := range []string{
+		"if true\n  skip if true\n",
+		"for $i in [1, 2]\n  skip if $i == 1\n  get \"https://x/$i\"\n",
+	} {
+		p := NewV2(input)
+		if _, err := p.Parse(); err == nil {
+			t.Errorf("%q: expected a parse error", input)
+			continue
+		}
+		if errs := p.Errors(); len(errs) != 1 || !strings.Contains(errs[0], "line 2: skip is only allowed at the top level") {
+			t.Errorf("%q: expected a single top level error, got %q", input, errs)
+		}
+	}
+}
+
+func TestParserV2RequestSkipIf(t *testing.T) {
+	input := `
+@bulk_done true
+for $i in 5
+  get "https://api.example.com/items/$i" skip if $i == 1 or $i >= 3
+  if $i == 0
+    post "https://api.example.com/items/$i/touch" skip if $missing.field
+post "https://api.example.com/bulk" body {all=true} skip if $bulk_done
+get "https://api.example.com/last" skip if false
+skip if true
+get "https://api.example.com/never"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	var urls []string
+	for _, req := range requests {
+		for _, m := range []string{"get", "post"} {
+			if url, ok := req[m].(string); ok {
+				urls = append(urls, url)
+			}
+		}
+	}
+	want := []string{
+		"https://api.example.com/items/0",
+		"https://api.example.com/items/0/touch",
+		"https://api.example.com/items/2",
+		"https://api.example.com/last",
+	}
+	if fmt.Sprint(urls) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, urls)
+	}
+
+	if _, err := ParseFile("get \"https://x\" skip\n"); err == nil {
+		t.Error("expected parse error for skip without if")
+	}
+}
+
+func TestParserV2Assert(t *testing.T) {
+	input := `
+get "https://api.example.com/users/1"
+assert status 200
+assert time < 500ms
+assert body.user.name == "John"
+assert headers.content-type != "text/html"
+assert count >= 3
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	stmt := program.Statements[0].(*ast.RequestStmt)
+	if len(stmt.Asserts) != 5 {
+		t.Fatalf("expected 5 assertions, got %d", len(stmt.Asserts))
+	}
+	if stmt.Asserts[0].Operator != "==" || stmt.Asserts[1].Operator != "<" {
+		t.Errorf("unexpected operators: %q, %q", stmt.Asserts[0].Operator, stmt.Asserts[1].Operator)
+	}
+
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	asserts := requests[0]["assert"]
+
+	response := map[string]interface{}{
+		"status":  int64(200),
+		"headers": map[string]interface{}{"Content-Type": "application/json"},
+		"body": map[string]interface{}{
+			"user":  map[string]interface{}{"name": "John"},
+			"count": int64(3),
+		},
+	}
+	if failures := eval.CheckAssertions(asserts, response, 120*time.Millisecond); len(failures) != 0 {
+		t.Errorf("expected all assertions to pass, got %v", failures)
+	}
+
+	response["status"] = int64(500)
+	failures := eval.CheckAssertions(asserts, response, 800*time.Millisecond)
+	if len(failures) != 2 {
+		t.Fatalf("expected 2 failures, got %v", failures)
+	}
+	if !strings.Contains(failures[0], "line 3: assert status == 200") || !strings.Contains(failures[0], "got 500") {
+		t.Errorf("unexpected status failure: %s", failures[0])
+	}
+	if !strings.Contains(failures[1], "assert time < 500ms") || !strings.Contains(failures[1], "got 800ms") {
+		t.Errorf("unexpected time failure: %s", failures[1])
+	}
+
+	if _, err := ParseFile("get \"https://api.example.com\"\nassert status\n"); err == nil {
+		t.Error("expected error for assertion without a value")
+	}
+}
+
+func TestParserV2Validate(t *testing.T) {
+	dir := t.TempDir()
+	schemaFile := filepath.Join(dir, "user.json")
+	if err := os.WriteFile(schemaFile, []byte(`{"type": "object", "required": ["id"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	input := `
+get "https://api.example.com/users"
+validate schema` + "`" + `{
+  "type": "object",
+  "required": ["users"],
+  "properties": {
+    "users": {"type": "array", "items": {"type": "object", "properties": {"name": {"type": "string"}}}}
+  }
+}` + "`" + `
+get "https://api.example.com/users/1"
+validate file` + "`" + schemaFile + "`" + `
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	valid := map[string]interface{}{
+		"body": map[string]interface{}{
+			"users": []interface{}{map[string]interface{}{"name": "John"}},
+		},
+	}
+	if failures := eval.CheckSchema(requests[0]["validate"], valid); len(failures) != 0 {
+		t.Errorf("expected the body to match, got %v", failures)
+	}
+	invalid := map[string]interface{}{
+		"body": map[string]interface{}{
+			"users": []interface{}{map[string]interface{}{"name": float64(1)}},
+		},
+	}
+	failures := eval.CheckSchema(requests[0]["validate"], invalid)
+	if len(failures) != 1 || !strings.Contains(failures[0], "line 3: validate body.users.0.name:") {
+		t.Errorf("unexpected failures: %v", failures)
+	}
+
+	if failures := eval.CheckSchema(requests[1]["validate"], map[string]interface{}{"body": "not json"}); len(failures) != 1 {
+		t.Errorf("expected a failure for a non-object body, got %v", failures)
+	}
+	if failures := eval.CheckSchema(nil, invalid); failures != nil {
+		t.Errorf("expected no failures without validate, got %v", failures)
+	}
+
+	if _, err := ParseFile("get \"https://x\"\nvalidate\n"); err == nil {
+		t.Error("expected parse error for validate without a schema")
+	}
+	program, err = ParseFile("get \"https://x\"\nvalidate schema`{\"type\": 5}`\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "invalid schema") {
+		t.Errorf("expected invalid schema error, got %v", err)
+	}
+}
+
+func TestParserV2HeaderBlockValueWarning(t *testing.T) {
+	// X-Meta is followed by an indented block by mistake
+	input := `
+get "https://api.example.com"
+headers
+  Accept "application/json"
+  X-Meta
+    trace on
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var warnings bytes.Buffer
+	if _, err := eval.NewEvaluator(eval.WithWarningOutput(&warnings)).EvalToRequests(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	got := warnings.String()
+	if !strings.Contains(got, `line 5: header "X-Meta" has a block value`) {
+		t.Errorf("expected warning for X-Meta, got %q", got)
+	}
+	if strings.Contains(got, "Accept") {
+		t.Errorf("unexpected warning for a string header: %q", got)
+	}
+}
+
+func TestParserV2Insecure(t *testing.T) {
+	input := `
+get "https://internal.example.com/a"
+insecure true
+---
+@insecure true
+get "https://internal.example.com/b"
+---
+get "https://internal.example.com/c"
+insecure false
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	want := []bool{true, true, false}
+	for i, req := range requests {
+		if got, _ := req["insecure"].(bool); got != want[i] {
+			t.Errorf("request %d: expected insecure %v, got %v", i+1, want[i], req["insecure"])
+		}
+	}
+}
+
+func TestParserV2CACert(t *testing.T) {
+	input := `
+@ca_cert "certs/ca.pem"
+get "https://internal.example.com/a"
+---
+get "https://internal.example.com/b"
+ca_cert "/etc/ssl/other.pem"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator(eval.WithBasePath("/project")).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	// Relative paths resolve against the file's directory
+	want := []string{"/project/certs/ca.pem", "/etc/ssl/other.pem"}
+	for i, req := range requests {
+		if req["ca_cert"] != want[i] {
+			t.Errorf("request %d: expected ca_cert %q, got %v", i+1, want[i], req["ca_cert"])
+		}
+	}
+}
+
+func TestParserV2Proxy(t *testing.T) {
+	input := `
+get "https://api.example.com/a"
+---
+@proxy "http://proxy.internal:3128"
+get "https://api.example.com/b"
+body
+  proxy "a body key"
+---
+get "https://api.example.com/c"
+proxy "socks5://localhost:1080"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	want := []interface{}{nil, "http://proxy.internal:3128", "socks5://localhost:1080"}
+	for i, req := range requests {
+		if req["proxy"] != want[i] {
+			t.Errorf("request %d: expected proxy %v, got %v", i+1, want[i], req["proxy"])
+		}
+	}
+	if body, _ := requests[1]["body"].(map[string]interface{}); body["proxy"] != "a body key" {
+		t.Errorf("expected proxy to stay usable as a body key, got %v", requests[1]["body"])
+	}
+}
+
+func TestParserV2Overrides(t *testing.T) {
+	input := `
+@base_url "https://api.example.com"
+@limit 10
+get "$base_url/users"
+query
+  limit $limit
+  token $token
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	evaluator := eval.NewEvaluator(eval.WithOverrides(map[string]string{
+		"base_url": "https://staging.example.com",
+		"limit":    "50",
+		"token":    "xyz",
+	}))
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	req := requests[0]
+	if req["get"] != "https://staging.example.com/users" {
+		t.Errorf("expected overridden base_url, got %v", req["get"])
+	}
+	query := req["query"].(map[string]interface{})
+	if query["limit"] != int64(50) {
+		t.Errorf("expected limit to be inferred as int 50, got %#v", query["limit"])
+	}
+	if query["token"] != "xyz" {
+		t.Errorf("expected token from override, got %#v", query["token"])
+	}
+}
+
+func TestParserV2BraceInterpolation(t *testing.T) {
+	input := `
+@base_url "https://api.example.com"
+@user
+  name john
+@version 2
+get "${base_url}/v${version}beta/${user.name}_profile"
+headers
+  X-Mixed "$base_url${ version }"
+  X-Unclosed "${base_url"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	req := requests[0]
+	if want := "https://api.example.com/v2beta/john_profile"; req["get"] != want {
+		t.Errorf("expected %q, got %v", want, req["get"])
+	}
+	headers := req["headers"].(map[string]interface{})
+	if want := "https://api.example.com2"; headers["X-Mixed"] != want {
+		t.Errorf("expected %q, got %v", want, headers["X-Mixed"])
+	}
+	if want := "${base_url"; headers["X-Unclosed"] != want {
+		t.Errorf("expected unterminated reference to be kept, got %v", headers["X-Unclosed"])
+	}
+}
+
+func TestParserV2LenFunction(t *testing.T) {
+	input := `
+@items
+  a
+  b
+  c
+@user
+  name José
+@empty []
+if len($items) > 2
+  post "https://api.example.com/batch"
+  body
+    count len($items)
+    fields len($user)
+    name_length len($user.name)
+    none len($empty)
+if len($empty) > 0
+  get "https://api.example.com/never"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	call, ok := program.Statements[3].(*ast.IfStmt).Branches[0].Condition.(*ast.BinaryExpr).Left.(*ast.CallExpr)
+	if !ok || call.Name != "len" || len(call.Args) != 1 {
+		t.Fatalf("expected len() call in condition, got %#v", program.Statements[3].(*ast.IfStmt).Branches[0].Condition)
+	}
+
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(requests))
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	want := map[string]int64{"count": 3, "fields": 1, "name_length": 4, "none": 0}
+	for key, n := range want {
+		if body[key] != n {
+			t.Errorf("%s: expected %d, got %#v", key, n, body[key])
+		}
+	}
+
+	// Unknown functions and wrong argument counts are errors
+	for _, src := range []string{
+		"@x nope($items)\n",
+		"if len(1, 2) > 0\n  get \"https://api.example.com\"\n",
+		"@n len(5)\n",
+	} {
+		program, err := ParseFile(src)
+		if err != nil {
+			t.Fatalf("parse error for %q: %v", src, err)
+		}
+		if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil {
+			t.Errorf("expected eval error for %q", src)
+		}
+	}
+}
+
+func TestParserV2StringFunctions(t *testing.T) {
+	input := `
+@user
+  name "  John Smith  "
+  role Admin
+post "https://api.example.com/${lower(user.role)}/users"
+body
+  upper upper($user.role)
+  lower lower($user.role)
+  trim trim($user.name)
+  nested upper(trim($user.name))
+  number upper(42)
+  null_val trim(null)
+  greeting "Hello, ${trim($user.name)}!"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if want := "https://api.example.com/admin/users"; requests[0]["post"] != want {
+		t.Errorf("expected %q, got %v", want, requests[0]["post"])
+	}
+	body := requests[0]["body"].(map[string]interface{})
+
+	tests := []struct {
+		key      string
+		expected interface{}
+	}{
+		{"upper", "ADMIN"},
+		{"lower", "admin"},
+		{"trim", "John Smith"},
+		{"nested", "JOHN SMITH"},
+		{"number", "42"},
+		{"null_val", ""},
+		{"greeting", "Hello, John Smith!"},
+	}
+
+	for _, tt := range tests {
+		if body[tt.key] != tt.expected {
+			t.Errorf("%s: expected %v (%T), got %v (%T)",
+				tt.key, tt.expected, tt.expected, body[tt.key], body[tt.key])
+		}
+	}
+
+	// Unknown functions inside ${} are reported
+	program, err = ParseFile(`get "https://api.example.com/${shout(user)}"` + "\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "unknown function shout()") {
+		t.Errorf("expected unknown function error, got %v", err)
+	}
+}
+
+func TestParserV2ShortCircuit(t *testing.T) {
+	// nope() is not a function: evaluating it would fail the statement
+	input := `
+@items []
+if false and nope($items)
+  get "https://api.example.com/and"
+if true or nope($items)
+  get "https://api.example.com/or"
+if len($items) > 0 and $items.0.id == 1
+  get "https://api.example.com/guarded"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("right side should not have been evaluated: %v", err)
+	}
+	if len(requests) != 1 || requests[0]["get"] != "https://api.example.com/or" {
+		t.Errorf("expected only the or branch to run, got %v", requests)
+	}
+
+	// Without short-circuiting the right side is evaluated
+	program, err = ParseFile("if true and nope(1)\n  get \"https://api.example.com\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil {
+		t.Error("expected unknown function error when the right side is needed")
+	}
+}
+
+func TestParserV2DefaultOperator(t *testing.T) {
+	t.Setenv("HAIKU_TEST_TOKEN", "secret")
+	t.Setenv("HAIKU_TEST_EMPTY", "")
+	os.Unsetenv("HAIKU_TEST_UNSET")
+
+	input := `
+@name "haiku"
+@price "$price"
+post "https://api.example.com"
+headers
+  X-Set $env.HAIKU_TEST_TOKEN ?? "anonymous"
+  X-Empty $env.HAIKU_TEST_EMPTY ?? "anonymous"
+  X-Unset $env.HAIKU_TEST_UNSET ?? "anonymous"
+  X-Chain $missing ?? $env.HAIKU_TEST_UNSET ?? "last"
+  X-Concat $env.HAIKU_TEST_UNSET ?? "user-" + $name
+  X-Lazy $name ?? nope(1)
+  X-Inline "Bearer ${env.HAIKU_TEST_UNSET ?? 'anonymous'}"
+  X-Inline-Set "Bearer ${env.HAIKU_TEST_TOKEN ?? 'anonymous'}"
+  X-Inline-Var "${missing ?? name}"
+  X-Inline-Defined "${price ?? 'free'}"
+  X-Quoted "$env.HAIKU_TEST_UNSET ?? 'anonymous'"
+  X-Quoted-Set "Bearer $env.HAIKU_TEST_TOKEN ?? 'anonymous'"
+  X-Quoted-Chain "$missing ?? $env.HAIKU_TEST_EMPTY ?? $name!"
+  X-Quoted-Text "$name ?? maybe"
+body
+  unset $env.HAIKU_TEST_UNSET
+  empty $env.HAIKU_TEST_EMPTY
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	headers := requests[0]["headers"].(map[string]interface{})
+	want := map[string]string{
+		"X-Set":        "secret",
+		"X-Empty":      "anonymous",
+		"X-Unset":      "anonymous",
+		"X-Chain":      "last",
+		"X-Concat":     "user-haiku",
+		"X-Lazy":       "haiku",
+		"X-Inline":     "Bearer anonymous",
+		"X-Inline-Set": "Bearer secret",
+		"X-Inline-Var": "haiku",
+		// A variable whose value looks like its own reference is still defined
+		"X-Inline-Defined": "$price",
+		"X-Quoted":         "anonymous",
+		"X-Quoted-Set":     "Bearer secret",
+		"X-Quoted-Chain":   "haiku!",
+		"X-Quoted-Text":    "haiku ?? maybe",
+	}
+	for name, value := range want {
+		if headers[name] != value {
+			t.Errorf("%s: expected %q, got %v", name, value, headers[name])
+		}
+	}
+
+	// An unset environment variable is null, a set but empty one is ""
+	body := requests[0]["body"].(map[string]interface{})
+	if val, ok := body["unset"]; !ok || val != nil {
+		t.Errorf("expected unset env var to be null, got %#v", val)
+	}
+	if body["empty"] != "" {
+		t.Errorf("expected empty env var to be \"\", got %#v", body["empty"])
+	}
+}
+
+func TestParserV2Pick(t *testing.T) {
+	// evalWithResponse evaluates input with a mock previous response as $_
+	evalWithResponse := func(input string) map[string]interface{} {
+		t.Helper()
+		program, err := ParseFile(input)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		evaluator := eval.NewEvaluator()
+		evaluator.SetPrevResponse(map[string]interface{}{
+			"status":  int64(200),
+			"headers": map[string]interface{}{"Content-Type": "application/json"},
+			"body": map[string]interface{}{
+				"id":   int64(7),
+				"name": "Ada Lovelace",
+				"user": map[string]interface{}{"email": "ada@example.com"},
+			},
+		})
+		requests, err := evaluator.EvalToRequests(program)
+		if err != nil {
+			t.Fatalf("eval error: %v", err)
+		}
+		return requests[0]["body"].(map[string]interface{})
+	}
+
+	body := evalWithResponse(`
+post "https://api.example.com/profiles"
+body pick($_, id, name -> full_name, "user.email", "user.email" -> contact, missing, status)
+`)
+	want := map[string]interface{}{
+		"id":        int64(7),
+		"full_name": "Ada Lovelace",
+		"email":     "ada@example.com",
+		"contact":   "ada@example.com",
+		"missing":   nil,
+		"status":    int64(200),
+	}
+	if len(body) != len(want) {
+		t.Errorf("expected %d fields, got %v", len(want), body)
+	}
+	for k, v := range want {
+		if got, ok := body[k]; !ok || got != v {
+			t.Errorf("%s: expected %v, got %v", k, v, got)
+		}
+	}
+
+	body = evalWithResponse(`
+post "https://api.example.com/profiles"
+body
+  profile pick($_.body.user, email->mail)
+`)
+	profile := body["profile"].(map[string]interface{})
+	if len(profile) != 1 || profile["mail"] != "ada@example.com" {
+		t.Errorf("unexpected profile: %v", profile)
+	}
+
+	// Renames are only accepted by pick
+	program, err := ParseFile("@x len(a -> b)\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil {
+		t.Error("expected error for rename argument to len()")
+	}
+}
+
+func TestParserV2DefaultHeaders(t *testing.T) {
+	input := `
+@headers
+  Accept "application/json"
+  Content-Type "application/json"
+  post
+    X-Csrf-Token "abc"
+
+get "https://api.example.com/users"
+---
+post "https://api.example.com/users"
+body
+  name John
+---
+post "https://api.example.com/upload"
+headers
+  content-type "text/plain"
+body "raw text"
+---
+put "https://api.example.com/users/1"
+form
+  name John
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(requests))
+	}
+
+	want := []map[string]interface{}{
+		// No body: the default Content-Type is left out, method headers don't apply
+		{"Accept": "application/json"},
+		{"Accept": "application/json", "Content-Type": "application/json", "X-Csrf-Token": "abc"},
+		// Explicit headers replace defaults regardless of case
+		{"Accept": "application/json", "content-type": "text/plain", "X-Csrf-Token": "abc"},
+		// A form body gets its own Content-Type when sent
+		{"Accept": "application/json"},
+	}
+	for i, req := range requests {
+		headers, _ := req["headers"].(map[string]interface{})
+		if len(headers) != len(want[i]) {
+			t.Errorf("request %d: expected headers %v, got %v", i+1, want[i], headers)
+			continue
+		}
+		for k, v := range want[i] {
+			if headers[k] != v {
+				t.Errorf("request %d: expected %s %v, got %v", i+1, k, v, headers[k])
+			}
+		}
+	}
+}
+
+func TestParserV2Capture(t *testing.T) {
+	input := `
+post "https://api.example.com/login"
+capture token $_.data.token
+get "https://api.example.com/me"
+headers
+  Authorization "Bearer $token"
+for $id in 1..2
+  get "https://api.example.com/users/$id"
+  capture name $_.data.name
+  post "https://api.example.com/greetings"
+  body
+    text "hi $name"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Each response echoes back something derived from the request URL
+	callback := func(req map[string]interface{}) (map[string]interface{}, error) {
+		data := map[string]interface{}{}
+		if url, ok := req["post"].(string); ok && strings.HasSuffix(url, "/login") {
+			data["token"] = "t0k3n"
+		}
+		if url, ok := req["get"].(string); ok && strings.Contains(url, "/users/") {
+			data["name"] = "user" + url[strings.LastIndex(url, "/")+1:]
+		}
+		body := map[string]interface{}{"data": data}
+		return map[string]interface{}{"status": int64(200), "body": body}, nil
+	}
+	requests, err := eval.NewEvaluator(eval.WithRequestCallback(callback)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 6 {
+		t.Fatalf("expected 6 requests, got %d", len(requests))
+	}
+
+	headers := requests[1]["headers"].(map[string]interface{})
+	if headers["Authorization"] != "Bearer t0k3n" {
+		t.Errorf("expected captured token in header, got %v", headers["Authorization"])
+	}
+	// Inside the loop the capture holds the value from the current iteration
+	for i, want := range []string{"hi user1", "hi user2"} {
+		body := requests[3+2*i]["body"].(map[string]interface{})
+		if body["text"] != want {
+			t.Errorf("iteration %d: expected %q, got %v", i+1, want, body["text"])
+		}
+	}
+
+	// Capturing before any request is an error
+	program, err = ParseFile("capture token $_.token\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "no previous response") {
+		t.Errorf("expected no previous response error, got %v", err)
+	}
+
+	if _, err := ParseFile("get \"https://api.example.com\"\ncapture token\n"); err == nil {
+		t.Error("expected parse error for capture without a value")
+	}
+}
+
+func TestParserV2RangeStep(t *testing.T) {
+	tests := []struct {
+		rng  string
+		want []string
+	}{
+		{"1..3", []string{"1", "2", "3"}},
+		{"0..10 step 5", []string{"0", "5", "10"}},
+		{"1..6 step 2", []string{"1", "3", "5"}},
+		{"3..1 step -1", []string{"3", "2", "1"}},
+		{"$start..1 step -2", []string{"5", "3", "1"}},
+		{"2..1", nil},
+		{"1..3 step -1", nil},
+	}
+
+	for _, tt := range tests {
+		input := "@start 5\nfor $i in " + tt.rng + "\n  get \"https://api.example.com/items/$i\"\n"
+		program, err := ParseFile(input)
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", tt.rng, err)
+		}
+		requests, err := eval.NewEvaluator().EvalToRequests(program)
+		if err != nil {
+			t.Fatalf("%s: eval error: %v", tt.rng, err)
+		}
+		var got []string
+		for _, req := range requests {
+			url, _ := req["get"].(string)
+			got = append(got, strings.TrimPrefix(url, "https://api.example.com/items/"))
+		}
+		if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: expected %v, got %v", tt.rng, tt.want, got)
+		}
+	}
+
+	program, err := ParseFile("for $i in 1..3 step 0\n  get \"https://api.example.com/items/$i\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "step must not be zero") {
+		t.Errorf("expected zero step error, got %v", err)
+	}
+
+	// Huge ranges fail instead of building the whole list in memory
+	for _, rng := range []string{"1..2000000", "0..9223372036854775807 step 2", "$_.total..1 step -1"} {
+		program, err := ParseFile("for $i in " + rng + "\n  get \"https://api.example.com/items/$i\"\n")
+		if err != nil {
+			t.Fatalf("%s: parse error: %v", rng, err)
+		}
+		evaluator := eval.NewEvaluator()
+		evaluator.SetPrevResponse(map[string]interface{}{"body": map[string]interface{}{"total": int64(5000000)}})
+		if _, err := evaluator.EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "items") {
+			t.Errorf("%s: expected a range size error, got %v", rng, err)
+		}
+	}
+}
+
+func TestParserV2Delay(t *testing.T) {
+	input := `
+@delay "30ms"
+get "https://api.example.com/first"
+for $i in 1..2
+  get "https://api.example.com/items/$i"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	start := time.Now()
+	var offsets []time.Duration
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		offsets = append(offsets, time.Since(start))
+		return map[string]interface{}{"status": int64(200)}, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if len(offsets) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(offsets))
+	}
+	// No delay before the first request, then at least 30ms between requests
+	if offsets[0] >= 30*time.Millisecond {
+		t.Errorf("first request was delayed by %v", offsets[0])
+	}
+	for i := 1; i < len(offsets); i++ {
+		if gap := offsets[i] - offsets[i-1]; gap < 30*time.Millisecond {
+			t.Errorf("request %d came %v after the previous one, expected at least 30ms", i+1, gap)
+		}
+	}
+}
+
+func TestParserV2ParallelRate(t *testing.T) {
+	input := `
+parallel 4 rate 20/s for $i in 1..5
+  get "https://api.example.com/items/$i"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	stmt := program.Statements[0].(*ast.ForStmt)
+	if stmt.Concurrency != 4 || stmt.Rate != 20 {
+		t.Fatalf("expected concurrency 4 and rate 20, got %d and %v", stmt.Concurrency, stmt.Rate)
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		return nil, nil
+	}))
+	start := time.Now()
+	if err := evaluator.EvalParallelForWithOutput(stmt); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	// 5 iterations at 20/s: the last one starts 4 intervals (200ms) after the first
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected rate limit to spread iterations over at least 200ms, took %v", elapsed)
+	}
+	if calls != 5 {
+		t.Errorf("expected 5 requests, got %d", calls)
+	}
+	if rate, _ := evaluator.GetParallelStats()["rate"].(string); !strings.HasSuffix(rate, "/s") {
+		t.Errorf("expected achieved rate in stats, got %q", rate)
+	}
+
+	for _, bad := range []string{"parallel rate for 3\n  get \"http://x\"\n", "parallel rate 10 for 3\n  get \"http://x\"\n"} {
+		if _, err := ParseFile(bad); err == nil {
+			t.Errorf("expected parse error for %q", bad)
+		}
+	}
+}
+
+func TestParserV2ContinueOnError(t *testing.T) {
+	input := `
+for $i in 3
+  get "https://api.example.com/items/$i"
+get "https://api.example.com/after?status=$_.status"
+parallel 2 for $i in 4
+  get "https://api.example.com/slow/$i"
+get "https://api.example.com/done"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var mu sync.Mutex
+	var sent []string
+	callback := func(req map[string]interface{}) (map[string]interface{}, error) {
+		url := req["get"].(string)
+		mu.Lock()
+		sent = append(sent, url)
+		mu.Unlock()
+		switch {
+		case strings.HasSuffix(url, "/items/2"):
+			return nil, fmt.Errorf("connection refused")
+		case strings.Contains(url, "/slow/") && !strings.HasSuffix(url, "/0"):
+			return nil, fmt.Errorf("deadline exceeded")
+		}
+		return map[string]interface{}{"status": int64(200)}, nil
+	}
+	kind := func(err error) string {
+		if strings.Contains(err.Error(), "deadline") {
+			return "timeout"
+		}
+		return "connection"
+	}
+
+	// Without the option the first failure stops the run
+	if _, err := eval.NewEvaluator(eval.WithRequestCallback(callback)).Eval(program); err == nil {
+		t.Fatal("expected the failed request to stop the run")
+	}
+
+	sent = nil
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(callback), eval.WithContinueOnError(kind))
+	for _, stmt := range program.Statements {
+		if loop, ok := stmt.(*ast.ForStmt); ok && loop.Parallel {
+			err = evaluator.EvalParallelForWithOutput(loop)
+		} else {
+			_, err = evaluator.Eval(&ast.Program{Statements: []ast.Statement{stmt}})
+		}
+		if err != nil {
+			t.Fatalf("expected the run to go on, got %v", err)
+		}
+	}
+	if len(sent) != 9 {
+		t.Errorf("expected all 9 requests to be sent, got %d: %v", len(sent), sent)
+	}
+	// $_ after a failed request has status 0
+	if len(sent) > 3 && sent[3] != "https://api.example.com/after?status=0" {
+		t.Errorf("expected $_.status to be 0 after a failed request, got %s", sent[3])
+	}
+
+	stats := evaluator.GetParallelStats()
+	if stats["failed"] != 3 || stats["success"] != 1 {
+		t.Errorf("expected 3 failed and 1 successful iteration, got %v", stats)
+	}
+	groups, _ := stats["errors"].([]interface{})
+	if len(groups) != 1 || groups[0].(map[string]interface{})["kind"] != "timeout" || groups[0].(map[string]interface{})["count"] != 3 {
+		t.Errorf("expected the loop's errors grouped by kind, got %v", stats["errors"])
+	}
+
+	want := []eval.ErrorGroup{
+		{Kind: "connection", Count: 1, Message: "connection refused"},
+		{Kind: "timeout", Count: 3, Message: "deadline exceeded"},
+	}
+	if got := evaluator.RequestFailures(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected failures %v, got %v", want, got)
+	}
+}
+
+func TestParserV2Sleep(t *testing.T) {
+	input := `
+@pause "10ms"
+get "https://api.example.com/a"
+sleep 20ms
+for $i in 2
+  sleep $pause
+  if $i == 1
+    sleep "0.01"
+post "https://api.example.com/b"
+body
+  sleep 5
+  state sleep
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Without a request callback (-p) nothing waits
+	start := time.Now()
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 15*time.Millisecond {
+		t.Errorf("expected no pause without executing requests, took %v", elapsed)
+	}
+	body := requests[1]["body"].(map[string]interface{})
+	if body["sleep"] != int64(5) || body["state"] != "sleep" {
+		t.Errorf("expected sleep to stay usable as a key and a value, got %v", body)
+	}
+
+	var times []time.Time
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		times = append(times, time.Now())
+		return nil, nil
+	}))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	// 20ms at the top level, 10ms per iteration and 10ms in the if
+	if len(times) != 2 || times[1].Sub(times[0]) < 50*time.Millisecond {
+		t.Errorf("expected at least 50ms between the requests, got %v", times)
+	}
+
+	for input, msg := range map[string]string{
+		"sleep\n":          "expected duration after sleep",
+		"sleep \"soon\"\n": "line 1: sleep:",
+		"sleep -1\n":       "negative duration",
+	} {
+		program, err := ParseFile(input)
+		if err == nil {
+			_, err = eval.NewEvaluator(eval.WithRequestCallback(func(map[string]interface{}) (map[string]interface{}, error) {
+				return nil, nil
+			})).Eval(program)
+		}
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%q: expected error containing %q, got %v", input, msg, err)
+		}
+	}
+}
+
+// countingStdin counts Read calls so the test can check stdin is read once
+type countingStdin struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingStdin) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func TestParserV2StdinProcessor(t *testing.T) {
+	input := `
+for $i in 1..2
+  post "https://api.example.com/items/$i"
+  body stdin` + "``" + `
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// JSON input becomes structured data, shared by every request in the run
+	stdin := &countingStdin{r: strings.NewReader(`{"name": "Ann"}`)}
+	requests, err := eval.NewEvaluator(eval.WithStdin(stdin)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+	for i, req := range requests {
+		body, ok := req["body"].(map[string]interface{})
+		if !ok || body["name"] != "Ann" {
+			t.Errorf("request %d: expected JSON body from stdin, got %#v", i+1, req["body"])
+		}
+	}
+	// A second ReadAll call would only see EOF, but it must not happen at all
+	if reads := stdin.reads; reads > 2 {
+		t.Errorf("expected stdin to be read once, got %d Read calls", reads)
+	}
+
+	// Anything else is kept as a raw string
+	requests, err = eval.NewEvaluator(eval.WithStdin(strings.NewReader("a=1&b=2\n"))).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if body := requests[0]["body"]; body != "a=1&b=2\n" {
+		t.Errorf("expected raw body, got %#v", body)
+	}
+
+	// Without a stdin reader (the script came from stdin) it is an error
+	_, err = eval.NewEvaluator().EvalToRequests(program)
+	if err == nil || !strings.Contains(err.Error(), "stdin`` is not available") {
+		t.Errorf("expected stdin not available error, got %v", err)
+	}
+
+	// Content between the backticks is rejected
+	program, err = ParseFile("post \"https://api.example.com\"\nbody stdin`data`\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	_, err = eval.NewEvaluator(eval.WithStdin(strings.NewReader("x"))).EvalToRequests(program)
+	if err == nil || !strings.Contains(err.Error(), "takes no content") {
+		t.Errorf("expected takes no content error, got %v", err)
+	}
+}
+
+func TestParserV2ResponseHistory(t *testing.T) {
+	input := `
+@prefix "p"
+get "https://api.example.com/login"
+get "https://api.example.com/users/$_.body.n"
+get "https://api.example.com/orders/$_.body.n/$_1.body.n/$_2.body.n"
+post "https://api.example.com/check"
+body
+  first $responses.0.body.n
+  count $_.body.n
+  missing $_9
+parallel 2 for $i in 2
+  get "https://api.example.com/par/$i"
+  get "https://api.example.com/par/$i/$_1.body.n"
+get "https://api.example.com/after/$_.body.n"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	var mu sync.Mutex
+	var sent []map[string]interface{}
+	callback := func(req map[string]interface{}) (map[string]interface{}, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, req)
+		return map[string]interface{}{"status": int64(200), "body": map[string]interface{}{"n": int64(len(sent))}}, nil
+	}
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(callback))
+	for _, stmt := range program.Statements {
+		if loop, ok := stmt.(*ast.ForStmt); ok && loop.Parallel {
+			err = evaluator.EvalParallelForWithOutput(loop)
+		} else {
+			_, err = evaluator.Eval(&ast.Program{Statements: []ast.Statement{stmt}})
+		}
+		if err != nil {
+			t.Fatalf("eval error: %v", err)
+		}
+	}
+	if len(sent) != 9 {
+		t.Fatalf("expected 9 requests, got %d", len(sent))
+	}
+
+	if url := sent[2]["get"]; url != "https://api.example.com/orders/2/1/<nil>" {
+		t.Errorf("expected $_1 and $_2 to count back from $_, got %v", url)
+	}
+	body := sent[3]["body"].(map[string]interface{})
+	if body["first"] != int64(1) || body["count"] != int64(3) || body["missing"] != nil {
+		t.Errorf("unexpected body: %v", body)
+	}
+	// Each parallel iteration sees only its own responses after the ones before the loop
+	chained := 0
+	for _, req := range sent[4:8] {
+		url := req["get"].(string)
+		if parts := strings.Split(strings.TrimPrefix(url, "https://api.example.com/par/"), "/"); len(parts) == 2 {
+			chained++
+			if parts[1] != "4" {
+				t.Errorf("expected $_1 in the iteration to be the request before the loop, got %s", url)
+			}
+		}
+	}
+	if chained != 2 {
+		t.Errorf("expected 2 chained requests in the parallel loop, got %d", chained)
+	}
+	// The parallel loop doesn't change $_ or the history after it
+	if url := sent[8]["get"]; url != "https://api.example.com/after/4" {
+		t.Errorf("expected $_ to be the last response before the loop, got %v", url)
+	}
+
+	// A variable named responses shadows the history
+	program, err = ParseFile("@responses 3\nget \"https://x/$responses\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if requests[0]["get"] != "https://x/3" {
+		t.Errorf("expected @responses to win, got %v", requests[0]["get"])
+	}
+
+	// @history keeps only the latest responses
+	program, err = ParseFile(`
+@history 2
+for $i in 1..5
+  get "https://api.example.com/items/$i"
+get "https://api.example.com/last/${$responses.0.body.n}/$_2.body.n"
+`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	sent = nil
+	evaluator = eval.NewEvaluator(eval.WithRequestCallback(callback))
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if url := sent[5]["get"]; url != "https://api.example.com/last/4/<nil>" {
+		t.Errorf("expected the history to keep the last 2 responses, got %v", url)
+	}
+}
+
+func TestParserV2IndexPaths(t *testing.T) {
+	input := `
+@items
+  a
+  b
+  c
+@users json` + "`" + `[{"name": "x"}, {"name": "y"}]` + "`" + `
+get "https://api.example.com/$items.-1/$items[0]/$users[-1].name/${items[1]}/$missing[0]"
+body
+  last $items.-1
+  first $items[0]
+  name $users[1].name
+  second_last $users.-2.name
+  out_of_range $items.-4
+  spaced "$items [0]"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	if url := requests[0]["get"]; url != "https://api.example.com/c/a/y/b/$missing[0]" {
+		t.Errorf("unexpected url: %v", url)
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	want := map[string]interface{}{
+		"last":         "c",
+		"first":        "a",
+		"name":         "y",
+		"second_last":  "x",
+		"out_of_range": nil,
+		"spaced":       "[a b c] [0]",
+	}
+	for k, v := range want {
+		if body[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, body[k])
+		}
+	}
+
+	if _, err := ParseFile("get \"https://x\"\nbody\n  id $items[name]\n"); err == nil {
+		t.Error("expected parse error for a non-integer bracket index")
+	}
+}
+
+func TestParserV2WildcardPaths(t *testing.T) {
+	input := `
+@data json` + "`" + `{"items": [{"id": 1, "tags": ["a"]}, {"name": "no id"}, {"id": 3, "tags": ["b", "c"]}]}` + "`" + `
+capture ids $data.items.*.id
+get "https://api.example.com/batch?ids=${data.items.*.id}"
+body
+  ids $ids
+  last_tags $data.items.*.tags.-1
+  on_object $data.*.id
+for $id in $data.items.*.id
+  if $id == _
+    continue
+  get "https://api.example.com/items/$id"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	// capture needs a previous response
+	evaluator := eval.NewEvaluator()
+	evaluator.SetPrevResponse(map[string]interface{}{"status": int64(200)})
+	requests, err := evaluator.EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	if url := requests[0]["get"]; url != "https://api.example.com/batch?ids=[1 <nil> 3]" {
+		t.Errorf("unexpected url: %v", url)
+	}
+	body := requests[0]["body"].(map[string]interface{})
+	if fmt.Sprint(body["ids"]) != "[1 <nil> 3]" {
+		t.Errorf("expected missing fields to be null, got %v", body["ids"])
+	}
+	if fmt.Sprint(body["last_tags"]) != "[a <nil> c]" {
+		t.Errorf("unexpected last tags: %v", body["last_tags"])
+	}
+	if body["on_object"] != nil {
+		t.Errorf("expected * on an object to be null, got %v", body["on_object"])
+	}
+	if requests[1]["get"] != "https://api.example.com/items/1" || requests[2]["get"] != "https://api.example.com/items/3" {
+		t.Errorf("unexpected loop requests: %v, %v", requests[1]["get"], requests[2]["get"])
+	}
+}
+
+func TestParserV2DefaultTimeoutOption(t *testing.T) {
+	input := `
+@timeout 5s
+get "https://api.example.com/a"
+get "https://api.example.com/b"
+timeout 2s
+parallel 2 for $i in 2
+  @timeout 9s
+  get "https://api.example.com/c/$i"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	requests, err := eval.NewEvaluator(eval.WithDefaultTimeout(750 * time.Millisecond)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	want := []time.Duration{750 * time.Millisecond, 2 * time.Second, 750 * time.Millisecond, 750 * time.Millisecond}
+	if len(requests) != len(want) {
+		t.Fatalf("expected %d requests, got %d", len(want), len(requests))
+	}
+	for i, req := range requests {
+		if req["timeout"] != want[i] {
+			t.Errorf("request %d: expected timeout %v, got %v", i, want[i], req["timeout"])
+		}
+	}
+
+	// Without the option (or with a non-positive duration) @timeout applies
+	requests, err = eval.NewEvaluator(eval.WithDefaultTimeout(0)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if requests[0]["timeout"] != 5*time.Second {
+		t.Errorf("expected @timeout to apply, got %v", requests[0]["timeout"])
+	}
+
+	if d, err := eval.ParseTimeout("1.5m"); err != nil || d != 90*time.Second {
+		t.Errorf("expected 1m30s, got %v (%v)", d, err)
+	}
+	if _, err := eval.ParseTimeout("soon"); err == nil {
+		t.Error("expected error for a duration without a number")
+	}
+}
+
+func TestParserV2ParallelPercentiles(t *testing.T) {
+	input := `
+parallel 10 for $i in 10
+  get "https://api.example.com/items/$i"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	stmt := program.Statements[0].(*ast.ForStmt)
+
+	// Item i takes (i+1)*5ms, so the iteration times are clearly ordered
+	evaluator := eval.NewEvaluator(eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		url := req["get"].(string)
+		n, _ := strconv.Atoi(url[strings.LastIndex(url, "/")+1:])
+		time.Sleep(time.Duration(n+1) * 5 * time.Millisecond)
+		return nil, nil
+	}))
+	if err := evaluator.EvalParallelForWithOutput(stmt); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	stats := evaluator.GetParallelStats()
+	durations := map[string]time.Duration{}
+	for _, key := range []string{"min_time", "p50_time", "p95_time", "p99_time", "max_time"} {
+		s, _ := stats[key].(string)
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatalf("%s: expected a duration, got %q", key, s)
+		}
+		durations[key] = d
+	}
+	// Nearest rank over 10 samples: p50 is the 5th time, p95 and p99 the 10th (the maximum)
+	if d := durations["p50_time"]; d < 25*time.Millisecond || d >= 50*time.Millisecond {
+		t.Errorf("expected p50 around 25ms, got %v", d)
+	}
+	if durations["p95_time"] != durations["max_time"] || durations["p99_time"] != durations["max_time"] {
+		t.Errorf("expected p95 and p99 to be the maximum with 10 samples, got %v", durations)
+	}
+	if durations["min_time"] > durations["p50_time"] {
+		t.Errorf("expected min <= p50, got %v", durations)
+	}
+}
+
+func TestParserV2ParallelBytes(t *testing.T) {
+	input := `
+parallel 3 for $i in 4
+  get "https://api.example.com/items/$i"
+  echo "$_"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	stmt := program.Statements[0].(*ast.ForStmt)
+
+	executor := eval.WithRequestExecutor(func(req map[string]interface{}) (eval.RequestResult, error) {
+		return eval.RequestResult{Response: map[string]interface{}{"status": int64(200)}, Bytes: 100}, nil
+	})
+
+	evaluator := eval.NewEvaluator(executor)
+	if err := evaluator.EvalParallelForWithOutput(stmt); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	stats := evaluator.GetParallelStats()
+	if stats["total_bytes"] != int64(400) {
+		t.Errorf("expected 400 bytes, got %v", stats["total_bytes"])
+	}
+	if rps, ok := stats["throughput"].(float64); !ok || rps <= 0 {
+		t.Errorf("expected a positive throughput, got %v", stats["throughput"])
+	}
+
+	// Without real-time output the stats have the same fields
+	evaluator = eval.NewEvaluator(executor)
+	if _, err := evaluator.Eval(program); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	stats = evaluator.GetParallelStats()
+	if stats["total_bytes"] != int64(400) {
+		t.Errorf("expected 400 bytes, got %v", stats["total_bytes"])
+	}
+	if rps, ok := stats["throughput"].(float64); !ok || rps <= 0 {
+		t.Errorf("expected a positive throughput, got %v", stats["throughput"])
+	}
+}
+
+func TestParserV2Templates(t *testing.T) {
+	input := `
+@token abc
+@trace_headers
+  X-Trace trace
+
+@template authed
+  headers
+    Authorization "Bearer $token"
+    X-Trace authed
+  timeout 5s
+  assert status 200
+
+@template create
+  use authed
+  headers
+    Content-Type "application/json"
+  query
+    v 1
+  body
+    source haiku
+    count 1
+
+post "https://api.example.com/items" use create use trace_headers
+headers
+  Accept "application/json"
+body
+  count 2
+
+get "https://api.example.com/items" use authed
+timeout 1s
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(requests))
+	}
+
+	post := requests[0]
+	headers := post["headers"].(map[string]interface{})
+	wantHeaders := map[string]interface{}{
+		"Authorization": "Bearer abc",
+		"Content-Type":  "application/json",
+		"Accept":        "application/json",
+		"X-Trace":       "trace", // the header set is used after the template
+	}
+	for k, v := range wantHeaders {
+		if headers[k] != v {
+			t.Errorf("header %s: expected %v, got %v", k, v, headers[k])
+		}
+	}
+	body := post["body"].(map[string]interface{})
+	if body["source"] != "haiku" || body["count"] != int64(2) {
+		t.Errorf("expected template body merged under the request's, got %v", body)
+	}
+	if query := post["query"].(map[string]interface{}); query["v"] != int64(1) {
+		t.Errorf("expected template query, got %v", query)
+	}
+	if post["timeout"] != 5*time.Second {
+		t.Errorf("expected timeout from the nested template, got %v", post["timeout"])
+	}
+	if asserts, _ := post["assert"].([]interface{}); len(asserts) != 1 {
+		t.Errorf("expected the template's assertion, got %v", post["assert"])
+	}
+
+	if requests[1]["timeout"] != time.Second {
+		t.Errorf("expected the request's own timeout to win, got %v", requests[1]["timeout"])
+	}
+	if _, ok := requests[1]["body"]; ok {
+		t.Errorf("expected no body on the get request, got %v", requests[1]["body"])
+	}
+
+	for _, src := range []string{
+		"@template a\n  use b\n@template b\n  use a\nget \"https://x\" use a\n",
+		"get \"https://x\" use missing\n",
+	} {
+		program, err := ParseFile(src)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil {
+			t.Errorf("expected eval error for %q", src)
+		}
+	}
+	if _, err := ParseFile("@template a\n  get \"https://x\"\n"); err == nil {
+		t.Error("expected parse error for a request inside a template")
+	}
+}
+
+func TestParserV2URLDefaults(t *testing.T) {
+	input := `
+@headers
+  Accept "application/json"
+  X-Scope global
+
+@defaults
+  "https://api.internal/**"
+    headers
+      Authorization "Bearer abc"
+      X-Scope internal
+      post
+        X-Csrf-Token csrf
+  "https://api.internal/public/*"
+    headers
+      X-Scope public
+
+post "https://api.internal/public/items?page=2"
+headers
+  X-Request-Id 42
+body
+  name John
+
+get "https://api.internal/users/1"
+headers
+  X-Scope own
+
+get "https://example.com/public/items"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	want := []map[string]interface{}{
+		{
+			"Accept":        "application/json",
+			"Authorization": "Bearer abc",
+			"X-Scope":       "public", // the longer pattern wins
+			"X-Csrf-Token":  "csrf",
+			"X-Request-Id":  int64(42),
+		},
+		{
+			"Accept":        "application/json",
+			"Authorization": "Bearer abc",
+			"X-Scope":       "own", // explicit headers win
+		},
+		{
+			"Accept":  "application/json",
+			"X-Scope": "global",
+		},
+	}
+	for i, req := range requests {
+		headers := req["headers"].(map[string]interface{})
+		if len(headers) != len(want[i]) {
+			t.Errorf("request %d: expected headers %v, got %v", i+1, want[i], headers)
+			continue
+		}
+		for k, v := range want[i] {
+			if headers[k] != v {
+				t.Errorf("request %d: header %s: expected %v, got %v", i+1, k, v, headers[k])
+			}
+		}
+	}
+
+	program, err = ParseFile("@defaults\n  \"https://x/*\"\n    body\n      a 1\nget \"https://x/y\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "unsupported section") {
+		t.Errorf("expected unsupported section error, got %v", err)
+	}
+}
+
+func TestParserV2Match(t *testing.T) {
+	input := "for $code in json`[200, 404, 410, 500]`\n" + `  match $code
+    case 200
+      get "https://api.example.com/ok"
+    case 404, 410
+      get "https://api.example.com/gone/$code"
+    default
+      get "https://api.example.com/other/$code"
+
+match "b"
+  case "a"
+    get "https://api.example.com/a"
+
+for $i in 5
+  match $i
+    case 1
+      continue
+    case 3
+      break
+  get "https://api.example.com/try/$i"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+
+	want := []string{
+		"https://api.example.com/ok",
+		"https://api.example.com/gone/404",
+		"https://api.example.com/gone/410",
+		"https://api.example.com/other/500",
+		"https://api.example.com/try/0",
+		"https://api.example.com/try/2",
+	}
+	if len(requests) != len(want) {
+		t.Fatalf("expected %d requests, got %d: %v", len(want), len(requests), requests)
+	}
+	for i, url := range want {
+		if requests[i]["get"] != url {
+			t.Errorf("request %d: expected %s, got %v", i+1, url, requests[i]["get"])
+		}
+	}
+
+	for _, src := range []string{
+		"match $x\nget \"https://x\"\n",
+		"match $x\n  when 1\n    get \"https://x\"\n",
+		"match $x\n  default\n    get \"https://x\"\n  default\n    get \"https://y\"\n",
+	} {
+		if _, err := ParseFile(src); err == nil {
+			t.Errorf("expected parse error for %q", src)
+		}
+	}
+}
+
+func TestParserV2Functions(t *testing.T) {
+	input := `
+@base "https://api.example.com"
+@role guest
+
+def createUser($name, $role)
+  @path users
+  post "$base/$path"
+  body
+    name $name
+    role $role
+
+def fetchAll($ids)
+  for $id in $ids
+    ? $id == 2
+      continue
+    get "$base/items/$id"
+
+createUser "Alice" admin
+createUser("Bob", $role)
+fetchAll json` + "`[1, 2, 3]`" + `
+get "$base/$role"
+`
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 5 {
+		t.Fatalf("expected 5 requests, got %d: %v", len(requests), requests)
+	}
+	for i, want := range []map[string]interface{}{
+		{"name": "Alice", "role": "admin"},
+		{"name": "Bob", "role": "guest"},
+	} {
+		body := requests[i]["body"].(map[string]interface{})
+		if body["name"] != want["name"] || body["role"] != want["role"] {
+			t.Errorf("request %d: expected body %v, got %v", i+1, want, body)
+		}
+	}
+	for i, url := range []string{"https://api.example.com/items/1", "https://api.example.com/items/3"} {
+		if requests[i+2]["get"] != url {
+			t.Errorf("request %d: expected %s, got %v", i+3, url, requests[i+2]["get"])
+		}
+	}
+	// Parameters and @var definitions inside the function are local to the call
+	if requests[4]["get"] != "https://api.example.com/guest" {
+		t.Errorf("expected the caller's $role after the calls, got %v", requests[4]["get"])
+	}
+
+	for src, want := range map[string]string{
+		"missing 1\n": `undefined function "missing"`,
+		"def f($a)\n  get \"https://x/$a\"\nf 1 2\n": "f expects 1 argument(s), got 2",
+		"def f\n  f\nf\n": "nested deeper than",
+		"def f\n  break\nfor $i in 2\n  f\n  get \"https://x\"\n": "break outside of a loop",
+	} {
+		program, err := ParseFile(src)
+		if err != nil {
+			t.Fatalf("parse error for %q: %v", src, err)
+		}
+		if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected error containing %q, got %v", src, want, err)
+		}
+	}
+
+	// Leftover words after a value are not calls, only words that start a line
+	if _, err := ParseFile("@timeout 5 s\nget \"https://x\"\n"); err != nil {
+		t.Errorf("unexpected parse error: %v", err)
+	}
+	if _, err := ParseFile("def f(a)\n  get \"https://x\"\n"); err == nil {
+		t.Error("expected parse error for a parameter without $")
+	}
+}
+
+func TestParserV2GraphQL(t *testing.T) {
+	input := "@base \"https://api.example.com\"\n@id 42\n\n" +
+		"graphql \"$base/graphql\"\nquery`\n  query User($id: ID!) {\n    user(id: $id) { name }\n  }\n`\nvariables\n  id $id\n\n" +
+		"graphql \"$base/graphql\" query`{ viewer { login } }`\nheaders\n  Content-Type \"application/graphql-response+json\"\n\n" +
+		"post \"$base/items\"\nbody\n  kind graphql\n"
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	first := requests[0]
+	if first["post"] != "https://api.example.com/graphql" {
+		t.Errorf("expected a POST to the graphql URL, got %v", first)
+	}
+	body := first["body"].(map[string]interface{})
+	if body["query"] != "query User($id: ID!) {\n    user(id: $id) { name }\n  }" {
+		t.Errorf("expected the query document uninterpolated, got %q", body["query"])
+	}
+	if vars := body["variables"].(map[string]interface{}); vars["id"] != int64(42) {
+		t.Errorf("expected variables {id: 42}, got %v", vars)
+	}
+	if ct := first["headers"].(map[string]interface{})["Content-Type"]; ct != "application/json" {
+		t.Errorf("expected Content-Type application/json, got %v", ct)
+	}
+
+	second := requests[1]
+	if _, ok := second["body"].(map[string]interface{})["variables"]; ok {
+		t.Errorf("expected no variables without a variables section, got %v", second["body"])
+	}
+	if ct := second["headers"].(map[string]interface{})["Content-Type"]; ct != "application/graphql-response+json" {
+		t.Errorf("expected the explicit Content-Type to win, got %v", ct)
+	}
+
+	if kind := requests[2]["body"].(map[string]interface{})["kind"]; kind != "graphql" {
+		t.Errorf("expected graphql as a plain value, got %v", kind)
+	}
+
+	for _, src := range []string{
+		"graphql \"https://x/graphql\"\n",
+		"graphql \"https://x/graphql\" query`{ a }`\nbody\n  a 1\n",
+	} {
+		if _, err := ParseFile(src); err == nil {
+			t.Errorf("expected parse error for %q", src)
+		}
+	}
+}
+
+func TestParserV2WebSocket(t *testing.T) {
+	input := "@room lobby\n\n" +
+		"ws \"wss://chat.example.com/$room\"\ntimeout 5s\nsend\n  hello\n  json`{\"type\": \"join\", \"room\": \"lobby\"}`\n\n" +
+		"ws \"wss://chat.example.com/ping\" send ping\n\n" +
+		"post \"https://api.example.com/items\"\nbody\n  transport ws\n"
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("expected 3 requests, got %d", len(requests))
+	}
+
+	first := requests[0]
+	if first["ws"] != "wss://chat.example.com/lobby" {
+		t.Errorf("expected the ws URL under ws, got %v", first)
+	}
+	send, ok := first["send"].([]interface{})
+	if !ok || len(send) != 2 || send[0] != "hello" {
+		t.Fatalf("expected two messages, got %v", first["send"])
+	}
+	if msg, ok := send[1].(map[string]interface{}); !ok || msg["type"] != "join" {
+		t.Errorf("expected a JSON message, got %v", send[1])
+	}
+	if first["timeout"] != 5*time.Second {
+		t.Errorf("expected the request timeout, got %v", first["timeout"])
+	}
+
+	if requests[1]["send"] != "ping" {
+		t.Errorf("expected an inline send, got %v", requests[1]["send"])
+	}
+	if transport := requests[2]["body"].(map[string]interface{})["transport"]; transport != "ws" {
+		t.Errorf("expected ws as a plain value, got %v", transport)
+	}
+
+	if _, err := ParseFile("ws \"wss://x\"\nbody\n  a 1\n"); err == nil {
+		t.Error("expected parse error for a ws request with a body")
+	}
+}
+
+func TestParserV2CSV(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "users.csv")
+	os.WriteFile(csvPath, []byte("\ufeffname, role\nAlice,admin\n\n\"Smith, Bob\",\"says \"\"hi\"\"\"\n"), 0644)
+	tsvPath := filepath.Join(dir, "items.tsv")
+	os.WriteFile(tsvPath, []byte("id\tlabel\n1\tone, two\n"), 0644)
+
+	input := "for $row in file`" + csvPath + "`\n  post \"https://api.example.com/users\"\n  body\n    name $row.name\n    role $row.role\n\n" +
+		"for $item in file`" + tsvPath + "`\n  get \"https://api.example.com/items/$item.id\"\n\n" +
+		"@csv_delimiter \";\"\nfor $r in csv`\n  id;label\n  7;\"a;b\"\n`\n  get \"https://api.example.com/labels/$r.id\"\n  query\n    label $r.label\n"
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(requests) != 4 {
+		t.Fatalf("expected 4 requests, got %d: %v", len(requests), requests)
+	}
+
+	for i, want := range []map[string]interface{}{
+		{"name": "Alice", "role": "admin"},
+		{"name": "Smith, Bob", "role": `says "hi"`},
+	} {
+		body := requests[i]["body"].(map[string]interface{})
+		if body["name"] != want["name"] || body["role"] != want["role"] {
+			t.Errorf("row %d: expected %v, got %v", i+1, want, body)
+		}
+	}
+	if requests[2]["get"] != "https://api.example.com/items/1" {
+		t.Errorf("expected the TSV row, got %v", requests[2]["get"])
+	}
+	if requests[3]["get"] != "https://api.example.com/labels/7" || requests[3]["query"].(map[string]interface{})["label"] != "a;b" {
+		t.Errorf("expected the inline CSV row with ; as delimiter, got %v", requests[3])
+	}
+
+	for src, want := range map[string]string{
+		"@x csv`a,b\n1`\n":                      "wrong number of fields",
+		"@csv_delimiter \"ab\"\n@x csv`a\n1`\n": "single character",
+	} {
+		program, err := ParseFile(src)
+		if err != nil {
+			t.Fatalf("parse error for %q: %v", src, err)
+		}
+		if _, err := eval.NewEvaluator().EvalToRequests(program); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: expected error containing %q, got %v", src, want, err)
+		}
+	}
+}
+
+func TestParserV2UnknownProcessor(t *testing.T) {
+	input := "@data jsom`{\"a\": 1}`\n@schema schema`{\"type\": \"object\"}`\npost \"https://example.com/api\"\nbody $data\n"
+	program, err := ParseFile(input)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+
+	// Lenient by default: a warning, and the content as a raw string
+	var warnings bytes.Buffer
+	reqs, err := eval.NewEvaluator(eval.WithWarningOutput(&warnings)).EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if len(reqs) != 1 || reqs[0]["body"] != `{"a": 1}` {
+		t.Errorf("expected raw string body, got %v", reqs)
+	}
+	// schema`...` is a known processor, only jsom warns
+	if got := warnings.String(); !strings.Contains(got, `line 1: unknown processor "jsom"`) || strings.Count(got, "[warning]") != 1 {
+		t.Errorf("expected one warning for jsom, got %q", got)
+	}
+
+	_, err = eval.NewEvaluator(eval.WithStrict(true)).EvalToRequests(program)
+	if err == nil || !strings.Contains(err.Error(), `line 1: unknown processor "jsom" (valid processors: base64, csv, file`) {
+		t.Errorf("expected unknown processor error in strict mode, got %v", err)
+	}
+}
+
+func TestParserV2ErrorPosition(t *testing.T) {
+	program, err := ParseFile("@n 1\n\nfor $i in 2\n  if $i > 0\n    sleep \"bad\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	_, err = eval.NewEvaluator().EvalToRequests(program)
+	var pe *eval.PosError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a PosError, got %v", err)
+	}
+	// The innermost statement wins over the loop and the if
+	if pe.Pos != (ast.Position{Line: 5, Column: 5}) || pe.File != "" {
+		t.Errorf("expected the sleep at 5:5, got %s:%+v", pe.File, pe.Pos)
+	}
+	if !strings.HasPrefix(err.Error(), "line 5: sleep: ") {
+		t.Errorf("unexpected message: %v", err)
+	}
+
+	// Errors in an imported file point into that file
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "common.haiku"), []byte("@a 1\ncapture id $_.id\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eval.SetImportParser(ParseFile)
+	program, err = ParseFile("@b 2\nimport \"common.haiku\"\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	_, err = eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program)
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a PosError, got %v", err)
+	}
+	if pe.File != filepath.Join(dir, "common.haiku") || pe.Pos.Line != 2 {
+		t.Errorf("expected line 2 of common.haiku, got %s:%+v", pe.File, pe.Pos)
+	}
+}
+
+func TestParserV2ImportOnly(t *testing.T) {
+	dir := t.TempDir()
+	config := `
+@base_url "https://api.example.com"
+@token "secret-token"
+@internal 1
+if $env.HAIKU_TEST_STAGE == "staging"
+  @base_url "https://staging.example.com"
+get "$base_url/warmup"
+`
+	if err := os.WriteFile(filepath.Join(dir, "config.haiku"), []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eval.SetImportParser(ParseFile)
+
+	program, err := ParseFile("import \"config.haiku\" only base_url, token\nget \"$base_url/users\"\nquery\n  token $token\n  internal $internal\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	imp := program.Statements[0].(*ast.ImportStmt)
+	if !reflect.DeepEqual(imp.Only, []string{"base_url", "token"}) {
+		t.Errorf("expected only [base_url token], got %v", imp.Only)
+	}
+
+	t.Setenv("HAIKU_TEST_STAGE", "staging")
+	var sent []string
+	evaluator := eval.NewEvaluator(eval.WithBasePath(dir), eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+		sent = append(sent, fmt.Sprintf("%v", req["get"]))
+		return map[string]interface{}{}, nil
+	}))
+	requests, err := evaluator.Eval(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	// The request in config.haiku is neither sent nor collected
+	if len(requests) != 1 || !reflect.DeepEqual(sent, []string{"https://staging.example.com/users"}) {
+		t.Errorf("expected only the importer's request, got %v (sent %v)", requests, sent)
+	}
+	query, _ := requests[0]["query"].(map[string]interface{})
+	if query["token"] != "secret-token" || query["internal"] != nil {
+		t.Errorf("expected only token to be imported, got %v", query)
+	}
+
+	program, err = ParseFile("import \"config.haiku\" only missing\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program); err == nil || !strings.Contains(err.Error(), "variable missing is not defined") {
+		t.Errorf("expected undefined variable error, got %v", err)
+	}
+
+	if _, err := ParseFile("import \"config.haiku\" only\n"); err == nil || !strings.Contains(err.Error(), "expected variable name after only") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+func TestParserV2ImportSkipsRequests(t *testing.T) {
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	setup := fmt.Sprintf("@base_url %q\nget \"$base_url/seed\"\nfor $i in 2\n  get \"$base_url/seed/$i\"\n@after 1\n", server.URL)
+	if err := os.WriteFile(filepath.Join(dir, "setup.haiku"), []byte(setup), 0644); err != nil {
+		t.Fatal(err)
+	}
+	eval.SetImportParser(ParseFile)
+
+	run := func(input string) (int32, string) {
+		t.Helper()
+		hits.Store(0)
+		program, err := ParseFile(input)
+		if err != nil {
+			t.Fatalf("parse error: %v", err)
+		}
+		var warnings bytes.Buffer
+		evaluator := eval.NewEvaluator(eval.WithBasePath(dir), eval.WithWarningOutput(&warnings), eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+			resp, err := http.Get(fmt.Sprintf("%v", req["get"]))
+			if err != nil {
+				return nil, err
+			}
+			resp.Body.Close()
+			return map[string]interface{}{"status": int64(resp.StatusCode)}, nil
+		}))
+		if _, err := evaluator.Eval(program); err != nil {
+			t.Fatalf("eval error: %v", err)
+		}
+		return hits.Load(), warnings.String()
+	}
+
+	// By default the imported file only defines variables; the importer's own request is sent
+	got, warnings := run("import \"setup.haiku\"\nget \"$base_url/users?after=$after\"\n")
+	if got != 1 {
+		t.Errorf("expected only the importer's request, got %d requests", got)
+	}
+	if !strings.Contains(warnings, `skipped 2 request(s) and loop(s)`) {
+		t.Errorf("expected a warning about the skipped requests, got %q", warnings)
+	}
+
+	got, warnings = run("import \"setup.haiku\" with requests\n")
+	if got != 3 || warnings != "" {
+		t.Errorf("expected the imported requests to run, got %d requests (warnings %q)", got, warnings)
+	}
+
+	if _, err := ParseFile("import \"setup.haiku\" with\n"); err == nil || !strings.Contains(err.Error(), "expected requests after with") {
+		t.Errorf("expected parse error, got %v", err)
+	}
+}
+
+func TestParserV2CircularImport(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "lib"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.haiku":      "@a 1\nimport \"b.haiku\"\n",
+		"b.haiku":      "@b 1\nimport \"lib/../a.haiku\"\n",
+		"main.haiku":   "import \"common.haiku\"\nimport \"common.haiku\"\n",
+		"common.haiku": "@base \"https://api.example.com\"\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	eval.SetImportParser(ParseFile)
+
+	program, err := ParseFile(files["a.haiku"])
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	a, b := filepath.Join(dir, "a.haiku"), filepath.Join(dir, "b.haiku")
+	_, err = eval.NewEvaluator(eval.WithBasePath(dir), eval.WithScriptPath(a)).EvalToRequests(program)
+	want := fmt.Sprintf("circular import: %s -> %s -> %s/lib/../a.haiku (%s)", a, b, dir, a)
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("expected %q, got %v", want, err)
+	}
+
+	// Without the script path the cycle is found one import later
+	_, err = eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program)
+	if err == nil || !strings.Contains(err.Error(), "circular import: "+b) {
+		t.Errorf("expected a circular import error, got %v", err)
+	}
+
+	// Importing the same file twice is not a cycle
+	program, err = ParseFile(files["main.haiku"])
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	if _, err := eval.NewEvaluator(eval.WithBasePath(dir)).EvalToRequests(program); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParserV2KeywordVarNames(t *testing.T) {
+	// Keywords added to the language must stay usable as variable names
+	for _, name := range []string{"timeout", "query", "def", "sleep", "capture", "graphql", "ws"} {
+		program, err := ParseFile("@" + name + " 1\n")
+		if err != nil {
+			t.Errorf("@%s: parse error: %v", name, err)
+			continue
+		}
+		def, ok := program.Statements[0].(*ast.VarDefStmt)
+		if !ok || def.Name != name {
+			t.Errorf("@%s: expected a variable definition, got %#v", name, program.Statements[0])
+		}
+	}
+}
+
+func TestParserV2MethodKeyword(t *testing.T) {
+	// method is a keyword, but stays usable as a variable, a key and a value
+	program, err := ParseFile("@method \"PURGE\"\nmethod $method \"https://cdn.example.com/a\"\nbody\n  method method\n")
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	requests, err := eval.NewEvaluator().EvalToRequests(program)
+	if err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	body, _ := requests[0]["body"].(map[string]interface{})
+	if len(requests) != 1 || requests[0]["method"] != "PURGE" || body["method"] != "method" {
+		t.Errorf("unexpected requests: %v", requests)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/LingHeChen/haiku/eval"
+	"github.com/LingHeChen/haiku/parser"
+)
+
+// replContinuations 以这些关键字开头的行属于上一条语句（请求的各个部分、条件分支）
+var replContinuations = map[string]bool{
+	"headers":  true,
+	"query":    true,
+	"body":     true,
+	"form":     true,
+	"timeout":  true,
+	"retry":    true,
+	"auth":     true,
+	"use":      true,
+	"assert":   true,
+	"validate": true,
+	"insecure": true,
+	"ca_cert":  true,
+	"proxy":    true,
+	"else":     true,
+	":":        true,
+}
+
+// isREPLContinuation 判断输入行是否是当前语句的延续（缩进行或请求部分关键字）
+func isREPLContinuation(line string) bool {
+	if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+		return true
+	}
+	fields := strings.Fields(line)
+	return len(fields) > 0 && replContinuations[fields[0]]
+}
+
+// inRawString 判断已缓冲的行是否停在未闭合的 """ 字符串中
+func inRawString(lines []string) bool {
+	count := 0
+	for _, line := range lines {
+		count += strings.Count(line, `"""`)
+	}
+	return count%2 == 1
+}
+
+// runREPL 交互模式：逐条读取语句并执行，变量和 $_ 在多次输入之间保留
+// 语句在输入空行或开始下一条顶层语句时执行；输入 exit 或 EOF 结束
+func runREPL(in io.Reader, out io.Writer, basePath string) {
+	eval.SetImportParser(parser.ParseFile)
+
+	client := newClient()
+	evaluator := eval.NewEvaluator(
+		eval.WithBasePath(basePath),
+		eval.WithOverrides(setVars),
+		eval.WithDefaultTimeout(defaultTimeout),
+		eval.WithStrict(strictMode),
+		eval.WithRequestCallback(func(req map[string]interface{}) (map[string]interface{}, error) {
+			start := time.Now()
+			// ws 请求的消息到达时立即输出，最后只输出握手的状态行
+			var onMessage func(msg []byte)
+			if req["ws"] != nil {
+				onMessage = func(msg []byte) {
+					out.Write(append(msg, '\n'))
+				}
+			}
+			resp, err := sendRequest(client, req, onMessage)
+			if err != nil {
+				return nil, err
+			}
+			if resp.Streamed {
+				renderStatus(out, resp)
+			} else {
+				writeResponse(out, resp, time.Since(start), req, false)
+			}
+			return responseRef(resp), nil
+		}),
+	)
+
+	var lines []string
+	// run 解析并执行已缓冲的语句，出错时只输出错误，不退出
+	run := func() {
+		if len(lines) == 0 {
+			return
+		}
+		input := strings.Join(lines, "\n") + "\n"
+		lines = nil
+
+		program, err := parser.ParseFile(input)
+		if err != nil {
+			fmt.Fprintf(out, "%s解析错误: %v%s\n", color(ansiRed), err, color(ansiReset))
+			return
+		}
+		if _, err := evaluator.Eval(program); err != nil {
+			fmt.Fprintf(out, "%s执行错误: %v%s\n", color(ansiRed), err, color(ansiReset))
+		}
+	}
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if len(lines) == 0 {
+			fmt.Fprint(out, "haiku> ")
+		} else {
+			fmt.Fprint(out, "...    ")
+		}
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			run()
+			return
+		}
+
+		line := scanner.Text()
+		// 未闭合的 """ 字符串中的行（包括空行和不缩进的行）原样属于当前语句
+		if inRawString(lines) {
+			lines = append(lines, line)
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			run()
+			continue
+		}
+		if len(lines) > 0 && !isREPLContinuation(line) {
+			run()
+		}
+		if len(lines) == 0 && (trimmed == "exit" || trimmed == "quit") {
+			return
+		}
+		lines = append(lines, line)
+	}
+}
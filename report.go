@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LingHeChen/haiku/request"
+)
+
+// runReport --json-output 写入的运行报告，供 CI 等程序读取。格式（version 1）：
+//
+//	{
+//	  "version": 1,
+//	  "started_at": "2026-01-02T15:04:05+08:00",  // 开始运行的时间（RFC 3339）
+//	  "duration_ms": 1234.5,                      // 整个运行的耗时
+//	  "exit_code": 0,                             // haiku 的退出码
+//	  "summary": {
+//	    "requests": 3,                            // 执行的请求数
+//	    "failed_requests": 0,                     // 失败（没有响应）的请求数
+//	    "failed_assertions": 1                    // 失败的断言数（包括 validate 的每个错误）
+//	  },
+//	  "requests": [                               // 每个请求一项，按完成的顺序
+//	    {
+//	      "method": "GET",
+//	      "url": "https://api.example.com/users",
+//	      "status": 200,                          // 请求失败时省略
+//	      "duration_ms": 12.3,
+//	      "parallel": false,                      // 是否来自 parallel for
+//	      "assertions": 2,                        // assert 的个数，validate 算一个
+//	      "failures": ["line 3: assert ..."],     // 失败的断言，全部通过时省略
+//	      "error": "request timed out: ..."       // 请求失败时的错误，成功时省略
+//	    }
+//	  ],
+//	  "parallel_loops": [                         // 每个 parallel for 一项，没有时省略
+//	    {
+//	      "loop": 1, "total": 10, "success": 10, "failed": 0, "total_bytes": 2048,
+//	      "total_ms": 120.5, "min_ms": 8.1, "max_ms": 30.2, "avg_ms": 12, "p50_ms": 11, "p95_ms": 28, "p99_ms": 30.2,
+//	      "wall_ms": 35.4, "throughput": 282.5,                         // 整个循环的耗时和每秒请求数
+//	      "errors": [{"kind": "timeout", "count": 1, "message": "..."}]  // 失败的请求按类型汇总，没有时省略
+//	    }
+//	  ]
+//	}
+//
+// 字段只增加不删除；不兼容的修改会增加 version
+type runReport struct {
+	mu       sync.Mutex // 并行循环中请求回调会被并发调用
+	started  time.Time
+	requests []reportRequest
+
+	// parallelStats 返回 parallel for 的统计（evaluator.GetAllParallelStats），写入时调用
+	parallelStats func() []map[string]interface{}
+}
+
+// reportRequest 报告中的一个请求
+type reportRequest struct {
+	Method     string   `json:"method"`
+	URL        string   `json:"url"`
+	Status     int      `json:"status,omitempty"`
+	DurationMS float64  `json:"duration_ms"`
+	Parallel   bool     `json:"parallel"`
+	Assertions int      `json:"assertions"`
+	Failures   []string `json:"failures,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func newRunReport() *runReport {
+	return &runReport{started: time.Now()}
+}
+
+// add 记录一个请求的结果，resp 为 nil 时 err 为请求失败的原因
+func (r *runReport) add(req map[string]interface{}, resp *request.Response, duration time.Duration, parallel bool, failures []string, err error) {
+	method, url := requestLine(req)
+	entry := reportRequest{
+		Method:     method,
+		URL:        url,
+		DurationMS: milliseconds(duration),
+		Parallel:   parallel,
+		Failures:   failures,
+	}
+	if asserts, ok := req["assert"].([]interface{}); ok {
+		entry.Assertions = len(asserts)
+	}
+	if req["validate"] != nil {
+		entry.Assertions++
+	}
+	if resp != nil {
+		entry.Status = resp.StatusCode
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	r.mu.Lock()
+	r.requests = append(r.requests, entry)
+	r.mu.Unlock()
+}
+
+// parallelLoops 返回 parallel for 的统计，*_time 的时长转换为毫秒数（*_ms），不包括用于显示的 rate
+func (r *runReport) parallelLoops() []map[string]interface{} {
+	if r.parallelStats == nil {
+		return nil
+	}
+	var loops []map[string]interface{}
+	for i, stats := range r.parallelStats() {
+		loop := map[string]interface{}{"loop": i + 1}
+		for k, v := range stats {
+			if name, ok := strings.CutSuffix(k, "_time"); ok {
+				if s, ok := v.(string); ok {
+					if d, err := time.ParseDuration(s); err == nil {
+						loop[name+"_ms"] = milliseconds(d)
+						continue
+					}
+				}
+			}
+			if k == "rate" {
+				continue // throughput 的显示格式
+			}
+			loop[k] = v
+		}
+		loops = append(loops, loop)
+	}
+	return loops
+}
+
+// write 将报告写入 path
+func (r *runReport) write(path string, exitCode int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	type summary struct {
+		Requests         int `json:"requests"`
+		FailedRequests   int `json:"failed_requests"`
+		FailedAssertions int `json:"failed_assertions"`
+	}
+	var sum summary
+	for _, req := range r.requests {
+		sum.Requests++
+		if req.Error != "" {
+			sum.FailedRequests++
+		}
+		sum.FailedAssertions += len(req.Failures)
+	}
+
+	requests := r.requests
+	if requests == nil {
+		requests = []reportRequest{}
+	}
+	doc := struct {
+		Version       int                      `json:"version"`
+		StartedAt     string                   `json:"started_at"`
+		DurationMS    float64                  `json:"duration_ms"`
+		ExitCode      int                      `json:"exit_code"`
+		Summary       summary                  `json:"summary"`
+		Requests      []reportRequest          `json:"requests"`
+		ParallelLoops []map[string]interface{} `json:"parallel_loops,omitempty"`
+	}{
+		Version:       1,
+		StartedAt:     r.started.Format(time.RFC3339),
+		DurationMS:    milliseconds(time.Since(r.started)),
+		ExitCode:      exitCode,
+		Summary:       sum,
+		Requests:      requests,
+		ParallelLoops: r.parallelLoops(),
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0644)
+}
+
+// milliseconds 将时长转换为毫秒数，保留到微秒
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
@@ -0,0 +1,210 @@
+package request
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsV4Algorithm SigV4 签名算法的名称，出现在 Authorization 头和待签名字符串中
+const awsV4Algorithm = "AWS4-HMAC-SHA256"
+
+// awsV4Credentials auth awsv4 的凭据，来自 mapData["auth"]
+type awsV4Credentials struct {
+	accessKey    string
+	secretKey    string
+	region       string
+	service      string
+	sessionToken string // 临时凭据（STS）的 session token，为空时不发送 X-Amz-Security-Token
+}
+
+// awsV4Auth 返回 mapData["auth"] 中的 awsv4 凭据，不是 awsv4 时 ok 为 false
+func awsV4Auth(mapData map[string]interface{}) (awsV4Credentials, bool) {
+	auth, ok := mapData["auth"].(map[string]interface{})
+	if !ok || auth["scheme"] != "awsv4" {
+		return awsV4Credentials{}, false
+	}
+	var creds awsV4Credentials
+	creds.accessKey, _ = auth["access_key"].(string)
+	creds.secretKey, _ = auth["secret_key"].(string)
+	creds.region, _ = auth["region"].(string)
+	creds.service, _ = auth["service"].(string)
+	creds.sessionToken, _ = auth["session_token"].(string)
+	return creds, true
+}
+
+// applyAWSV4 对 auth awsv4 的请求做 SigV4 签名（已显式设置 Authorization 头时不签名）
+// 签名包含时间，每次发送（包括重试）前都要重新签名，请求头和请求体都必须已经设置好
+func applyAWSV4(req *http.Request, mapData map[string]interface{}) error {
+	creds, ok := awsV4Auth(mapData)
+	if !ok || req.Header.Get("Authorization") != "" {
+		return nil
+	}
+	return signAWSV4(req, creds, time.Now())
+}
+
+// signAWSV4 按 AWS Signature Version 4 计算签名，设置 X-Amz-Date 和 Authorization 头
+// （有 session token 时还有 X-Amz-Security-Token，S3 还需要 X-Amz-Content-Sha256）
+func signAWSV4(req *http.Request, creds awsV4Credentials, now time.Time) error {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := strings.Join([]string{now.Format("20060102"), creds.region, creds.service, "aws4_request"}, "/")
+
+	payloadHash, err := awsV4PayloadHash(req)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	if creds.service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+
+	headers, signedHeaders := awsV4CanonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsV4CanonicalPath(req.URL, creds.service),
+		awsV4CanonicalQuery(req.URL),
+		headers,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	stringToSign := strings.Join([]string{awsV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), now.Format("20060102"))
+	key = hmacSHA256(key, creds.region)
+	key = hmacSHA256(key, creds.service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsV4Algorithm, creds.accessKey, scope, signedHeaders, signature))
+	return nil
+}
+
+// awsV4PayloadHash 返回请求体的 SHA-256（十六进制），读取的是请求体的副本，不影响发送
+func awsV4PayloadHash(req *http.Request) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return sha256Hex(nil), nil
+	}
+	if req.GetBody == nil {
+		return "", fmt.Errorf("awsv4: request body cannot be read for signing")
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return "", fmt.Errorf("awsv4: failed to read body: %w", err)
+	}
+	defer body.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", fmt.Errorf("awsv4: failed to read body: %w", err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// awsV4CanonicalPath 返回规范化的路径：除 S3 外，已编码的路径再按 SigV4 的规则编码一次
+func awsV4CanonicalPath(u *url.URL, service string) string {
+	path := u.EscapedPath()
+	if service == "s3" {
+		path = u.Path
+	}
+	if path == "" {
+		return "/"
+	}
+	return awsV4Escape(path, false)
+}
+
+// awsV4CanonicalQuery 返回规范化的查询字符串：键和值分别编码，按键（再按值）排序
+func awsV4CanonicalQuery(u *url.URL) string {
+	type pair struct{ key, value string }
+	var pairs []pair
+	for key, values := range u.Query() {
+		for _, v := range values {
+			pairs = append(pairs, pair{awsV4Escape(key, true), awsV4Escape(v, true)})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].key != pairs[j].key {
+			return pairs[i].key < pairs[j].key
+		}
+		return pairs[i].value < pairs[j].value
+	})
+	parts := make([]string, len(pairs))
+	for i, p := range pairs {
+		parts[i] = p.key + "=" + p.value
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsV4CanonicalHeaders 返回规范化的请求头（每行 name:value，以换行结尾）和签名的请求头名称列表
+// 签名 Host 和请求上的所有头，User-Agent 和 Expect 可能被代理修改，不签名
+func awsV4CanonicalHeaders(req *http.Request) (string, string) {
+	values := map[string]string{"host": req.Host}
+	if req.Host == "" {
+		values["host"] = req.URL.Host
+	}
+	for name, vs := range req.Header {
+		name = strings.ToLower(name)
+		switch name {
+		case "authorization", "user-agent", "expect":
+			continue
+		}
+		trimmed := make([]string, len(vs))
+		for i, v := range vs {
+			// 去掉首尾空白，连续的空白合并为一个空格
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + values[name] + "\n")
+	}
+	return b.String(), strings.Join(names, ";")
+}
+
+// awsV4Escape 按 SigV4 的规则编码：只保留字母、数字和 -_.~，其他字节编码为大写的 %XX
+// encodeSlash 为 false 时保留路径中的 /
+func awsV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// sha256Hex 返回 data 的 SHA-256（十六进制）
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSHA256 返回以 key 为密钥的 data 的 HMAC-SHA256
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
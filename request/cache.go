@@ -0,0 +1,139 @@
+package request
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cache 保存在磁盘目录中的响应缓存（--cache），只缓存安全方法（GET、HEAD）的 2xx 响应，
+// 按方法、URL 和请求头（包括认证）区分。有效期按响应的 Cache-Control max-age 或 Expires 计算，
+// 都没有时使用默认的 ttl；Cache-Control 为 no-store 或 no-cache 的响应不缓存
+type Cache struct {
+	dir string
+	ttl time.Duration
+}
+
+// cacheEntry 缓存文件的内容
+type cacheEntry struct {
+	Expires  time.Time `json:"expires"`
+	Response *Response `json:"response"`
+}
+
+// NewCache 创建使用 dir 目录的缓存，目录不存在时创建
+func NewCache(dir string, ttl time.Duration) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{dir: dir, ttl: ttl}, nil
+}
+
+// WithCache 对安全方法的请求先查缓存，命中时不发送请求，返回的 Response.Cached 为 true。
+// 流式读取（DoStream 的 onLine 不为 nil）时不使用缓存
+func WithCache(cache *Cache) Option {
+	return func(c *Client) {
+		c.cache = cache
+	}
+}
+
+// cacheKey 返回请求的缓存 key：方法、URL 和排序后的请求头的 SHA-256
+// 只对安全方法返回非空的 key
+func cacheKey(req *http.Request) string {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", req.Method, req.URL.String())
+	names := make([]string, 0, len(req.Header))
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%s: %s\n", name, strings.Join(req.Header[name], ", "))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get 返回未过期的缓存响应，过期的缓存文件顺便删除
+func (c *Cache) get(key string) (*Response, bool) {
+	path := filepath.Join(c.dir, key+".json")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Response == nil {
+		return nil, false
+	}
+	if !time.Now().Before(entry.Expires) {
+		os.Remove(path)
+		return nil, false
+	}
+	entry.Response.Cached = true
+	return entry.Response, true
+}
+
+// put 保存响应，不可缓存的响应（非 2xx、no-store、已过期）不保存
+// 先写入临时文件再重命名，并行请求写同一个 key 时不会读到写了一半的文件
+func (c *Cache) put(key string, resp *Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil
+	}
+	now := time.Now()
+	expires := c.expires(resp, now)
+	if !expires.After(now) {
+		return nil
+	}
+
+	data, err := json.Marshal(cacheEntry{Expires: expires, Response: resp})
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, key+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(c.dir, key+".json"))
+}
+
+// expires 按 Cache-Control 和 Expires 计算响应的过期时间，返回 now 或更早表示不缓存
+// Cache-Control 优先于 Expires；无法解析的 Expires 按已过期处理（RFC 9111 5.3）
+func (c *Cache) expires(resp *Response, now time.Time) time.Time {
+	for _, directive := range strings.Split(resp.Headers["Cache-Control"], ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache":
+			return now
+		case strings.HasPrefix(directive, "max-age="):
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return now.Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	if value, ok := resp.Headers["Expires"]; ok {
+		t, err := http.ParseTime(value)
+		if err != nil {
+			return now
+		}
+		return t
+	}
+	return now.Add(c.ttl)
+}
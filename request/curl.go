@@ -0,0 +1,88 @@
+package request
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ToCurl 将 mapData 转换为等价的 curl 命令行（与 Do 使用相同的请求构造逻辑）
+func ToCurl(mapData map[string]interface{}) (string, error) {
+	method, url, err := extractMethodAndURL(mapData)
+	if err != nil {
+		return "", err
+	}
+	url, err = applyQuery(url, mapData)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := newHTTPRequest(method, url, mapData)
+	if err != nil {
+		return "", err
+	}
+
+	// 第一行为 curl、方法和 URL，其余参数各占一行
+	first := "curl"
+	switch method {
+	case "GET":
+	case "HEAD":
+		first += " --head"
+	default:
+		first += " -X " + method
+	}
+	parts := []string{first + " " + shellQuote(url)}
+	if insecure, _ := mapData["insecure"].(bool); insecure {
+		parts = append(parts, "--insecure")
+	}
+	if caCert, ok := mapData["ca_cert"].(string); ok && caCert != "" {
+		parts = append(parts, "--cacert "+shellQuote(caCert))
+	}
+	if proxy, ok := mapData["proxy"].(string); ok && proxy != "" {
+		parts = append(parts, "--proxy "+shellQuote(proxy))
+	}
+
+	for _, name := range sortedKeys(req.Header) {
+		for _, v := range req.Header[name] {
+			parts = append(parts, "-H "+shellQuote(name+": "+v))
+		}
+	}
+	// auth awsv4 由 curl 签名（curl 7.75+）
+	if creds, ok := awsV4Auth(mapData); ok && req.Header.Get("Authorization") == "" {
+		parts = append(parts,
+			"--aws-sigv4 "+shellQuote("aws:amz:"+creds.region+":"+creds.service),
+			"--user "+shellQuote(creds.accessKey+":"+creds.secretKey))
+		if creds.sessionToken != "" {
+			parts = append(parts, "-H "+shellQuote("X-Amz-Security-Token: "+creds.sessionToken))
+		}
+	}
+
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return "", fmt.Errorf("failed to read body: %w", err)
+		}
+		// --data 会把 @ 开头的值当作文件名，这种情况改用 --data-raw
+		flag := "--data"
+		if strings.HasPrefix(string(body), "@") {
+			flag = "--data-raw"
+		}
+		parts = append(parts, flag+" "+shellQuote(string(body)))
+	}
+
+	timeout, ok, err := extractTimeout(mapData)
+	if err != nil {
+		return "", err
+	}
+	if ok && timeout > 0 {
+		parts = append(parts, "--max-time "+strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	}
+
+	return strings.Join(parts, " \\\n  "), nil
+}
+
+// shellQuote 用单引号包裹字符串，内部的单引号按 shell 规则转义
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
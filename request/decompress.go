@@ -0,0 +1,91 @@
+package request
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DecompressError 表示压缩的响应体无法解压（数据损坏或与 Content-Encoding 不符）
+type DecompressError struct {
+	Encoding string
+	Err      error
+}
+
+func (e *DecompressError) Error() string {
+	return fmt.Sprintf("failed to decompress %s response body: %v", e.Encoding, e.Err)
+}
+
+func (e *DecompressError) Unwrap() error {
+	return e.Err
+}
+
+// countingReader 统计读取的字节数，用于记录压缩前的大小
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// decompressReader 根据 Content-Encoding 返回解压后的 reader
+// 支持 gzip、deflate、br；没有编码或 identity 时返回 nil，其他未知编码原样保留
+// 响应体为空时（有些服务器对空响应也发送 Content-Encoding）同样返回 nil，不当作错误
+// Go 的 Transport 只在自己添加 Accept-Encoding 时才会自动解压，
+// 用户手动设置 Accept-Encoding 时需要在这里处理
+func decompressReader(encoding string, r io.Reader) (io.Reader, error) {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	switch encoding {
+	case "gzip", "x-gzip", "deflate", "br":
+	default:
+		return nil, nil
+	}
+	br := bufio.NewReader(r)
+	if _, err := br.Peek(1); err == io.EOF {
+		return nil, nil
+	}
+
+	switch encoding {
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, &DecompressError{Encoding: "gzip", Err: err}
+		}
+		return zr, nil
+	case "deflate":
+		// 标准的 deflate 是 zlib 格式，但有些服务器直接发送原始 deflate 数据
+		header, _ := br.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, &DecompressError{Encoding: "deflate", Err: err}
+			}
+			return zr, nil
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(br), nil
+	}
+	return nil, nil
+}
+
+// isDecompressError 判断读取解压数据时的错误是否来自损坏的压缩数据
+func isDecompressError(err error) bool {
+	var corrupt flate.CorruptInputError
+	return errors.As(err, &corrupt) ||
+		errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, zlib.ErrHeader) || errors.Is(err, zlib.ErrChecksum) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		strings.HasPrefix(err.Error(), "brotli:")
+}
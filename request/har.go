@@ -0,0 +1,211 @@
+package request
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAREntry 一次已执行的请求及其响应，用于导出 HAR
+type HAREntry struct {
+	Request   map[string]interface{} // 与 Do 使用的 mapData 相同
+	Response  *Response
+	StartedAt time.Time
+}
+
+// HAR 1.2 结构（只包含 haiku 能提供的字段）
+type harLog struct {
+	Log harContent `json:"log"`
+}
+
+type harContent struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harBody        `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+}
+
+type harBody struct {
+	Size        int    `json:"size"`
+	Compression int    `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text"`
+	Encoding    string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// HAR 将已执行的请求和响应序列化为 HAR 1.2 JSON
+// 请求部分按 Do 的构造逻辑重建（query、请求头、认证、请求体）；
+// 耗时只有总时长，记为 time 和 timings.wait
+func HAR(entries []HAREntry, creatorVersion string) ([]byte, error) {
+	log := harLog{Log: harContent{
+		Version: "1.2",
+		Creator: harCreator{Name: "haiku", Version: creatorVersion},
+		Entries: make([]harEntry, 0, len(entries)),
+	}}
+
+	for _, e := range entries {
+		req, err := harRequestFrom(e.Request)
+		if err != nil {
+			return nil, err
+		}
+		ms := float64(e.Response.Duration) / float64(time.Millisecond)
+		log.Log.Entries = append(log.Log.Entries, harEntry{
+			StartedDateTime: e.StartedAt.Format(time.RFC3339Nano),
+			Time:            ms,
+			Request:         req,
+			Response:        harResponseFrom(e.Response),
+			Timings:         harTimings{Wait: ms},
+		})
+	}
+
+	return json.MarshalIndent(log, "", "  ")
+}
+
+// harRequestFrom 根据 mapData 重建 HAR 请求
+func harRequestFrom(mapData map[string]interface{}) (harRequest, error) {
+	method, url, err := extractMethodAndURL(mapData)
+	if err != nil {
+		return harRequest{}, err
+	}
+	url, err = applyQuery(url, mapData)
+	if err != nil {
+		return harRequest{}, err
+	}
+	req, err := newHTTPRequest(method, url, mapData)
+	if err != nil {
+		return harRequest{}, err
+	}
+
+	out := harRequest{
+		Method:      method,
+		URL:         url,
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		QueryString: []harNameValue{},
+		HeadersSize: -1,
+	}
+	for _, name := range sortedKeys(req.Header) {
+		for _, v := range req.Header[name] {
+			out.Headers = append(out.Headers, harNameValue{Name: name, Value: v})
+		}
+	}
+	query := req.URL.Query()
+	for _, name := range sortedKeys(query) {
+		for _, v := range query[name] {
+			out.QueryString = append(out.QueryString, harNameValue{Name: name, Value: v})
+		}
+	}
+
+	if req.Body != nil {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return harRequest{}, fmt.Errorf("failed to read body: %w", err)
+		}
+		out.BodySize = len(body)
+		out.PostData = &harPostData{MimeType: req.Header.Get("Content-Type"), Text: string(body)}
+	}
+	return out, nil
+}
+
+// harResponseFrom 将 Response 转换为 HAR 响应，非 UTF-8 的 body 使用 base64
+func harResponseFrom(resp *Response) harResponse {
+	out := harResponse{
+		Status:      resp.StatusCode,
+		StatusText:  strings.TrimSpace(strings.TrimPrefix(resp.Status, fmt.Sprintf("%d", resp.StatusCode))),
+		HTTPVersion: "HTTP/1.1",
+		Cookies:     []harNameValue{},
+		Headers:     []harNameValue{},
+		RedirectURL: resp.Headers["Location"],
+		HeadersSize: -1,
+		BodySize:    len(resp.Body),
+	}
+	if resp.Proto != "" {
+		out.HTTPVersion = resp.Proto
+	}
+	for _, name := range sortedKeys(resp.Headers) {
+		out.Headers = append(out.Headers, harNameValue{Name: name, Value: resp.Headers[name]})
+	}
+
+	out.Content = harBody{Size: len(resp.Body), MimeType: resp.Headers["Content-Type"]}
+	// 压缩传输时 bodySize 为实际传输的字节数，compression 为解压后多出的字节数
+	if resp.CompressedSize > 0 {
+		out.BodySize = int(resp.CompressedSize)
+		out.Content.Compression = len(resp.Body) - int(resp.CompressedSize)
+	}
+	if utf8.Valid(resp.Body) {
+		out.Content.Text = string(resp.Body)
+	} else {
+		out.Content.Text = base64.StdEncoding.EncodeToString(resp.Body)
+		out.Content.Encoding = "base64"
+	}
+	return out
+}
+
+// sortedKeys 返回排序后的 key，保证输出稳定
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
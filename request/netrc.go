@@ -0,0 +1,117 @@
+package request
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// NetrcEntry .netrc 中的一条 machine（或 default）记录
+type NetrcEntry struct {
+	Machine  string // 为空表示 default
+	Login    string
+	Password string
+}
+
+// Netrc 解析后的 .netrc 文件
+type Netrc struct {
+	Entries []NetrcEntry
+}
+
+// Lookup 查找 host 对应的凭据，没有匹配的 machine 时使用 default
+func (n *Netrc) Lookup(host string) (NetrcEntry, bool) {
+	var def *NetrcEntry
+	for i, e := range n.Entries {
+		if e.Machine == "" {
+			if def == nil {
+				def = &n.Entries[i]
+			}
+			continue
+		}
+		if strings.EqualFold(e.Machine, host) {
+			return e, true
+		}
+	}
+	if def != nil {
+		return *def, true
+	}
+	return NetrcEntry{}, false
+}
+
+// LoadNetrc 读取并解析 .netrc 文件
+func LoadNetrc(path string) (*Netrc, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseNetrc(f)
+}
+
+// ParseNetrc 解析 .netrc 内容
+// 支持 machine / default / login / password / account，# 开头为注释，macdef 定义会被跳过
+func ParseNetrc(r io.Reader) (*Netrc, error) {
+	n := &Netrc{}
+	var current *NetrcEntry
+	inMacdef := false
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		// macdef 一直持续到空行
+		if inMacdef {
+			if strings.TrimSpace(line) == "" {
+				inMacdef = false
+			}
+			continue
+		}
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "default":
+				n.Entries = append(n.Entries, NetrcEntry{})
+				current = &n.Entries[len(n.Entries)-1]
+				continue
+			case "macdef":
+				inMacdef = true
+				i = len(fields)
+				continue
+			}
+
+			// 其余关键字都需要一个值
+			key := fields[i]
+			if i+1 >= len(fields) {
+				return nil, fmt.Errorf("netrc line %d: missing value for %q", lineNum, key)
+			}
+			i++
+			value := fields[i]
+
+			switch key {
+			case "machine":
+				n.Entries = append(n.Entries, NetrcEntry{Machine: value})
+				current = &n.Entries[len(n.Entries)-1]
+			case "login", "password", "account":
+				if current == nil {
+					return nil, fmt.Errorf("netrc line %d: %q before machine", lineNum, key)
+				}
+				if key == "login" {
+					current.Login = value
+				} else if key == "password" {
+					current.Password = value
+				}
+			default:
+				return nil, fmt.Errorf("netrc line %d: unknown token %q", lineNum, key)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
@@ -0,0 +1,29 @@
+package request
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ParseProxyURL 解析并校验代理 URL，支持 http、https、socks5 和 socks5h
+// 没有 scheme 时按 http 处理（与 curl 相同），如 localhost:8080
+func ParseProxyURL(raw string) (*url.URL, error) {
+	s := strings.TrimSpace(raw)
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL %q: %w", raw, err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: unsupported scheme %q (use http, https, socks5 or socks5h)", raw, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", raw)
+	}
+	return u, nil
+}
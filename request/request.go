@@ -2,13 +2,26 @@
 package request
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/LingHeChen/haiku/xmlmap"
 )
 
 // Response 表示 HTTP 响应
@@ -18,6 +31,18 @@ type Response struct {
 	Headers    map[string]string // 响应头
 	Body       []byte            // 响应体
 	Duration   time.Duration     // 请求耗时
+	Truncated  bool              // 响应体超过最大读取长度被截断
+	// 经 gzip/deflate/br 压缩传输时解压前的字节数，未压缩时为 0
+	CompressedSize int64
+	// 响应体通过 DoStream 逐行读取，Body 只保留最后一行
+	Streamed bool
+	// 最终请求的 URL（跟随重定向后），Redirected 表示与最初请求的 URL 不同
+	URL        string
+	Redirected bool
+	// 实际使用的协议（如 HTTP/1.1、HTTP/2.0）
+	Proto string
+	// 响应来自缓存（WithCache），没有发送请求
+	Cached bool
 }
 
 // String 返回响应体的字符串形式
@@ -32,12 +57,80 @@ func (r *Response) JSON() (map[string]interface{}, error) {
 	return result, err
 }
 
+// ErrorKind 请求错误的类别
+type ErrorKind string
+
+const (
+	ErrConnection ErrorKind = "connection" // 无法连接或连接中断
+	ErrTimeout    ErrorKind = "timeout"    // 超时
+	ErrProtocol   ErrorKind = "protocol"   // 服务器返回的不是合法的 HTTP 响应
+)
+
+// RequestError 发送请求失败时返回的错误，Kind 区分连接、超时和协议错误
+type RequestError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *RequestError) Error() string {
+	switch e.Kind {
+	case ErrTimeout:
+		return fmt.Sprintf("request timed out: %v", e.Err)
+	case ErrProtocol:
+		return fmt.Sprintf("protocol error: server did not send a valid HTTP response: %v", e.Err)
+	default:
+		return fmt.Sprintf("request failed: %v", e.Err)
+	}
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// classifyError 将 http.Client.Do 返回的错误归类
+// net/http 对格式错误的响应没有导出错误类型，只能按错误信息判断
+func classifyError(err error) *RequestError {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &RequestError{Kind: ErrTimeout, Err: err}
+	}
+	var recordErr tls.RecordHeaderError
+	if errors.As(err, &recordErr) || strings.Contains(err.Error(), "malformed HTTP") {
+		return &RequestError{Kind: ErrProtocol, Err: err}
+	}
+	return &RequestError{Kind: ErrConnection, Err: err}
+}
+
 // Client HTTP 客户端
 type Client struct {
-	httpClient *http.Client
-	timeout    time.Duration
+	httpClient      *http.Client
+	timeout         time.Duration
+	maxResponseSize int64  // 响应体最大读取字节数，0 表示不限制
+	insecure        bool   // 默认跳过 TLS 证书校验（请求中的 insecure 优先）
+	proxy           string // 默认的代理 URL（请求中的 proxy 优先），为空时使用 HTTP_PROXY 等环境变量
+	protocol        string // 强制使用的协议（ProtocolHTTP1、ProtocolHTTP2），为空时自动协商
+
+	netrc       *Netrc                      // 按 host 提供 basic auth 凭据（--netrc）
+	cache       *Cache                      // 安全方法的响应缓存（--cache），为 nil 时不缓存
+	trace       func(dump []byte, out bool) // 原始请求和响应的回调（--trace），为 nil 时不导出
+	transportMu sync.Mutex
+	transports  map[transportSettings]http.RoundTripper // 按 TLS 和代理配置缓存的 transport，首次使用时创建
+}
+
+// transportSettings 请求级 TLS 和代理配置，作为 transport 缓存的 key
+type transportSettings struct {
+	insecure bool   // 跳过证书校验
+	caCert   string // PEM 格式的 CA 证书文件路径，为空时使用系统证书
+	proxy    string // 代理 URL，为空时使用环境变量中的代理
+	protocol string // 强制使用的协议，为空时自动协商
 }
 
+// WithProtocol 可选的协议
+const (
+	ProtocolHTTP1 = "http1.1" // 只使用 HTTP/1.1，TLS 上也不协商 HTTP/2
+	ProtocolHTTP2 = "http2"   // 只使用 HTTP/2：TLS 上要求 h2，明文连接使用 h2c（prior knowledge）
+)
+
 // Option 客户端配置选项
 type Option func(*Client)
 
@@ -49,6 +142,82 @@ func WithTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithTransport 设置自定义的 http.RoundTripper（用于录制、mock 或埋点）
+func WithTransport(rt http.RoundTripper) Option {
+	return func(c *Client) {
+		c.httpClient.Transport = rt
+	}
+}
+
+// WithCookieJar 设置 cookie jar，响应中的 Set-Cookie 会在后续请求中按 host 自动带上
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(c *Client) {
+		c.httpClient.Jar = jar
+	}
+}
+
+// WithMaxResponseSize 限制读取的响应体字节数，超出部分丢弃并标记 Truncated
+func WithMaxResponseSize(n int64) Option {
+	return func(c *Client) {
+		c.maxResponseSize = n
+	}
+}
+
+// WithInsecure 设置是否默认跳过 TLS 证书校验（类似 curl -k）
+func WithInsecure(insecure bool) Option {
+	return func(c *Client) {
+		c.insecure = insecure
+	}
+}
+
+// WithProxy 设置所有请求默认使用的代理（http、https、socks5 或 socks5h URL），
+// 代替 HTTP_PROXY、HTTPS_PROXY 和 NO_PROXY 环境变量；无效的 URL 在发送请求时报错，可以先用 ParseProxyURL 校验
+func WithProxy(proxyURL string) Option {
+	return func(c *Client) {
+		c.proxy = proxyURL
+	}
+}
+
+// WithProtocol 强制所有请求使用指定的协议（ProtocolHTTP1 或 ProtocolHTTP2），为空时自动协商
+// （TLS 上优先 HTTP/2，明文连接使用 HTTP/1.1）。自定义的 RoundTripper（WithTransport）不受影响
+func WithProtocol(protocol string) Option {
+	return func(c *Client) {
+		c.protocol = protocol
+	}
+}
+
+// WithTrace 在每次发送请求前和收到响应后调用 trace（重试时每次都调用）。out 为 true 时 dump 是
+// 发出的原始请求（httputil.DumpRequestOut，包括 Go 自动添加的请求头）；否则是响应的状态行、响应头和
+// 响应体，响应体为解压后的内容，流式读取（DoStream）时不包含响应体
+func WithTrace(trace func(dump []byte, out bool)) Option {
+	return func(c *Client) {
+		c.trace = trace
+	}
+}
+
+// WithNetrc 使用 .netrc 中与请求 host 匹配的凭据作为 basic auth（请求已有 Authorization 时不覆盖）
+func WithNetrc(n *Netrc) Option {
+	return func(c *Client) {
+		c.netrc = n
+	}
+}
+
+// WithRedirectPolicy 设置重定向策略：follow 为 false 时不跟随重定向，3xx 响应（包括 Location 头）原样返回；
+// 否则最多跟随 max 次，超出时请求失败。不设置时使用 Go 的默认策略（最多 10 次）
+func WithRedirectPolicy(follow bool, max int) Option {
+	return func(c *Client) {
+		c.httpClient.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if !follow {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > max {
+				return fmt.Errorf("stopped after %d redirects", max)
+			}
+			return nil
+		}
+	}
+}
+
 // New 创建一个新的 HTTP 客户端
 func New(opts ...Option) *Client {
 	c := &Client{
@@ -66,6 +235,14 @@ func New(opts ...Option) *Client {
 
 // Do 根据 mapData 执行 HTTP 请求
 func (c *Client) Do(mapData map[string]interface{}) (*Response, error) {
+	return c.DoStream(mapData, nil)
+}
+
+// DoStream 与 Do 相同，但 onLine 不为 nil 时逐行读取响应体，每行到达时立即调用 onLine（不含换行符），
+// 不缓存整个响应体，适用于 SSE、NDJSON 等流式接口。
+// 返回的 Response.Body 只保留最后一个非空行（text/event-stream 时为最后一个 data: 行的内容），供 $_ 引用。
+// 设置了 retry 时只逐行输出最终那次请求，会被重试的响应整体读取后丢弃
+func (c *Client) DoStream(mapData map[string]interface{}, onLine func(line []byte)) (*Response, error) {
 	start := time.Now()
 
 	// 1. 确定 HTTP 方法和 URL
@@ -74,56 +251,267 @@ func (c *Client) Do(mapData map[string]interface{}) (*Response, error) {
 		return nil, err
 	}
 
-	// 2. 准备请求体
-	bodyReader, err := prepareBody(mapData)
+	// 合并 query 参数（保留 URL 中已有的查询字符串）
+	url, err = applyQuery(url, mapData)
 	if err != nil {
 		return nil, err
 	}
 
-	// 3. 创建请求
-	req, err := http.NewRequest(method, url, bodyReader)
+	// 2. 处理 timeout（请求级 timeout 优先于 client 默认 timeout）
+	client := c.httpClient
+	timeout, hasTimeout, err := extractTimeout(mapData)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
+		return nil, err
+	}
+	settings := transportSettings{insecure: c.insecure, proxy: c.proxy, protocol: c.protocol}
+	if v, ok := mapData["insecure"].(bool); ok {
+		settings.insecure = v
+	}
+	if v, ok := mapData["ca_cert"].(string); ok {
+		settings.caCert = v
+	}
+	if v, ok := mapData["proxy"].(string); ok && v != "" {
+		settings.proxy = v
+	}
+	if hasTimeout || settings != (transportSettings{}) {
+		// 创建临时 client 使用指定的 timeout 和 transport（保留 cookie jar 等配置）
+		tempClient := *c.httpClient
+		if hasTimeout {
+			tempClient.Timeout = timeout
+		}
+		if settings != (transportSettings{}) {
+			rt, err := c.transport(settings)
+			if err != nil {
+				return nil, err
+			}
+			tempClient.Transport = rt
+		}
+		client = &tempClient
 	}
 
-	// 4. 添加请求头
-	applyHeaders(req, mapData)
+	// 3. 安全方法先查缓存（流式读取时不使用缓存）
+	var key string
+	if c.cache != nil && onLine == nil {
+		req, err := newHTTPRequest(method, url, mapData)
+		if err != nil {
+			return nil, err
+		}
+		c.applyNetrc(req)
+		key = cacheKey(req)
+		if key != "" {
+			if resp, ok := c.cache.get(key); ok {
+				resp.Duration = time.Since(start)
+				return resp, nil
+			}
+		}
+	}
 
-	// 5. 处理 timeout（请求级 timeout 优先于 client 默认 timeout）
-	client := c.httpClient
-	if timeoutVal, ok := mapData["timeout"]; ok {
-		var timeout time.Duration
-		switch v := timeoutVal.(type) {
-		case time.Duration:
-			timeout = v
-		case int64:
-			timeout = time.Duration(v)
-		case float64:
-			timeout = time.Duration(v)
-		default:
-			return nil, fmt.Errorf("invalid timeout type: %T", timeoutVal)
+	// 4. 执行请求，连接失败或 5xx（设置了 on 时为指定的状态码）时按 retry 配置重试
+	policy, err := extractRetryPolicy(mapData, method)
+	if err != nil {
+		return nil, err
+	}
+	var waited time.Duration // Retry-After 累计的等待时间
+	for attempt := 1; ; attempt++ {
+		// 会被重试的响应不逐行输出（见 send）；已经输出的行无法撤回，读取中途出错时也不再重试，
+		// 这样 --stream 只输出最终那次请求的响应体
+		var streamed bool
+		lineFn := onLine
+		if onLine != nil {
+			lineFn = func(line []byte) {
+				streamed = true
+				onLine(line)
+			}
+		}
+		retryable := func(status int) bool { return policy.retriesStatus(attempt, status) }
+		resp, err := c.send(client, method, url, mapData, lineFn, retryable)
+		delay, retry := policy.next(attempt, resp, err, waited)
+		if streamed {
+			retry = false
+		}
+		if !retry {
+			if resp != nil {
+				resp.Duration = time.Since(start)
+			}
+			if key != "" && err == nil {
+				// 写缓存失败不影响请求，下次运行时重新发送即可
+				c.cache.put(key, resp)
+			}
+			return resp, err
 		}
-		// 创建临时 client 使用指定的 timeout
-		tempClient := &http.Client{
-			Timeout: timeout,
+		waited += delay
+		time.Sleep(delay)
+	}
+}
+
+// transport 返回按 settings 配置 TLS（跳过证书校验或信任指定的 CA）、代理和协议的 transport
+// 基于 client 的 transport 克隆一份，不修改共享的全局配置；自定义的 RoundTripper 原样使用
+func (c *Client) transport(settings transportSettings) (http.RoundTripper, error) {
+	c.transportMu.Lock()
+	defer c.transportMu.Unlock()
+	if rt, ok := c.transports[settings]; ok {
+		return rt, nil
+	}
+
+	rt := c.httpClient.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	if base, ok := rt.(*http.Transport); ok {
+		t := base.Clone()
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.InsecureSkipVerify = settings.insecure
+		if settings.caCert != "" {
+			pool, err := loadCertPool(settings.caCert)
+			if err != nil {
+				return nil, err
+			}
+			t.TLSClientConfig.RootCAs = pool
+		}
+		if settings.proxy != "" {
+			proxyURL, err := ParseProxyURL(settings.proxy)
+			if err != nil {
+				return nil, err
+			}
+			t.Proxy = http.ProxyURL(proxyURL)
+		}
+		switch settings.protocol {
+		case ProtocolHTTP1:
+			t.Protocols = new(http.Protocols)
+			t.Protocols.SetHTTP1(true)
+			// 克隆的 TLS 配置可能已包含 h2，不能再通过 ALPN 协商
+			t.TLSClientConfig.NextProtos = []string{"http/1.1"}
+		case ProtocolHTTP2:
+			t.Protocols = new(http.Protocols)
+			t.Protocols.SetHTTP2(true)
+			t.Protocols.SetUnencryptedHTTP2(true)
+		}
+		rt = t
+	}
+
+	if c.transports == nil {
+		c.transports = make(map[transportSettings]http.RoundTripper)
+	}
+	c.transports[settings] = rt
+	return rt, nil
+}
+
+// loadCertPool 读取 PEM 格式的 CA 证书文件
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("failed to load CA bundle %s: no PEM certificates found", path)
+	}
+	return pool, nil
+}
+
+// send 发送一次请求并读取响应
+// retryable 判断该状态码的响应是否会被重试，会重试时不调用 onLine，响应体整体读取
+func (c *Client) send(client *http.Client, method, url string, mapData map[string]interface{}, onLine func(line []byte), retryable func(status int) bool) (*Response, error) {
+	// 每次重试都需要重新创建请求体（awsv4 也要重新签名）
+	req, err := newHTTPRequest(method, url, mapData)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyAWSV4(req, mapData); err != nil {
+		return nil, err
+	}
+	c.applyNetrc(req)
+	if c.trace != nil {
+		// DumpRequestOut 读取请求体后会放回一份副本，不影响发送
+		dump, err := httputil.DumpRequestOut(req, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump request: %w", err)
 		}
-		client = tempClient
+		c.trace(dump, true)
 	}
 
-	// 6. 执行请求
+	// 执行请求
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %w", err)
+		return nil, classifyError(err)
 	}
 	defer resp.Body.Close()
+	if onLine != nil && retryable(resp.StatusCode) {
+		onLine = nil
+	}
+
+	// 压缩的响应体先解压，CompressedSize 记录实际传输的字节数
+	raw := &countingReader{r: resp.Body}
+	var respReader io.Reader = raw
+	encoding := resp.Header.Get("Content-Encoding")
+	var decoded io.Reader
+	if req.Method != http.MethodHead && resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusNotModified {
+		// HEAD、204 和 304 的响应没有响应体，Content-Encoding 只是描述资源本身
+		decoded, err = decompressReader(encoding, raw)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if decoded != nil {
+		respReader = decoded
+	}
 
-	// 7. 读取响应
-	respBody, err := io.ReadAll(resp.Body)
+	// 读取响应（多读 1 字节用于判断是否超出限制，限制作用于解压后的大小）
+	if c.maxResponseSize > 0 {
+		respReader = io.LimitReader(respReader, c.maxResponseSize+1)
+	}
+	var respBody []byte
+	truncated := false
+	if onLine != nil {
+		// 流式读取时 body 只保留最后一行，需要单独统计读取的总字节数；多读的 1 字节不输出
+		streamed := &countingReader{r: respReader}
+		var lineReader io.Reader = streamed
+		if c.maxResponseSize > 0 {
+			lineReader = io.LimitReader(streamed, c.maxResponseSize)
+		}
+		sse := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+		respBody, err = readLines(lineReader, onLine, sse)
+		if err == nil && c.maxResponseSize > 0 {
+			io.CopyN(io.Discard, streamed, 1)
+			truncated = streamed.n > c.maxResponseSize
+		}
+	} else {
+		respBody, err = io.ReadAll(respReader)
+	}
 	if err != nil {
+		if decoded != nil && isDecompressError(err) {
+			return nil, &DecompressError{Encoding: encoding, Err: err}
+		}
 		return nil, fmt.Errorf("failed to read response: %w", err)
 	}
+	var compressedSize int64
+	if decoded != nil {
+		compressedSize = raw.n
+	}
+	if c.maxResponseSize > 0 && int64(len(respBody)) > c.maxResponseSize {
+		respBody = respBody[:c.maxResponseSize]
+		truncated = true
+	}
+	if c.trace != nil {
+		dump, err := httputil.DumpResponse(resp, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump response: %w", err)
+		}
+		if onLine == nil {
+			dump = append(dump, respBody...)
+		}
+		c.trace(dump, false)
+	}
 
-	// 8. 构建响应对象
+	// 跟随重定向后 resp.Request 为最后一次请求；自定义 RoundTripper 可能不设置
+	finalURL := req.URL.String()
+	if resp.Request != nil {
+		finalURL = resp.Request.URL.String()
+	}
+
+	// 构建响应对象
 	headers := make(map[string]string)
 	for k, v := range resp.Header {
 		if len(v) > 0 {
@@ -132,27 +520,356 @@ func (c *Client) Do(mapData map[string]interface{}) (*Response, error) {
 	}
 
 	return &Response{
-		StatusCode: resp.StatusCode,
-		Status:     resp.Status,
-		Headers:    headers,
-		Body:       respBody,
-		Duration:   time.Since(start),
+		StatusCode:     resp.StatusCode,
+		Status:         resp.Status,
+		Headers:        headers,
+		Body:           respBody,
+		Truncated:      truncated,
+		CompressedSize: compressedSize,
+		Streamed:       onLine != nil,
+		URL:            finalURL,
+		Redirected:     finalURL != req.URL.String(),
+		Proto:          resp.Proto,
 	}, nil
 }
 
+// readLines 逐行读取 r 并调用 onLine，返回最后一个非空行
+// sse 为 true 时只有 "data:" 行作为返回值（去掉前缀），这样 NDJSON 和 SSE 的最后一条 JSON 都能作为 $_ 使用
+func readLines(r io.Reader, onLine func(line []byte), sse bool) ([]byte, error) {
+	var last []byte
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			line = bytes.TrimRight(line, "\r\n")
+			onLine(line)
+			if sse {
+				if data, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+					last = bytes.TrimSpace(data)
+				}
+			} else if len(bytes.TrimSpace(line)) > 0 {
+				last = line
+			}
+		}
+		if err == io.EOF {
+			return last, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// newHTTPRequest 根据 mapData 创建 *http.Request（请求体、请求头和认证）
+func newHTTPRequest(method, url string, mapData map[string]interface{}) (*http.Request, error) {
+	// 准备请求体
+	bodyReader, err := prepareBody(mapData)
+	if err != nil {
+		return nil, err
+	}
+
+	// 创建请求
+	req, err := http.NewRequest(method, url, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// 添加请求头（form 请求体未指定 Content-Type 时自动补上）
+	applyHeaders(req, mapData)
+	if _, ok := mapData["form"]; ok && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", formContentType)
+	}
+	applyAuth(req, mapData)
+	return req, nil
+}
+
+// extractTimeout 从 mapData["timeout"] 读取请求级超时（纳秒）
+func extractTimeout(mapData map[string]interface{}) (time.Duration, bool, error) {
+	timeoutVal, ok := mapData["timeout"]
+	if !ok {
+		return 0, false, nil
+	}
+	switch v := timeoutVal.(type) {
+	case time.Duration:
+		return v, true, nil
+	case int64:
+		return time.Duration(v), true, nil
+	case float64:
+		return time.Duration(v), true, nil
+	default:
+		return 0, false, fmt.Errorf("invalid timeout type: %T", timeoutVal)
+	}
+}
+
+// retryBaseDelay 重试间隔的基准时间
+var retryBaseDelay = 500 * time.Millisecond
+
+// maxRetryDelay 退避时间的上限，避免 linear/exponential 在重试次数较多时等待过久或溢出
+var maxRetryDelay = 30 * time.Second
+
+// maxRetryAfter 一个请求按 Retry-After 累计等待的上限，避免服务器让客户端等待过久
+var maxRetryAfter = time.Minute
+
+// retryPolicy 请求的重试策略
+type retryPolicy struct {
+	count    int    // 最大重试次数（不含首次请求）
+	backoff  string // fixed / linear / exponential
+	statuses []int  // 重试的状态码（retry on），为空时重试 5xx
+}
+
+// next 返回第 attempt 次请求的结果是否需要重试以及重试前的等待时间
+// 连接失败总是重试；响应带有 Retry-After 时按它等待（代替退避时间），
+// waited 为之前按 Retry-After 等待的总时间，加上本次超过 maxRetryAfter 时只等到上限，已到上限时不再重试
+func (p retryPolicy) next(attempt int, resp *Response, err error, waited time.Duration) (time.Duration, bool) {
+	if attempt > p.count {
+		return 0, false
+	}
+	if err != nil {
+		return p.delay(attempt), true
+	}
+	if !p.retriesStatus(attempt, resp.StatusCode) {
+		return 0, false
+	}
+
+	wait, ok := parseRetryAfter(resp.Headers["Retry-After"], time.Now())
+	if !ok {
+		return p.delay(attempt), true
+	}
+	if remaining := maxRetryAfter - waited; wait > remaining {
+		if remaining <= 0 {
+			return 0, false
+		}
+		wait = remaining
+	}
+	return wait, true
+}
+
+// retriesStatus 返回第 attempt 次请求得到该状态码时是否重试（不考虑 Retry-After 的等待上限）
+func (p retryPolicy) retriesStatus(attempt, status int) bool {
+	if attempt > p.count {
+		return false
+	}
+	if len(p.statuses) > 0 {
+		return slices.Contains(p.statuses, status)
+	}
+	return status >= 500
+}
+
+// parseRetryAfter 解析 Retry-After 头：秒数或 HTTP 日期（RFC 9110 10.2.3），已经过去的日期为 0
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		// 先截到 maxRetryAfter，避免很大的秒数乘法溢出
+		seconds = min(seconds, int(maxRetryAfter/time.Second))
+		return time.Duration(seconds) * time.Second, true
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// delay 返回第 attempt 次失败后的等待时间，不超过 maxRetryDelay
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := retryBaseDelay
+	switch p.backoff {
+	case "linear":
+		if attempt > int(maxRetryDelay/retryBaseDelay) {
+			return maxRetryDelay
+		}
+		d = retryBaseDelay * time.Duration(attempt)
+	case "exponential":
+		// 逐次翻倍，超过上限即停止，避免移位溢出
+		for i := 1; i < attempt && d < maxRetryDelay; i++ {
+			d *= 2
+		}
+	}
+	return min(d, maxRetryDelay)
+}
+
+// extractRetryPolicy 从 mapData["retry"] 读取重试配置
+// 默认只重试幂等方法（GET/HEAD/OPTIONS），其他方法需要显式设置 always
+func extractRetryPolicy(mapData map[string]interface{}, method string) (retryPolicy, error) {
+	retry, ok := mapData["retry"].(map[string]interface{})
+	if !ok {
+		return retryPolicy{}, nil
+	}
+
+	var policy retryPolicy
+	switch v := retry["count"].(type) {
+	case int64:
+		policy.count = int(v)
+	case int:
+		policy.count = v
+	case float64:
+		policy.count = int(v)
+	default:
+		return retryPolicy{}, fmt.Errorf("invalid retry count type: %T", retry["count"])
+	}
+	if policy.count < 0 {
+		return retryPolicy{}, fmt.Errorf("invalid retry count: %d", policy.count)
+	}
+	policy.backoff, _ = retry["backoff"].(string)
+	if on, ok := retry["on"].([]interface{}); ok {
+		for _, v := range on {
+			switch status := v.(type) {
+			case int64:
+				policy.statuses = append(policy.statuses, int(status))
+			case int:
+				policy.statuses = append(policy.statuses, status)
+			case float64:
+				policy.statuses = append(policy.statuses, int(status))
+			default:
+				return retryPolicy{}, fmt.Errorf("invalid retry status type: %T", v)
+			}
+		}
+	}
+
+	always, _ := retry["always"].(bool)
+	switch method {
+	case "GET", "HEAD", "OPTIONS":
+	default:
+		if !always {
+			policy.count = 0
+		}
+	}
+	return policy, nil
+}
+
 // extractMethodAndURL 从 mapData 中提取 HTTP 方法和 URL
+// 自定义方法（method "PURGE" "url"）的方法名在 "method" 中、URL 在 "url" 中，优先于标准方法
 func extractMethodAndURL(mapData map[string]interface{}) (string, string, error) {
 	methods := []string{"get", "post", "put", "delete", "patch", "head", "options"}
+	var found []string
 	for _, m := range methods {
-		if v, ok := mapData[m]; ok {
-			return strings.ToUpper(m), v.(string), nil
+		if _, ok := mapData[m]; ok {
+			found = append(found, m)
+		}
+	}
+
+	if v, ok := mapData["method"]; ok {
+		// method 和标准方法同时出现时同样无法判断用户意图
+		if len(found) > 0 {
+			return "", "", fmt.Errorf("conflicting HTTP methods in request: method, %s", strings.Join(found, ", "))
+		}
+		method, ok := v.(string)
+		if !ok || !validMethod(method) {
+			return "", "", fmt.Errorf("invalid HTTP method %q", fmt.Sprint(v))
+		}
+		if mapData["url"] == nil {
+			return "", "", fmt.Errorf("missing URL for %s", method)
+		}
+		url, ok := mapData["url"].(string)
+		if !ok {
+			return "", "", fmt.Errorf("invalid URL for %s: %v", method, mapData["url"])
+		}
+		// 方法名区分大小写（RFC 9110），按原样发送
+		return method, url, nil
+	}
+
+	if _, ok := mapData["ws"]; ok {
+		return "", "", fmt.Errorf("ws request is a websocket connection, not an HTTP request")
+	}
+
+	switch len(found) {
+	case 0:
+		return "", "", fmt.Errorf("missing HTTP method (get/post/put/delete/patch/head/options)")
+	case 1:
+	default:
+		// 多个方法无法判断用户意图，不按固定顺序挑选
+		return "", "", fmt.Errorf("conflicting HTTP methods in request: %s", strings.Join(found, ", "))
+	}
+
+	m := found[0]
+	v := mapData[m]
+	if v == nil {
+		return "", "", fmt.Errorf("missing URL for %s", m)
+	}
+	url, ok := v.(string)
+	if !ok {
+		return "", "", fmt.Errorf("invalid URL for %s: %v", m, v)
+	}
+	return strings.ToUpper(m), url, nil
+}
+
+// validMethod 检查方法名是否为合法的 token（RFC 9110）
+func validMethod(method string) bool {
+	if method == "" {
+		return false
+	}
+	for _, r := range method {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", r) {
+			continue
 		}
+		return false
 	}
-	return "", "", fmt.Errorf("missing HTTP method (get/post/put/delete/patch/head/options)")
+	return true
+}
+
+// applyQuery 将 mapData["query"] 编码后追加到 URL 上，数组值展开为重复的 key
+// URL 中已有的参数原样保留（顺序和编码不变），新参数追加在后面
+func applyQuery(rawURL string, mapData map[string]interface{}) (string, error) {
+	query, ok := mapData["query"].(map[string]interface{})
+	if !ok || len(query) == 0 {
+		return rawURL, nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+
+	values := url.Values{}
+	for k, v := range query {
+		switch vals := v.(type) {
+		case []interface{}:
+			for _, item := range vals {
+				values.Add(k, queryValue(item))
+			}
+		default:
+			values.Add(k, queryValue(v))
+		}
+	}
+	if u.RawQuery == "" {
+		u.RawQuery = values.Encode()
+	} else {
+		u.RawQuery += "&" + values.Encode()
+	}
+	return u.String(), nil
+}
+
+// queryValue 将 query 参数值转换为字符串，nil 转为空字符串
+// 数字使用十进制形式（50、0.5），不会出现科学计数法
+func queryValue(v interface{}) string {
+	switch n := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(n, 10)
+	case int:
+		return strconv.Itoa(n)
+	case float64:
+		return strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	return fmt.Sprintf("%v", v)
 }
 
 // prepareBody 准备请求体
 func prepareBody(mapData map[string]interface{}) (io.Reader, error) {
+	if form, ok := mapData["form"]; ok {
+		if _, hasBody := mapData["body"]; hasBody {
+			return nil, fmt.Errorf("body and form cannot be used together")
+		}
+		return encodeForm(form)
+	}
+
 	body, ok := mapData["body"]
 	if !ok {
 		return nil, nil
@@ -161,7 +878,24 @@ func prepareBody(mapData map[string]interface{}) (io.Reader, error) {
 	switch b := body.(type) {
 	case string:
 		return strings.NewReader(b), nil
+	case bool, int64, int, float64:
+		// 标量 body 按 JSON 字面量发送（true、42、3.14）
+		jsonBytes, err := json.Marshal(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal body: %w", err)
+		}
+		return bytes.NewReader(jsonBytes), nil
 	case map[string]interface{}, []interface{}:
+		if isFormContentType(mapData) {
+			return encodeForm(b)
+		}
+		if isXMLContentType(mapData) {
+			xmlBytes, err := xmlmap.Encode(b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to encode XML body: %w", err)
+			}
+			return bytes.NewReader(xmlBytes), nil
+		}
 		jsonBytes, err := json.Marshal(b)
 		if err != nil {
 			return nil, fmt.Errorf("failed to marshal body: %w", err)
@@ -172,6 +906,102 @@ func prepareBody(mapData map[string]interface{}) (io.Reader, error) {
 	}
 }
 
+// formContentType 表单请求体的 Content-Type
+const formContentType = "application/x-www-form-urlencoded"
+
+// isFormContentType 判断请求头中的 Content-Type 是否为表单编码
+func isFormContentType(mapData map[string]interface{}) bool {
+	return strings.HasPrefix(requestContentType(mapData), formContentType)
+}
+
+// isXMLContentType 判断请求头中的 Content-Type 是否为 XML（application/xml、text/xml 或 +xml 后缀）
+func isXMLContentType(mapData map[string]interface{}) bool {
+	mediaType, _, _ := strings.Cut(requestContentType(mapData), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml")
+}
+
+// requestContentType 返回请求头中的 Content-Type（小写），没有设置时为空
+func requestContentType(mapData map[string]interface{}) string {
+	headers, ok := mapData["headers"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, "Content-Type") {
+			return strings.ToLower(fmt.Sprintf("%v", v))
+		}
+	}
+	return ""
+}
+
+// encodeForm 将 map 编码为 k1=v1&k2=v2
+// 数组展开为重复的 key，嵌套对象使用方括号展开（user[name]=John）
+func encodeForm(data interface{}) (io.Reader, error) {
+	fields, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("form body must be an object, got %T", data)
+	}
+
+	values := url.Values{}
+	for k, v := range fields {
+		if err := addFormValue(values, k, v); err != nil {
+			return nil, err
+		}
+	}
+	return strings.NewReader(values.Encode()), nil
+}
+
+// addFormValue 递归地将字段添加到 values 中
+func addFormValue(values url.Values, key string, val interface{}) error {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for k, item := range v {
+			if err := addFormValue(values, key+"["+k+"]", item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			switch item.(type) {
+			case map[string]interface{}, []interface{}:
+				return fmt.Errorf("form field %q: nested values inside arrays are not supported", key)
+			}
+			values.Add(key, queryValue(item))
+		}
+	default:
+		values.Add(key, queryValue(v))
+	}
+	return nil
+}
+
+// applyAuth 根据 mapData["auth"] 设置 Authorization 头（已显式设置该头时不覆盖）
+func applyAuth(req *http.Request, mapData map[string]interface{}) {
+	auth, ok := mapData["auth"].(map[string]interface{})
+	if !ok || req.Header.Get("Authorization") != "" {
+		return
+	}
+	switch auth["scheme"] {
+	case "basic":
+		username, _ := auth["username"].(string)
+		password, _ := auth["password"].(string)
+		req.SetBasicAuth(username, password)
+	case "bearer":
+		token, _ := auth["token"].(string)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// applyNetrc 请求没有 Authorization 头时，使用 .netrc 中该 host 的凭据
+func (c *Client) applyNetrc(req *http.Request) {
+	if c.netrc == nil || req.Header.Get("Authorization") != "" {
+		return
+	}
+	if entry, ok := c.netrc.Lookup(req.URL.Hostname()); ok && entry.Login != "" {
+		req.SetBasicAuth(entry.Login, entry.Password)
+	}
+}
+
 // applyHeaders 应用请求头
 func applyHeaders(req *http.Request, mapData map[string]interface{}) {
 	headers, ok := mapData["headers"].(map[string]interface{})
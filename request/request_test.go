@@ -0,0 +1,1719 @@
+package request
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// stubTransport returns a canned response and records the last request
+type stubTransport struct {
+	lastReq *http.Request
+}
+
+func (s *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.lastReq = req
+	return &http.Response{
+		StatusCode: 201,
+		Status:     "201 Created",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(`{"id": 7}`)),
+		Request:    req,
+	}, nil
+}
+
+func TestWithTransport(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	resp, err := client.Do(map[string]interface{}{
+		"post":    "https://api.example.com/users",
+		"headers": map[string]interface{}{"X-Test": "yes"},
+		"body":    map[string]interface{}{"name": "John"},
+		"timeout": 5 * time.Second, // request-level timeout must keep the transport
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+
+	if rt.lastReq == nil {
+		t.Fatal("expected custom transport to be used")
+	}
+	if rt.lastReq.Method != "POST" || rt.lastReq.URL.String() != "https://api.example.com/users" {
+		t.Errorf("unexpected request: %s %s", rt.lastReq.Method, rt.lastReq.URL)
+	}
+	if rt.lastReq.Header.Get("X-Test") != "yes" {
+		t.Errorf("expected X-Test header to be sent")
+	}
+
+	if resp.StatusCode != 201 {
+		t.Errorf("expected status 201, got %d", resp.StatusCode)
+	}
+	data, err := resp.JSON()
+	if err != nil || data["id"] != float64(7) {
+		t.Errorf("expected canned body, got %s", resp.String())
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	_, err := client.Do(map[string]interface{}{
+		"get": "https://api.example.com/search?page=2",
+		"query": map[string]interface{}{
+			"q":    "a b&c",
+			"tags": []interface{}{"x", "y"},
+			"n":    int64(10),
+		},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+
+	got := rt.lastReq.URL.Query()
+	if got.Get("page") != "2" {
+		t.Errorf("expected existing page param to be kept, got %q", rt.lastReq.URL.RawQuery)
+	}
+	if got.Get("q") != "a b&c" || got.Get("n") != "10" {
+		t.Errorf("unexpected query values: %q", rt.lastReq.URL.RawQuery)
+	}
+	if tags := got["tags"]; len(tags) != 2 || tags[0] != "x" || tags[1] != "y" {
+		t.Errorf("expected repeated tags params, got %v", tags)
+	}
+	if !strings.Contains(rt.lastReq.URL.RawQuery, "q=a+b%26c") {
+		t.Errorf("expected percent-encoded q, got %q", rt.lastReq.URL.RawQuery)
+	}
+
+	// Parameters already in the URL keep their order and encoding
+	_, err = client.Do(map[string]interface{}{
+		"get":   "https://api.example.com/search?z=1&a=%7e&flag",
+		"query": map[string]interface{}{"b": "2"},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if got := rt.lastReq.URL.RawQuery; got != "z=1&a=%7e&flag&b=2" {
+		t.Errorf("expected the query to be appended, got %q", got)
+	}
+}
+
+func TestQueryNumbers(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	_, err := client.Do(map[string]interface{}{
+		"get": "https://api.example.com/items",
+		"query": map[string]interface{}{
+			"limit": int64(50),
+			"ratio": 0.25,
+			"page":  float64(3),
+			"max":   1e21,
+		},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+
+	want := "limit=50&max=1000000000000000000000&page=3&ratio=0.25"
+	if got := rt.lastReq.URL.RawQuery; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestMaxResponseSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1000)))
+	}))
+	defer server.Close()
+
+	resp, err := New(WithMaxResponseSize(100)).Do(map[string]interface{}{"get": server.URL})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if !resp.Truncated {
+		t.Errorf("expected response to be marked truncated")
+	}
+	if len(resp.Body) != 100 {
+		t.Errorf("expected 100 bytes, got %d", len(resp.Body))
+	}
+
+	resp, err = New(WithMaxResponseSize(1000)).Do(map[string]interface{}{"get": server.URL})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.Truncated || len(resp.Body) != 1000 {
+		t.Errorf("body at the limit should not be truncated (truncated=%v, len=%d)", resp.Truncated, len(resp.Body))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	resp, err := New().Do(map[string]interface{}{
+		"get":   server.URL,
+		"retry": map[string]interface{}{"count": int64(3), "backoff": "exponential", "always": false},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.StatusCode != 200 || calls != 3 {
+		t.Errorf("expected success after 3 attempts, got status %d after %d", resp.StatusCode, calls)
+	}
+
+	// Non-idempotent methods are not retried unless "always" is set
+	calls = 0
+	resp, err = New().Do(map[string]interface{}{
+		"post":  server.URL,
+		"body":  "data",
+		"retry": map[string]interface{}{"count": int64(3), "backoff": "fixed", "always": false},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+		t.Errorf("expected POST to be sent once, got status %d after %d", resp.StatusCode, calls)
+	}
+
+	calls = 0
+	resp, err = New().Do(map[string]interface{}{
+		"post":  server.URL,
+		"body":  "data",
+		"retry": map[string]interface{}{"count": int64(1), "backoff": "fixed", "always": true},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || calls != 2 {
+		t.Errorf("expected POST to be retried once, got status %d after %d", resp.StatusCode, calls)
+	}
+}
+
+func TestRetryOnStatus(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	var statuses []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[0]
+		statuses = statuses[1:]
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "0")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	retry := map[string]interface{}{"count": int64(3), "backoff": "fixed", "always": false, "on": []interface{}{int64(429), int64(503)}}
+
+	// 只重试 on 中的状态码
+	statuses = []int{429, 503, 200}
+	resp, err := New().Do(map[string]interface{}{"get": server.URL, "retry": retry})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.StatusCode != 200 || len(statuses) != 0 {
+		t.Errorf("expected success after retrying 429 and 503, got status %d", resp.StatusCode)
+	}
+
+	statuses = []int{500, 200}
+	resp, err = New().Do(map[string]interface{}{"get": server.URL, "retry": retry})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.StatusCode != 500 {
+		t.Errorf("expected 500 not to be retried, got status %d", resp.StatusCode)
+	}
+}
+
+func TestRetryPolicyNext(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Second
+
+	policy := retryPolicy{count: 3, backoff: "fixed", statuses: []int{429}}
+	withRetryAfter := func(v string) *Response {
+		return &Response{StatusCode: 429, Headers: map[string]string{"Retry-After": v}}
+	}
+	tests := []struct {
+		name    string
+		attempt int
+		resp    *Response
+		err     error
+		waited  time.Duration
+		delay   time.Duration
+		retry   bool
+	}{
+		{"backoff without Retry-After", 1, &Response{StatusCode: 429}, nil, 0, time.Second, true},
+		{"Retry-After seconds", 1, withRetryAfter("7"), nil, 0, 7 * time.Second, true},
+		{"huge Retry-After seconds", 1, withRetryAfter("9223372037"), nil, 0, maxRetryAfter, true},
+		{"Retry-After date", 1, withRetryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)), nil, 0, maxRetryAfter, true},
+		{"Retry-After in the past", 1, withRetryAfter("Sun, 06 Nov 1994 08:49:37 GMT"), nil, 0, 0, true},
+		{"invalid Retry-After", 1, withRetryAfter("soon"), nil, 0, time.Second, true},
+		{"capped by the total wait", 2, withRetryAfter("60"), nil, maxRetryAfter - 10*time.Second, 10 * time.Second, true},
+		{"total wait used up", 2, withRetryAfter("1"), nil, maxRetryAfter, 0, false},
+		{"status not listed", 1, &Response{StatusCode: 503}, nil, 0, 0, false},
+		{"connection error", 1, nil, errors.New("refused"), 0, time.Second, true},
+		{"out of retries", 4, withRetryAfter("1"), nil, 0, 0, false},
+	}
+	for _, tt := range tests {
+		delay, retry := policy.next(tt.attempt, tt.resp, tt.err, tt.waited)
+		if retry != tt.retry || delay != tt.delay {
+			t.Errorf("%s: got (%v, %v), want (%v, %v)", tt.name, delay, retry, tt.delay, tt.retry)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Second
+
+	tests := []struct {
+		backoff string
+		attempt int
+		want    time.Duration
+	}{
+		{"fixed", 5, time.Second},
+		{"linear", 3, 3 * time.Second},
+		{"linear", 1000, maxRetryDelay},
+		{"exponential", 1, time.Second},
+		{"exponential", 4, 8 * time.Second},
+		{"exponential", 10, maxRetryDelay},
+		{"exponential", 100, maxRetryDelay},
+	}
+	for _, tt := range tests {
+		if got := (retryPolicy{backoff: tt.backoff}).delay(tt.attempt); got != tt.want {
+			t.Errorf("%s attempt %d: expected %v, got %v", tt.backoff, tt.attempt, tt.want, got)
+		}
+	}
+}
+
+func TestFormBody(t *testing.T) {
+	var gotType string
+	var gotForm map[string][]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotType = r.Header.Get("Content-Type")
+		r.ParseForm()
+		gotForm = r.PostForm
+	}))
+	defer server.Close()
+
+	_, err := New().Do(map[string]interface{}{
+		"post": server.URL,
+		"form": map[string]interface{}{
+			"name":  "John Doe",
+			"tags":  []interface{}{"a", "b"},
+			"user":  map[string]interface{}{"age": int64(30)},
+			"agree": true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if gotType != "application/x-www-form-urlencoded" {
+		t.Errorf("expected form content type, got %q", gotType)
+	}
+	if gotForm["name"][0] != "John Doe" || gotForm["user[age]"][0] != "30" || gotForm["agree"][0] != "true" {
+		t.Errorf("unexpected form: %v", gotForm)
+	}
+	if len(gotForm["tags"]) != 2 {
+		t.Errorf("expected repeated tags, got %v", gotForm["tags"])
+	}
+
+	// A map body is form-encoded when the Content-Type header asks for it
+	_, err = New().Do(map[string]interface{}{
+		"post":    server.URL,
+		"headers": map[string]interface{}{"content-type": "application/x-www-form-urlencoded; charset=utf-8"},
+		"body":    map[string]interface{}{"q": "x&y"},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if gotForm["q"][0] != "x&y" {
+		t.Errorf("expected form-encoded body, got %v", gotForm)
+	}
+
+	_, err = New().Do(map[string]interface{}{
+		"post": server.URL,
+		"form": map[string]interface{}{"items": []interface{}{map[string]interface{}{"id": 1}}},
+	})
+	if err == nil {
+		t.Errorf("expected error for objects nested in form arrays")
+	}
+}
+
+func TestXMLBody(t *testing.T) {
+	var gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		gotBody = string(data)
+	}))
+	defer server.Close()
+
+	// A map body is encoded as XML when the Content-Type header asks for it
+	_, err := New().Do(map[string]interface{}{
+		"post":    server.URL,
+		"headers": map[string]interface{}{"Content-Type": "application/soap+xml; charset=utf-8"},
+		"body": map[string]interface{}{
+			"user": map[string]interface{}{"@id": int64(1), "name": "A & B", "tag": []interface{}{"x", "y"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<user id="1"><name>A &amp; B</name><tag>x</tag><tag>y</tag></user>`
+	if gotBody != want {
+		t.Errorf("unexpected XML body:\n got  %s\n want %s", gotBody, want)
+	}
+
+	// A string body is sent as is
+	_, err = New().Do(map[string]interface{}{
+		"post":    server.URL,
+		"headers": map[string]interface{}{"Content-Type": "text/xml"},
+		"body":    "<raw/>",
+	})
+	if err != nil || gotBody != "<raw/>" {
+		t.Errorf("expected raw string body, got %q (%v)", gotBody, err)
+	}
+
+	// XML needs a single root element
+	_, err = New().Do(map[string]interface{}{
+		"post":    server.URL,
+		"headers": map[string]interface{}{"Content-Type": "application/xml"},
+		"body":    map[string]interface{}{"a": "1", "b": "2"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "failed to encode XML body") {
+		t.Errorf("expected XML encoding error, got %v", err)
+	}
+}
+
+func TestWithCookieJar(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		case "/me":
+			if c, err := r.Cookie("session"); err == nil {
+				w.Write([]byte(c.Value))
+			}
+		}
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := New(WithCookieJar(jar))
+
+	if _, err := client.Do(map[string]interface{}{"post": server.URL + "/login"}); err != nil {
+		t.Fatalf("login error: %v", err)
+	}
+	resp, err := client.Do(map[string]interface{}{
+		"get":     server.URL + "/me",
+		"timeout": 5 * time.Second, // request-level timeout must keep the jar
+	})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.String() != "abc" {
+		t.Errorf("expected session cookie to be sent, got %q", resp.String())
+	}
+
+	// Without a jar, cookies are not carried over
+	resp, err = New().Do(map[string]interface{}{"get": server.URL + "/me"})
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if resp.String() != "" {
+		t.Errorf("expected no cookie without a jar, got %q", resp.String())
+	}
+}
+
+func TestAuth(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	if _, err := client.Do(map[string]interface{}{
+		"get":  "https://api.example.com",
+		"auth": map[string]interface{}{"scheme": "basic", "username": "admin", "password": "s3cret"},
+	}); err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if user, pass, ok := rt.lastReq.BasicAuth(); !ok || user != "admin" || pass != "s3cret" {
+		t.Errorf("expected basic auth admin:s3cret, got %q %q %v", user, pass, ok)
+	}
+
+	if _, err := client.Do(map[string]interface{}{
+		"get":  "https://api.example.com",
+		"auth": map[string]interface{}{"scheme": "bearer", "token": "abc"},
+	}); err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if got := rt.lastReq.Header.Get("Authorization"); got != "Bearer abc" {
+		t.Errorf("expected bearer token, got %q", got)
+	}
+
+	// An explicit Authorization header takes precedence
+	if _, err := client.Do(map[string]interface{}{
+		"get":     "https://api.example.com",
+		"headers": map[string]interface{}{"Authorization": "Token xyz"},
+		"auth":    map[string]interface{}{"scheme": "bearer", "token": "abc"},
+	}); err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if got := rt.lastReq.Header.Get("Authorization"); got != "Token xyz" {
+		t.Errorf("expected explicit header to win, got %q", got)
+	}
+}
+
+func TestSignAWSV4(t *testing.T) {
+	// get-vanilla 和 post-x-www-form-urlencoded，来自 AWS 的 SigV4 测试集
+	creds := awsV4Credentials{
+		accessKey: "AKIDEXAMPLE",
+		secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		region:    "us-east-1",
+		service:   "service",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	req, _ := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	if err := signAWSV4(req, creds, now); err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("get-vanilla:\ngot  %s\nwant %s", got, want)
+	}
+	if got := req.Header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("unexpected X-Amz-Date %q", got)
+	}
+
+	req, _ = http.NewRequest("POST", "https://example.amazonaws.com/", strings.NewReader("Param1=value1"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := signAWSV4(req, creds, now); err != nil {
+		t.Fatalf("sign error: %v", err)
+	}
+	want = "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("post-x-www-form-urlencoded:\ngot  %s\nwant %s", got, want)
+	}
+	// 签名读取的是请求体的副本
+	if body, _ := io.ReadAll(req.Body); string(body) != "Param1=value1" {
+		t.Errorf("body consumed by signing: %q", body)
+	}
+}
+
+func TestAWSV4Auth(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+	auth := map[string]interface{}{
+		"scheme":        "awsv4",
+		"access_key":    "AKIDEXAMPLE",
+		"secret_key":    "secret",
+		"region":        "eu-west-1",
+		"service":       "s3",
+		"session_token": "token",
+	}
+
+	if _, err := client.Do(map[string]interface{}{
+		"put":  "https://bucket.s3.amazonaws.com/my key.txt",
+		"body": "hello",
+		"auth": auth,
+	}); err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	h := rt.lastReq.Header
+	if got := h.Get("Authorization"); !strings.HasPrefix(got, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") ||
+		!strings.Contains(got, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date;x-amz-security-token, Signature=") {
+		t.Errorf("unexpected Authorization %q", got)
+	}
+	if got := h.Get("X-Amz-Security-Token"); got != "token" {
+		t.Errorf("expected session token header, got %q", got)
+	}
+	// S3 需要请求体的 SHA-256
+	if got := h.Get("X-Amz-Content-Sha256"); got != "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824" {
+		t.Errorf("unexpected X-Amz-Content-Sha256 %q", got)
+	}
+	if body, _ := io.ReadAll(rt.lastReq.Body); string(body) != "hello" {
+		t.Errorf("unexpected body %q", body)
+	}
+
+	// 显式的 Authorization 头优先
+	if _, err := client.Do(map[string]interface{}{
+		"get":     "https://bucket.s3.amazonaws.com/",
+		"headers": map[string]interface{}{"Authorization": "Token xyz"},
+		"auth":    auth,
+	}); err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	if got := rt.lastReq.Header.Get("Authorization"); got != "Token xyz" || rt.lastReq.Header.Get("X-Amz-Date") != "" {
+		t.Errorf("expected explicit header to win, got %q", got)
+	}
+}
+
+func TestAWSV4Canonical(t *testing.T) {
+	u, _ := url.Parse("https://example.com/a b/%C3%A9?b=2&a=x y&a=1&a-b=3&c")
+	if got, want := awsV4CanonicalPath(u, "execute-api"), "/a%2520b/%25C3%25A9"; got != want {
+		t.Errorf("path: got %q, want %q", got, want)
+	}
+	if got, want := awsV4CanonicalPath(u, "s3"), "/a%20b/%C3%A9"; got != want {
+		t.Errorf("s3 path: got %q, want %q", got, want)
+	}
+	if got, want := awsV4CanonicalQuery(u), "a=1&a=x%20y&a-b=3&b=2&c="; got != want {
+		t.Errorf("query: got %q, want %q", got, want)
+	}
+}
+
+func TestToCurl(t *testing.T) {
+	got, err := ToCurl(map[string]interface{}{
+		"post":    "https://api.example.com/users",
+		"headers": map[string]interface{}{"Content-Type": "application/json"},
+		"query":   map[string]interface{}{"dry_run": true},
+		"body":    map[string]interface{}{"name": "O'Brien"},
+		"timeout": 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("ToCurl error: %v", err)
+	}
+	want := `curl -X POST 'https://api.example.com/users?dry_run=true' \
+  -H 'Content-Type: application/json' \
+  --data '{"name":"O'\''Brien"}' \
+  --max-time 5`
+	if got != want {
+		t.Errorf("unexpected curl command:\n%s\nwant:\n%s", got, want)
+	}
+
+	// GET without body or timeout, auth turned into a header
+	got, err = ToCurl(map[string]interface{}{
+		"get":  "https://api.example.com",
+		"auth": map[string]interface{}{"scheme": "bearer", "token": "abc"},
+	})
+	if err != nil {
+		t.Fatalf("ToCurl error: %v", err)
+	}
+	if want := "curl 'https://api.example.com' \\\n  -H 'Authorization: Bearer abc'"; got != want {
+		t.Errorf("unexpected curl command:\n%s", got)
+	}
+
+	// awsv4 is signed by curl itself
+	got, err = ToCurl(map[string]interface{}{
+		"get":  "https://sqs.us-east-1.amazonaws.com/",
+		"auth": map[string]interface{}{"scheme": "awsv4", "access_key": "AK", "secret_key": "SK", "region": "us-east-1", "service": "sqs", "session_token": "tok"},
+	})
+	if err != nil {
+		t.Fatalf("ToCurl error: %v", err)
+	}
+	if want := "curl 'https://sqs.us-east-1.amazonaws.com/' \\\n  --aws-sigv4 'aws:amz:us-east-1:sqs' \\\n  --user 'AK:SK' \\\n  -H 'X-Amz-Security-Token: tok'"; got != want {
+		t.Errorf("unexpected curl command:\n%s", got)
+	}
+
+	if _, err := ToCurl(map[string]interface{}{"body": "x"}); err == nil {
+		t.Error("expected error for missing method")
+	}
+}
+
+func TestHAR(t *testing.T) {
+	started := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	entries := []HAREntry{
+		{
+			Request: map[string]interface{}{
+				"post":    "https://api.example.com/users",
+				"query":   map[string]interface{}{"dry_run": true},
+				"headers": map[string]interface{}{"Content-Type": "application/json"},
+				"body":    map[string]interface{}{"name": "John"},
+			},
+			Response: &Response{
+				StatusCode: 201,
+				Status:     "201 Created",
+				Headers:    map[string]string{"Content-Type": "application/json"},
+				Body:       []byte(`{"id":1}`),
+				Duration:   150 * time.Millisecond,
+			},
+			StartedAt: started,
+		},
+		{
+			Request:   map[string]interface{}{"get": "https://api.example.com/logo.png"},
+			Response:  &Response{StatusCode: 200, Status: "200 OK", Body: []byte{0xff, 0xd8}},
+			StartedAt: started.Add(time.Second),
+		},
+	}
+
+	data, err := HAR(entries, "1.0")
+	if err != nil {
+		t.Fatalf("HAR error: %v", err)
+	}
+
+	var har struct {
+		Log struct {
+			Version string
+			Entries []struct {
+				StartedDateTime string
+				Time            float64
+				Request         struct {
+					Method      string
+					URL         string
+					QueryString []struct{ Name, Value string }
+					PostData    *struct{ MimeType, Text string }
+				}
+				Response struct {
+					Status     int
+					StatusText string
+					Content    struct {
+						Size           int
+						Text, Encoding string
+					}
+				}
+				Timings struct{ Wait float64 }
+			}
+		}
+	}
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatalf("invalid HAR JSON: %v", err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("unexpected HAR log: %s", data)
+	}
+
+	e := har.Log.Entries[0]
+	if e.Request.Method != "POST" || e.Request.URL != "https://api.example.com/users?dry_run=true" {
+		t.Errorf("unexpected request: %s %s", e.Request.Method, e.Request.URL)
+	}
+	if len(e.Request.QueryString) != 1 || e.Request.QueryString[0].Name != "dry_run" {
+		t.Errorf("unexpected query string: %v", e.Request.QueryString)
+	}
+	if e.Request.PostData == nil || e.Request.PostData.Text != `{"name":"John"}` || e.Request.PostData.MimeType != "application/json" {
+		t.Errorf("unexpected post data: %+v", e.Request.PostData)
+	}
+	if e.Response.Status != 201 || e.Response.StatusText != "Created" || e.Response.Content.Text != `{"id":1}` {
+		t.Errorf("unexpected response: %+v", e.Response)
+	}
+	if e.Time != 150 || e.Timings.Wait != 150 || e.StartedDateTime != "2024-01-02T03:04:05Z" {
+		t.Errorf("unexpected timings: time=%v wait=%v started=%s", e.Time, e.Timings.Wait, e.StartedDateTime)
+	}
+
+	// Binary bodies are base64-encoded
+	if c := har.Log.Entries[1].Response.Content; c.Encoding != "base64" || c.Text != "/9g=" || c.Size != 2 {
+		t.Errorf("unexpected binary content: %+v", c)
+	}
+}
+
+func TestInsecure(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := New()
+	if _, err := client.Do(map[string]interface{}{"get": server.URL}); err == nil {
+		t.Fatal("expected certificate error for self-signed server")
+	}
+	resp, err := client.Do(map[string]interface{}{"get": server.URL, "insecure": true})
+	if err != nil {
+		t.Fatalf("expected insecure request to succeed: %v", err)
+	}
+	if resp.String() != "ok" {
+		t.Errorf("unexpected body: %q", resp.String())
+	}
+	// The shared default transport is left untouched
+	if cfg := http.DefaultTransport.(*http.Transport).TLSClientConfig; cfg != nil && cfg.InsecureSkipVerify {
+		t.Error("default transport was modified")
+	}
+
+	// Client-wide setting (-k), overridable per request
+	client = New(WithInsecure(true))
+	if _, err := client.Do(map[string]interface{}{"get": server.URL}); err != nil {
+		t.Fatalf("expected insecure client to succeed: %v", err)
+	}
+	if _, err := client.Do(map[string]interface{}{"get": server.URL, "insecure": false}); err == nil {
+		t.Error("expected insecure false to verify certificates")
+	}
+}
+
+func TestCACert(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// The test server's certificate is its own CA; trust it via a PEM bundle
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.pem")
+	block := &pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}
+	if err := os.WriteFile(caPath, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	client := New()
+	resp, err := client.Do(map[string]interface{}{"get": server.URL, "ca_cert": caPath})
+	if err != nil {
+		t.Fatalf("expected request with custom CA to succeed: %v", err)
+	}
+	if resp.String() != "ok" {
+		t.Errorf("unexpected body: %q", resp.String())
+	}
+	// The CA only applies to requests that ask for it
+	if _, err := client.Do(map[string]interface{}{"get": server.URL}); err == nil {
+		t.Error("expected certificate error without ca_cert")
+	}
+
+	// Load errors name the problem
+	badPath := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(badPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{badPath, filepath.Join(dir, "missing.pem")} {
+		_, err := client.Do(map[string]interface{}{"get": server.URL, "ca_cert": path})
+		if err == nil || !strings.Contains(err.Error(), "failed to load CA bundle") {
+			t.Errorf("%s: expected CA bundle load error, got %v", filepath.Base(path), err)
+		}
+	}
+}
+
+func TestNetrc(t *testing.T) {
+	var gotAuth []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		gotAuth = append(gotAuth, user+":"+pass)
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), ".netrc")
+	content := `# credentials
+machine 127.0.0.1
+  login admin
+  password s3cret
+
+macdef init
+  cd /tmp
+
+default login anonymous password guest
+`
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	n, err := LoadNetrc(path)
+	if err != nil {
+		t.Fatalf("LoadNetrc error: %v", err)
+	}
+
+	client := New(WithNetrc(n))
+	requests := []map[string]interface{}{
+		{"get": server.URL},
+		// explicit auth and Authorization headers take precedence
+		{"get": server.URL, "auth": map[string]interface{}{"scheme": "basic", "username": "me", "password": "pw"}},
+		{"get": server.URL, "headers": map[string]interface{}{"Authorization": "Bearer abc"}},
+	}
+	for _, req := range requests {
+		if _, err := client.Do(req); err != nil {
+			t.Fatalf("request error: %v", err)
+		}
+	}
+	want := []string{"admin:s3cret", "me:pw", ":"}
+	if strings.Join(gotAuth, " ") != strings.Join(want, " ") {
+		t.Errorf("expected %v, got %v", want, gotAuth)
+	}
+
+	if e, ok := n.Lookup("other.example.com"); !ok || e.Login != "anonymous" || e.Password != "guest" {
+		t.Errorf("expected default entry, got %+v %v", e, ok)
+	}
+
+	if _, err := ParseNetrc(strings.NewReader("login admin\n")); err == nil {
+		t.Error("expected error for login before machine")
+	}
+}
+
+func TestConflictingMethods(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	_, err := client.Do(map[string]interface{}{
+		"get":  "https://api.example.com/a",
+		"post": "https://api.example.com/b",
+	})
+	if err == nil || !strings.Contains(err.Error(), "conflicting HTTP methods in request: get, post") {
+		t.Fatalf("expected conflicting methods error, got %v", err)
+	}
+	if rt.lastReq != nil {
+		t.Error("no request should have been sent")
+	}
+	if _, err := ToCurl(map[string]interface{}{"put": "https://a", "delete": "https://b"}); err == nil {
+		t.Error("expected ToCurl to reject conflicting methods")
+	}
+}
+
+func TestCustomMethod(t *testing.T) {
+	rt := &stubTransport{}
+	client := New(WithTransport(rt))
+
+	_, err := client.Do(map[string]interface{}{
+		"method": "PURGE",
+		"url":    "https://cdn.example.com/a",
+		"query":  map[string]interface{}{"v": int64(1)},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rt.lastReq.Method != "PURGE" || rt.lastReq.URL.String() != "https://cdn.example.com/a?v=1" {
+		t.Errorf("unexpected request: %s %s", rt.lastReq.Method, rt.lastReq.URL)
+	}
+
+	cmd, err := ToCurl(map[string]interface{}{"method": "LOCK", "url": "https://dav.example.com/f"})
+	if err != nil || !strings.HasPrefix(cmd, "curl -X LOCK 'https://dav.example.com/f'") {
+		t.Errorf("unexpected curl command %q (err %v)", cmd, err)
+	}
+
+	for _, tt := range []struct {
+		mapData map[string]interface{}
+		msg     string
+	}{
+		{map[string]interface{}{"method": "BAD VERB", "url": "https://a"}, `invalid HTTP method "BAD VERB"`},
+		{map[string]interface{}{"method": "", "url": "https://a"}, `invalid HTTP method ""`},
+		{map[string]interface{}{"method": int64(1), "url": "https://a"}, `invalid HTTP method "1"`},
+		{map[string]interface{}{"method": "PURGE"}, "missing URL for PURGE"},
+		{map[string]interface{}{"method": "PURGE", "url": int64(1)}, "invalid URL for PURGE"},
+		{map[string]interface{}{"method": "PURGE", "url": "https://a", "get": "https://b"}, "conflicting HTTP methods in request: method, get"},
+	} {
+		if _, err := client.Do(tt.mapData); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("Do(%v) error = %v, want %q", tt.mapData, err, tt.msg)
+		}
+	}
+}
+
+func TestRequestErrorKinds(t *testing.T) {
+	// A TCP server that answers with something that isn't HTTP
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-OpenSSH_9.6\r\n\r\n"))
+			conn.Close()
+		}
+	}()
+
+	kindOf := func(mapData map[string]interface{}) ErrorKind {
+		t.Helper()
+		_, err := New().Do(mapData)
+		var reqErr *RequestError
+		if !errors.As(err, &reqErr) {
+			t.Fatalf("expected *RequestError, got %v", err)
+		}
+		return reqErr.Kind
+	}
+
+	if kind := kindOf(map[string]interface{}{"get": "http://" + ln.Addr().String()}); kind != ErrProtocol {
+		t.Errorf("garbage response: expected %s, got %s", ErrProtocol, kind)
+	}
+
+	// A closed port is a connection error
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := closed.Addr().String()
+	closed.Close()
+	if kind := kindOf(map[string]interface{}{"get": "http://" + addr}); kind != ErrConnection {
+		t.Errorf("closed port: expected %s, got %s", ErrConnection, kind)
+	}
+
+	// A server that never answers in time is a timeout
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	if kind := kindOf(map[string]interface{}{"get": slow.URL, "timeout": 20 * time.Millisecond}); kind != ErrTimeout {
+		t.Errorf("slow server: expected %s, got %s", ErrTimeout, kind)
+	}
+}
+
+func TestDecompressResponse(t *testing.T) {
+	payload := []byte(`{"message": "` + strings.Repeat("hello ", 100) + `"}`)
+	compress := func(w io.WriteCloser) {
+		w.Write(payload)
+		w.Close()
+	}
+	encoded := map[string][]byte{}
+	var buf bytes.Buffer
+	compress(gzip.NewWriter(&buf))
+	encoded["gzip"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	compress(zlib.NewWriter(&buf))
+	encoded["deflate"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	compress(fw)
+	encoded["raw-deflate"] = bytes.Clone(buf.Bytes())
+	buf.Reset()
+	compress(brotli.NewWriter(&buf))
+	encoded["br"] = bytes.Clone(buf.Bytes())
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/")
+		switch name {
+		case "plain":
+			w.Write(payload)
+		case "corrupt":
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(encoded["gzip"][:len(encoded["gzip"])/2])
+		default:
+			w.Header().Set("Content-Encoding", strings.TrimPrefix(name, "raw-"))
+			w.Write(encoded[name])
+		}
+	}))
+	defer server.Close()
+
+	// Setting Accept-Encoding by hand turns off the transport's own gzip handling
+	get := func(name string) (*Response, error) {
+		return New().Do(map[string]interface{}{
+			"get":     server.URL + "/" + name,
+			"headers": map[string]interface{}{"Accept-Encoding": "gzip, deflate, br"},
+		})
+	}
+
+	for _, name := range []string{"gzip", "deflate", "raw-deflate", "br"} {
+		resp, err := get(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(resp.Body, payload) {
+			t.Errorf("%s: body was not decompressed: %q", name, resp.Body)
+		}
+		if resp.CompressedSize != int64(len(encoded[name])) {
+			t.Errorf("%s: expected compressed size %d, got %d", name, len(encoded[name]), resp.CompressedSize)
+		}
+		if _, err := resp.JSON(); err != nil {
+			t.Errorf("%s: JSON failed: %v", name, err)
+		}
+	}
+
+	resp, err := get("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.CompressedSize != 0 || !bytes.Equal(resp.Body, payload) {
+		t.Errorf("plain: expected untouched body and no compressed size, got %d", resp.CompressedSize)
+	}
+
+	_, err = get("corrupt")
+	var decErr *DecompressError
+	if !errors.As(err, &decErr) || decErr.Encoding != "gzip" {
+		t.Errorf("corrupt: expected gzip DecompressError, got %v", err)
+	}
+}
+
+func TestDecompressEmptyBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/no-content":
+			w.WriteHeader(http.StatusNoContent)
+		case "/not-modified":
+			w.WriteHeader(http.StatusNotModified)
+		case "/empty":
+			// 200 with an empty body despite Content-Encoding
+		default:
+			w.Header().Set("Content-Length", "120")
+		}
+	}))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method, path string
+		status       int
+	}{
+		{"head", "/resource", 200},
+		{"get", "/no-content", 204},
+		{"get", "/not-modified", 304},
+		{"get", "/empty", 200},
+	} {
+		resp, err := New().Do(map[string]interface{}{
+			tt.method: server.URL + tt.path,
+			"headers": map[string]interface{}{"Accept-Encoding": "gzip"},
+		})
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.method, tt.path, err)
+			continue
+		}
+		if resp.StatusCode != tt.status || len(resp.Body) != 0 || resp.CompressedSize != 0 {
+			t.Errorf("%s %s: expected an empty %d response, got %d %q", tt.method, tt.path, tt.status, resp.StatusCode, resp.Body)
+		}
+	}
+}
+
+func TestDoStream(t *testing.T) {
+	// The server waits for the client to see the first line before sending the rest
+	firstSeen := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/sse" {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "event: tick\ndata: {\"n\": 1}\n\ndata: {\"n\": 2}\n\n")
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"n\": 1}\n")
+		w.(http.Flusher).Flush()
+		select {
+		case <-firstSeen:
+		case <-time.After(2 * time.Second):
+		}
+		io.WriteString(w, "{\"n\": 2}\r\n\n")
+	}))
+	defer server.Close()
+
+	var lines []string
+	resp, err := New().DoStream(map[string]interface{}{"get": server.URL + "/ndjson"}, func(line []byte) {
+		if len(lines) == 0 {
+			close(firstSeen)
+		}
+		lines = append(lines, string(line))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Duration >= 2*time.Second {
+		t.Errorf("first line was not delivered before the body finished")
+	}
+	if strings.Join(lines, "|") != `{"n": 1}|{"n": 2}|` {
+		t.Errorf("unexpected lines: %q", lines)
+	}
+	if string(resp.Body) != `{"n": 2}` || !resp.Streamed {
+		t.Errorf("expected the last non-empty line as body, got %q (streamed=%v)", resp.Body, resp.Streamed)
+	}
+
+	// SSE: the body is the payload of the last data: line
+	resp, err = New().DoStream(map[string]interface{}{"get": server.URL + "/sse"}, func([]byte) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp.Body) != `{"n": 2}` {
+		t.Errorf("expected last SSE data as body, got %q", resp.Body)
+	}
+
+	// The size limit stops the stream and marks the response as truncated
+	lines = nil
+	resp, err = New(WithMaxResponseSize(14)).DoStream(map[string]interface{}{"get": server.URL + "/sse"}, func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Truncated || strings.Join(lines, "|") != "event: tick|da" {
+		t.Errorf("expected truncated stream, got %q (truncated=%v)", lines, resp.Truncated)
+	}
+}
+
+func TestDoStreamRetry(t *testing.T) {
+	defer func(d time.Duration) { retryBaseDelay = d }(retryBaseDelay)
+	retryBaseDelay = time.Millisecond
+
+	// The first attempt fails with a streamed error body, the second succeeds
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			io.WriteString(w, "busy\n")
+			return
+		}
+		io.WriteString(w, "one\ntwo\n")
+	}))
+	defer server.Close()
+
+	var lines []string
+	resp, err := New().DoStream(map[string]interface{}{
+		"get":   server.URL,
+		"retry": map[string]interface{}{"count": int64(2), "backoff": "fixed"},
+	}, func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 || resp.StatusCode != 200 {
+		t.Errorf("expected success on the second attempt, got status %d after %d", resp.StatusCode, calls)
+	}
+	if strings.Join(lines, "|") != "one|two" {
+		t.Errorf("expected only the final attempt to be streamed, got %q", lines)
+	}
+
+	// When the retries are used up, the last response is streamed
+	calls = 0
+	lines = nil
+	resp, err = New().DoStream(map[string]interface{}{
+		"get":   server.URL,
+		"retry": map[string]interface{}{"count": int64(0), "backoff": "fixed"},
+	}, func(line []byte) {
+		lines = append(lines, string(line))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || !resp.Streamed || strings.Join(lines, "|") != "busy" {
+		t.Errorf("expected the failed response to be streamed, got %q (status %d)", lines, resp.StatusCode)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	// /3 redirects to /2, /2 to /1, /1 to /0, which answers 200
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/"))
+		if n == 0 {
+			w.Write([]byte("done"))
+			return
+		}
+		http.Redirect(w, r, "/"+strconv.Itoa(n-1), http.StatusFound)
+	}))
+	defer server.Close()
+	start := map[string]interface{}{"get": server.URL + "/3"}
+
+	// Default: follow and record the final URL
+	resp, err := New().Do(start)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != 200 || !resp.Redirected || resp.URL != server.URL+"/0" {
+		t.Errorf("expected 200 from %s/0 after redirects, got %d from %s (redirected %v)", server.URL, resp.StatusCode, resp.URL, resp.Redirected)
+	}
+
+	// No redirect: URL is the request URL
+	resp, err = New().Do(map[string]interface{}{"get": server.URL + "/0"})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.Redirected || resp.URL != server.URL+"/0" {
+		t.Errorf("expected no redirect, got %s (redirected %v)", resp.URL, resp.Redirected)
+	}
+
+	// Not following returns the 302 with its Location header
+	resp, err = New(WithRedirectPolicy(false, 0)).Do(start)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusFound || resp.Headers["Location"] != "/2" || resp.Redirected {
+		t.Errorf("expected unfollowed 302 to /2, got %d to %q (redirected %v)", resp.StatusCode, resp.Headers["Location"], resp.Redirected)
+	}
+
+	// Exactly max redirects is fine, one more is an error
+	if _, err := New(WithRedirectPolicy(true, 3)).Do(start); err != nil {
+		t.Errorf("3 redirects with max 3: %v", err)
+	}
+	_, err = New(WithRedirectPolicy(true, 2)).Do(start)
+	if err == nil || !strings.Contains(err.Error(), "stopped after 2 redirects") {
+		t.Errorf("expected stopped after 2 redirects error, got %v", err)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	// An HTTP proxy receives the absolute URL of the target
+	var mu sync.Mutex
+	var seen []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.URL.String())
+		mu.Unlock()
+		w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("other proxy"))
+	}))
+	defer other.Close()
+
+	client := New(WithProxy(proxy.URL))
+	resp, err := client.Do(map[string]interface{}{"get": "http://api.example.invalid/users?page=2"})
+	if err != nil {
+		t.Fatalf("request through proxy failed: %v", err)
+	}
+	if string(resp.Body) != "proxied" || len(seen) != 1 || seen[0] != "http://api.example.invalid/users?page=2" {
+		t.Errorf("expected the proxy to receive the request, got body %q and %v", resp.Body, seen)
+	}
+
+	// A request-level proxy wins over the client default
+	resp, err = client.Do(map[string]interface{}{"get": "http://api.example.invalid/", "proxy": other.URL})
+	if err != nil {
+		t.Fatalf("request through request-level proxy failed: %v", err)
+	}
+	if string(resp.Body) != "other proxy" {
+		t.Errorf("expected request-level proxy to be used, got %q", resp.Body)
+	}
+
+	// An invalid proxy fails the request instead of connecting directly
+	if _, err := New(WithProxy("ftp://proxy.internal")).Do(map[string]interface{}{"get": "http://api.example.invalid/"}); err == nil || !strings.Contains(err.Error(), "unsupported scheme") {
+		t.Errorf("expected invalid proxy error, got %v", err)
+	}
+
+	if cmd, err := ToCurl(map[string]interface{}{"get": "http://api.example.invalid/", "proxy": "socks5://localhost:1080"}); err != nil || !strings.Contains(cmd, "--proxy 'socks5://localhost:1080'") {
+		t.Errorf("expected --proxy in curl command, got %q (%v)", cmd, err)
+	}
+}
+
+func TestParseProxyURL(t *testing.T) {
+	valid := map[string]string{
+		"http://proxy.internal:3128":      "http://proxy.internal:3128",
+		"socks5://user:pw@localhost:1080": "socks5://user:pw@localhost:1080",
+		"socks5h://localhost:1080":        "socks5h://localhost:1080",
+		"localhost:8080":                  "http://localhost:8080",
+	}
+	for raw, want := range valid {
+		u, err := ParseProxyURL(raw)
+		if err != nil || u.String() != want {
+			t.Errorf("ParseProxyURL(%q) = %v, %v; want %s", raw, u, err, want)
+		}
+	}
+	for _, raw := range []string{"ftp://proxy.internal", "http://", "http://[::1"} {
+		if _, err := ParseProxyURL(raw); err == nil {
+			t.Errorf("ParseProxyURL(%q): expected an error", raw)
+		}
+	}
+}
+
+func TestWithProtocol(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	})
+	tlsServer := httptest.NewUnstartedServer(handler)
+	tlsServer.EnableHTTP2 = true
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+
+	// Plain-text server that also accepts h2c with prior knowledge
+	plainServer := httptest.NewUnstartedServer(handler)
+	plainServer.Config.Protocols = new(http.Protocols)
+	plainServer.Config.Protocols.SetHTTP1(true)
+	plainServer.Config.Protocols.SetUnencryptedHTTP2(true)
+	plainServer.Start()
+	defer plainServer.Close()
+
+	tests := []struct {
+		protocol string
+		url      string
+		want     string
+	}{
+		{"", tlsServer.URL, "HTTP/2.0"},
+		{ProtocolHTTP1, tlsServer.URL, "HTTP/1.1"},
+		{ProtocolHTTP2, tlsServer.URL, "HTTP/2.0"},
+		{"", plainServer.URL, "HTTP/1.1"},
+		{ProtocolHTTP2, plainServer.URL, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		client := New(WithInsecure(true), WithProtocol(tt.protocol))
+		resp, err := client.Do(map[string]interface{}{"get": tt.url})
+		if err != nil {
+			t.Fatalf("protocol %q %s: %v", tt.protocol, tt.url, err)
+		}
+		if resp.String() != tt.want || resp.Proto != tt.want {
+			t.Errorf("protocol %q %s: server saw %s, response is %s; want %s", tt.protocol, tt.url, resp.String(), resp.Proto, tt.want)
+		}
+	}
+}
+
+func TestWithTrace(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Echo", "yes")
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	var dumps []string
+	var outs []bool
+	client := New(WithTrace(func(dump []byte, out bool) {
+		dumps = append(dumps, string(dump))
+		outs = append(outs, out)
+	}))
+	resp, err := client.Do(map[string]interface{}{
+		"post":    server.URL + "/items",
+		"headers": map[string]interface{}{"X-Sig": "abc"},
+		"body":    map[string]interface{}{"name": "John"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The dump must not consume the request body
+	if resp.String() != `{"name":"John"}` {
+		t.Errorf("unexpected echoed body: %q", resp.String())
+	}
+
+	if len(dumps) != 2 || !outs[0] || outs[1] {
+		t.Fatalf("expected a request and a response dump, got %q", dumps)
+	}
+	for _, want := range []string{"POST /items HTTP/1.1\r\n", "X-Sig: abc\r\n", "Content-Length: 15\r\n", `{"name":"John"}`} {
+		if !strings.Contains(dumps[0], want) {
+			t.Errorf("request dump missing %q:\n%s", want, dumps[0])
+		}
+	}
+	for _, want := range []string{"HTTP/1.1 200 OK\r\n", "X-Echo: yes\r\n", "\r\n\r\n" + `{"name":"John"}`} {
+		if !strings.Contains(dumps[1], want) {
+			t.Errorf("response dump missing %q:\n%s", want, dumps[1])
+		}
+	}
+}
+
+// websocketServer accepts a websocket handshake and passes the connection to serve
+func websocketServer(t *testing.T, serve func(ws *wsConn)) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+			return
+		}
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		rw.WriteString("Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+		rw.Flush()
+		serve(&wsConn{conn: conn, br: rw.Reader, limit: maxWebSocketFrame})
+	}))
+}
+
+// writeServerFrame writes an unmasked frame, as servers send them
+func writeServerFrame(ws *wsConn, opcode byte, payload string) {
+	ws.conn.Write(append([]byte{0x80 | opcode, byte(len(payload))}, payload...))
+}
+
+func TestDoWebSocket(t *testing.T) {
+	server := websocketServer(t, func(ws *wsConn) {
+		for i := 0; i < 2; i++ {
+			msg, err := ws.readMessage()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			writeServerFrame(ws, wsText, "echo: "+string(msg))
+		}
+		writeServerFrame(ws, wsPing, "")
+		writeServerFrame(ws, wsClose, "\x03\xe8")
+		ws.readMessage() // the pong and the close reply
+	})
+	defer server.Close()
+
+	var received []string
+	resp, err := New().DoWebSocket(map[string]interface{}{
+		"ws":   "ws" + strings.TrimPrefix(server.URL, "http") + "/socket",
+		"send": []interface{}{"hello", map[string]interface{}{"n": 1}},
+	}, func(msg []byte) {
+		received = append(received, string(msg))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"echo: hello", `echo: {"n":1}`}
+	if strings.Join(received, "|") != strings.Join(want, "|") {
+		t.Errorf("expected messages %q, got %q", want, received)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.String() != want[1] || !resp.Streamed {
+		t.Errorf("unexpected response: %d %q streamed=%v", resp.StatusCode, resp.String(), resp.Streamed)
+	}
+}
+
+func TestDoWebSocketTimeout(t *testing.T) {
+	server := websocketServer(t, func(ws *wsConn) {
+		writeServerFrame(ws, wsText, "first")
+		// Keep the connection open until the client gives up
+		ws.readMessage()
+	})
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := New().DoWebSocket(map[string]interface{}{
+		"ws":      "ws" + strings.TrimPrefix(server.URL, "http"),
+		"timeout": 100 * time.Millisecond,
+	}, nil)
+	if err != nil {
+		t.Fatalf("a timeout should end the connection without an error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the read loop to stop after the timeout, took %v", elapsed)
+	}
+	if resp.String() != "first" {
+		t.Errorf("expected the last message in the body, got %q", resp.String())
+	}
+}
+
+func TestDoWebSocketIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { webSocketIdleTimeout = d }(webSocketIdleTimeout)
+	webSocketIdleTimeout = 100 * time.Millisecond
+
+	// Without a timeout, a server that goes quiet ends the read after the idle time
+	server := websocketServer(t, func(ws *wsConn) {
+		writeServerFrame(ws, wsText, "first")
+		ws.readMessage()
+	})
+	defer server.Close()
+
+	start := time.Now()
+	resp, err := New().DoWebSocket(map[string]interface{}{
+		"ws":      "ws" + strings.TrimPrefix(server.URL, "http"),
+		"timeout": time.Duration(0),
+	}, nil)
+	if err != nil {
+		t.Fatalf("an idle connection should end without an error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the read loop to stop when idle, took %v", elapsed)
+	}
+	if resp.String() != "first" {
+		t.Errorf("expected the last message in the body, got %q", resp.String())
+	}
+}
+
+// wsPipe returns the client end of an in-memory websocket connection and the
+// raw server end, which writes frames byte by byte
+func wsPipe(t *testing.T) (*wsConn, *wsConn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return &wsConn{conn: client, br: bufio.NewReader(client), limit: 100},
+		&wsConn{conn: server, br: bufio.NewReader(server), limit: 100}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	// A fragmented message with a ping in between: the ping is answered with
+	// the same payload and the fragments are joined
+	client, server := wsPipe(t)
+	pong := make(chan string, 1)
+	go func() {
+		server.conn.Write([]byte("\x01\x02ab"))   // text, not final
+		server.conn.Write([]byte("\x89\x04ping")) // ping
+		_, opcode, payload, _ := server.readFrame()
+		if opcode == wsPong {
+			pong <- string(payload)
+		}
+		close(pong)
+		server.conn.Write([]byte("\x00\x01c")) // continuation, not final
+		server.conn.Write([]byte("\x80\x01d")) // final continuation
+	}()
+	msg, err := client.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "abcd" {
+		t.Errorf("expected the fragments to be joined, got %q", msg)
+	}
+	if p := <-pong; p != "ping" {
+		t.Errorf("expected a pong with the ping payload, got %q", p)
+	}
+
+	// A close frame is answered with the server's status code
+	client, server = wsPipe(t)
+	reply := make(chan []byte, 1)
+	go func() {
+		server.conn.Write([]byte("\x88\x05\x03\xe9bye"))
+		_, opcode, payload, _ := server.readFrame()
+		if opcode == wsClose {
+			reply <- payload
+		}
+		close(reply)
+	}()
+	if _, err := client.readMessage(); !errors.Is(err, io.EOF) {
+		t.Errorf("expected io.EOF after a close frame, got %v", err)
+	}
+	if p := <-reply; string(p) != "\x03\xe9" {
+		t.Errorf("expected the close reply to carry status 1001, got %q", p)
+	}
+}
+
+func TestWebSocketFrameLengths(t *testing.T) {
+	// writeFrame 按长度选择 7 位、16 位和 64 位长度字段，客户端帧总是带掩码，readFrame 能还原
+	for _, n := range []int{0, 125, 126, 0xFFFF, 0x10000} {
+		client, server := wsPipe(t)
+		server.limit = 1 << 20
+		payload := bytes.Repeat([]byte("x"), n)
+		go client.writeFrame(wsBinary, payload)
+
+		head := make([]byte, 2)
+		if _, err := io.ReadFull(server.br, head); err != nil {
+			t.Fatal(err)
+		}
+		if head[1]&0x80 == 0 {
+			t.Errorf("%d bytes: expected a masked client frame", n)
+		}
+		want := byte(n)
+		if n > 0xFFFF {
+			want = 127
+		} else if n > 125 {
+			want = 126
+		}
+		if head[1]&0x7F != want {
+			t.Errorf("%d bytes: expected length code %d, got %d", n, want, head[1]&0x7F)
+		}
+
+		// 把读过的帧头放回去，交给 readFrame 解析整个帧
+		server.br = bufio.NewReader(io.MultiReader(bytes.NewReader(head), server.br))
+		fin, opcode, got, err := server.readFrame()
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !fin || opcode != wsBinary || !bytes.Equal(got, payload) {
+			t.Errorf("%d bytes: expected the payload back, got fin=%v opcode=%#x len=%d", n, fin, opcode, len(got))
+		}
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames string
+		want   string
+	}{
+		{"fragmented ping", "\x09\x00", "invalid control frame"},
+		{"oversized ping", "\x89\x7e\x00\x7e", "invalid control frame"},
+		{"oversized close", "\x88\x7e\x00\x80", "invalid control frame"},
+		{"continuation without a message", "\x80\x01a", "unexpected continuation frame"},
+		{"message inside a fragmented message", "\x01\x01a\x81\x01b", "new message before"},
+		{"unknown opcode", "\x83\x00", "unknown opcode"},
+		{"reserved bit", "\xc1\x01a", "reserved bits set"},
+		{"truncated payload", "\x81\x05ab", "EOF"},
+		{"message too large", "\x81\x7e\x00\xc8", "exceeds 100 bytes"},
+	}
+	for _, tt := range tests {
+		client, server := wsPipe(t)
+		go func() {
+			// 写完后关闭，让截断的帧读到 EOF
+			server.conn.Write([]byte(tt.frames))
+			server.conn.Close()
+		}()
+		if _, err := client.readMessage(); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.want, err)
+		}
+	}
+}
+
+func TestDoWebSocketErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer server.Close()
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	if _, err := New().DoWebSocket(map[string]interface{}{"ws": wsURL}, nil); err == nil || !strings.Contains(err.Error(), "200 OK") {
+		t.Errorf("expected a handshake error, got %v", err)
+	}
+	if _, err := New().DoWebSocket(map[string]interface{}{"ws": server.URL}, nil); err == nil || !strings.Contains(err.Error(), "ws://") {
+		t.Errorf("expected an error for an http:// URL, got %v", err)
+	}
+	if _, err := New().Do(map[string]interface{}{"ws": wsURL}); err == nil || !strings.Contains(err.Error(), "websocket") {
+		t.Errorf("expected Do to reject a ws request, got %v", err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	hits := map[string]int{}
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.Method+" "+r.URL.Path]++
+		n := hits[r.Method+" "+r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/expired":
+			w.Header().Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+		case "/max-age":
+			w.Header().Set("Cache-Control", "public, max-age=3600")
+			w.Header().Set("Expires", "Thu, 01 Jan 1970 00:00:00 GMT")
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, "%s %s #%d", r.Method, r.URL.Path, n)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	// Every run gets a new client, as each haiku invocation does
+	do := func(req map[string]interface{}) *Response {
+		t.Helper()
+		cache, err := NewCache(dir, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := New(WithCache(cache)).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name   string
+		req    map[string]interface{}
+		cached bool
+	}{
+		{"GET", map[string]interface{}{"get": server.URL + "/items"}, true},
+		{"GET with Cache-Control max-age over Expires", map[string]interface{}{"get": server.URL + "/max-age"}, true},
+		{"POST", map[string]interface{}{"post": server.URL + "/items"}, false},
+		{"no-store", map[string]interface{}{"get": server.URL + "/no-store"}, false},
+		{"expired", map[string]interface{}{"get": server.URL + "/expired"}, false},
+		{"404", map[string]interface{}{"get": server.URL + "/missing"}, false},
+	}
+	for _, tt := range tests {
+		first := do(tt.req)
+		second := do(tt.req)
+		if first.Cached {
+			t.Errorf("%s: first response should not come from the cache", tt.name)
+		}
+		if second.Cached != tt.cached || (second.String() == first.String()) != tt.cached {
+			t.Errorf("%s: expected cached=%v, got %v with bodies %q and %q", tt.name, tt.cached, second.Cached, first.String(), second.String())
+		}
+	}
+
+	// Headers are part of the key, so another token gets its own response
+	withToken := map[string]interface{}{"get": server.URL + "/items", "headers": map[string]interface{}{"Authorization": "Bearer other"}}
+	if resp := do(withToken); resp.Cached || resp.String() != "GET /items #2" {
+		t.Errorf("expected a request with other headers to be sent, got %q cached=%v", resp.String(), resp.Cached)
+	}
+
+	// Past the default TTL the response is fetched again
+	cache, _ := NewCache(dir, 20*time.Millisecond)
+	client := New(WithCache(cache))
+	url := server.URL + "/short"
+	client.Do(map[string]interface{}{"get": url})
+	time.Sleep(50 * time.Millisecond)
+	if resp, err := client.Do(map[string]interface{}{"get": url}); err != nil || resp.Cached {
+		t.Errorf("expected an expired entry to be refetched, got %v cached=%v", err, resp != nil && resp.Cached)
+	}
+}
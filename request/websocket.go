@@ -0,0 +1,405 @@
+package request
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 客户端只用到 RFC 6455 的一小部分（握手、分片、控制帧、掩码），不协商扩展和子协议，
+// 所以直接实现，不引入第三方 WebSocket 库
+
+// websocketGUID 握手时与 Sec-WebSocket-Key 拼接，用于计算 Sec-WebSocket-Accept（RFC 6455 1.3）
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// maxWebSocketFrame 未设置 WithMaxResponseSize 时单个帧的最大长度，避免按错误的长度字段分配内存
+const maxWebSocketFrame = 1 << 30
+
+// webSocketIdleTimeout timeout 为 0 时的空闲上限：超过这么久没有收到任何帧就结束读取，
+// 避免服务器既不发消息也不关闭连接时一直等待
+var webSocketIdleTimeout = 30 * time.Second
+
+// maxControlPayload 控制帧（close、ping、pong）负载的最大长度（RFC 6455 5.5）
+const maxControlPayload = 125
+
+// WebSocket 帧的操作码（RFC 6455 5.2）
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// DoWebSocket 连接 mapData["ws"] 中的 WebSocket URL（ws:// 或 wss://），依次发送 mapData["send"] 中的消息
+// （字符串原样作为文本帧，其他值编码为 JSON），然后读取服务器发来的消息，每条到达时调用 onMessage，
+// 直到服务器关闭连接或超时。请求级 timeout 优先于 client 默认 timeout，为 0 时一直读到连接关闭，
+// 但连续 webSocketIdleTimeout 没有收到任何帧时结束；超时结束不算错误。
+// 返回的 Response 为握手的响应，Body 为最后一条消息，供 $_ 引用
+func (c *Client) DoWebSocket(mapData map[string]interface{}, onMessage func(msg []byte)) (*Response, error) {
+	start := time.Now()
+
+	rawURL, ok := mapData["ws"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid URL for ws: %v", mapData["ws"])
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url %q: %w", rawURL, err)
+	}
+	// 握手是普通的 HTTP 请求
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	default:
+		return nil, fmt.Errorf("invalid websocket URL %q: expected ws:// or wss://", rawURL)
+	}
+	handshakeURL, err := applyQuery(u.String(), mapData)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := websocketMessages(mapData["send"])
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := c.timeout
+	if t, ok, err := extractTimeout(mapData); err != nil {
+		return nil, err
+	} else if ok {
+		timeout = t
+	}
+
+	// HTTP/2 没有 Upgrade，握手只能使用 HTTP/1.1
+	settings := transportSettings{insecure: c.insecure, proxy: c.proxy, protocol: ProtocolHTTP1}
+	if v, ok := mapData["insecure"].(bool); ok {
+		settings.insecure = v
+	}
+	if v, ok := mapData["ca_cert"].(string); ok {
+		settings.caCert = v
+	}
+	if v, ok := mapData["proxy"].(string); ok && v != "" {
+		settings.proxy = v
+	}
+	rt, err := c.transport(settings)
+	if err != nil {
+		return nil, err
+	}
+	// http.Client 的 Timeout 包括读取响应体，会中断整个连接，超时改由下面的计时器控制
+	client := *c.httpClient
+	client.Transport = rt
+	client.Timeout = 0
+
+	req, err := newHTTPRequest(http.MethodGet, handshakeURL, mapData)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyAWSV4(req, mapData); err != nil {
+		return nil, err
+	}
+	c.applyNetrc(req)
+	key := make([]byte, 16)
+	rand.Read(key)
+	challenge := base64.StdEncoding.EncodeToString(key)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", challenge)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var timedOut atomic.Bool
+	expire := func() {
+		timedOut.Store(true)
+		cancel()
+	}
+	var idle *time.Timer // timeout 为 0 时每收到一个帧重新计时
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, expire)
+		defer timer.Stop()
+	} else {
+		idle = time.AfterFunc(webSocketIdleTimeout, expire)
+		defer idle.Stop()
+	}
+	req = req.WithContext(ctx)
+
+	if c.trace != nil {
+		dump, err := httputil.DumpRequestOut(req, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump request: %w", err)
+		}
+		c.trace(dump, true)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if timedOut.Load() {
+			return nil, &RequestError{Kind: ErrTimeout, Err: err}
+		}
+		return nil, classifyError(err)
+	}
+	defer resp.Body.Close()
+	if c.trace != nil {
+		dump, err := httputil.DumpResponse(resp, false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to dump response: %w", err)
+		}
+		c.trace(dump, false)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket handshake failed: server responded %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(challenge) {
+		return nil, fmt.Errorf("websocket handshake failed: invalid Sec-WebSocket-Accept")
+	}
+	conn, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return nil, fmt.Errorf("websocket handshake failed: connection cannot be upgraded")
+	}
+
+	limit := c.maxResponseSize
+	if limit <= 0 {
+		limit = maxWebSocketFrame
+	}
+	ws := &wsConn{conn: conn, br: bufio.NewReader(conn), limit: limit}
+	if idle != nil {
+		ws.onFrame = func() { idle.Reset(webSocketIdleTimeout) }
+	}
+	// 超时时发送关闭帧并断开连接，使阻塞的读取返回；正常结束时只断开连接
+	go func() {
+		<-ctx.Done()
+		if timedOut.Load() {
+			ws.writeFrame(wsClose, []byte{0x03, 0xE8}) // 1000：正常关闭
+		}
+		conn.Close()
+	}()
+
+	for _, msg := range messages {
+		if err := ws.writeFrame(wsText, msg); err != nil {
+			if timedOut.Load() {
+				return nil, &RequestError{Kind: ErrTimeout, Err: err}
+			}
+			return nil, &RequestError{Kind: ErrConnection, Err: err}
+		}
+	}
+
+	var last []byte
+	for {
+		msg, err := ws.readMessage()
+		if err != nil {
+			if timedOut.Load() || errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, &RequestError{Kind: ErrConnection, Err: err}
+		}
+		if onMessage != nil {
+			onMessage(msg)
+		}
+		last = msg
+	}
+
+	headers := make(map[string]string)
+	for k, v := range resp.Header {
+		if len(v) > 0 {
+			headers[k] = v[0]
+		}
+	}
+	return &Response{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Headers:    headers,
+		Body:       last,
+		Duration:   time.Since(start),
+		Streamed:   true,
+		URL:        rawURL,
+		Proto:      resp.Proto,
+	}, nil
+}
+
+// websocketMessages 将 send 的值转换为要发送的消息：数组中每个元素一条，其他值作为一条
+// 字符串原样发送，其他值编码为 JSON
+func websocketMessages(v interface{}) ([][]byte, error) {
+	var items []interface{}
+	switch s := v.(type) {
+	case nil:
+		return nil, nil
+	case []interface{}:
+		items = s
+	default:
+		items = []interface{}{s}
+	}
+
+	messages := make([][]byte, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			messages = append(messages, []byte(s))
+			continue
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode websocket message: %w", err)
+		}
+		messages = append(messages, data)
+	}
+	return messages, nil
+}
+
+// websocketAccept 计算服务器对 Sec-WebSocket-Key 应答的 Sec-WebSocket-Accept
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// wsConn 握手后的 WebSocket 连接，只实现客户端需要的部分：发送带掩码的帧，读取消息并应答 ping 和关闭帧
+type wsConn struct {
+	conn    io.ReadWriteCloser
+	br      *bufio.Reader
+	limit   int64      // 单条消息的最大字节数
+	mu      sync.Mutex // 超时时关闭帧从另一个 goroutine 写入
+	onFrame func()     // 每读到一个帧时调用（空闲计时），可以为 nil
+}
+
+// readMessage 读取下一条文本或二进制消息（合并分片，分片之间可以穿插控制帧）。服务器关闭连接时返回 io.EOF
+func (ws *wsConn) readMessage() ([]byte, error) {
+	var msg []byte
+	fragmented := false // 已经收到消息的第一个分片，等待后续的 continuation 帧
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		if ws.onFrame != nil {
+			ws.onFrame()
+		}
+		switch opcode {
+		case wsPing:
+			if err := ws.writeFrame(wsPong, payload); err != nil {
+				return nil, err
+			}
+		case wsPong:
+		case wsClose:
+			// 回应关闭帧（带上服务器的状态码）后结束
+			ws.writeFrame(wsClose, payload[:min(len(payload), 2)])
+			return nil, io.EOF
+		case wsText, wsBinary, wsContinuation:
+			if (opcode == wsContinuation) != fragmented {
+				if fragmented {
+					return nil, fmt.Errorf("websocket protocol error: new message before the previous one ended")
+				}
+				return nil, fmt.Errorf("websocket protocol error: unexpected continuation frame")
+			}
+			msg = append(msg, payload...)
+			if int64(len(msg)) > ws.limit {
+				return nil, fmt.Errorf("websocket message exceeds %d bytes", ws.limit)
+			}
+			if fin {
+				return msg, nil
+			}
+			fragmented = true
+		default:
+			return nil, fmt.Errorf("websocket protocol error: unknown opcode %#x", opcode)
+		}
+	}
+}
+
+// readFrame 读取一个帧（RFC 6455 5.2），服务器发送的帧通常不带掩码，带掩码时也能处理
+func (ws *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(ws.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0F
+	// 没有协商扩展，RSV1-3 必须为 0（RFC 6455 5.2）
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, fmt.Errorf("websocket protocol error: reserved bits set (%#x)", head[0]&0x70)
+	}
+	masked := head[1]&0x80 != 0
+
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	// 控制帧不能分片，负载不超过 125 字节
+	if opcode >= wsClose && (!fin || length > maxControlPayload) {
+		return false, 0, nil, fmt.Errorf("websocket protocol error: invalid control frame (opcode %#x, %d bytes)", opcode, length)
+	}
+	if length > uint64(ws.limit) {
+		return false, 0, nil, fmt.Errorf("websocket message exceeds %d bytes", ws.limit)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// writeFrame 发送一个完整的帧，客户端发送的帧必须带掩码
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	var mask [4]byte
+	rand.Read(mask[:])
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	_, err := ws.conn.Write(frame)
+	return err
+}
+
+// DoWebSocket 使用默认客户端连接 WebSocket
+func DoWebSocket(mapData map[string]interface{}, onMessage func(msg []byte)) (*Response, error) {
+	return defaultClient.DoWebSocket(mapData, onMessage)
+}
@@ -0,0 +1,248 @@
+// Package xmlmap 在 XML 和 map 之间转换，供 xml`...` 处理器和 XML 请求体使用
+//
+// 转换规则：
+//   - 结果是只有一个 key 的 map，key 为根元素名：<user/> → {"user": ""}
+//   - 属性写成 "@" 开头的 key：<user id="1"/> → {"user": {"@id": "1"}}
+//   - 只有文本的元素为字符串；同时有属性或子元素时，文本放在 "#text" 中
+//   - 重复的子元素合并为数组，按出现顺序排列
+//   - 所有值都是字符串（XML 没有类型）；元素名保留命名空间前缀（soap:Envelope）
+package xmlmap
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TextKey 同时有属性或子元素时存放元素文本的 key
+const TextKey = "#text"
+
+// AttrPrefix 属性 key 的前缀
+const AttrPrefix = "@"
+
+// Decode 将 XML 文档解析为 map，根元素名作为唯一的 key
+func Decode(data []byte) (map[string]interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root map[string]interface{}
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil {
+				return nil, errors.New("XML document has more than one root element")
+			}
+			name := qualifiedName(t.Name)
+			value, err := decodeElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+			root = map[string]interface{}{name: value}
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("XML document has text outside the root element")
+			}
+		case xml.EndElement:
+			return nil, fmt.Errorf("unexpected closing tag </%s>", qualifiedName(t.Name))
+		}
+	}
+	if root == nil {
+		return nil, errors.New("XML document has no root element")
+	}
+	return root, nil
+}
+
+// decodeElement 读取 start 对应元素的内容，直到匹配的结束标签
+func decodeElement(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	fields := map[string]interface{}{}
+	for _, attr := range start.Attr {
+		key := AttrPrefix + qualifiedName(attr.Name)
+		if _, dup := fields[key]; dup {
+			return nil, fmt.Errorf("XML element <%s> has duplicate attribute %s", qualifiedName(start.Name), qualifiedName(attr.Name))
+		}
+		fields[key] = attr.Value
+	}
+	var text strings.Builder
+
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			return nil, fmt.Errorf("XML element <%s> is not closed", qualifiedName(start.Name))
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			name := qualifiedName(t.Name)
+			child, err := decodeElement(d, t)
+			if err != nil {
+				return nil, err
+			}
+			switch existing := fields[name].(type) {
+			case nil:
+				fields[name] = child
+			case []interface{}:
+				fields[name] = append(existing, child)
+			default:
+				fields[name] = []interface{}{existing, child}
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			// RawToken 不检查标签是否匹配
+			if t.Name != start.Name {
+				return nil, fmt.Errorf("XML element <%s> is closed by </%s>", qualifiedName(start.Name), qualifiedName(t.Name))
+			}
+			// 没有属性和子元素时文本原样保留，否则去掉子元素之间的空白
+			content := text.String()
+			if len(fields) == 0 {
+				return content, nil
+			}
+			if trimmed := strings.TrimSpace(content); trimmed != "" {
+				fields[TextKey] = trimmed
+			}
+			return fields, nil
+		}
+	}
+}
+
+// qualifiedName 返回带命名空间前缀的名称（RawToken 不解析命名空间，Space 为前缀）
+func qualifiedName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// Encode 将 map 编码为 XML 文档（带 XML 声明），map 必须只有一个 key 作为根元素
+// 同一元素的属性和子元素按 key 排序输出，数组展开为重复的元素
+func Encode(v interface{}) ([]byte, error) {
+	root, ok := v.(map[string]interface{})
+	if !ok || len(root) != 1 {
+		return nil, errors.New("XML body must be an object with exactly one root element")
+	}
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	for name, value := range root {
+		if _, isList := value.([]interface{}); isList {
+			return nil, errors.New("XML body must have exactly one root element, got an array")
+		}
+		if err := encodeElement(&buf, name, value); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeElement(buf *bytes.Buffer, name string, value interface{}) error {
+	if !validName(name) {
+		return fmt.Errorf("invalid XML element name %q", name)
+	}
+	buf.WriteString("<" + name)
+
+	fields, isMap := value.(map[string]interface{})
+	if !isMap {
+		buf.WriteString(">")
+		if err := writeText(buf, value); err != nil {
+			return fmt.Errorf("<%s>: %w", name, err)
+		}
+		buf.WriteString("</" + name + ">")
+		return nil
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		attr, ok := strings.CutPrefix(k, AttrPrefix)
+		if !ok {
+			continue
+		}
+		if !validName(attr) {
+			return fmt.Errorf("invalid XML attribute name %q", attr)
+		}
+		buf.WriteString(" " + attr + `="`)
+		if err := writeText(buf, fields[k]); err != nil {
+			return fmt.Errorf("<%s %s>: %w", name, attr, err)
+		}
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+
+	if text, ok := fields[TextKey]; ok {
+		if err := writeText(buf, text); err != nil {
+			return fmt.Errorf("<%s>: %w", name, err)
+		}
+	}
+	for _, k := range keys {
+		if strings.HasPrefix(k, AttrPrefix) || k == TextKey {
+			continue
+		}
+		items, isList := fields[k].([]interface{})
+		if !isList {
+			items = []interface{}{fields[k]}
+		}
+		for _, item := range items {
+			if _, nested := item.([]interface{}); nested {
+				return fmt.Errorf("<%s>: nested arrays cannot be encoded as XML", k)
+			}
+			if err := encodeElement(buf, k, item); err != nil {
+				return err
+			}
+		}
+	}
+	buf.WriteString("</" + name + ">")
+	return nil
+}
+
+// writeText 写出转义后的标量值，null 为空
+func writeText(buf *bytes.Buffer, v interface{}) error {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		s = v
+	case bool:
+		s = strconv.FormatBool(v)
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	case int:
+		s = strconv.Itoa(v)
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Errorf("cannot encode %T as XML text", v)
+	}
+	return xml.EscapeText(buf, []byte(s))
+}
+
+// validName 检查元素或属性名（允许一个命名空间前缀）
+func validName(name string) bool {
+	if name == "" || strings.Count(name, ":") > 1 || strings.HasPrefix(name, ":") || strings.HasSuffix(name, ":") {
+		return false
+	}
+	for i, r := range name {
+		switch {
+		case r == '_' || r == ':' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r > 0x7f:
+		case i > 0 && (r == '-' || r == '.' || r >= '0' && r <= '9'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+package xmlmap
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// toJSON marshals v without escaping <, > and &, so expectations stay readable
+func toJSON(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
+
+func TestDecode(t *testing.T) {
+	input := `<?xml version="1.0"?>
+<!-- an order -->
+<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/">
+  <soap:Body>
+    <order id="7">
+      <item sku="a">Pen</item>
+      <item sku="b">Ink</item>
+      <note><![CDATA[fragile & <heavy>]]></note>
+      <gift/>
+      <total currency="EUR">12.50</total>
+    </order>
+  </soap:Body>
+</soap:Envelope>`
+	got, err := Decode([]byte(input))
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	want := `{"soap:Envelope":{"@xmlns:soap":"http://schemas.xmlsoap.org/soap/envelope/","soap:Body":{"order":{"@id":"7","gift":"","item":[{"#text":"Pen","@sku":"a"},{"#text":"Ink","@sku":"b"}],"note":"fragile & <heavy>","total":{"#text":"12.50","@currency":"EUR"}}}}}`
+	if data := toJSON(got); data != want {
+		t.Errorf("unexpected result:\n got  %s\n want %s", data, want)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := map[string]string{
+		"":                    "no root element",
+		"<a></b>":             "closed by </b>",
+		"<a><b></a>":          "closed by </a>",
+		"<a>":                 "not closed",
+		"<a/><b/>":            "more than one root element",
+		"text <a/>":           "text outside the root element",
+		`<a x="1" x="2"></a>`: "duplicate attribute x",
+		"<a>&unknown;</a>":    "",
+		"</a>":                "unexpected closing tag",
+	}
+	for input, msg := range tests {
+		_, err := Decode([]byte(input))
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("Decode(%q) error = %v, want %q", input, err, msg)
+		}
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	body := map[string]interface{}{
+		"order": map[string]interface{}{
+			"@id":    int64(7),
+			"@x:tag": "a&b",
+			"item": []interface{}{
+				map[string]interface{}{"@sku": "a", "#text": "Pen"},
+				"Ink <blue>",
+			},
+			"price":  12.5,
+			"gift":   false,
+			"note":   nil,
+			"x:meta": map[string]interface{}{"count": int64(2)},
+		},
+	}
+	data, err := Encode(body)
+	if err != nil {
+		t.Fatalf("encode error: %v", err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<order id="7" x:tag="a&amp;b"><gift>false</gift><item sku="a">Pen</item><item>Ink &lt;blue&gt;</item><note></note><price>12.5</price><x:meta><count>2</count></x:meta></order>`
+	if string(data) != want {
+		t.Errorf("unexpected XML:\n got  %s\n want %s", data, want)
+	}
+
+	decoded, err := Decode(data)
+	if err != nil {
+		t.Fatalf("decode error: %v", err)
+	}
+	got := toJSON(decoded)
+	wantJSON := `{"order":{"@id":"7","@x:tag":"a&b","gift":"false","item":[{"#text":"Pen","@sku":"a"},"Ink <blue>"],"note":"","price":"12.5","x:meta":{"count":"2"}}}`
+	if got != wantJSON {
+		t.Errorf("round trip mismatch:\n got  %s\n want %s", got, wantJSON)
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	tests := []struct {
+		body interface{}
+		msg  string
+	}{
+		{map[string]interface{}{"a": "1", "b": "2"}, "exactly one root element"},
+		{[]interface{}{"a"}, "exactly one root element"},
+		{map[string]interface{}{"a": []interface{}{"1", "2"}}, "got an array"},
+		{map[string]interface{}{"bad name": "1"}, "invalid XML element name"},
+		{map[string]interface{}{"a": map[string]interface{}{"@1x": "1"}}, "invalid XML attribute name"},
+		{map[string]interface{}{"a": map[string]interface{}{"b": []interface{}{[]interface{}{"1"}}}}, "nested arrays"},
+		{map[string]interface{}{"a": map[string]interface{}{"@b": map[string]interface{}{}}}, "cannot encode"},
+	}
+	for _, tt := range tests {
+		_, err := Encode(tt.body)
+		if err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("Encode(%v) error = %v, want %q", tt.body, err, tt.msg)
+		}
+	}
+}